@@ -13,17 +13,52 @@ import (
 
 func main() {
 	port := flag.String("port", "3478", "Port to listen on (server mode)")
+	public := flag.String("public", "", "Address clients reach the server at, if it isn't the listen address")
+	relay := flag.Bool("relay", false, "Relay traffic for peers that can't hole punch to each other")
+	relayBandwidth := flag.Int("relay-bandwidth", 64*1024, "Bandwidth quota of every relay allocation in bytes per second, 0 for none")
+	stateFile := flag.String("state", "", "File to keep queue positions and the leader in across restarts")
+	admin := flag.String("admin", "", "Address to serve the admin and metrics endpoint on, e.g. 127.0.0.1:9478")
+	adminRemote := flag.Bool("admin-remote", false, "Allow the unauthenticated admin endpoint on addresses other than loopback")
+	peer := flag.String("peer", "", "Replication address of the other server of a high-availability pair")
+	replication := flag.String("replication", ":3479", "Address to take replication from the other server on")
+	replicationSecret := flag.String("replication-secret", "", "Secret shared by the pair to authenticate replication")
+	standby := flag.Bool("standby", false, "Start as the standby of the pair instead of the active server")
+	flag.Parse()
 
-	runServer(*port)
+	runServer(*port, *public, *relay, *relayBandwidth, *stateFile, *admin, *adminRemote, *peer, *replication, *replicationSecret, *standby)
 }
 
-func runServer(port string) {
+func runServer(port, public string, relay bool, relayBandwidth int, stateFile, admin string, adminRemote bool, peer, replication, replicationSecret string, standby bool) {
 	config := &stun.ServerConfig{
 		ListenAddress: ":" + port,
 		ClientTimeout: 30 * 1000000000, // 30 seconds in nanoseconds
 		PingInterval:  10 * 1000000000, // 10 seconds in nanoseconds
 		MaxQueueSize:  100,
 		EnableLogging: true,
+		PublicAddress: public,
+
+		EnableRelay:         relay,
+		RelayBandwidth:      relayBandwidth,
+		MaxRelayAllocations: 50,
+
+		StateFile:    stateFile,
+		ReclaimGrace: 30 * 1000000000, // 30 seconds in nanoseconds
+
+		LeaseDuration: 30 * 1000000000, // 30 seconds in nanoseconds
+
+		AdminAddress:     admin,
+		AdminAllowRemote: adminRemote,
+
+		RateLimit:    20,
+		RateBurst:    40,
+		MaxInFlight:  256,
+		BanThreshold: 100,
+		BanDuration:  60 * 1000000000, // 1 minute in nanoseconds
+
+		PeerAddress:        peer,
+		ReplicationAddress: replication,
+		ReplicationSecret:  replicationSecret,
+		Standby:            standby,
 	}
 
 	server := stun.NewServer(config)
@@ -0,0 +1,174 @@
+package api
+
+/*
+
+This file is for client identities. Every client holds an ECDSA P-256 key and
+is known to the server by the fingerprint of its public key, its UDP address
+is only where to reach it. Registration proves the client holds the key by
+signing a nonce from the server together with the server's address, as the
+client reaches it, and the client's, as the server sees it, so a signed
+challenge can't be passed on to another server or answered from another
+address. Messages that act on a registration, like pings, are signed over
+their type, timestamp, sender and data. The server only accepts each
+client's signed messages in timestamp order, so a captured one can't be
+replayed.
+
+*/
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// SignatureMaxAge is how far a signed message's timestamp may be from the
+// receiver's clock before the message is rejected as a replay
+const SignatureMaxAge = time.Minute
+
+// NonceSize is the size of registration challenge nonces
+const NonceSize = 32
+
+const (
+	challengeContext = "mosaic-register\x00"
+	messageContext   = "mosaic-message\x00"
+)
+
+var (
+	ErrInvalidPublicKey = errors.New("invalid public key")
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrStaleSignature   = errors.New("signature timestamp out of range")
+)
+
+// GenerateKey creates a new client identity key
+func GenerateKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// EncodePublicKey returns the form a public key is sent in, base64 of its PKIX encoding
+func EncodePublicKey(key *ecdsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(der), nil
+}
+
+// ParsePublicKey reads a public key encoded by EncodePublicKey, only P-256 keys are accepted
+func ParsePublicKey(encoded string) (*ecdsa.PublicKey, error) {
+	der, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidPublicKey
+	}
+	parsed, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, ErrInvalidPublicKey
+	}
+	key, ok := parsed.(*ecdsa.PublicKey)
+	if !ok || key.Curve != elliptic.P256() {
+		return nil, ErrInvalidPublicKey
+	}
+	return key, nil
+}
+
+// Fingerprint returns the ID of the client holding key, the hex of the first
+// 16 bytes of the SHA-256 of its PKIX encoding
+func Fingerprint(key *ecdsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:16]), nil
+}
+
+// NewNonce returns a random registration challenge nonce
+func NewNonce() ([]byte, error) {
+	nonce := make([]byte, NonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// challengeDigest is what a challenge signature covers
+func challengeDigest(nonce []byte, serverAddr, clientAddr string) []byte {
+	digest := sha256.Sum256([]byte(challengeContext + serverAddr + "\x00" + clientAddr + "\x00" + string(nonce)))
+	return digest[:]
+}
+
+// SignChallenge signs a registration challenge nonce from the server at
+// serverAddr, sent to the client at clientAddr
+func SignChallenge(key *ecdsa.PrivateKey, nonce []byte, serverAddr, clientAddr string) ([]byte, error) {
+	return ecdsa.SignASN1(rand.Reader, key, challengeDigest(nonce, serverAddr, clientAddr))
+}
+
+// VerifyChallenge reports whether sig is a signature by key of nonce from
+// the server at serverAddr, sent to the client at clientAddr
+func VerifyChallenge(key *ecdsa.PublicKey, nonce []byte, serverAddr, clientAddr string, sig []byte) bool {
+	return ecdsa.VerifyASN1(key, challengeDigest(nonce, serverAddr, clientAddr), sig)
+}
+
+// messageDigest is what a message signature covers. Data is a struct on the
+// sender and the map it was decoded into on the receiver, so it is hashed in
+// the form both turn into: decoded into a map and encoded again, which sorts
+// the keys.
+func (m *Message) messageDigest() ([]byte, error) {
+	var data []byte
+	if m.Data != nil {
+		encoded, err := json.Marshal(m.Data)
+		if err != nil {
+			return nil, err
+		}
+		var decoded any
+		if err := json.Unmarshal(encoded, &decoded); err != nil {
+			return nil, err
+		}
+		if data, err = json.Marshal(decoded); err != nil {
+			return nil, err
+		}
+	}
+
+	content := messageContext + string(m.Type) + "\x00" + strconv.FormatInt(m.Timestamp.UnixNano(), 10) + "\x00" + m.Sign.PubKey + "\x00" + string(data)
+	digest := sha256.Sum256([]byte(content))
+	return digest[:], nil
+}
+
+// SignWith signs the message with the sender's key, Sign.PubKey has to
+// already hold the sender's ID
+func (m *Message) SignWith(key *ecdsa.PrivateKey) error {
+	digest, err := m.messageDigest()
+	if err != nil {
+		return err
+	}
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest)
+	if err != nil {
+		return err
+	}
+	m.Sign.Sig = sig
+	return nil
+}
+
+// VerifySign checks that the message was signed by key within
+// SignatureMaxAge. Receivers still have to check it is newer than the last
+// message they took from the sender, or it could be a replay.
+func (m *Message) VerifySign(key *ecdsa.PublicKey) error {
+	if len(m.Sign.Sig) == 0 {
+		return ErrInvalidSignature
+	}
+	digest, err := m.messageDigest()
+	if err != nil || !ecdsa.VerifyASN1(key, digest, m.Sign.Sig) {
+		return ErrInvalidSignature
+	}
+	if age := time.Since(m.Timestamp); age > SignatureMaxAge || age < -SignatureMaxAge {
+		return ErrStaleSignature
+	}
+	return nil
+}
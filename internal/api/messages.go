@@ -14,6 +14,10 @@ const (
 	// Client to Server messages
 	ClientRegister MessageType = "client_register"
 	ClientPing     MessageType = "client_ping"
+	RelayRequest   MessageType = "relay_request"
+	LeaderLost     MessageType = "leader_lost"
+	// ChallengeResponse answers a RegisterChallenge with the signed nonce
+	ChallengeResponse MessageType = "challenge_response"
 
 	// Server to Client messages
 	RegisterSuccess  MessageType = "register_success"
@@ -21,6 +25,9 @@ const (
 	ServerError      MessageType = "server_error"
 	WaitingForPeer   MessageType = "waiting_for_peer"
 	AssignedAsLeader MessageType = "assigned_as_leader"
+	RelayAllocated   MessageType = "relay_allocated"
+	// RegisterChallenge asks a registering client to sign a nonce with its key
+	RegisterChallenge MessageType = "register_challenge"
 
 	// Leader to Peer message 
 	// To be sent to the joining node contianing a list of all nodes in the network
@@ -41,19 +48,44 @@ type Message struct {
 	Type      MessageType `json:"type"`
 	Timestamp time.Time   `json:"timestamp"`
 	Data      any         `json:"data,omitempty"`
+
+	// size is how many bytes the message was on the wire
+	size int
 }
 
 type Signature struct {
 	PubKey string `json:"pub_key"`
+	// Sig is set on messages signed with SignWith, see identity.go
+	Sig []byte `json:"sig,omitempty"`
 }
 
 func NewSignature(pubKey string) Signature {
 	return Signature{PubKey: pubKey}
 }
 
-// ClientRegisterData represents client registration information (no data needed)
+// ClientRegisterData represents client registration information, the client
+// ID is the fingerprint of PublicKey
 type ClientRegisterData struct {
-	// No fields needed - client ID is derived from network address
+	// PublicKey is the client's P-256 key, encoded by EncodePublicKey
+	PublicKey string `json:"public_key"`
+	// NetworkID names the cluster to join, the default one if it is empty
+	NetworkID string `json:"network_id,omitempty"`
+	// JoinSecret has to match the secret the network was created with. It
+	// is sent in plaintext, anyone who sees the registration can join.
+	JoinSecret string `json:"join_secret,omitempty"`
+}
+
+// RegisterChallengeData holds the nonce a registering client has to sign
+// and the client's address as the server sees it, which is signed with it
+type RegisterChallengeData struct {
+	Nonce   []byte `json:"nonce"`
+	Address string `json:"address"`
+}
+
+// ChallengeResponseData proves the client holds the key it registered with
+type ChallengeResponseData struct {
+	Nonce     []byte `json:"nonce"`
+	Signature []byte `json:"signature"`
 }
 
 type RegisterSuccessData struct {
@@ -61,10 +93,13 @@ type RegisterSuccessData struct {
 	ID      string `json:"id"`
 }
 
-// Doesnt need to contain anything
 // This message is sent to the first node to connect to the server tell them that they are
 // the leader and must maintain a connection to the server
 type ServerAssignedLeaderData struct {
+	// Term goes up with every new leader, an assignment from an older term is stale
+	Term uint `json:"term"`
+	// LeaseDuration is how long the leader stays leader without pinging the server
+	LeaseDuration time.Duration `json:"lease_duration"`
 }
 
 // Dictionary of nodeID's and there respective UDPAddr
@@ -86,6 +121,37 @@ type PeerTextMessageData struct {
 type PeerAssignmentData struct {
 	PeerAddress string `json:"peer_address"`
 	PeerID      string `json:"peer_id"`
+	// Term is the term of the leader the assignment was made under
+	Term uint `json:"term"`
+}
+
+// LeaderLostData is sent by a member whose leader stopped answering its pings.
+// It names the network since the server only keeps the member among the
+// network's members once it is paired.
+type LeaderLostData struct {
+	// PublicKey is the key the member registered with, the server checks
+	// the signature against the one it recorded when pairing the member
+	PublicKey  string `json:"public_key"`
+	NetworkID  string `json:"network_id,omitempty"`
+	JoinSecret string `json:"join_secret,omitempty"`
+	LeaderID   string `json:"leader_id"`
+	// Term is the term the member last heard of, a report about an older
+	// term's leader can't end the current one
+	Term uint `json:"term"`
+}
+
+// RelayRequestData asks the server to relay traffic to a peer that hole
+// punching couldn't reach. Both peers have to ask before anything is relayed.
+type RelayRequestData struct {
+	PeerAddress string `json:"peer_address"`
+}
+
+// RelayAllocatedData tells a client where to send to reach its peer through the relay
+type RelayAllocatedData struct {
+	PeerAddress  string `json:"peer_address"`
+	RelayAddress string `json:"relay_address"`
+	// Bandwidth is the quota of the allocation in bytes per second, 0 if there is none
+	Bandwidth int `json:"bandwidth"`
 }
 
 // ServerErrorData contains error information
@@ -147,31 +213,68 @@ func NewCurrentMembersMessage(members map[string]*net.UDPAddr, senderID string)
 
 }
 
-func NewServerAssignedLeaderMessage() *Message {
+func NewServerAssignedLeaderMessage(term uint, leaseDuration time.Duration) *Message {
 	return &Message{
 		Type:      AssignedAsLeader,
 		Timestamp: time.Now(),
-		Data:      ServerAssignedLeaderData{},
+		Data: ServerAssignedLeaderData{
+			Term:          term,
+			LeaseDuration: leaseDuration,
+		},
 	}
 }
 
 // NewClientRegisterMessage creates a client registration message
-func NewClientRegisterMessage() *Message {
+func NewClientRegisterMessage(publicKey string) *Message {
+	return NewNetworkRegisterMessage(publicKey, "", "")
+}
+
+// NewNetworkRegisterMessage creates a client registration message for a network
+func NewNetworkRegisterMessage(publicKey, networkID, joinSecret string) *Message {
 	return &Message{
 		Type:      ClientRegister,
 		Timestamp: time.Now(),
-		Data:      ClientRegisterData{},
+		Data: ClientRegisterData{
+			PublicKey:  publicKey,
+			NetworkID:  networkID,
+			JoinSecret: joinSecret,
+		},
+	}
+}
+
+// NewRegisterChallengeMessage creates a challenge for a registering client at clientAddr
+func NewRegisterChallengeMessage(nonce []byte, clientAddr string) *Message {
+	return &Message{
+		Type:      RegisterChallenge,
+		Timestamp: time.Now(),
+		Data: RegisterChallengeData{
+			Nonce:   nonce,
+			Address: clientAddr,
+		},
+	}
+}
+
+// NewChallengeResponseMessage creates the answer to a registration challenge
+func NewChallengeResponseMessage(nonce, signature []byte) *Message {
+	return &Message{
+		Type:      ChallengeResponse,
+		Timestamp: time.Now(),
+		Data: ChallengeResponseData{
+			Nonce:     nonce,
+			Signature: signature,
+		},
 	}
 }
 
 // NewPeerAssignmentMessage creates a peer assignment message
-func NewPeerAssignmentMessage(peerAddr *net.UDPAddr, peerID string) *Message {
+func NewPeerAssignmentMessage(peerAddr *net.UDPAddr, peerID string, term uint) *Message {
 	return &Message{
 		Type:      PeerAssignment,
 		Timestamp: time.Now(),
 		Data: PeerAssignmentData{
 			PeerAddress: peerAddr.String(),
 			PeerID:      peerID,
+			Term:        term,
 		},
 	}
 }
@@ -187,6 +290,47 @@ func NewRegisterSuccessMessage(message, id string) *Message {
 	}
 }
 
+// NewLeaderLostMessage creates a message reporting that the leader of term stopped answering
+func NewLeaderLostMessage(sign Signature, publicKey, networkID, joinSecret, leaderID string, term uint) *Message {
+	return &Message{
+		Sign:      sign,
+		Type:      LeaderLost,
+		Timestamp: time.Now(),
+		Data: LeaderLostData{
+			PublicKey:  publicKey,
+			NetworkID:  networkID,
+			JoinSecret: joinSecret,
+			LeaderID:   leaderID,
+			Term:       term,
+		},
+	}
+}
+
+// NewRelayRequestMessage creates a request for a relay to peerAddr
+func NewRelayRequestMessage(sign Signature, peerAddr *net.UDPAddr) *Message {
+	return &Message{
+		Sign:      sign,
+		Type:      RelayRequest,
+		Timestamp: time.Now(),
+		Data: RelayRequestData{
+			PeerAddress: peerAddr.String(),
+		},
+	}
+}
+
+// NewRelayAllocatedMessage creates a message telling a client its relay address for a peer
+func NewRelayAllocatedMessage(peerAddr, relayAddr *net.UDPAddr, bandwidth int) *Message {
+	return &Message{
+		Type:      RelayAllocated,
+		Timestamp: time.Now(),
+		Data: RelayAllocatedData{
+			PeerAddress:  peerAddr.String(),
+			RelayAddress: relayAddr.String(),
+			Bandwidth:    bandwidth,
+		},
+	}
+}
+
 // NewWaitingForPeerMessage creates a waiting message
 func NewWaitingForPeerMessage() *Message {
 	return &Message{
@@ -250,17 +394,61 @@ func (m *Message) Serialize() ([]byte, error) {
 func DeserializeMessage(data []byte) (*Message, error) {
 	var msg Message
 	err := json.Unmarshal(data, &msg)
+	msg.size = len(data)
 	return &msg, err
 }
 
+// Size returns how many bytes the message was on the wire, 0 if it wasn't deserialized
+func (m *Message) Size() int {
+	return m.size
+}
+
 // GetClientRegisterData extracts client registration data from message
 func (m *Message) GetClientRegisterData() (*ClientRegisterData, error) {
 	if m.Type != ClientRegister && m.Type != ClientPing {
 		return nil, ErrInvalidMessageType
 	}
 
-	// No data validation needed since ClientRegisterData is empty
-	return &ClientRegisterData{}, nil
+	dataBytes, err := json.Marshal(m.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	var data ClientRegisterData
+	err = json.Unmarshal(dataBytes, &data)
+	return &data, err
+}
+
+// GetRegisterChallengeData extracts the challenge nonce from message
+func (m *Message) GetRegisterChallengeData() (*RegisterChallengeData, error) {
+	if m.Type != RegisterChallenge {
+		return nil, ErrInvalidMessageType
+	}
+
+	dataBytes, err := json.Marshal(m.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	var data RegisterChallengeData
+	err = json.Unmarshal(dataBytes, &data)
+	return &data, err
+}
+
+// GetChallengeResponseData extracts the signed nonce from message
+func (m *Message) GetChallengeResponseData() (*ChallengeResponseData, error) {
+	if m.Type != ChallengeResponse {
+		return nil, ErrInvalidMessageType
+	}
+
+	dataBytes, err := json.Marshal(m.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	var data ChallengeResponseData
+	err = json.Unmarshal(dataBytes, &data)
+	return &data, err
 }
 
 func (m *Message) GetCurrentMembersData() (*CurrentMembersData, error) {
@@ -343,6 +531,54 @@ func (m *Message) GetPeerAssignmentData() (*PeerAssignmentData, error) {
 	return &data, err
 }
 
+// GetLeaderLostData extracts leader lost data from message
+func (m *Message) GetLeaderLostData() (*LeaderLostData, error) {
+	if m.Type != LeaderLost {
+		return nil, ErrInvalidMessageType
+	}
+
+	dataBytes, err := json.Marshal(m.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	var data LeaderLostData
+	err = json.Unmarshal(dataBytes, &data)
+	return &data, err
+}
+
+// GetRelayRequestData extracts relay request data from message
+func (m *Message) GetRelayRequestData() (*RelayRequestData, error) {
+	if m.Type != RelayRequest {
+		return nil, ErrInvalidMessageType
+	}
+
+	dataBytes, err := json.Marshal(m.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	var data RelayRequestData
+	err = json.Unmarshal(dataBytes, &data)
+	return &data, err
+}
+
+// GetRelayAllocatedData extracts relay allocation data from message
+func (m *Message) GetRelayAllocatedData() (*RelayAllocatedData, error) {
+	if m.Type != RelayAllocated {
+		return nil, ErrInvalidMessageType
+	}
+
+	dataBytes, err := json.Marshal(m.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	var data RelayAllocatedData
+	err = json.Unmarshal(dataBytes, &data)
+	return &data, err
+}
+
 // GetServerErrorData extracts error data from message
 func (m *Message) GetServerErrorData() (*ServerErrorData, error) {
 	if m.Type != ServerError {
@@ -0,0 +1,322 @@
+package api
+
+/*
+
+This file is for the binary messages of standard STUN from RFC 5389, only as
+much as the Binding method needs. The server speaks them on the same port as
+the JSON messages, a STUN message always starts with two zero bits and
+carries the magic cookie while every JSON message starts with '{'.
+
+*/
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+)
+
+const (
+	magicCookie      = 0x2112A442
+	stunHeaderSize   = 20
+	transactionIDLen = 12
+
+	// STUNMethodBinding is the Binding method, the only one the server knows
+	STUNMethodBinding = 0x001
+
+	classRequest       = 0x0
+	classIndication    = 0x1
+	classSuccess       = 0x2
+	classErrorResponse = 0x3
+
+	attrMappedAddress    = 0x0001
+	attrErrorCode        = 0x0009
+	attrXorMappedAddress = 0x0020
+	attrSoftware         = 0x8022
+	attrFingerprint      = 0x8028
+
+	familyIPv4 = 0x01
+	familyIPv6 = 0x02
+
+	// fingerprintXor is XORed into the CRC-32 of the FINGERPRINT attribute
+	fingerprintXor = 0x5354554e
+
+	software = "mosaic"
+	// requestSoftwareSize pads the SOFTWARE of our requests so they are no
+	// smaller than a bare IPv6 Binding response, servers that don't know the
+	// sender, like ours, answer with no more than they were sent
+	requestSoftwareSize = 24
+)
+
+var (
+	ErrNotSTUN             = errors.New("not a STUN message")
+	ErrTransactionMismatch = errors.New("STUN response is for another transaction")
+	ErrNoMappedAddress     = errors.New("STUN response has no mapped address")
+	ErrNotSTUNRequest      = errors.New("STUN message is not a request")
+)
+
+// TransactionID ties a STUN response to its request
+type TransactionID [transactionIDLen]byte
+
+// stunMessage is a parsed STUN message, attributes keep their order
+type stunMessage struct {
+	method     uint16
+	class      uint16
+	id         TransactionID
+	attributes []stunAttribute
+}
+
+type stunAttribute struct {
+	kind  uint16
+	value []byte
+}
+
+// IsSTUNMessage reports whether data looks like an RFC 5389 message rather
+// than one of our JSON messages
+func IsSTUNMessage(data []byte) bool {
+	return len(data) >= stunHeaderSize &&
+		data[0]&0xC0 == 0 &&
+		binary.BigEndian.Uint32(data[4:8]) == magicCookie
+}
+
+// NewBindingRequest returns a Binding Request with a fresh transaction ID
+func NewBindingRequest() (TransactionID, []byte, error) {
+	var id TransactionID
+	if _, err := rand.Read(id[:]); err != nil {
+		return id, nil, err
+	}
+
+	msg := &stunMessage{method: STUNMethodBinding, class: classRequest, id: id}
+	msg.add(attrSoftware, []byte(fmt.Sprintf("%-*s", requestSoftwareSize, software)))
+	return id, msg.marshal(), nil
+}
+
+// NewBindingResponse returns a Binding success response telling the sender of
+// request id that it was seen coming from addr
+func NewBindingResponse(id TransactionID, addr *net.UDPAddr) []byte {
+	msg := &stunMessage{method: STUNMethodBinding, class: classSuccess, id: id}
+	msg.add(attrXorMappedAddress, xorAddress(addr, id))
+	msg.add(attrSoftware, []byte(software))
+	return msg.marshal()
+}
+
+// NewBareBindingResponse is NewBindingResponse without the SOFTWARE
+// attribute, the smallest answer to a Binding request
+func NewBareBindingResponse(id TransactionID, addr *net.UDPAddr) []byte {
+	msg := &stunMessage{method: STUNMethodBinding, class: classSuccess, id: id}
+	msg.add(attrXorMappedAddress, xorAddress(addr, id))
+	return msg.marshal()
+}
+
+// ParseSTUNRequest returns the method and transaction ID of a STUN request.
+// Indications and responses are ErrNotSTUNRequest, a server must not answer them.
+func ParseSTUNRequest(data []byte) (uint16, TransactionID, error) {
+	msg, err := parseSTUNMessage(data)
+	if err != nil {
+		return 0, TransactionID{}, err
+	}
+	if msg.class != classRequest {
+		return 0, msg.id, ErrNotSTUNRequest
+	}
+	return msg.method, msg.id, nil
+}
+
+// NewSTUNErrorResponse returns an error response to request id of method
+// with an ERROR-CODE attribute holding code, like 400, and reason
+func NewSTUNErrorResponse(method uint16, id TransactionID, code int, reason string) []byte {
+	msg := &stunMessage{method: method, class: classErrorResponse, id: id}
+	msg.add(attrErrorCode, append([]byte{0, 0, byte(code / 100), byte(code % 100)}, reason...))
+	return msg.marshal()
+}
+
+// ParseBindingResponse returns the address a Binding success response for
+// request id says the client was seen coming from. XOR-MAPPED-ADDRESS is
+// preferred, MAPPED-ADDRESS is only there for servers older than RFC 5389.
+func ParseBindingResponse(data []byte, id TransactionID) (*net.UDPAddr, error) {
+	msg, err := parseSTUNMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	if msg.id != id {
+		return nil, ErrTransactionMismatch
+	}
+	if msg.method != STUNMethodBinding {
+		return nil, fmt.Errorf("expected a Binding response, got method %#x", msg.method)
+	}
+	if msg.class == classErrorResponse {
+		if value := msg.get(attrErrorCode); len(value) >= 4 {
+			return nil, fmt.Errorf("STUN error %d: %s", int(value[2]&0x7)*100+int(value[3]), value[4:])
+		}
+		return nil, errors.New("STUN error response")
+	}
+	if msg.class != classSuccess {
+		return nil, fmt.Errorf("expected a Binding response, got class %d", msg.class)
+	}
+
+	if value := msg.get(attrXorMappedAddress); value != nil {
+		return parseAddress(value, &id)
+	}
+	if value := msg.get(attrMappedAddress); value != nil {
+		return parseAddress(value, nil)
+	}
+	return nil, ErrNoMappedAddress
+}
+
+func (m *stunMessage) add(kind uint16, value []byte) {
+	m.attributes = append(m.attributes, stunAttribute{kind: kind, value: value})
+}
+
+// get returns the value of the first attribute of kind, nil if there is none
+func (m *stunMessage) get(kind uint16) []byte {
+	for _, attribute := range m.attributes {
+		if attribute.kind == kind {
+			return attribute.value
+		}
+	}
+	return nil
+}
+
+// marshal encodes the message with a FINGERPRINT attribute at the end
+func (m *stunMessage) marshal() []byte {
+	buf := make([]byte, stunHeaderSize, 128)
+	binary.BigEndian.PutUint16(buf[0:2], messageType(m.method, m.class))
+	binary.BigEndian.PutUint32(buf[4:8], magicCookie)
+	copy(buf[8:20], m.id[:])
+
+	for _, attribute := range m.attributes {
+		buf = appendAttribute(buf, attribute.kind, attribute.value)
+	}
+
+	// the length has to count the fingerprint before its crc is taken
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(buf)-stunHeaderSize+8))
+	fingerprint := make([]byte, 4)
+	binary.BigEndian.PutUint32(fingerprint, crc32.ChecksumIEEE(buf)^fingerprintXor)
+	return appendAttribute(buf, attrFingerprint, fingerprint)
+}
+
+func appendAttribute(buf []byte, kind uint16, value []byte) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, kind)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(value)))
+	buf = append(buf, value...)
+	// attributes are padded to a multiple of 4 bytes
+	for len(buf)%4 != 0 {
+		buf = append(buf, 0)
+	}
+	return buf
+}
+
+// parseSTUNMessage checks the header, walks the attributes and checks the
+// FINGERPRINT if there is one
+func parseSTUNMessage(data []byte) (*stunMessage, error) {
+	if !IsSTUNMessage(data) {
+		return nil, ErrNotSTUN
+	}
+
+	length := int(binary.BigEndian.Uint16(data[2:4]))
+	if length%4 != 0 || stunHeaderSize+length != len(data) {
+		return nil, fmt.Errorf("%w: length %d doesn't match the %d byte packet", ErrNotSTUN, length, len(data))
+	}
+
+	typ := binary.BigEndian.Uint16(data[0:2])
+	msg := &stunMessage{
+		method: typ&0x000F | (typ>>1)&0x0070 | (typ>>2)&0x0F80,
+		class:  (typ>>4)&0x1 | (typ>>7)&0x2,
+	}
+	copy(msg.id[:], data[8:20])
+
+	for offset := stunHeaderSize; offset < len(data); {
+		if offset+4 > len(data) {
+			return nil, fmt.Errorf("%w: attribute header runs past the end", ErrNotSTUN)
+		}
+		kind := binary.BigEndian.Uint16(data[offset : offset+2])
+		size := int(binary.BigEndian.Uint16(data[offset+2 : offset+4]))
+		start := offset + 4
+		if start+size > len(data) {
+			return nil, fmt.Errorf("%w: attribute %#x runs past the end", ErrNotSTUN, kind)
+		}
+
+		if kind == attrFingerprint {
+			if size != 4 || start+size != len(data) {
+				return nil, fmt.Errorf("%w: FINGERPRINT has to be the last attribute", ErrNotSTUN)
+			}
+			if crc32.ChecksumIEEE(data[:offset])^fingerprintXor != binary.BigEndian.Uint32(data[start:]) {
+				return nil, fmt.Errorf("%w: FINGERPRINT doesn't match", ErrNotSTUN)
+			}
+		}
+
+		msg.add(kind, data[start:start+size])
+		offset = start + (size+3)&^3
+	}
+
+	return msg, nil
+}
+
+// messageType interleaves the method and class bits the way RFC 5389 lays them out
+func messageType(method uint16, class uint16) uint16 {
+	return method&0x000F | (method&0x0070)<<1 | (method&0x0F80)<<2 |
+		(class&0x1)<<4 | (class&0x2)<<7
+}
+
+// xorAddress encodes addr as an XOR-MAPPED-ADDRESS value
+func xorAddress(addr *net.UDPAddr, id TransactionID) []byte {
+	key := xorKey(id)
+	port := uint16(addr.Port) ^ uint16(magicCookie>>16)
+
+	ip := addr.IP.To4()
+	family := byte(familyIPv4)
+	if ip == nil {
+		ip = addr.IP.To16()
+		family = familyIPv6
+	}
+
+	value := []byte{0, family, byte(port >> 8), byte(port)}
+	for i, b := range ip {
+		value = append(value, b^key[i])
+	}
+	return value
+}
+
+// parseAddress decodes a MAPPED-ADDRESS value, or an XOR-MAPPED-ADDRESS one
+// when id is given
+func parseAddress(value []byte, id *TransactionID) (*net.UDPAddr, error) {
+	if len(value) < 4 {
+		return nil, fmt.Errorf("%w: address attribute is too short", ErrNotSTUN)
+	}
+
+	size := 0
+	switch value[1] {
+	case familyIPv4:
+		size = net.IPv4len
+	case familyIPv6:
+		size = net.IPv6len
+	default:
+		return nil, fmt.Errorf("%w: unknown address family %d", ErrNotSTUN, value[1])
+	}
+	if len(value) != 4+size {
+		return nil, fmt.Errorf("%w: address attribute is %d bytes", ErrNotSTUN, len(value))
+	}
+
+	port := binary.BigEndian.Uint16(value[2:4])
+	ip := make(net.IP, size)
+	copy(ip, value[4:])
+	if id != nil {
+		key := xorKey(*id)
+		port ^= uint16(magicCookie >> 16)
+		for i := range ip {
+			ip[i] ^= key[i]
+		}
+	}
+
+	return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// xorKey is what an XOR-MAPPED-ADDRESS is XORed with, the magic cookie
+// followed by the transaction ID
+func xorKey(id TransactionID) [16]byte {
+	var key [16]byte
+	binary.BigEndian.PutUint32(key[:4], magicCookie)
+	copy(key[4:], id[:])
+	return key
+}
@@ -0,0 +1,79 @@
+package encoding
+
+import (
+	"sync"
+)
+
+const (
+	// bufferClass is what pooled buffer sizes are rounded up to, so files
+	// with slightly different block sizes still share buffers. Anything
+	// smaller isn't worth pooling.
+	bufferClass = 64 * 1024
+
+	// compressorMemory is roughly what a flate writer holds on to
+	compressorMemory = 1024 * 1024
+)
+
+// bufferPool hands out the stripe buffers and compressors encodeStripes needs
+// so a run of files doesn't allocate them fresh for every file. A nil pool
+// just allocates.
+type bufferPool struct {
+	// classes maps a rounded buffer size to the *sync.Pool holding buffers of it
+	classes     sync.Map
+	compressors sync.Pool
+}
+
+func newBufferPool() *bufferPool {
+	return &bufferPool{}
+}
+
+// bufferSize is how many bytes a buffer of size bytes from the pool really takes
+func bufferSize(size int) int64 {
+	if size < bufferClass {
+		return int64(size)
+	}
+	return int64((size + bufferClass - 1) / bufferClass * bufferClass)
+}
+
+// get returns a buffer of length size, its contents are whatever the last user left
+func (p *bufferPool) get(size int) []byte {
+	if p == nil || size < bufferClass {
+		return make([]byte, size)
+	}
+
+	class := int(bufferSize(size))
+	pool, _ := p.classes.LoadOrStore(class, &sync.Pool{})
+	if buf, ok := pool.(*sync.Pool).Get().(*[]byte); ok {
+		return (*buf)[:size]
+	}
+	return make([]byte, size, class)
+}
+
+// put gives a buffer from get back, it must not be used after
+func (p *bufferPool) put(buf []byte) {
+	if p == nil || cap(buf) < bufferClass || int64(cap(buf)) != bufferSize(cap(buf)) {
+		return
+	}
+
+	pool, _ := p.classes.LoadOrStore(cap(buf), &sync.Pool{})
+	buf = buf[:0]
+	pool.(*sync.Pool).Put(&buf)
+}
+
+func (p *bufferPool) getCompressor() (*stripeCompressor, error) {
+	if p != nil {
+		if compressor, ok := p.compressors.Get().(*stripeCompressor); ok {
+			compressor.checked = false
+			compressor.skip = false
+			return compressor, nil
+		}
+	}
+	return newStripeCompressor()
+}
+
+func (p *bufferPool) putCompressor(compressor *stripeCompressor) {
+	if p == nil || compressor == nil {
+		return
+	}
+	p.compressors.Put(compressor)
+}
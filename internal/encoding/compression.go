@@ -0,0 +1,121 @@
+package encoding
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// With compression on every stripe is deflated on its own before it is
+// encrypted and split. A flag byte in front of each stripe says whether it was
+// actually deflated, stripes that don't get smaller are stored as they are.
+const (
+	compressionFlate = "flate"
+
+	stripeStored   byte = 0
+	stripeDeflated byte = 1
+
+	// compressionOverhead is the flag byte every stripe gets
+	compressionOverhead = 1
+)
+
+// stripeCompressor deflates the stripes of one file
+type stripeCompressor struct {
+	writer *flate.Writer
+	buf    bytes.Buffer
+
+	// skip is set when the first stripe looks like a format that is already
+	// compressed, there is no point burning cpu on the rest of the file then
+	checked bool
+	skip    bool
+}
+
+func newStripeCompressor() (*stripeCompressor, error) {
+	writer, err := flate.NewWriter(nil, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	return &stripeCompressor{writer: writer}, nil
+}
+
+// compress returns the stripe with its flag byte in front, deflated if that
+// makes it smaller. The returned slice is only valid until the next call.
+func (c *stripeCompressor) compress(stripe []byte) ([]byte, error) {
+	if !c.checked {
+		c.skip = alreadyCompressed(stripe)
+		c.checked = true
+	}
+
+	c.buf.Reset()
+	if !c.skip {
+		c.buf.WriteByte(stripeDeflated)
+		c.writer.Reset(&c.buf)
+		if _, err := c.writer.Write(stripe); err != nil {
+			return nil, err
+		}
+		if err := c.writer.Close(); err != nil {
+			return nil, err
+		}
+		if c.buf.Len() < compressionOverhead+len(stripe) {
+			return c.buf.Bytes(), nil
+		}
+		c.buf.Reset()
+	}
+
+	c.buf.WriteByte(stripeStored)
+	c.buf.Write(stripe)
+	return c.buf.Bytes(), nil
+}
+
+// decompressStripe undoes compress. maxSize is the most a stripe can inflate
+// to, anything bigger means the stripe is not what the encoder wrote.
+func decompressStripe(payload []byte, maxSize int) ([]byte, error) {
+	if len(payload) < compressionOverhead {
+		return nil, fmt.Errorf("compressed stripe is missing its flag byte")
+	}
+
+	switch payload[0] {
+	case stripeStored:
+		return payload[compressionOverhead:], nil
+	case stripeDeflated:
+		reader := flate.NewReader(bytes.NewReader(payload[compressionOverhead:]))
+		defer reader.Close()
+
+		stripe, err := io.ReadAll(io.LimitReader(reader, int64(maxSize)+1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to inflate stripe: %w", err)
+		}
+		if len(stripe) > maxSize {
+			return nil, fmt.Errorf("stripe inflates past the %d byte stripe size", maxSize)
+		}
+		return stripe, nil
+	default:
+		return nil, fmt.Errorf("unknown stripe compression flag %d", payload[0])
+	}
+}
+
+// alreadyCompressed guesses from the first bytes of a file whether it is in a
+// format that is compressed already, like most images, video and archives
+func alreadyCompressed(data []byte) bool {
+	if len(data) > 512 {
+		data = data[:512] // only need first 512 bytes
+	}
+	mimeType := http.DetectContentType(data)
+
+	switch {
+	case strings.HasPrefix(mimeType, "video/"), strings.HasPrefix(mimeType, "audio/"):
+		return true
+	}
+
+	switch mimeType {
+	case "image/png", "image/jpeg", "image/gif", "image/webp",
+		"application/zip", "application/x-gzip", "application/x-rar-compressed",
+		"font/woff", "font/woff2":
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,89 @@
+package encoding
+
+import (
+	"bytes"
+	"testing"
+)
+
+func shardsSize(shards [][]byte) int {
+	total := 0
+	for _, shard := range shards {
+		total += len(shard)
+	}
+	return total
+}
+
+func TestCompression_RoundTrip(t *testing.T) {
+	text := bytes.Repeat([]byte("all work and no play makes jack a dull boy. "), 500)
+
+	for _, identity := range [][]byte{nil, []byte("alice's account key")} {
+		enc := newTestEncoder(t, 4, 2, &EncoderOptions{BlockSize: 1024, Identity: identity, Compress: true})
+		shards := encodeToBuffers(t, enc, text, FileMeta{Name: "jack.txt", Size: int64(len(text))})
+
+		plain := newTestEncoder(t, 4, 2, &EncoderOptions{BlockSize: 1024, Identity: identity})
+		uncompressed := encodeToBuffers(t, plain, text, FileMeta{Name: "jack.txt", Size: int64(len(text))})
+		if shardsSize(shards) >= shardsSize(uncompressed)/4 {
+			t.Errorf("compressed shards take %d bytes, uncompressed %d", shardsSize(shards), shardsSize(uncompressed))
+		}
+
+		shards[1] = nil
+		shards[4] = nil
+
+		var out bytes.Buffer
+		if err := enc.DecodeStream(shardReaders(shards), &out); err != nil {
+			t.Fatalf("DecodeStream failed: %v", err)
+		}
+		if !bytes.Equal(out.Bytes(), text) {
+			t.Fatal("decoded data does not match original")
+		}
+	}
+}
+
+func TestCompression_IncompressibleData(t *testing.T) {
+	enc := newTestEncoder(t, 4, 2, &EncoderOptions{BlockSize: 1024, Compress: true})
+
+	// a png signature followed by noise, nothing in here should get deflated
+	data := append([]byte("\x89PNG\x0D\x0A\x1A\x0A"), testData(5000)...)
+	if !alreadyCompressed(data) {
+		t.Fatal("expected png data to be detected as already compressed")
+	}
+
+	shards := encodeToBuffers(t, enc, data, FileMeta{Name: "photo.png", Size: int64(len(data))})
+	var out bytes.Buffer
+	if err := enc.DecodeStream(shardReaders(shards), &out); err != nil {
+		t.Fatalf("DecodeStream failed: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Fatal("decoded data does not match original")
+	}
+
+	compressor, err := newStripeCompressor()
+	if err != nil {
+		t.Fatalf("failed to create compressor: %v", err)
+	}
+	stripe, err := compressor.compress(data)
+	if err != nil {
+		t.Fatalf("compress failed: %v", err)
+	}
+	if stripe[0] != stripeStored || !bytes.Equal(stripe[compressionOverhead:], data) {
+		t.Error("expected already compressed data to be stored as is")
+	}
+}
+
+func TestDecompressStripe_TooLarge(t *testing.T) {
+	compressor, err := newStripeCompressor()
+	if err != nil {
+		t.Fatalf("failed to create compressor: %v", err)
+	}
+	stripe, err := compressor.compress(make([]byte, 10000))
+	if err != nil {
+		t.Fatalf("compress failed: %v", err)
+	}
+	if stripe[0] != stripeDeflated {
+		t.Fatal("expected zeros to be deflated")
+	}
+
+	if _, err := decompressStripe(stripe, 4096); err == nil {
+		t.Error("expected a stripe inflating past the stripe size to fail")
+	}
+}
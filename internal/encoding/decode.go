@@ -1,165 +1,99 @@
 package encoding
 
 import (
-	"bytes"
-	"fmt"
-	"io"
-	"log"
-	"net/http"
+	"context"
 	"os"
 	"path/filepath"
-	"strings"
-	"sync"
+	"time"
 )
 
-// has to remember file length
 // relativePath is the path inside the IN folder where incoming shards are stored
-// should be a directory not a file
-func (e *Encoder) DecodeShards(relativePath string, fileLength int) error {
-	totalShards := e.parity + e.shards
-	fileName := filepath.Base(relativePath)
-	fileNameNoExt := strings.TrimSuffix(fileName, filepath.Ext(fileName))
+// should be a directory not a file. The file name, length and encoding all come
+// from the shard headers. The file is written to its original path under the
+// OUT folder with its original mode and modification time.
+func (e *Encoder) DecodeShards(relativePath string) error {
+	return e.DecodeShardsContext(context.Background(), relativePath, nil)
+}
 
-	type shardResult struct {
-		index  int
-		result []byte
+// DecodeShardsContext is DecodeShards that can be cancelled through ctx and
+// reports progress, if not nil, after every stripe. The file is decoded next
+// to its final path and only moved there once it is complete, so a cancelled
+// or failed decode leaves nothing behind.
+func (e *Encoder) DecodeShardsContext(ctx context.Context, relativePath string, progress ProgressFunc) error {
+	shards, err := openShards(e.shardsIn, filepath.ToSlash(relativePath))
+	if err != nil {
+		return err
 	}
+	defer closeShards(shards)
 
-	shardFiles := make([]*os.File, totalShards)
-	for i := 0; i < totalShards; i++ {
-		shardName := fmt.Sprintf("shard%d_%s.dat", i, fileNameNoExt)
-		shardPath := filepath.Join(e.dirIn, relativePath, shardName)
-
-		file, err := os.Open(shardPath)
-		if err != nil {
-			shardFiles[i] = nil
-			continue
-		}
-		shardFiles[i] = file
+	header, ordered, err := readShardHeaders(rewindShards(shards))
+	if err != nil {
+		return err
 	}
-
-	// makes sure outpath exists if not it creates it
-	outPath := filepath.Dir(filepath.Join(e.dirOut, relativePath))
-	err := os.MkdirAll(outPath, 0755)
+	sealer, info, err := openFileCipher(e.identity, header)
 	if err != nil {
-		log.Fatal("here")
 		return err
 	}
 
-	// on first run through it finds the file extension creates the file then further
-	// writes to that file
-	var outFile *os.File
-	writtenBytes := 0
-	fileCreated := false
-	for {
-		if fileLength <= writtenBytes {
-			break
-		}
-
-		shardResults := make(chan shardResult, totalShards)
-		shardArray := make([][]byte, totalShards)
-		var shardReaders sync.WaitGroup
-
-		for index, file := range shardFiles {
-			if file == nil {
-				continue
-			}
-
-			shardReaders.Add(1)
-			go func(index int, file *os.File) {
-				defer shardReaders.Done()
-				shard := make([]byte, e.blockSize)
-
-				io.ReadFull(file, shard)
-				// ts silent error is not that tuff
-
-				shardResults <- shardResult{index: index, result: shard}
-
-			}(index, file)
-		}
-
-		go func() {
-			shardReaders.Wait()
-			close(shardResults)
-		}()
-
-		var dataReadCount int
-		for res := range shardResults {
-			shardArray[res.index] = res.result
-			if res.result != nil {
-				dataReadCount++
-			}
-		}
-
-		// CRITICAL FIX: Exit condition 2: If zero non-nil blocks were read in this iteration,
-		// it means all active shards are exhausted. Break the decoding loop to prevent
-		// continuous reconstruction failure on empty data.
-		if dataReadCount == 0 {
-			break
-		}
-
-		err := e.encoder.ReconstructData(shardArray)
-		if err != nil {
-			return err
-		}
-
-		var buf bytes.Buffer
-
-		// works except for padding
-		err = e.encoder.Join(&buf, shardArray, e.shards*e.blockSize)
-		joinedBytes := buf.Bytes()
-		if !fileCreated {
-
-			fileExtension := detectExtension(joinedBytes)
-			fileOutDir := filepath.Join(e.dirOut, filepath.Dir(relativePath))
-			fileOutPath := filepath.Join(fileOutDir, fileNameNoExt+fileExtension)
-			os.MkdirAll(fileOutDir, 0755)
+	fileOutPath := filepath.Join(e.dirOut, decodedFilePath(info, relativePath))
+	// makes sure outpath exists if not it creates it
+	if err := os.MkdirAll(filepath.Dir(fileOutPath), 0755); err != nil {
+		return err
+	}
 
-			outFile, err = os.Create(fileOutPath)
-			if err != nil {
-				return err
-			}
-			defer outFile.Close()
+	outFile, err := os.CreateTemp(filepath.Dir(fileOutPath), ".decode-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(outFile.Name())
 
-			fileCreated = true
-		}
+	if err := decodeStripes(ctx, header, sealer, ordered, outFile, progress); err != nil {
+		outFile.Close()
+		return err
+	}
+	if err := outFile.Close(); err != nil {
+		return err
+	}
 
-		remaining := fileLength - writtenBytes
-		toWrite := len(joinedBytes)
-		if remaining < toWrite {
-			toWrite = remaining
-		}
+	if err := restoreFileInfo(outFile.Name(), info); err != nil {
+		return err
+	}
+	return os.Rename(outFile.Name(), fileOutPath)
+}
 
-		totalWritten := 0
-		for totalWritten < toWrite {
-			n, err := outFile.Write(joinedBytes[totalWritten:toWrite])
-			if err != nil {
-				return err
-			}
-			totalWritten += n
-			writtenBytes += n
-		}
+// decodedFilePath is where a decoded file goes relative to the OUT folder. The
+// path recorded in the header is used as long as it stays inside the folder,
+// otherwise the file goes next to where its shards were in the IN folder.
+func decodedFilePath(info fileInfo, relativePath string) string {
+	if path := filepath.FromSlash(info.Path); info.Path != "" && filepath.IsLocal(path) {
+		return path
 	}
 
-	return nil
+	// Base keeps a shard header from pointing the output outside the folder
+	fileName := filepath.Base(relativePath)
+	if info.Name != "" {
+		fileName = filepath.Base(info.Name)
+	}
+	return filepath.Join(filepath.Dir(relativePath), fileName)
 }
 
-func detectExtension(data []byte) string {
-	if len(data) > 512 {
-		data = data[:512] // only need first 512 bytes
+// restoreFileInfo puts back the mode and modification time recorded for the
+// file, files without a recorded mode get 0644. Only the permission bits are
+// restored, setuid and friends coming from someone else's shards is not
+// something we want.
+func restoreFileInfo(path string, info fileInfo) error {
+	mode := os.FileMode(0644)
+	if info.Mode != 0 {
+		mode = os.FileMode(info.Mode).Perm()
 	}
-	mimeType := http.DetectContentType(data)
-
-	switch mimeType {
-	case "image/png":
-		return ".png"
-	case "image/jpeg":
-		return ".jpg"
-	case "application/pdf":
-		return ".pdf"
-	case "text/plain; charset=utf-8":
-		return ".txt"
-	default:
-		return ".bin" // fallback
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+	if info.ModTime != 0 {
+		modTime := time.Unix(0, info.ModTime)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			return err
+		}
 	}
+	return nil
 }
@@ -10,7 +10,6 @@ import (
 
 // TestDecodeShards_Performance runs full encode→decode and prints throughput (MB/s)
 func TestDecodeShards_Performance(t *testing.T) {
-	tmpIn := t.TempDir()
 	tmpOut := t.TempDir()
 
 	// prepare a moderately large file (e.g., 50 MB)
@@ -26,17 +25,14 @@ func TestDecodeShards_Performance(t *testing.T) {
 		t.Fatalf("failed to write input file: %v", err)
 	}
 
-	// create encoder
-	enc, err := NewEncoder(4, 2, tmpOut, tmpIn)
+	// create encoder, the shards stay in memory so the decoder finds them right away
+	options := DefaultEncoderOptions()
+	options.Store = NewMemoryStore()
+	enc, err := NewEncoderWithOptions(4, 2, tmpOut, tmpOut, options)
 	if err != nil {
 		t.Fatalf("failed to create encoder: %v", err)
 	}
 
-	// make .bin dir for encoded output
-	if err := os.MkdirAll(filepath.Join(tmpOut, ".bin"), 0755); err != nil {
-		t.Fatalf("failed to make .bin dir: %v", err)
-	}
-
 	// encode
 	startEncode := time.Now()
 	if err := enc.EncodeFile(fileName); err != nil {
@@ -44,31 +40,14 @@ func TestDecodeShards_Performance(t *testing.T) {
 	}
 	encodeElapsed := time.Since(startEncode).Seconds()
 
-	// move shards to decoder input (.bin/<fileName>)
-	shardDir := filepath.Join(tmpOut, ".bin", fileName)
-	shards, err := os.ReadDir(shardDir)
-	if err != nil {
-		t.Fatalf("failed to read shard dir: %v", err)
-	}
-	targetShardDir := filepath.Join(tmpIn, fileName)
-	if err := os.MkdirAll(targetShardDir, 0755); err != nil {
-		t.Fatalf("failed to create shard dir: %v", err)
-	}
-	for _, shard := range shards {
-		src := filepath.Join(shardDir, shard.Name())
-		dst := filepath.Join(targetShardDir, shard.Name())
-		b, err := os.ReadFile(src)
-		if err != nil {
-			t.Fatalf("failed to read shard: %v", err)
-		}
-		if err := os.WriteFile(dst, b, 0644); err != nil {
-			t.Fatalf("failed to write shard: %v", err)
-		}
+	// the decoder has to rebuild the file from the shards alone
+	if err := os.Remove(inFilePath); err != nil {
+		t.Fatalf("failed to remove input file: %v", err)
 	}
 
 	// decode
 	startDecode := time.Now()
-	if err := enc.DecodeShards(fileName, len(data)); err != nil {
+	if err := enc.DecodeShards(fileName); err != nil {
 		t.Fatalf("DecodeShards failed: %v", err)
 	}
 	decodeElapsed := time.Since(startDecode).Seconds()
@@ -93,3 +72,87 @@ func TestDecodeShards_Performance(t *testing.T) {
 	t.Logf("Decode: %.2f MB in %.2f s (%.2f MB/s)", mb, decodeElapsed, decodeThroughput)
 }
 
+
+func TestDecodeShards_RestoresPathModeAndModTime(t *testing.T) {
+	tmpOut := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tmpOut, ".bin"), 0755); err != nil {
+		t.Fatalf("failed to make .bin dir: %v", err)
+	}
+	enc, err := NewEncoder(3, 2, tmpOut, filepath.Join(tmpOut, ".bin"))
+	if err != nil {
+		t.Fatalf("failed to create encoder: %v", err)
+	}
+
+	// two files that only differ in extension in a nested folder
+	relativePaths := []string{filepath.Join("docs", "2024", "report.pdf"), filepath.Join("docs", "2024", "report.docx")}
+	modTime := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	contents := make(map[string][]byte)
+	for i, relativePath := range relativePaths {
+		data := testData(3000 + i)
+		contents[relativePath] = data
+
+		path := filepath.Join(tmpOut, relativePath)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("failed to make input dir: %v", err)
+		}
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatalf("failed to write input file: %v", err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatalf("failed to set mod time: %v", err)
+		}
+		if err := enc.EncodeFile(relativePath); err != nil {
+			t.Fatalf("EncodeFile failed: %v", err)
+		}
+	}
+
+	if err := os.RemoveAll(filepath.Join(tmpOut, "docs")); err != nil {
+		t.Fatalf("failed to remove input files: %v", err)
+	}
+
+	for _, relativePath := range relativePaths {
+		if err := enc.DecodeShards(relativePath); err != nil {
+			t.Fatalf("DecodeShards failed: %v", err)
+		}
+
+		path := filepath.Join(tmpOut, relativePath)
+		decoded, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read decoded file: %v", err)
+		}
+		if !bytes.Equal(decoded, contents[relativePath]) {
+			t.Errorf("decoded %s does not match original data", relativePath)
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("failed to stat decoded file: %v", err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("expected mode 0600 for %s, got %v", relativePath, info.Mode().Perm())
+		}
+		if !info.ModTime().Equal(modTime) {
+			t.Errorf("expected mod time %v for %s, got %v", modTime, relativePath, info.ModTime())
+		}
+	}
+}
+
+func TestDecodedFilePath(t *testing.T) {
+	tests := []struct {
+		info         fileInfo
+		relativePath string
+		expected     string
+	}{
+		{fileInfo{Name: "notes.md", Path: "docs/notes.md"}, "elsewhere", filepath.Join("docs", "notes.md")},
+		{fileInfo{Name: "notes.md"}, filepath.Join("docs", "x"), filepath.Join("docs", "notes.md")},
+		{fileInfo{Name: "notes.md", Path: "../../etc/notes.md"}, "notes.md", "notes.md"},
+		{fileInfo{Name: "../notes.md", Path: "/etc/notes.md"}, "notes.md", "notes.md"},
+		{fileInfo{}, filepath.Join("docs", "notes.md"), filepath.Join("docs", "notes.md")},
+	}
+
+	for _, test := range tests {
+		if got := decodedFilePath(test.info, test.relativePath); got != test.expected {
+			t.Errorf("decodedFilePath(%+v, %q) = %q, expected %q", test.info, test.relativePath, got, test.expected)
+		}
+	}
+}
@@ -1,81 +1,125 @@
 package encoding
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-	"sync"
 )
 
 // filepath is relative to the storage dir where all the users drive files are stored
 // essentially bin will be a copy of the filestructure just with shard folders at the base
 // instead of files
 func (e *Encoder) EncodeFile(relativeFilePath string) error {
-	shardOutDir := filepath.Join(e.dirOut, ".bin", relativeFilePath)
+	return e.EncodeFileContext(context.Background(), relativeFilePath, nil)
+}
+
+// EncodeFileContext is EncodeFile that can be cancelled through ctx and
+// reports progress, if not nil, after every stripe. Shards are only committed
+// to the store once every one of them is complete, so a cancelled or failed
+// encode leaves the old shards alone.
+func (e *Encoder) EncodeFileContext(ctx context.Context, relativeFilePath string, progress ProgressFunc) error {
+	_, err := e.encodeFile(ctx, relativeFilePath, progress, false)
+	return err
+}
+
+// encodeFile does the work for EncodeFileContext and ReencodeFileContext.
+// With incremental set the file's current shards are used as the prior
+// encode, if there are any.
+func (e *Encoder) encodeFile(ctx context.Context, relativeFilePath string, progress ProgressFunc, incremental bool) (*Delta, error) {
 	encodeFilePath := filepath.Join(e.dirOut, relativeFilePath)
-	fileName := filepath.Base(relativeFilePath)
-	fileName = fileName[:len(fileName)-len(filepath.Ext(fileName))]
+	fileID := filepath.ToSlash(relativeFilePath)
 
-	if err := os.MkdirAll(shardOutDir, 0755); err != nil {
-		return err
+	in, err := os.Open(encodeFilePath)
+	if err != nil {
+		return nil, err
 	}
+	defer in.Close()
 
-	shardFiles := make([]*os.File, e.parity+e.shards)
-	for i := range shardFiles {
-		shardName := fmt.Sprintf("shard%d_%s.dat", i, fileName)
-		filePath := filepath.Join(shardOutDir, shardName)
-		file, err := os.Create(filePath)
+	info, err := in.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	writers := make([]ShardWriter, 0, e.parity+e.shards)
+	defer func() {
+		for _, writer := range writers {
+			writer.Abort()
+		}
+	}()
+
+	shards := make([]io.Writer, e.parity+e.shards)
+	rootWriters := make([]*merkleWriter, len(shards))
+	for i := range shards {
+		writer, err := e.shardsOut.Put(fileID, i)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		shardFiles[i] = file
-		defer file.Close()
+		writers = append(writers, writer)
+		rootWriters[i] = newMerkleWriter(writer)
+		shards[i] = rootWriters[i]
 	}
 
-	in, err := os.Open(encodeFilePath)
-	if err != nil {
-		return err
+	meta := FileMeta{
+		Name:    filepath.Base(relativeFilePath),
+		Path:    relativeFilePath,
+		Size:    info.Size(),
+		Mode:    info.Mode(),
+		ModTime: info.ModTime(),
 	}
-	readBuffer := make([]byte, e.blockSize*e.shards)
 
-	for {
-		lastBitReadIndex, err := io.ReadFull(in, readBuffer)
-		if err == io.EOF {
-			break
-		}
-		if err == io.ErrUnexpectedEOF {
-			for i := lastBitReadIndex; i < len(readBuffer); i++ {
-				readBuffer[i] = 0
-			}
-		} else if err != nil {
-			return err
-		}
-		splitFile, err := e.encoder.Split(readBuffer)
+	var prior *priorEncoding
+	var priorShards []io.ReadSeekCloser
+	if incremental {
+		priorShards, err = openShards(e.shardsOut, fileID)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		defer closeShards(priorShards)
+		prior = e.openPriorEncoding(rewindShards(priorShards))
+	}
+
+	delta, err := e.encodeStripes(ctx, in, shards, meta, progress, prior)
+	if err != nil {
+		return nil, err
+	}
 
-		e.encoder.Encode(splitFile)
-		var shardWriters sync.WaitGroup
-		for i := range len(shardFiles) {
-			shardWriters.Add(1)
-			go func(i int) {
-				defer shardWriters.Done()
-				if _, err := shardFiles[i].Write(splitFile[i]); err != nil {
-					panic(err)
-				}
-			}(i)
+	// only the roots stay with the owner to check the peers' proofs against.
+	// They are written before the shards are committed and put in place
+	// after, so a failure on the way doesn't leave new shards with old roots.
+	roots := make([]MerkleRoot, len(rootWriters))
+	for i, writer := range rootWriters {
+		if roots[i], err = writer.root(); err != nil {
+			return nil, err
 		}
+	}
+	staged, err := e.stageShardRoots(relativeFilePath, roots)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(staged)
 
-		shardWriters.Wait()
-		if lastBitReadIndex < len(readBuffer) {
-			break
+	// the old shards may still be open for reading which stops the rename on windows
+	closeShards(priorShards)
+	for _, writer := range writers {
+		if err := writer.Commit(); err != nil {
+			return nil, err
 		}
+	}
+	writers = nil
 
+	rootsPath, _ := e.rootsPath(relativeFilePath)
+	if err := os.Rename(staged, rootsPath); err != nil {
+		return nil, err
 	}
 
-	fmt.Printf("files encoded shards found: %s", shardOutDir)
-	return nil
+	return delta, nil
+}
+
+// shardFileName is the name of the file holding shard index of fileName. The
+// extension is kept so report.pdf and report.docx don't share shard names.
+func shardFileName(index int, fileName string) string {
+	return fmt.Sprintf("shard%d_%s.dat", index, fileName)
 }
@@ -108,3 +108,93 @@ func TestEncodeFile_Performance(t *testing.T) {
 	}
 }
 
+
+// --- Tests for block size selection ---
+
+func TestBlockSizeFor(t *testing.T) {
+	enc, err := NewEncoderWithOptions(4, 2, t.TempDir(), t.TempDir(), &EncoderOptions{
+		MinBlockSize: 4096,
+		MaxBlockSize: 1024 * 1024,
+	})
+	if err != nil {
+		t.Fatalf("failed to create encoder: %v", err)
+	}
+
+	tests := []struct {
+		size     int64
+		expected int
+	}{
+		{-1, 1024 * 1024},
+		{0, 4096},
+		{100, 4096},
+		{4 * 100000, 100032},
+		{1 << 30, 1024 * 1024},
+	}
+
+	for _, test := range tests {
+		if got := enc.blockSizeFor(test.size); got != test.expected {
+			t.Errorf("blockSizeFor(%d) = %d, expected %d", test.size, got, test.expected)
+		}
+	}
+
+	enc.blockSize = 777
+	if got := enc.blockSizeFor(1 << 30); got != 777 {
+		t.Errorf("expected fixed block size 777, got %d", got)
+	}
+}
+
+func TestNewEncoderWithOptions_InvalidBlockSizes(t *testing.T) {
+	_, err := NewEncoderWithOptions(4, 2, t.TempDir(), t.TempDir(), &EncoderOptions{
+		MinBlockSize: 2048,
+		MaxBlockSize: 1024,
+	})
+	if err == nil {
+		t.Fatal("expected error for min block size above max, got nil")
+	}
+}
+
+func TestNewEncoderWithOptions_DefaultBlockSizes(t *testing.T) {
+	enc, err := NewEncoderWithOptions(4, 2, t.TempDir(), t.TempDir(), &EncoderOptions{})
+	if err != nil {
+		t.Fatalf("failed to create encoder: %v", err)
+	}
+	if enc.minBlockSize != defaultMinBlockSize || enc.maxBlockSize != defaultMaxBlockSize {
+		t.Errorf("expected the default block sizes, got %d and %d", enc.minBlockSize, enc.maxBlockSize)
+	}
+
+	_, err = NewEncoderWithOptions(4, 2, t.TempDir(), t.TempDir(), &EncoderOptions{MinBlockSize: -1})
+	if err == nil {
+		t.Fatal("expected error for a negative min block size, got nil")
+	}
+}
+
+func TestEncodeFile_SmallFileIsNotPadded(t *testing.T) {
+	tmpOut := t.TempDir()
+	enc, err := NewEncoder(4, 2, tmpOut, t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create encoder: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(tmpOut, "config.json"), []byte(`{"debug": true}`), 0644); err != nil {
+		t.Fatalf("failed to write input file: %v", err)
+	}
+	if err := enc.EncodeFile("config.json"); err != nil {
+		t.Fatalf("EncodeFile failed: %v", err)
+	}
+
+	shardDir := filepath.Join(tmpOut, ".bin", "config.json")
+	files, err := os.ReadDir(shardDir)
+	if err != nil {
+		t.Fatalf("failed to read shard dir: %v", err)
+	}
+	for _, file := range files {
+		info, err := file.Info()
+		if err != nil {
+			t.Fatalf("failed to stat shard: %v", err)
+		}
+		// header plus one tiny block, nowhere near a full block
+		if info.Size() > 1024 {
+			t.Errorf("expected a small shard, %s is %d bytes", file.Name(), info.Size())
+		}
+	}
+}
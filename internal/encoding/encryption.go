@@ -0,0 +1,288 @@
+package encoding
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"math"
+)
+
+// Encrypted files get a random AES-256 key of their own. The key is stored in
+// every shard header wrapped (AES-GCM) with a key derived from the user's
+// identity, so only someone holding that identity can decode the file.
+//
+// Each stripe is sealed on its own before it is split into blocks which keeps
+// encoding and decoding streaming. Every seal gets a random nonce, stored
+// after the sealed stripe, so a re-encode that keeps the file key never
+// reuses a nonce, not even when an earlier attempt from the same generation
+// was thrown away after its shards went out. The stripe index, the generation
+// of the encode that wrote the stripe and whether it is the file's last stripe
+// are authenticated as additional data, so stripes can't be reordered or
+// swapped and a file cut short after any stripe fails to decode. An encrypted
+// file always has a last stripe, an empty one if the file is empty. The sealed
+// file info says whether the encode recorded a file hash, which it does
+// whenever it can seek back in its shards, so the hash can't be dropped from
+// the header to skip checking it.
+const (
+	fileKeySize = 32
+
+	// infoStripe is the stripe index the file name, path, mode and
+	// modification time are sealed under, stripes never get this far
+	infoStripe = math.MaxUint32
+
+	wrapKeyInfo = "mosaic file key wrap v1"
+	hashKeyInfo = "mosaic file hash v1"
+)
+
+var (
+	ErrMissingIdentity = errors.New("file is encrypted but the encoder has no identity to decrypt it")
+	ErrWrongIdentity   = errors.New("file key can't be unwrapped with this identity")
+	ErrStripeAuth      = errors.New("stripe failed authentication")
+)
+
+// stripeCipher seals and opens the stripes of one file
+type stripeCipher struct {
+	aead cipher.AEAD
+	// hashKey keys the file hash so the header doesn't give away a plain hash of the contents
+	hashKey []byte
+}
+
+func newStripeCipher(fileKey []byte) (*stripeCipher, error) {
+	block, err := aes.NewCipher(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	hashKey, err := hkdf.Key(sha256.New, fileKey, nil, hashKeyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	return &stripeCipher{
+		aead:    aead,
+		hashKey: hashKey,
+	}, nil
+}
+
+// overhead is how much bigger sealing makes a stripe, the nonce and the tag
+func (c *stripeCipher) overhead() int {
+	return c.aead.NonceSize() + c.aead.Overhead()
+}
+
+// stripeAAD is the additional data a stripe is sealed with
+func stripeAAD(stripe uint32, generation uint32, last bool) []byte {
+	aad := binary.BigEndian.AppendUint32(nil, stripe)
+	aad = binary.BigEndian.AppendUint32(aad, generation)
+	if last {
+		return append(aad, 1)
+	}
+	return append(aad, 0)
+}
+
+// seal appends the sealed stripe and its nonce to dst, last is set for the
+// file's last stripe
+func (c *stripeCipher) seal(dst []byte, plaintext []byte, stripe int, generation uint32, last bool) []byte {
+	return c.sealWith(dst, plaintext, stripeAAD(uint32(stripe), generation, last))
+}
+
+// open appends the opened stripe to dst, it fails unless last says whether
+// the stripe was sealed as the file's last one
+func (c *stripeCipher) open(dst []byte, sealed []byte, stripe int, generation uint32, last bool) ([]byte, error) {
+	return c.openWith(dst, sealed, stripeAAD(uint32(stripe), generation, last))
+}
+
+// sealWith seals plaintext under a fresh random nonce and appends it to dst
+// followed by the nonce. The nonce goes last so opening in place works.
+func (c *stripeCipher) sealWith(dst []byte, plaintext []byte, aad []byte) []byte {
+	nonce := make([]byte, c.aead.NonceSize())
+	// crypto/rand.Read never fails
+	rand.Read(nonce)
+	return append(c.aead.Seal(dst, nonce, plaintext, aad), nonce...)
+}
+
+func (c *stripeCipher) openWith(dst []byte, sealed []byte, aad []byte) ([]byte, error) {
+	if len(sealed) < c.aead.NonceSize() {
+		return nil, ErrStripeAuth
+	}
+	split := len(sealed) - c.aead.NonceSize()
+	ciphertext, nonce := sealed[:split], sealed[split:]
+	plaintext, err := c.aead.Open(dst, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, ErrStripeAuth
+	}
+	return plaintext, nil
+}
+
+// infoAAD is the additional data the file info is sealed with, hashed says
+// whether the header carries a file hash
+func infoAAD(generation uint32, hashed bool) []byte {
+	return stripeAAD(infoStripe, generation, hashed)
+}
+
+// newHash returns the hash used for the file hash in the header
+func (c *stripeCipher) newHash() hash.Hash {
+	return hmac.New(sha256.New, c.hashKey)
+}
+
+// sealInfo moves the file info in header into SealedInfo, sealed under the
+// header's generation. hashed says whether the file hash will be filled in.
+func (c *stripeCipher) sealInfo(header *ShardHeader, hashed bool) error {
+	info, err := json.Marshal(header.fileInfo())
+	if err != nil {
+		return err
+	}
+
+	header.SealedInfo = hex.EncodeToString(c.sealWith(nil, info, infoAAD(header.Generation, hashed)))
+	header.setFileInfo(fileInfo{})
+	return nil
+}
+
+// newFileCipher makes a fresh file key and fills in the encryption fields of
+// header, sealing away the file info already in it
+func newFileCipher(identity []byte, header *ShardHeader, hashed bool) (*stripeCipher, error) {
+	fileKey := make([]byte, fileKeySize)
+	if _, err := rand.Read(fileKey); err != nil {
+		return nil, err
+	}
+
+	wrappedKey, err := wrapFileKey(identity, fileKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sealer, err := newStripeCipher(fileKey)
+	if err != nil {
+		return nil, err
+	}
+
+	header.WrappedKey = hex.EncodeToString(wrappedKey)
+	if err := sealer.sealInfo(header, hashed); err != nil {
+		return nil, err
+	}
+
+	return sealer, nil
+}
+
+// reuseFileCipher opens the file key of an earlier encode of the file and
+// fills in the encryption fields of header with it, so stripes that didn't
+// change can be kept as they are. header has to have a newer generation than prior.
+func reuseFileCipher(identity []byte, prior *ShardHeader, header *ShardHeader, hashed bool) (*stripeCipher, error) {
+	if header.Generation <= prior.Generation {
+		return nil, fmt.Errorf("generation %d has to be newer than %d", header.Generation, prior.Generation)
+	}
+
+	sealer, _, err := openFileCipher(identity, prior)
+	if err != nil {
+		return nil, err
+	}
+	if sealer == nil {
+		return nil, errors.New("earlier encode is not encrypted")
+	}
+
+	header.WrappedKey = prior.WrappedKey
+	if err := sealer.sealInfo(header, hashed); err != nil {
+		return nil, err
+	}
+
+	return sealer, nil
+}
+
+// openFileCipher unwraps the file key of an encrypted file. It returns a nil
+// cipher for files that aren't encrypted. The file info is returned either way.
+func openFileCipher(identity []byte, header *ShardHeader) (*stripeCipher, fileInfo, error) {
+	if header.WrappedKey == "" {
+		return nil, header.fileInfo(), nil
+	}
+	if identity == nil {
+		return nil, fileInfo{}, ErrMissingIdentity
+	}
+
+	wrappedKey, err := hex.DecodeString(header.WrappedKey)
+	if err != nil {
+		return nil, fileInfo{}, ErrWrongIdentity
+	}
+	sealedInfo, err := hex.DecodeString(header.SealedInfo)
+	if err != nil {
+		return nil, fileInfo{}, ErrNotAShard
+	}
+
+	fileKey, err := unwrapFileKey(identity, wrappedKey)
+	if err != nil {
+		return nil, fileInfo{}, err
+	}
+
+	sealer, err := newStripeCipher(fileKey)
+	if err != nil {
+		return nil, fileInfo{}, err
+	}
+
+	// a header whose file hash was dropped doesn't match what was sealed
+	opened, err := sealer.openWith(nil, sealedInfo, infoAAD(header.Generation, header.FileHash != ""))
+	if err != nil {
+		return nil, fileInfo{}, err
+	}
+	var info fileInfo
+	if err := json.Unmarshal(opened, &info); err != nil {
+		return nil, fileInfo{}, fmt.Errorf("%w: sealed file info: %v", ErrNotAShard, err)
+	}
+
+	return sealer, info, nil
+}
+
+// wrapKeyAEAD returns the cipher file keys are wrapped with for identity
+func wrapKeyAEAD(identity []byte) (cipher.AEAD, error) {
+	wrapKey, err := hkdf.Key(sha256.New, identity, nil, wrapKeyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(wrapKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// wrapFileKey seals fileKey with the identity's wrapping key, the random nonce goes in front
+func wrapFileKey(identity []byte, fileKey []byte) ([]byte, error) {
+	aead, err := wrapKeyAEAD(identity)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, fileKey, nil), nil
+}
+
+func unwrapFileKey(identity []byte, wrappedKey []byte) ([]byte, error) {
+	aead, err := wrapKeyAEAD(identity)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrappedKey) < aead.NonceSize() {
+		return nil, ErrWrongIdentity
+	}
+
+	nonce, sealed := wrappedKey[:aead.NonceSize()], wrappedKey[aead.NonceSize():]
+	fileKey, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil || len(fileKey) != fileKeySize {
+		return nil, ErrWrongIdentity
+	}
+
+	return fileKey, nil
+}
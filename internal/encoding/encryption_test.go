@@ -0,0 +1,195 @@
+package encoding
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryption_RoundTrip(t *testing.T) {
+	enc := newTestEncoder(t, 4, 2, &EncoderOptions{BlockSize: 1024, Identity: []byte("alice's account key")})
+
+	secret := []byte("the quick brown fox jumps over the lazy dog. ")
+	data := bytes.Repeat(secret, 400)
+	shards := encodeToBuffers(t, enc, data, FileMeta{Name: "diary.txt", Size: int64(len(data))})
+
+	for i, shard := range shards {
+		if bytes.Contains(shard, secret[:16]) {
+			t.Errorf("shard %d contains plaintext", i)
+		}
+		if bytes.Contains(shard, []byte("diary.txt")) {
+			t.Errorf("shard %d contains the file name", i)
+		}
+	}
+
+	// spread over several stripes and missing two shards
+	shards[0] = nil
+	shards[5] = nil
+
+	var out bytes.Buffer
+	if err := enc.DecodeStream(shardReaders(shards), &out); err != nil {
+		t.Fatalf("DecodeStream failed: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Fatal("decrypted data does not match original")
+	}
+}
+
+func TestEncryption_WrongIdentity(t *testing.T) {
+	enc := newTestEncoder(t, 4, 2, &EncoderOptions{BlockSize: 1024, Identity: []byte("alice's account key")})
+	data := testData(3000)
+	shards := encodeToBuffers(t, enc, data, FileMeta{Name: "data.bin", Size: int64(len(data))})
+
+	mallory := newTestEncoder(t, 4, 2, &EncoderOptions{BlockSize: 1024, Identity: []byte("mallory's account key")})
+	if err := mallory.DecodeStream(shardReaders(shards), &bytes.Buffer{}); !errors.Is(err, ErrWrongIdentity) {
+		t.Errorf("expected ErrWrongIdentity, got %v", err)
+	}
+
+	plain, err := NewEncoder(4, 2, t.TempDir(), t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create encoder: %v", err)
+	}
+	if err := plain.DecodeStream(shardReaders(shards), &bytes.Buffer{}); !errors.Is(err, ErrMissingIdentity) {
+		t.Errorf("expected ErrMissingIdentity, got %v", err)
+	}
+}
+
+func TestEncryption_StripesCantBeSwapped(t *testing.T) {
+	sealer, err := newStripeCipher(make([]byte, fileKeySize))
+	if err != nil {
+		t.Fatalf("failed to create cipher: %v", err)
+	}
+
+	sealed := sealer.seal(nil, []byte("stripe zero"), 0, 0, false)
+	if _, err := sealer.open(nil, sealed, 1, 0, false); !errors.Is(err, ErrStripeAuth) {
+		t.Errorf("expected ErrStripeAuth opening a stripe at the wrong index, got %v", err)
+	}
+
+	if _, err := sealer.open(nil, sealed, 0, 1, false); !errors.Is(err, ErrStripeAuth) {
+		t.Errorf("expected ErrStripeAuth opening a stripe with the wrong generation, got %v", err)
+	}
+
+	if _, err := sealer.open(nil, sealed, 0, 0, true); !errors.Is(err, ErrStripeAuth) {
+		t.Errorf("expected ErrStripeAuth opening a stripe as the last one, got %v", err)
+	}
+
+	// an encode retried from the same generation doesn't reuse a nonce
+	if again := sealer.seal(nil, []byte("stripe zero"), 0, 0, false); bytes.Equal(again, sealed) {
+		t.Error("expected sealing the same stripe twice to use different nonces")
+	}
+
+	sealed[0] ^= 0x01
+	if _, err := sealer.open(nil, sealed, 0, 0, false); !errors.Is(err, ErrStripeAuth) {
+		t.Errorf("expected ErrStripeAuth for a tampered stripe, got %v", err)
+	}
+}
+
+func TestEncryption_DecodeShardsRestoresName(t *testing.T) {
+	tmpOut := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tmpOut, ".bin"), 0755); err != nil {
+		t.Fatalf("failed to make .bin dir: %v", err)
+	}
+
+	options := DefaultEncoderOptions()
+	options.Identity = []byte("alice's account key")
+	enc, err := NewEncoderWithOptions(3, 2, tmpOut, filepath.Join(tmpOut, ".bin"), options)
+	if err != nil {
+		t.Fatalf("failed to create encoder: %v", err)
+	}
+
+	data := testData(12345)
+	if err := os.WriteFile(filepath.Join(tmpOut, "taxes.pdf"), data, 0644); err != nil {
+		t.Fatalf("failed to write input file: %v", err)
+	}
+	if err := enc.EncodeFile("taxes.pdf"); err != nil {
+		t.Fatalf("EncodeFile failed: %v", err)
+	}
+	if err := os.Remove(filepath.Join(tmpOut, "taxes.pdf")); err != nil {
+		t.Fatalf("failed to remove input file: %v", err)
+	}
+
+	if err := enc.DecodeShards("taxes.pdf"); err != nil {
+		t.Fatalf("DecodeShards failed: %v", err)
+	}
+	decoded, err := os.ReadFile(filepath.Join(tmpOut, "taxes.pdf"))
+	if err != nil {
+		t.Fatalf("failed to read decoded file: %v", err)
+	}
+	if !bytes.Equal(decoded, data) {
+		t.Fatal("decoded file does not match original data")
+	}
+}
+
+func TestEncryption_TruncatedStreamFails(t *testing.T) {
+	options := DefaultEncoderOptions()
+	options.Identity = []byte("alice's account key")
+	options.BlockSize = 64
+	enc, err := NewEncoderWithOptions(4, 2, t.TempDir(), t.TempDir(), options)
+	if err != nil {
+		t.Fatalf("failed to create encoder: %v", err)
+	}
+
+	// without a known length or a hash only the sealed last stripe marks the end
+	data := testData(1000)
+	shards := encodeToBuffers(t, enc, data, FileMeta{Name: "data.bin", Size: -1})
+	var out bytes.Buffer
+	if err := enc.DecodeStream(shardReaders(shards), &out); err != nil || !bytes.Equal(out.Bytes(), data) {
+		t.Fatalf("DecodeStream of the whole file failed: %v", err)
+	}
+
+	for i, shard := range shards {
+		header, err := ReadShardHeader(bytes.NewReader(shard))
+		if err != nil {
+			t.Fatalf("failed to read shard header: %v", err)
+		}
+		headerBytes, _ := marshalShardHeader(header)
+		shards[i] = shard[:len(headerBytes)+2*(blockHeaderSize+header.BlockSize)]
+	}
+	if err := enc.DecodeStream(shardReaders(shards), &bytes.Buffer{}); !errors.Is(err, ErrStripeAuth) {
+		t.Errorf("expected ErrStripeAuth for a file cut short, got %v", err)
+	}
+
+	// nor can an empty file lose its only stripe
+	shards = encodeToBuffers(t, enc, nil, FileMeta{Name: "empty.bin", Size: -1})
+	for i, shard := range shards {
+		header, _ := ReadShardHeader(bytes.NewReader(shard))
+		headerBytes, _ := marshalShardHeader(header)
+		shards[i] = shard[:len(headerBytes)]
+	}
+	if err := enc.DecodeStream(shardReaders(shards), &bytes.Buffer{}); !errors.Is(err, ErrStripeAuth) {
+		t.Errorf("expected ErrStripeAuth for an empty file without its stripe, got %v", err)
+	}
+}
+
+func TestEncryption_FileHashCantBeDropped(t *testing.T) {
+	_, shardDir := encodeTestFile(t, "diary.txt", testData(5000), &EncoderOptions{Identity: []byte("alice's account key")})
+
+	shards := make([][]byte, 6)
+	for i := range shards {
+		shard, err := os.ReadFile(filepath.Join(shardDir, shardFileName(i, "diary.txt")))
+		if err != nil {
+			t.Fatalf("failed to read shard: %v", err)
+		}
+		header, err := ReadShardHeader(bytes.NewReader(shard))
+		if err != nil {
+			t.Fatalf("failed to read shard header: %v", err)
+		}
+		if header.FileHash == "" {
+			t.Fatal("expected an encrypted file written to seekable shards to record its hash")
+		}
+		oldHeader, _ := marshalShardHeader(header)
+		header.FileHash = ""
+		newHeader, err := marshalShardHeader(header)
+		if err != nil {
+			t.Fatalf("failed to marshal shard header: %v", err)
+		}
+		shards[i] = append(newHeader, shard[len(oldHeader):]...)
+	}
+
+	enc := newTestEncoder(t, 4, 2, &EncoderOptions{Identity: []byte("alice's account key")})
+	if err := enc.DecodeStream(shardReaders(shards), &bytes.Buffer{}); !errors.Is(err, ErrStripeAuth) {
+		t.Errorf("expected ErrStripeAuth once the file hash is dropped, got %v", err)
+	}
+}
@@ -0,0 +1,291 @@
+package encoding
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"strings"
+)
+
+// Every shard starts with a header so it can be decoded without knowing how it
+// was encoded:
+//
+//	magic "MOSH" | version uint16 | body length uint32 | JSON ShardHeader (space padded)
+//
+// After the header the shard is a list of blocks, one per stripe:
+//
+//	block length uint32 | data length uint32 | generation uint32 | stripe hash [32]byte | crc32c uint32 | block bytes
+//
+// The generation says which encode of the file last wrote the stripe and the
+// stripe hash is the hash of the stripe's file data, both are the same in
+// every shard's block of a stripe. They let a re-encode keep the stripes that
+// didn't change, see incremental.go. The crc covers everything before it and
+// the block so a flipped bit anywhere in the block marks it as bad and the
+// decoder treats it as an erasure.
+const (
+	shardMagic         = "MOSH"
+	shardFormatVersion = 6
+
+	headerPrefixSize = 4 + 2 + 4
+	// maxHeaderSize stops a corrupt length field from making us allocate a huge buffer
+	maxHeaderSize = 64 * 1024
+
+	stripeHashSize  = sha256.Size
+	blockHeaderSize = 4 + 4 + 4 + stripeHashSize + 4
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	ErrNotAShard         = errors.New("not a mosaic shard")
+	ErrUnsupportedFormat = errors.New("unsupported shard format version")
+	ErrCorruptBlock      = errors.New("shard block failed its checksum")
+	ErrTooFewShards      = errors.New("not enough intact shards to rebuild the file")
+	ErrFileHashMismatch  = errors.New("decoded file does not match the recorded hash")
+)
+
+// ShardHeader describes the file a shard belongs to and how it was encoded
+type ShardHeader struct {
+	DataShards   int `json:"data_shards"`
+	ParityShards int `json:"parity_shards"`
+	BlockSize    int `json:"block_size"`
+	ShardIndex   int `json:"shard_index"`
+	// Scheme is the redundancy scheme the shards were made with, see
+	// redundancy.go. LocalGroupSize is only set for SchemeLRC.
+	Scheme         string `json:"scheme"`
+	LocalGroupSize int    `json:"local_group_size,omitempty"`
+	// StripeSize is how many bytes of the file go in every stripe but the last
+	StripeSize int `json:"stripe_size"`
+	// Generation counts how many times the file has been re-encoded, the
+	// stripes written by the latest encode carry it in their blocks
+	Generation uint32 `json:"generation"`
+
+	// FileName, FilePath, FileMode and ModTime describe the file the shards
+	// were made from, see fileInfo. They are empty for encrypted files, which
+	// keep them in SealedInfo instead.
+	FileName string `json:"file_name"`
+	FilePath string `json:"file_path,omitempty"`
+	FileMode uint32 `json:"file_mode,omitempty"`
+	ModTime  int64  `json:"mod_time,omitempty"`
+
+	// FileLength is -1 and FileHash is empty when the encoder was given a stream
+	// of unknown length and could not go back to fill them in. For encrypted
+	// files FileHash is keyed with the file key.
+	FileLength int64  `json:"file_length"`
+	FileHash   string `json:"file_hash,omitempty"`
+
+	// set when the file is encrypted, see encryption.go
+	WrappedKey string `json:"wrapped_key,omitempty"`
+	SealedInfo string `json:"sealed_info,omitempty"`
+
+	// Compression names how the stripes were compressed, empty if they weren't.
+	// See compression.go.
+	Compression string `json:"compression,omitempty"`
+}
+
+// sameEncoding reports whether two headers come from the same encode of the same file
+func (h *ShardHeader) sameEncoding(other *ShardHeader) bool {
+	return h.DataShards == other.DataShards &&
+		h.ParityShards == other.ParityShards &&
+		h.BlockSize == other.BlockSize &&
+		h.Scheme == other.Scheme &&
+		h.LocalGroupSize == other.LocalGroupSize &&
+		h.StripeSize == other.StripeSize &&
+		h.Generation == other.Generation &&
+		h.FileName == other.FileName &&
+		h.FilePath == other.FilePath &&
+		h.FileMode == other.FileMode &&
+		h.ModTime == other.ModTime &&
+		h.FileLength == other.FileLength &&
+		h.FileHash == other.FileHash &&
+		h.WrappedKey == other.WrappedKey &&
+		h.SealedInfo == other.SealedInfo &&
+		h.Compression == other.Compression
+}
+
+// fileInfo is the part of a shard header describing the file itself rather
+// than how it was encoded
+type fileInfo struct {
+	Name string `json:"file_name"`
+	// Path is the slash separated path of the file relative to the folder it was encoded from
+	Path string `json:"file_path,omitempty"`
+	// Mode holds the os.FileMode bits and ModTime the unix nano modification
+	// time, both 0 when not known
+	Mode    uint32 `json:"file_mode,omitempty"`
+	ModTime int64  `json:"mod_time,omitempty"`
+}
+
+func (h *ShardHeader) fileInfo() fileInfo {
+	return fileInfo{
+		Name:    h.FileName,
+		Path:    h.FilePath,
+		Mode:    h.FileMode,
+		ModTime: h.ModTime,
+	}
+}
+
+func (h *ShardHeader) setFileInfo(info fileInfo) {
+	h.FileName = info.Name
+	h.FilePath = info.Path
+	h.FileMode = info.Mode
+	h.ModTime = info.ModTime
+}
+
+// marshalShardHeader serializes the header padded with spaces to the size it
+// has with the file length and hash filled in. That way the header can be
+// rewritten in place once they are known and a shard rebuilt later comes out
+// byte for byte the same as the original.
+func marshalShardHeader(h *ShardHeader) ([]byte, error) {
+	body, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+
+	sized := *h
+	sized.FileLength = math.MinInt64
+	sized.FileHash = strings.Repeat("0", sha256.Size*2)
+	fullBody, err := json.Marshal(&sized)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > len(fullBody) {
+		return nil, fmt.Errorf("shard header is longer than its reserved %d bytes", len(fullBody))
+	}
+
+	buf := make([]byte, headerPrefixSize+len(fullBody))
+	copy(buf, shardMagic)
+	binary.BigEndian.PutUint16(buf[4:6], shardFormatVersion)
+	binary.BigEndian.PutUint32(buf[6:10], uint32(len(fullBody)))
+	copy(buf[headerPrefixSize:], body)
+	for i := headerPrefixSize + len(body); i < len(buf); i++ {
+		buf[i] = ' '
+	}
+
+	return buf, nil
+}
+
+// ReadShardHeader reads the header at the start of a shard, leaving r at the first block
+func ReadShardHeader(r io.Reader) (*ShardHeader, error) {
+	prefix := make([]byte, headerPrefixSize)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotAShard, err)
+	}
+	if string(prefix[:4]) != shardMagic {
+		return nil, ErrNotAShard
+	}
+	if version := binary.BigEndian.Uint16(prefix[4:6]); version != shardFormatVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedFormat, version)
+	}
+
+	bodySize := binary.BigEndian.Uint32(prefix[6:10])
+	if bodySize > maxHeaderSize {
+		return nil, fmt.Errorf("%w: header of %d bytes", ErrNotAShard, bodySize)
+	}
+
+	body := make([]byte, bodySize)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotAShard, err)
+	}
+
+	var header ShardHeader
+	if err := json.Unmarshal(bytes.TrimRight(body, " "), &header); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotAShard, err)
+	}
+	if header.DataShards <= 0 || header.ParityShards < 0 || header.BlockSize <= 0 || header.StripeSize <= 0 ||
+		header.ShardIndex < 0 || header.ShardIndex >= header.DataShards+header.ParityShards {
+		return nil, fmt.Errorf("%w: invalid header values", ErrNotAShard)
+	}
+	switch header.Scheme {
+	case SchemeReedSolomon, SchemeReplication, SchemeLRC:
+	default:
+		return nil, fmt.Errorf("%w: unknown redundancy scheme %q", ErrUnsupportedFormat, header.Scheme)
+	}
+	if header.Compression != "" && header.Compression != compressionFlate {
+		return nil, fmt.Errorf("%w: unknown compression %q", ErrUnsupportedFormat, header.Compression)
+	}
+
+	return &header, nil
+}
+
+// blockMeta is what a block's record says about its stripe besides the block itself
+type blockMeta struct {
+	// dataLen is how many bytes of the stripe are file data rather than padding
+	dataLen    int
+	generation uint32
+	stripeHash [stripeHashSize]byte
+}
+
+// writeBlock writes one stripe's block of a shard together with its checksum
+func writeBlock(w io.Writer, block []byte, meta blockMeta) error {
+	head := make([]byte, blockHeaderSize, blockHeaderSize+len(block))
+	binary.BigEndian.PutUint32(head[0:4], uint32(len(block)))
+	binary.BigEndian.PutUint32(head[4:8], uint32(meta.dataLen))
+	binary.BigEndian.PutUint32(head[8:12], meta.generation)
+	copy(head[12:12+stripeHashSize], meta.stripeHash[:])
+	crcAt := blockHeaderSize - 4
+	crc := crc32.Update(crc32.Checksum(head[:crcAt], castagnoli), castagnoli, block)
+	binary.BigEndian.PutUint32(head[crcAt:], crc)
+
+	_, err := w.Write(append(head, block...))
+	return err
+}
+
+// readBlock reads the next block of a shard. It returns io.EOF when the shard
+// has no blocks left and ErrCorruptBlock when the block was read but its
+// checksum is wrong, in which case the shard can still be read further. Any
+// other error means the shard can't be trusted from here on.
+func readBlock(r io.Reader, maxBlockSize int) ([]byte, blockMeta, error) {
+	head := make([]byte, blockHeaderSize)
+	if _, err := io.ReadFull(r, head); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, blockMeta{}, fmt.Errorf("truncated block header: %w", err)
+		}
+		return nil, blockMeta{}, err
+	}
+
+	blockLen := int(binary.BigEndian.Uint32(head[0:4]))
+	if blockLen > maxBlockSize {
+		return nil, blockMeta{}, fmt.Errorf("block of %d bytes is larger than the %d byte block size", blockLen, maxBlockSize)
+	}
+	meta := blockMeta{
+		dataLen:    int(binary.BigEndian.Uint32(head[4:8])),
+		generation: binary.BigEndian.Uint32(head[8:12]),
+	}
+	copy(meta.stripeHash[:], head[12:12+stripeHashSize])
+
+	block := make([]byte, blockLen)
+	if _, err := io.ReadFull(r, block); err != nil {
+		return nil, blockMeta{}, fmt.Errorf("truncated block: %w", err)
+	}
+
+	crcAt := blockHeaderSize - 4
+	crc := crc32.Update(crc32.Checksum(head[:crcAt], castagnoli), castagnoli, block)
+	if crc != binary.BigEndian.Uint32(head[crcAt:]) {
+		return nil, blockMeta{}, ErrCorruptBlock
+	}
+
+	return block, meta, nil
+}
+
+// skipBlock moves r past the next block reading only its length. The block
+// isn't checked so a bad length only shows up as a corrupt block further on.
+func skipBlock(r io.ReadSeeker, maxBlockSize int) error {
+	head := make([]byte, blockHeaderSize)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return err
+	}
+
+	blockLen := int(binary.BigEndian.Uint32(head[0:4]))
+	if blockLen > maxBlockSize {
+		return fmt.Errorf("block of %d bytes is larger than the %d byte block size", blockLen, maxBlockSize)
+	}
+
+	_, err := r.Seek(int64(blockLen), io.SeekCurrent)
+	return err
+}
@@ -0,0 +1,139 @@
+package encoding
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestShardHeader_RoundTrip(t *testing.T) {
+	header := &ShardHeader{
+		DataShards:   4,
+		ParityShards: 2,
+		BlockSize:    1024,
+		ShardIndex:   5,
+		Scheme:       SchemeReedSolomon,
+		StripeSize:   4096,
+		FileName:     "notes.md",
+		FileLength:   -1,
+	}
+
+	buf, err := marshalShardHeader(header)
+	if err != nil {
+		t.Fatalf("failed to marshal header: %v", err)
+	}
+
+	// rewriting with the final length and hash has to keep the same size
+	header.FileLength = 1 << 40
+	header.FileHash = string(bytes.Repeat([]byte("a"), 64))
+	rewritten, err := marshalShardHeader(header)
+	if err != nil {
+		t.Fatalf("failed to rewrite header: %v", err)
+	}
+	if len(rewritten) != len(buf) {
+		t.Fatalf("rewritten header is %d bytes, expected %d", len(rewritten), len(buf))
+	}
+
+	read, err := ReadShardHeader(bytes.NewReader(rewritten))
+	if err != nil {
+		t.Fatalf("failed to read header: %v", err)
+	}
+	if *read != *header {
+		t.Errorf("expected %+v, got %+v", header, read)
+	}
+}
+
+func TestShardHeader_Invalid(t *testing.T) {
+	if _, err := ReadShardHeader(bytes.NewReader([]byte("not a shard at all"))); !errors.Is(err, ErrNotAShard) {
+		t.Errorf("expected ErrNotAShard, got %v", err)
+	}
+
+	buf, _ := marshalShardHeader(&ShardHeader{DataShards: 1, BlockSize: 1, Scheme: SchemeReedSolomon})
+	buf[5] = 99
+	if _, err := ReadShardHeader(bytes.NewReader(buf)); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("expected ErrUnsupportedFormat, got %v", err)
+	}
+}
+
+func TestDecodeStream_CorruptShards(t *testing.T) {
+	enc, err := NewEncoder(4, 2, t.TempDir(), t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create encoder: %v", err)
+	}
+	enc.blockSize = 512
+
+	data := testData(5000)
+	shards := encodeToBuffers(t, enc, data, FileMeta{Name: "data.bin", Size: int64(len(data))})
+
+	// flip a bit in the last block of one shard and wreck the header of another
+	shards[0][len(shards[0])-1] ^= 0x01
+	copy(shards[3], "XXXX")
+
+	// shard order shouldn't matter since the headers carry the index
+	shuffled := [][]byte{shards[5], shards[3], shards[1], shards[0], shards[4], shards[2]}
+
+	var out bytes.Buffer
+	if err := enc.DecodeStream(shardReaders(shuffled), &out); err != nil {
+		t.Fatalf("DecodeStream failed: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Fatal("decoded data does not match original")
+	}
+
+	// with a third shard gone the corrupt block can't be covered anymore
+	shuffled[0] = nil
+	shuffled[4] = nil
+	err = enc.DecodeStream(shardReaders(shuffled), &bytes.Buffer{})
+	if !errors.Is(err, ErrTooFewShards) {
+		t.Errorf("expected ErrTooFewShards, got %v", err)
+	}
+}
+
+func TestDecodeShards_UsesOnlyShardFiles(t *testing.T) {
+	// decode straight from where the encoder put the shards
+	tmpOut := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tmpOut, ".bin"), 0755); err != nil {
+		t.Fatalf("failed to make .bin dir: %v", err)
+	}
+	enc, err := NewEncoder(3, 2, tmpOut, filepath.Join(tmpOut, ".bin"))
+	if err != nil {
+		t.Fatalf("failed to create encoder: %v", err)
+	}
+
+	data := testData(70000)
+	if err := os.WriteFile(filepath.Join(tmpOut, "notes.md"), data, 0644); err != nil {
+		t.Fatalf("failed to write input file: %v", err)
+	}
+	if err := enc.EncodeFile("notes.md"); err != nil {
+		t.Fatalf("EncodeFile failed: %v", err)
+	}
+	if err := os.Remove(filepath.Join(tmpOut, "notes.md")); err != nil {
+		t.Fatalf("failed to remove input file: %v", err)
+	}
+
+	shard, err := os.ReadFile(filepath.Join(tmpOut, ".bin", "notes.md", "shard0_notes.md.dat"))
+	if err != nil {
+		t.Fatalf("failed to read shard: %v", err)
+	}
+	header, err := ReadShardHeader(bytes.NewReader(shard))
+	if err != nil {
+		t.Fatalf("failed to read shard header: %v", err)
+	}
+	if header.FileLength != int64(len(data)) || len(header.FileHash) != 64 {
+		t.Errorf("expected length and hash to be filled in, got %+v", header)
+	}
+
+	if err := enc.DecodeShards("notes.md"); err != nil {
+		t.Fatalf("DecodeShards failed: %v", err)
+	}
+
+	decoded, err := os.ReadFile(filepath.Join(tmpOut, "notes.md"))
+	if err != nil {
+		t.Fatalf("failed to read decoded file: %v", err)
+	}
+	if !bytes.Equal(decoded, data) {
+		t.Fatal("decoded file does not match original data")
+	}
+}
@@ -0,0 +1,120 @@
+package encoding
+
+import (
+	"context"
+	"io"
+)
+
+// Re-encoding a file that was edited only rewrites the stripes whose data
+// changed. Every block record carries the hash of its stripe's data, keyed
+// with the file key for encrypted files, so the new data can be compared
+// against the old shards stripe by stripe. Stripes that match are copied over
+// byte for byte and only the rest has to be sent to peers again.
+//
+// Stripes are cut at fixed offsets so this works for edits that keep the
+// length of the file, like rewriting a paragraph or patching a database page.
+// Inserting or deleting bytes shifts every stripe after the edit.
+
+// ShardRange is a run of bytes in one shard
+type ShardRange struct {
+	Shard  int
+	Offset int64
+	Length int64
+}
+
+// Delta says which bytes of a file's shards a re-encode wrote fresh
+type Delta struct {
+	// Changed lists the rewritten ranges, by shard and then offset. The header
+	// at the start of every shard is always in it.
+	Changed []ShardRange
+	// ShardSizes holds the new size of every shard, anything past it in an
+	// old copy of the shard is gone
+	ShardSizes []int64
+}
+
+// ReencodeFile encodes relativeFilePath like EncodeFile but keeps the stripes
+// that are unchanged since its shards were last written, and returns which
+// parts of the shards changed. Without usable old shards, say because the
+// encoder settings changed, every stripe is encoded fresh.
+func (e *Encoder) ReencodeFile(relativeFilePath string) (*Delta, error) {
+	return e.ReencodeFileContext(context.Background(), relativeFilePath, nil)
+}
+
+// ReencodeFileContext is ReencodeFile that can be cancelled through ctx and
+// reports progress, if not nil, after every stripe
+func (e *Encoder) ReencodeFileContext(ctx context.Context, relativeFilePath string, progress ProgressFunc) (*Delta, error) {
+	return e.encodeFile(ctx, relativeFilePath, progress, true)
+}
+
+// priorEncoding is an earlier encode of a file that a re-encode copies the
+// unchanged stripes from
+type priorEncoding struct {
+	header  *ShardHeader
+	stripes *stripeReader
+}
+
+// openPriorEncoding reads the headers of a file's old shards. It returns nil
+// when they can't be used, which just means everything gets encoded again.
+func (e *Encoder) openPriorEncoding(shards []io.Reader) *priorEncoding {
+	header, ordered, err := readShardHeaders(shards)
+	if err != nil || header.FileLength < 0 {
+		return nil
+	}
+	// an encrypted file can only be continued with the key it was encrypted with
+	if _, _, err := openFileCipher(e.identity, header); err != nil {
+		return nil
+	}
+
+	return &priorEncoding{
+		header:  header,
+		stripes: newStripeReader(header, ordered),
+	}
+}
+
+// compatible reports whether stripes of the prior encode can be reused in a
+// new encode described by header
+func (p *priorEncoding) compatible(header *ShardHeader, compress bool, encrypt bool) bool {
+	return p.header.DataShards == header.DataShards &&
+		p.header.ParityShards == header.ParityShards &&
+		p.header.Scheme == header.Scheme &&
+		p.header.LocalGroupSize == header.LocalGroupSize &&
+		(p.header.Compression != "") == compress &&
+		(p.header.WrappedKey != "") == encrypt
+}
+
+// unchangedStripe reads the prior encode's next stripe and returns its blocks,
+// with any missing ones rebuilt, and record if its data has the same hash as
+// the new stripe described by record. Otherwise it returns nil blocks and
+// record as it was passed in. Sealed stripes are only kept if they are still
+// the last stripe, or still not, since that is part of what they are sealed with.
+func (p *priorEncoding) unchangedStripe(codec Redundancy, record blockMeta, last bool) ([][]byte, blockMeta) {
+	if p.stripes == nil {
+		return nil, record
+	}
+
+	blocks, old, err := p.stripes.next()
+	if err != nil {
+		p.stripes = nil
+		return nil, record
+	}
+	if countBlocks(blocks) == 0 || old.stripeHash != record.stripeHash || !codec.CanReconstruct(blocks) {
+		return nil, record
+	}
+	if wasLast := p.stripes.stripe == p.stripes.stripeCount; p.header.WrappedKey != "" && wasLast != last {
+		return nil, record
+	}
+	if err := codec.Reconstruct(blocks); err != nil {
+		return nil, record
+	}
+
+	return blocks, old
+}
+
+// addShardRange appends a range to ranges, merging it into the last one when they touch
+func addShardRange(ranges []ShardRange, shard int, offset int64, length int64) []ShardRange {
+	if n := len(ranges); n > 0 && ranges[n-1].Offset+ranges[n-1].Length == offset {
+		ranges[n-1].Length += length
+		return ranges
+	}
+	return append(ranges, ShardRange{Shard: shard, Offset: offset, Length: length})
+}
@@ -0,0 +1,170 @@
+package encoding
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readShards returns the contents of every shard of fileName in shardDir
+func readShards(t *testing.T, shardDir string, fileName string, count int) [][]byte {
+	t.Helper()
+
+	shards := make([][]byte, count)
+	for i := range shards {
+		var err error
+		shards[i], err = os.ReadFile(filepath.Join(shardDir, shardFileName(i, fileName)))
+		if err != nil {
+			t.Fatalf("failed to read shard %d: %v", i, err)
+		}
+	}
+	return shards
+}
+
+// applyDelta patches old shards with the changed ranges of the new ones, the
+// way a peer holding the old shards would
+func applyDelta(old [][]byte, updated [][]byte, delta *Delta) [][]byte {
+	patched := make([][]byte, len(old))
+	for i := range old {
+		patched[i] = make([]byte, delta.ShardSizes[i])
+		copy(patched[i], old[i])
+	}
+	for _, r := range delta.Changed {
+		copy(patched[r.Shard][r.Offset:r.Offset+r.Length], updated[r.Shard][r.Offset:])
+	}
+	return patched
+}
+
+func TestReencodeFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		identity []byte
+	}{
+		{"plain", nil},
+		{"encrypted", []byte("alice's account key")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tmpOut := t.TempDir()
+			if err := os.MkdirAll(filepath.Join(tmpOut, ".bin"), 0755); err != nil {
+				t.Fatalf("failed to make .bin dir: %v", err)
+			}
+			options := DefaultEncoderOptions()
+			options.BlockSize = 1024
+			options.Identity = test.identity
+			enc, err := NewEncoderWithOptions(4, 2, tmpOut, filepath.Join(tmpOut, ".bin"), options)
+			if err != nil {
+				t.Fatalf("failed to create encoder: %v", err)
+			}
+
+			// 4000 bytes of file per stripe with encryption, 4096 without
+			data := testData(40000)
+			path := filepath.Join(tmpOut, "doc.txt")
+			shardDir := filepath.Join(tmpOut, ".bin", "doc.txt")
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				t.Fatalf("failed to write input file: %v", err)
+			}
+			if err := enc.EncodeFile("doc.txt"); err != nil {
+				t.Fatalf("EncodeFile failed: %v", err)
+			}
+			old := readShards(t, shardDir, "doc.txt", 6)
+
+			// edit a few bytes in the middle of the file
+			copy(data[20000:], "an edited paragraph")
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				t.Fatalf("failed to write edited file: %v", err)
+			}
+			delta, err := enc.ReencodeFile("doc.txt")
+			if err != nil {
+				t.Fatalf("ReencodeFile failed: %v", err)
+			}
+			updated := readShards(t, shardDir, "doc.txt", 6)
+
+			// every shard gets its header and one block rewritten
+			if len(delta.Changed) != 12 {
+				t.Fatalf("expected 12 changed ranges, got %+v", delta.Changed)
+			}
+			for i, r := range delta.Changed {
+				if r.Shard != i/2 {
+					t.Errorf("range %d is for shard %d, expected %d", i, r.Shard, i/2)
+				}
+				if i%2 == 1 && r.Length != blockHeaderSize+1024 {
+					t.Errorf("expected one changed block in range %d, got %+v", i, r)
+				}
+			}
+
+			patched := applyDelta(old, updated, delta)
+			for i := range updated {
+				if int64(len(updated[i])) != delta.ShardSizes[i] {
+					t.Errorf("shard %d is %d bytes, delta says %d", i, len(updated[i]), delta.ShardSizes[i])
+				}
+				if !bytes.Equal(patched[i], updated[i]) {
+					t.Errorf("shard %d differs from the old one outside the delta", i)
+				}
+			}
+
+			// an unchanged file only gets new headers
+			delta, err = enc.ReencodeFile("doc.txt")
+			if err != nil {
+				t.Fatalf("ReencodeFile failed: %v", err)
+			}
+			if len(delta.Changed) != 6 {
+				t.Errorf("expected only the 6 headers to change, got %+v", delta.Changed)
+			}
+
+			if err := os.Remove(path); err != nil {
+				t.Fatalf("failed to remove input file: %v", err)
+			}
+			if err := enc.DecodeShards("doc.txt"); err != nil {
+				t.Fatalf("DecodeShards failed: %v", err)
+			}
+			decoded, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("failed to read decoded file: %v", err)
+			}
+			if !bytes.Equal(decoded, data) {
+				t.Fatal("decoded file does not match the edited data")
+			}
+		})
+	}
+}
+
+func TestReencodeFile_IncompatibleEncodeStartsOver(t *testing.T) {
+	tmpOut := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tmpOut, ".bin"), 0755); err != nil {
+		t.Fatalf("failed to make .bin dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpOut, "doc.txt"), testData(40000), 0644); err != nil {
+		t.Fatalf("failed to write input file: %v", err)
+	}
+
+	enc, err := NewEncoder(4, 2, tmpOut, filepath.Join(tmpOut, ".bin"))
+	if err != nil {
+		t.Fatalf("failed to create encoder: %v", err)
+	}
+	if err := enc.EncodeFile("doc.txt"); err != nil {
+		t.Fatalf("EncodeFile failed: %v", err)
+	}
+
+	options := DefaultEncoderOptions()
+	options.Compress = true
+	compressing, err := NewEncoderWithOptions(4, 2, tmpOut, filepath.Join(tmpOut, ".bin"), options)
+	if err != nil {
+		t.Fatalf("failed to create encoder: %v", err)
+	}
+	delta, err := compressing.ReencodeFile("doc.txt")
+	if err != nil {
+		t.Fatalf("ReencodeFile failed: %v", err)
+	}
+
+	if len(delta.Changed) != 6 {
+		t.Fatalf("expected one range per shard, got %+v", delta.Changed)
+	}
+	for i, r := range delta.Changed {
+		if r.Offset != 0 || r.Length != delta.ShardSizes[i] {
+			t.Errorf("expected shard %d to be rewritten in full, got %+v", i, r)
+		}
+	}
+}
@@ -0,0 +1,415 @@
+package encoding
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Proofs of retrievability: every shard is cut into MerkleBlockSize blocks,
+// the last one possibly shorter, and a Merkle tree is built over them. The
+// owner keeps only the root. To check a peer still has a shard the owner asks
+// for a few random blocks, the peer answers with the blocks and the hashes
+// needed to get from each of them to the root, and the owner checks that
+// against the root it kept.
+//
+// Leaves are sha256(0x00 || block) and inner nodes sha256(0x01 || left || right)
+// so a leaf can't pass for an inner node. A node without a sibling at the end
+// of a level moves up a level as it is.
+const (
+	MerkleBlockSize = 4096
+
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+
+	// challengeNonceSize is the bytes of randomness in every challenge
+	challengeNonceSize = 16
+)
+
+var ErrProofInvalid = errors.New("proof does not match the shard root")
+
+// MerkleRoot is what the owner of a shard keeps to check proofs against
+type MerkleRoot struct {
+	Hash []byte `json:"hash"`
+	// Blocks is the number of leaves, the shape of the tree depends on it
+	Blocks int `json:"blocks"`
+	// Size is the length of the shard in bytes
+	Size int64 `json:"size"`
+}
+
+// Challenge asks a peer to prove it holds a shard
+type Challenge struct {
+	// Nonce makes every challenge different, the proof has to carry it back
+	Nonce  []byte `json:"nonce"`
+	Blocks []int  `json:"blocks"`
+}
+
+// Proof is a peer's answer to a Challenge
+type Proof struct {
+	Nonce  []byte       `json:"nonce"`
+	Blocks []BlockProof `json:"blocks"`
+}
+
+// BlockProof is one challenged block along with the sibling hashes on its way
+// up to the root, lowest first
+type BlockProof struct {
+	Index int      `json:"index"`
+	Data  []byte   `json:"data"`
+	Path  [][]byte `json:"path"`
+}
+
+// BuildMerkleRoot reads a shard to the end and returns the root of its tree
+func BuildMerkleRoot(shard io.Reader) (MerkleRoot, error) {
+	leaves, size, err := merkleLeaves(shard, nil)
+	if err != nil {
+		return MerkleRoot{}, err
+	}
+	levels := merkleLevels(leaves)
+	return MerkleRoot{Hash: levels[len(levels)-1][0], Blocks: len(leaves), Size: size}, nil
+}
+
+// NewChallenge picks count distinct blocks of the shard root was built from at
+// random, or every block if it has no more than count
+func NewChallenge(root MerkleRoot, count int) (*Challenge, error) {
+	if root.Blocks <= 0 || count <= 0 {
+		return nil, errors.New("Challenges need a shard with blocks and at least one block to ask for")
+	}
+
+	nonce := make([]byte, challengeNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	challenge := &Challenge{Nonce: nonce}
+	if count >= root.Blocks {
+		for i := range root.Blocks {
+			challenge.Blocks = append(challenge.Blocks, i)
+		}
+		return challenge, nil
+	}
+
+	picked := make(map[int]bool, count)
+	var buf [8]byte
+	for len(challenge.Blocks) < count {
+		if _, err := rand.Read(buf[:]); err != nil {
+			return nil, err
+		}
+		block := int(binary.BigEndian.Uint64(buf[:]) % uint64(root.Blocks))
+		if !picked[block] {
+			picked[block] = true
+			challenge.Blocks = append(challenge.Blocks, block)
+		}
+	}
+	slices.Sort(challenge.Blocks)
+	return challenge, nil
+}
+
+// Prove answers challenge from the shard. The whole shard is read since every
+// leaf is needed to build the paths.
+func Prove(shard io.Reader, challenge *Challenge) (*Proof, error) {
+	wanted := make(map[int][]byte, len(challenge.Blocks))
+	for _, block := range challenge.Blocks {
+		wanted[block] = nil
+	}
+
+	leaves, _, err := merkleLeaves(shard, wanted)
+	if err != nil {
+		return nil, err
+	}
+	levels := merkleLevels(leaves)
+
+	proof := &Proof{Nonce: slices.Clone(challenge.Nonce)}
+	for _, block := range challenge.Blocks {
+		if block < 0 || block >= len(leaves) {
+			return nil, fmt.Errorf("challenged block %d is outside the shard's %d blocks", block, len(leaves))
+		}
+
+		blockProof := BlockProof{Index: block, Data: wanted[block]}
+		index := block
+		for _, level := range levels[:len(levels)-1] {
+			if sibling := index ^ 1; sibling < len(level) {
+				blockProof.Path = append(blockProof.Path, level[sibling])
+			}
+			index /= 2
+		}
+		proof.Blocks = append(proof.Blocks, blockProof)
+	}
+	return proof, nil
+}
+
+// VerifyProof checks proof answers challenge for the shard root was built
+// from. Any mismatch is ErrProofInvalid.
+func VerifyProof(root MerkleRoot, challenge *Challenge, proof *Proof) error {
+	if !bytes.Equal(proof.Nonce, challenge.Nonce) {
+		return fmt.Errorf("%w: proof is for another challenge", ErrProofInvalid)
+	}
+	if len(proof.Blocks) != len(challenge.Blocks) {
+		return fmt.Errorf("%w: %d blocks proven, %d asked for", ErrProofInvalid, len(proof.Blocks), len(challenge.Blocks))
+	}
+
+	for i, blockProof := range proof.Blocks {
+		block := challenge.Blocks[i]
+		if blockProof.Index != block || block < 0 || block >= root.Blocks {
+			return fmt.Errorf("%w: expected block %d, got %d", ErrProofInvalid, block, blockProof.Index)
+		}
+
+		// every block is full size except the last
+		size := int64(MerkleBlockSize)
+		if block == root.Blocks-1 {
+			size = root.Size - int64(block)*MerkleBlockSize
+		}
+		if int64(len(blockProof.Data)) != size {
+			return fmt.Errorf("%w: block %d is %d bytes, expected %d", ErrProofInvalid, block, len(blockProof.Data), size)
+		}
+
+		hash := merkleLeaf(blockProof.Data)
+		path := blockProof.Path
+		index, width := block, root.Blocks
+		for width > 1 {
+			if sibling := index ^ 1; sibling < width {
+				if len(path) == 0 {
+					return fmt.Errorf("%w: path of block %d is too short", ErrProofInvalid, block)
+				}
+				if index%2 == 0 {
+					hash = merkleNode(hash, path[0])
+				} else {
+					hash = merkleNode(path[0], hash)
+				}
+				path = path[1:]
+			}
+			index /= 2
+			width = (width + 1) / 2
+		}
+
+		if len(path) != 0 || !bytes.Equal(hash, root.Hash) {
+			return fmt.Errorf("%w: block %d", ErrProofInvalid, block)
+		}
+	}
+	return nil
+}
+
+// ShardRoots returns the Merkle roots recorded when relativeFilePath was last
+// encoded, one per shard in shard order
+func (e *Encoder) ShardRoots(relativeFilePath string) ([]MerkleRoot, error) {
+	path, err := e.rootsPath(relativeFilePath)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var roots []MerkleRoot
+	if err := json.Unmarshal(buf, &roots); err != nil {
+		return nil, fmt.Errorf("reading shard roots: %w", err)
+	}
+	return roots, nil
+}
+
+// ProveShard answers challenge for shard index of relativePath in the IN folder
+func (e *Encoder) ProveShard(relativePath string, index int, challenge *Challenge) (*Proof, error) {
+	shard, err := e.shardsIn.Get(filepath.ToSlash(relativePath), index)
+	if err != nil {
+		return nil, err
+	}
+	defer shard.Close()
+	return Prove(shard, challenge)
+}
+
+// rootsPath is where the roots of a file's shards are kept, next to .bin in
+// the OUT folder since they stay with the owner when the shards go to peers
+func (e *Encoder) rootsPath(relativeFilePath string) (string, error) {
+	path := filepath.FromSlash(relativeFilePath)
+	if !filepath.IsLocal(path) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidFileID, relativeFilePath)
+	}
+	return filepath.Join(e.dirOut, ".roots", path+".json"), nil
+}
+
+// stageShardRoots writes roots to a temp file next to where the file's roots
+// are kept and returns its name. The caller renames it into place once the
+// shards are committed.
+func (e *Encoder) stageShardRoots(relativeFilePath string, roots []MerkleRoot) (string, error) {
+	buf, err := json.Marshal(roots)
+	if err != nil {
+		return "", err
+	}
+
+	path, err := e.rootsPath(relativeFilePath)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(path), ".roots-*")
+	if err != nil {
+		return "", err
+	}
+	if _, err := temp.Write(buf); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return "", err
+	}
+	if err := temp.Close(); err != nil {
+		os.Remove(temp.Name())
+		return "", err
+	}
+	return temp.Name(), nil
+}
+
+// merkleWriter builds the Merkle root of a shard from the bytes written to
+// it. The encoder goes back to fill in the header once the file is read, so
+// the blocks a header can reach are kept and only hashed at the end. Every
+// other write has to carry on where the last one stopped.
+type merkleWriter struct {
+	ShardWriter
+	pos  int64
+	size int64
+	// head holds the first merkleHeadSize bytes of the shard, tail the block
+	// being written after them
+	head   []byte
+	tail   []byte
+	leaves [][]byte
+	err    error
+}
+
+// merkleHeadSize is the largest header rounded up to whole blocks
+const merkleHeadSize = (headerPrefixSize + maxHeaderSize + MerkleBlockSize - 1) / MerkleBlockSize * MerkleBlockSize
+
+func newMerkleWriter(shard ShardWriter) *merkleWriter {
+	return &merkleWriter{ShardWriter: shard}
+}
+
+func (w *merkleWriter) Write(p []byte) (int, error) {
+	n, err := w.ShardWriter.Write(p)
+	w.record(p[:n])
+	return n, err
+}
+
+func (w *merkleWriter) Seek(offset int64, whence int) (int64, error) {
+	pos, err := w.ShardWriter.Seek(offset, whence)
+	if err == nil {
+		w.pos = pos
+	}
+	return pos, err
+}
+
+func (w *merkleWriter) record(p []byte) {
+	if w.pos < merkleHeadSize {
+		n := min(int64(len(p)), merkleHeadSize-w.pos)
+		if end := w.pos + n; end > int64(len(w.head)) {
+			w.head = append(w.head, make([]byte, end-int64(len(w.head)))...)
+		}
+		copy(w.head[w.pos:], p[:n])
+		p = p[n:]
+		w.pos += n
+	}
+
+	if len(p) > 0 && w.pos != max(w.size, merkleHeadSize) && w.err == nil {
+		w.err = fmt.Errorf("shard rewritten at %d past its header", w.pos)
+	}
+	for len(p) > 0 {
+		n := min(len(p), MerkleBlockSize-len(w.tail))
+		w.tail = append(w.tail, p[:n]...)
+		if len(w.tail) == MerkleBlockSize {
+			w.leaves = append(w.leaves, merkleLeaf(w.tail))
+			w.tail = w.tail[:0]
+		}
+		p = p[n:]
+		w.pos += int64(n)
+	}
+	w.size = max(w.size, w.pos)
+}
+
+// root returns the root of the tree over everything written
+func (w *merkleWriter) root() (MerkleRoot, error) {
+	if w.err != nil {
+		return MerkleRoot{}, w.err
+	}
+
+	leaves, _, err := merkleLeaves(bytes.NewReader(w.head), nil)
+	if err != nil {
+		return MerkleRoot{}, err
+	}
+	leaves = append(leaves, w.leaves...)
+	if len(w.tail) > 0 {
+		leaves = append(leaves, merkleLeaf(w.tail))
+	}
+	levels := merkleLevels(leaves)
+	return MerkleRoot{Hash: levels[len(levels)-1][0], Blocks: len(leaves), Size: w.size}, nil
+}
+
+// merkleLeaves hashes the shard block by block and returns the leaf hashes and
+// the shard size. The contents of the blocks that are keys of keep are put in it.
+func merkleLeaves(shard io.Reader, keep map[int][]byte) ([][]byte, int64, error) {
+	var leaves [][]byte
+	var size int64
+	buf := make([]byte, MerkleBlockSize)
+	for {
+		n, err := io.ReadFull(shard, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, 0, err
+		}
+
+		if _, ok := keep[len(leaves)]; ok {
+			keep[len(leaves)] = bytes.Clone(buf[:n])
+		}
+		leaves = append(leaves, merkleLeaf(buf[:n]))
+		size += int64(n)
+
+		if n < len(buf) {
+			break
+		}
+	}
+
+	if len(leaves) == 0 {
+		return nil, 0, errors.New("shard is empty")
+	}
+	return leaves, size, nil
+}
+
+// merkleLevels returns every level of the tree over leaves, the leaves first
+// and the root alone in the last one
+func merkleLevels(leaves [][]byte) [][][]byte {
+	levels := [][][]byte{leaves}
+	for level := leaves; len(level) > 1; {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+			} else {
+				next = append(next, merkleNode(level[i], level[i+1]))
+			}
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return levels
+}
+
+func merkleLeaf(block []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte{merkleLeafPrefix})
+	hash.Write(block)
+	return hash.Sum(nil)
+}
+
+func merkleNode(left []byte, right []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte{merkleNodePrefix})
+	hash.Write(left)
+	hash.Write(right)
+	return hash.Sum(nil)
+}
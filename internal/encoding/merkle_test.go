@@ -0,0 +1,150 @@
+package encoding
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMerkle_ProveAndVerify(t *testing.T) {
+	// block counts around powers of two exercise the nodes that move up a level
+	for _, size := range []int{1, MerkleBlockSize, 3 * MerkleBlockSize, 5*MerkleBlockSize + 100, 8 * MerkleBlockSize} {
+		shard := testData(size)
+		root, err := BuildMerkleRoot(bytes.NewReader(shard))
+		if err != nil {
+			t.Fatalf("BuildMerkleRoot failed: %v", err)
+		}
+
+		challenge, err := NewChallenge(root, root.Blocks)
+		if err != nil {
+			t.Fatalf("NewChallenge failed: %v", err)
+		}
+		if len(challenge.Blocks) != root.Blocks {
+			t.Fatalf("expected every one of %d blocks challenged, got %v", root.Blocks, challenge.Blocks)
+		}
+
+		proof, err := Prove(bytes.NewReader(shard), challenge)
+		if err != nil {
+			t.Fatalf("Prove failed: %v", err)
+		}
+		if err := VerifyProof(root, challenge, proof); err != nil {
+			t.Errorf("%d byte shard: VerifyProof failed: %v", size, err)
+		}
+	}
+}
+
+func TestMerkle_RejectsBadProofs(t *testing.T) {
+	shard := testData(10 * MerkleBlockSize)
+	root, err := BuildMerkleRoot(bytes.NewReader(shard))
+	if err != nil {
+		t.Fatalf("BuildMerkleRoot failed: %v", err)
+	}
+	challenge, err := NewChallenge(root, 3)
+	if err != nil {
+		t.Fatalf("NewChallenge failed: %v", err)
+	}
+	if len(challenge.Blocks) != 3 {
+		t.Fatalf("expected 3 challenged blocks, got %v", challenge.Blocks)
+	}
+
+	// a peer that lost part of the shard can't answer
+	damaged := bytes.Clone(shard)
+	for _, block := range challenge.Blocks {
+		damaged[block*MerkleBlockSize] ^= 0xFF
+	}
+	proof, err := Prove(bytes.NewReader(damaged), challenge)
+	if err != nil {
+		t.Fatalf("Prove failed: %v", err)
+	}
+	if err := VerifyProof(root, challenge, proof); !errors.Is(err, ErrProofInvalid) {
+		t.Errorf("expected ErrProofInvalid for a damaged shard, got %v", err)
+	}
+
+	// a proof only answers the challenge whose nonce it carries
+	proof, err = Prove(bytes.NewReader(shard), challenge)
+	if err != nil {
+		t.Fatalf("Prove failed: %v", err)
+	}
+	next, err := NewChallenge(root, 3)
+	if err != nil {
+		t.Fatalf("NewChallenge failed: %v", err)
+	}
+	next.Blocks = challenge.Blocks
+	if err := VerifyProof(root, next, proof); !errors.Is(err, ErrProofInvalid) {
+		t.Errorf("expected ErrProofInvalid for a replayed proof, got %v", err)
+	}
+
+	// nor can a path be dropped or a block swapped for another
+	proof.Blocks[0].Path = proof.Blocks[0].Path[1:]
+	if err := VerifyProof(root, challenge, proof); !errors.Is(err, ErrProofInvalid) {
+		t.Errorf("expected ErrProofInvalid for a short path, got %v", err)
+	}
+	proof, _ = Prove(bytes.NewReader(shard), challenge)
+	proof.Blocks[0], proof.Blocks[1] = proof.Blocks[1], proof.Blocks[0]
+	if err := VerifyProof(root, challenge, proof); !errors.Is(err, ErrProofInvalid) {
+		t.Errorf("expected ErrProofInvalid for swapped blocks, got %v", err)
+	}
+}
+
+func TestEncodeFile_RecordsShardRoots(t *testing.T) {
+	tmpOut := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tmpOut, ".bin"), 0755); err != nil {
+		t.Fatalf("failed to make .bin dir: %v", err)
+	}
+	enc, err := NewEncoder(4, 2, tmpOut, filepath.Join(tmpOut, ".bin"))
+	if err != nil {
+		t.Fatalf("failed to create encoder: %v", err)
+	}
+	// large enough that the shards run well past the blocks kept for the header
+	if err := os.WriteFile(filepath.Join(tmpOut, "notes.md"), testData(1000000), 0644); err != nil {
+		t.Fatalf("failed to write input file: %v", err)
+	}
+	if err := enc.EncodeFile("notes.md"); err != nil {
+		t.Fatalf("EncodeFile failed: %v", err)
+	}
+
+	roots, err := enc.ShardRoots("notes.md")
+	if err != nil {
+		t.Fatalf("ShardRoots failed: %v", err)
+	}
+	if len(roots) != 6 {
+		t.Fatalf("expected 6 roots, got %d", len(roots))
+	}
+
+	// the roots built while writing match the shards as committed
+	for i, root := range roots {
+		shard, err := enc.shardsOut.Get("notes.md", i)
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		built, err := BuildMerkleRoot(shard)
+		shard.Close()
+		if err != nil {
+			t.Fatalf("BuildMerkleRoot failed: %v", err)
+		}
+		if !reflect.DeepEqual(root, built) {
+			t.Errorf("shard %d: recorded root %+v, committed shard has %+v", i, root, built)
+		}
+	}
+	if _, err := enc.ShardRoots("../notes.md"); !errors.Is(err, ErrInvalidFileID) {
+		t.Errorf("expected ErrInvalidFileID for a path outside the folder, got %v", err)
+	}
+
+	// the IN folder is .bin here so the encoder can answer for its own shards
+	for i, root := range roots {
+		challenge, err := NewChallenge(root, 4)
+		if err != nil {
+			t.Fatalf("NewChallenge failed: %v", err)
+		}
+		proof, err := enc.ProveShard("notes.md", i, challenge)
+		if err != nil {
+			t.Fatalf("ProveShard failed: %v", err)
+		}
+		if err := VerifyProof(root, challenge, proof); err != nil {
+			t.Errorf("shard %d: VerifyProof failed: %v", i, err)
+		}
+	}
+}
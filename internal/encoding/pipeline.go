@@ -0,0 +1,266 @@
+package encoding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// DefaultMemoryBudget is the memory budget of a Pipeline when none is given
+const DefaultMemoryBudget = 256 * 1024 * 1024
+
+// PipelineOptions controls how many files a Pipeline encodes at once
+type PipelineOptions struct {
+	// Workers is how many files are encoded at the same time. 0 means one
+	// per CPU.
+	Workers int
+
+	// MemoryBudget caps the bytes of stripe buffers in use by all workers
+	// together, 0 means DefaultMemoryBudget. A worker waits for room in the
+	// budget before it starts on a file, and the block size is capped so any
+	// one file fits in the budget on its own.
+	MemoryBudget int64
+
+	// Progress, if not nil, is called after every stripe of every file. It
+	// is called from the workers so it has to be safe to call concurrently.
+	Progress func(relativeFilePath string, progress Progress)
+}
+
+// EncodeResult is what a Pipeline reports for every file it was given
+type EncodeResult struct {
+	Path string
+	Err  error
+}
+
+// Pipeline encodes many files at once, like everything in a folder being
+// uploaded, while keeping the memory all of them use under a budget. Stripe
+// buffers are pooled between files instead of being allocated for every one.
+type Pipeline struct {
+	// encoder is a copy of the encoder the pipeline was made from, with the
+	// buffer pool set and the block size capped to the budget
+	encoder  Encoder
+	workers  int
+	budget   *memoryBudget
+	progress func(string, Progress)
+}
+
+// NewPipeline makes a pipeline that encodes files the way e does, nil options
+// means the defaults
+func (e *Encoder) NewPipeline(options *PipelineOptions) (*Pipeline, error) {
+	if options == nil {
+		options = &PipelineOptions{}
+	}
+
+	workers := options.Workers
+	if workers == 0 {
+		workers = runtime.NumCPU()
+	}
+	budget := options.MemoryBudget
+	if budget == 0 {
+		budget = DefaultMemoryBudget
+	}
+	if workers < 0 || budget < 0 {
+		return nil, errors.New("Workers and memory budget can't be negative")
+	}
+
+	encoder := *e
+	encoder.buffers = newBufferPool()
+
+	// the biggest block size whose stripe buffers still fit in the budget
+	perBlock := int64(encoder.shards + encoder.shards + encoder.parity)
+	fixed := 2 * int64(bufferClass)
+	if encoder.compress {
+		perBlock += int64(encoder.shards)
+		fixed += compressorMemory
+	}
+	maxBlockSize := (budget - fixed) / perBlock &^ 63
+	if maxBlockSize < int64(encoder.minBlockSize) || maxBlockSize < int64(encoder.blockSize) {
+		return nil, fmt.Errorf("memory budget of %d bytes is too small for the encoder's block size", budget)
+	}
+	encoder.maxBlockSize = int(min(maxBlockSize, int64(encoder.maxBlockSize)))
+
+	return &Pipeline{
+		encoder:  encoder,
+		workers:  workers,
+		budget:   newMemoryBudget(budget),
+		progress: options.Progress,
+	}, nil
+}
+
+// EncodeFiles encodes every file in relativeFilePaths, like EncodeFile does,
+// and returns the errors of the files that failed joined together. It stops
+// handing out files once ctx is done.
+func (p *Pipeline) EncodeFiles(ctx context.Context, relativeFilePaths []string) error {
+	queue := make(chan string)
+	go func() {
+		defer close(queue)
+		for _, path := range relativeFilePaths {
+			select {
+			case queue <- path:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var errs []error
+	for result := range p.Run(ctx, queue) {
+		if result.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", result.Path, result.Err))
+		}
+	}
+	if len(errs) == 0 {
+		return ctx.Err()
+	}
+	return errors.Join(errs...)
+}
+
+// Run encodes the files coming in on queue until it is closed and sends the
+// result of every one of them on the returned channel, which is closed once
+// all the workers are done. Files queued after ctx is done are reported with
+// ctx's error.
+func (p *Pipeline) Run(ctx context.Context, queue <-chan string) <-chan EncodeResult {
+	results := make(chan EncodeResult, p.workers)
+
+	var workers sync.WaitGroup
+	for range p.workers {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for path := range queue {
+				results <- EncodeResult{Path: path, Err: p.encode(ctx, path)}
+			}
+		}()
+	}
+
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// encode waits for room in the budget for the file's stripe buffers and encodes it
+func (p *Pipeline) encode(ctx context.Context, relativeFilePath string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(filepath.Join(p.encoder.dirOut, relativeFilePath))
+	if err != nil {
+		return err
+	}
+
+	// the capped block size keeps every file inside the budget, the min is
+	// only there so an estimate that's off can't make it wait forever
+	memory := min(p.encoder.stripeMemory(info.Size()), p.budget.size)
+	if err := p.budget.acquire(ctx, memory); err != nil {
+		return err
+	}
+	defer p.budget.release(memory)
+
+	var progress ProgressFunc
+	if p.progress != nil {
+		progress = func(done Progress) {
+			p.progress(relativeFilePath, done)
+		}
+	}
+	return p.encoder.EncodeFileContext(ctx, relativeFilePath, progress)
+}
+
+// stripeMemory is how many bytes of buffers encodeStripes holds while encoding
+// a file of size bytes
+func (e *Encoder) stripeMemory(size int64) int64 {
+	codec, err := e.redundancyForSize(size)
+	if err != nil {
+		return 0
+	}
+
+	// the gcm tag and compression flag never take more than 64 bytes
+	if size >= 0 {
+		size += 64
+	}
+	blockSize := e.blockSizeForShards(size, codec.DataShards())
+	stripeSize := blockSize * codec.DataShards()
+
+	memory := bufferSize(blockSize*codec.TotalShards()) + bufferSize(stripeSize)
+	if e.compress {
+		memory += int64(stripeSize) + compressorMemory
+	}
+	return memory
+}
+
+// memoryBudget hands out bytes of a fixed budget, first come first served
+type memoryBudget struct {
+	mutex   sync.Mutex
+	size    int64
+	free    int64
+	waiting []*budgetWaiter
+}
+
+type budgetWaiter struct {
+	bytes int64
+	ready chan struct{}
+}
+
+func newMemoryBudget(size int64) *memoryBudget {
+	return &memoryBudget{size: size, free: size}
+}
+
+// acquire waits until bytes of the budget are free and takes them
+func (b *memoryBudget) acquire(ctx context.Context, bytes int64) error {
+	b.mutex.Lock()
+	if len(b.waiting) == 0 && b.free >= bytes {
+		b.free -= bytes
+		b.mutex.Unlock()
+		return nil
+	}
+	waiter := &budgetWaiter{bytes: bytes, ready: make(chan struct{})}
+	b.waiting = append(b.waiting, waiter)
+	b.mutex.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	select {
+	case <-waiter.ready:
+		// got the bytes right as ctx was done, give them back
+		b.free += bytes
+	default:
+		for i, w := range b.waiting {
+			if w == waiter {
+				b.waiting = append(b.waiting[:i], b.waiting[i+1:]...)
+				break
+			}
+		}
+	}
+	b.wake()
+	return ctx.Err()
+}
+
+// release gives back bytes taken by acquire
+func (b *memoryBudget) release(bytes int64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.free += bytes
+	b.wake()
+}
+
+// wake lets waiters through in order for as long as their bytes fit
+func (b *memoryBudget) wake() {
+	for len(b.waiting) > 0 && b.free >= b.waiting[0].bytes {
+		waiter := b.waiting[0]
+		b.waiting = b.waiting[1:]
+		b.free -= waiter.bytes
+		close(waiter.ready)
+	}
+}
@@ -0,0 +1,163 @@
+package encoding
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestPipeline_EncodeFiles(t *testing.T) {
+	tmpOut := t.TempDir()
+	store := NewMemoryStore()
+	options := DefaultEncoderOptions()
+	options.Store = store
+	options.Compress = true
+	enc, err := NewEncoderWithOptions(4, 2, tmpOut, tmpOut, options)
+	if err != nil {
+		t.Fatalf("failed to create encoder: %v", err)
+	}
+
+	files := map[string][]byte{}
+	var paths []string
+	for i := range 12 {
+		path := fmt.Sprintf("file%d.bin", i)
+		files[path] = testData(1000 + i*150000)
+		paths = append(paths, path)
+		if err := os.WriteFile(filepath.Join(tmpOut, path), files[path], 0644); err != nil {
+			t.Fatalf("failed to write input file: %v", err)
+		}
+	}
+
+	var mutex sync.Mutex
+	finished := map[string]bool{}
+	pipeline, err := enc.NewPipeline(&PipelineOptions{
+		Workers:      4,
+		MemoryBudget: 2 * 1024 * 1024,
+		Progress: func(path string, progress Progress) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if progress.Bytes == progress.Total {
+				finished[path] = true
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewPipeline failed: %v", err)
+	}
+	if pipeline.encoder.maxBlockSize*10 > 2*1024*1024 {
+		t.Errorf("expected the block size to be capped to the budget, got %d", pipeline.encoder.maxBlockSize)
+	}
+
+	if err := pipeline.EncodeFiles(context.Background(), paths); err != nil {
+		t.Fatalf("EncodeFiles failed: %v", err)
+	}
+	if len(finished) != len(paths) {
+		t.Errorf("expected progress to finish for all %d files, got %d", len(paths), len(finished))
+	}
+
+	for _, path := range paths {
+		if err := os.Remove(filepath.Join(tmpOut, path)); err != nil {
+			t.Fatalf("failed to remove input file: %v", err)
+		}
+		if err := enc.DecodeShards(path); err != nil {
+			t.Fatalf("DecodeShards %s failed: %v", path, err)
+		}
+		decoded, err := os.ReadFile(filepath.Join(tmpOut, path))
+		if err != nil {
+			t.Fatalf("failed to read decoded file: %v", err)
+		}
+		if !bytes.Equal(decoded, files[path]) {
+			t.Errorf("decoded %s does not match the original", path)
+		}
+	}
+}
+
+func TestPipeline_ReportsFailedFiles(t *testing.T) {
+	tmpOut := t.TempDir()
+	options := DefaultEncoderOptions()
+	options.Store = NewMemoryStore()
+	enc, err := NewEncoderWithOptions(4, 2, tmpOut, tmpOut, options)
+	if err != nil {
+		t.Fatalf("failed to create encoder: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpOut, "here.txt"), testData(5000), 0644); err != nil {
+		t.Fatalf("failed to write input file: %v", err)
+	}
+
+	pipeline, err := enc.NewPipeline(nil)
+	if err != nil {
+		t.Fatalf("NewPipeline failed: %v", err)
+	}
+	err = pipeline.EncodeFiles(context.Background(), []string{"here.txt", "missing.txt"})
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the missing file to be reported, got %v", err)
+	}
+	if indices, _ := options.Store.List("here.txt"); len(indices) != 6 {
+		t.Errorf("expected the other file to still be encoded, got shards %v", indices)
+	}
+}
+
+func TestNewPipeline_BudgetTooSmall(t *testing.T) {
+	enc, err := NewEncoder(4, 2, t.TempDir(), t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create encoder: %v", err)
+	}
+	if _, err := enc.NewPipeline(&PipelineOptions{MemoryBudget: 64 * 1024}); err == nil {
+		t.Error("expected a budget smaller than one stripe to be rejected")
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	budget := newMemoryBudget(100)
+
+	var mutex sync.Mutex
+	var inUse, most int64
+	var workers sync.WaitGroup
+	for i := range 20 {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			bytes := int64(10 + i*4)
+			if err := budget.acquire(context.Background(), bytes); err != nil {
+				t.Errorf("acquire failed: %v", err)
+				return
+			}
+			mutex.Lock()
+			inUse += bytes
+			most = max(most, inUse)
+			mutex.Unlock()
+
+			mutex.Lock()
+			inUse -= bytes
+			mutex.Unlock()
+			budget.release(bytes)
+		}()
+	}
+	workers.Wait()
+
+	if most > 100 {
+		t.Errorf("expected at most 100 bytes in use, got %d", most)
+	}
+	if budget.free != 100 {
+		t.Errorf("expected the whole budget back, got %d", budget.free)
+	}
+
+	// a waiter whose ctx is done gives up its place in line
+	if err := budget.acquire(context.Background(), 100); err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := budget.acquire(ctx, 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	budget.release(100)
+	if len(budget.waiting) != 0 || budget.free != 100 {
+		t.Errorf("expected no waiters and a full budget, got %d waiting and %d free", len(budget.waiting), budget.free)
+	}
+}
@@ -0,0 +1,161 @@
+package encoding
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	// DefaultPeerUptime is assumed for peers there is no uptime estimate for yet
+	DefaultPeerUptime = 0.9
+
+	// maxPlannedShards caps the shards in a plan. Every shard is another peer
+	// to reach on upload and download, past this the saving isn't worth it.
+	maxPlannedShards = 32
+)
+
+var (
+	ErrNotEnoughPeers        = errors.New("not enough peers for the durability target")
+	ErrDurabilityUnreachable = errors.New("durability target can't be reached with these peers")
+)
+
+// DurabilityTarget is how safe a file has to be
+type DurabilityTarget struct {
+	// Losses is how many shards, and so peers, can be lost at the same time
+	// with the file still readable, whatever their uptimes
+	Losses int
+	// Availability is the probability, between 0 and 1, that enough peers
+	// are up to read the file given their uptimes, like 0.9999
+	Availability float64
+}
+
+// ShardPlan is the shard counts PlanShards picked for a file
+type ShardPlan struct {
+	DataShards   int
+	ParityShards int
+	// Availability is the probability enough of the peers the shards go to
+	// are up to read the file
+	Availability float64
+	// StorageOverhead is the bytes stored per byte of file
+	StorageOverhead float64
+	// Explanation says in a sentence or two why these counts were picked
+	Explanation string
+}
+
+// PlanShards picks the cheapest data and parity shard counts that meet target
+// with peerCount peers to put the shards on, one shard per peer. uptimes holds
+// the fraction of time each peer is expected to be online for the peers that
+// have an estimate, the rest get DefaultPeerUptime. Shards are assumed to go
+// to the peers with the best uptime.
+//
+// Cheapest means the least storage overhead, with fewer shards in total
+// breaking ties so small networks aren't asked for more shards than needed.
+func PlanShards(target DurabilityTarget, peerCount int, uptimes []float64) (*ShardPlan, error) {
+	if target.Losses < 0 || target.Availability < 0 || target.Availability > 1 {
+		return nil, fmt.Errorf("invalid durability target %+v", target)
+	}
+	if len(uptimes) > peerCount {
+		return nil, fmt.Errorf("got %d uptimes for %d peers", len(uptimes), peerCount)
+	}
+	for _, uptime := range uptimes {
+		if uptime < 0 || uptime > 1 {
+			return nil, fmt.Errorf("uptime %v is not between 0 and 1", uptime)
+		}
+	}
+
+	// the encoder needs at least one data and one parity shard
+	losses := max(target.Losses, 1)
+	if peerCount < losses+1 {
+		return nil, fmt.Errorf("%w: surviving %d losses takes %d peers, there are %d", ErrNotEnoughPeers, target.Losses, losses+1, peerCount)
+	}
+
+	peers := slices.Clone(uptimes)
+	for len(peers) < peerCount {
+		peers = append(peers, DefaultPeerUptime)
+	}
+	slices.SortFunc(peers, func(a, b float64) int { return cmp.Compare(b, a) })
+
+	var candidates []ShardPlan
+	for total := losses + 1; total <= min(peerCount, maxPlannedShards); total++ {
+		up := upPeerDistribution(peers[:total])
+		for data := 1; data <= total-losses; data++ {
+			candidates = append(candidates, ShardPlan{
+				DataShards:      data,
+				ParityShards:    total - data,
+				Availability:    atLeast(up, data),
+				StorageOverhead: float64(total) / float64(data),
+			})
+		}
+	}
+	slices.SortStableFunc(candidates, func(a, b ShardPlan) int {
+		// compares total/data without going through floats
+		if c := cmp.Compare(a.total()*b.DataShards, b.total()*a.DataShards); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.total(), b.total())
+	})
+
+	best := -1
+	for i, candidate := range candidates {
+		if candidate.Availability >= target.Availability {
+			best = i
+			break
+		}
+	}
+	if best < 0 {
+		most := slices.MaxFunc(candidates, func(a, b ShardPlan) int { return cmp.Compare(a.Availability, b.Availability) })
+		return nil, fmt.Errorf("%w: the best is %d+%d with availability %.6g, %.6g is needed",
+			ErrDurabilityUnreachable, most.DataShards, most.ParityShards, most.Availability, target.Availability)
+	}
+
+	plan := candidates[best]
+	plan.Explanation = explainPlan(plan, target, peerCount, candidates[:best])
+	return &plan, nil
+}
+
+func (p ShardPlan) total() int {
+	return p.DataShards + p.ParityShards
+}
+
+// explainPlan describes plan and, if there was one, the cheaper plan that
+// missed the availability target
+func explainPlan(plan ShardPlan, target DurabilityTarget, peerCount int, cheaper []ShardPlan) string {
+	var explanation strings.Builder
+	fmt.Fprintf(&explanation, "%d data + %d parity shards on %d of %d peers survives %d lost peers (%d needed) and is readable with probability %.6g (%.6g needed) for %.2fx the file size.",
+		plan.DataShards, plan.ParityShards, plan.total(), peerCount, plan.ParityShards, target.Losses,
+		plan.Availability, target.Availability, plan.StorageOverhead)
+
+	if len(cheaper) > 0 {
+		// the most available of the cheaper plans came closest
+		closest := slices.MaxFunc(cheaper, func(a, b ShardPlan) int { return cmp.Compare(a.Availability, b.Availability) })
+		fmt.Fprintf(&explanation, " The cheaper %d+%d at %.2fx only reaches %.6g.",
+			closest.DataShards, closest.ParityShards, closest.StorageOverhead, closest.Availability)
+	}
+	return explanation.String()
+}
+
+// upPeerDistribution returns the probability that exactly i of the peers are up
+// for every i, the peers being up or down independently of each other
+func upPeerDistribution(uptimes []float64) []float64 {
+	up := make([]float64, len(uptimes)+1)
+	up[0] = 1
+	for n, uptime := range uptimes {
+		for i := n + 1; i > 0; i-- {
+			up[i] = up[i]*(1-uptime) + up[i-1]*uptime
+		}
+		up[0] *= 1 - uptime
+	}
+	return up
+}
+
+// atLeast returns the probability that at least count peers are up
+func atLeast(up []float64, count int) float64 {
+	probability := 0.0
+	for _, p := range up[count:] {
+		probability += p
+	}
+	return min(probability, 1)
+}
@@ -0,0 +1,92 @@
+package encoding
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestPlanShards(t *testing.T) {
+	tests := []struct {
+		name       string
+		target     DurabilityTarget
+		peerCount  int
+		uptimes    []float64
+		wantData   int
+		wantParity int
+	}{
+		{"three reliable peers", DurabilityTarget{Losses: 1, Availability: 0.99}, 3, []float64{0.99, 0.99, 0.99}, 2, 1},
+		{"three flaky peers", DurabilityTarget{Losses: 1, Availability: 0.99}, 3, []float64{0.8, 0.8, 0.8}, 1, 2},
+		{"big reliable network", DurabilityTarget{Losses: 3, Availability: 0.9999}, 50, repeatUptime(50, 0.99), 21, 3},
+		{"unknown uptimes", DurabilityTarget{Losses: 2, Availability: 0.999}, 10, nil, 5, 4},
+		{"best peers get the shards", DurabilityTarget{Losses: 1, Availability: 0.999}, 5, []float64{0.5, 0.5, 0.999, 0.999, 0.999}, 2, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plan, err := PlanShards(test.target, test.peerCount, test.uptimes)
+			if err != nil {
+				t.Fatalf("PlanShards failed: %v", err)
+			}
+			if plan.DataShards != test.wantData || plan.ParityShards != test.wantParity {
+				t.Errorf("expected %d+%d, got %d+%d: %s", test.wantData, test.wantParity, plan.DataShards, plan.ParityShards, plan.Explanation)
+			}
+			if plan.Availability < test.target.Availability {
+				t.Errorf("plan availability %v is under the target", plan.Availability)
+			}
+			if plan.ParityShards < test.target.Losses || plan.DataShards+plan.ParityShards > test.peerCount {
+				t.Errorf("plan %d+%d doesn't fit the target and peers", plan.DataShards, plan.ParityShards)
+			}
+			if plan.Explanation == "" {
+				t.Error("expected an explanation")
+			}
+		})
+	}
+}
+
+func TestPlanShards_ExplainsRejectedCheaperPlan(t *testing.T) {
+	plan, err := PlanShards(DurabilityTarget{Losses: 1, Availability: 0.99}, 3, []float64{0.8, 0.8, 0.8})
+	if err != nil {
+		t.Fatalf("PlanShards failed: %v", err)
+	}
+	if !strings.Contains(plan.Explanation, "The cheaper 1+1") {
+		t.Errorf("expected the explanation to mention the cheaper 1+1, got %q", plan.Explanation)
+	}
+}
+
+func TestPlanShards_Unreachable(t *testing.T) {
+	if _, err := PlanShards(DurabilityTarget{Losses: 3}, 3, nil); !errors.Is(err, ErrNotEnoughPeers) {
+		t.Errorf("expected ErrNotEnoughPeers, got %v", err)
+	}
+	if _, err := PlanShards(DurabilityTarget{Losses: 1, Availability: 0.9999}, 2, []float64{0.5, 0.5}); !errors.Is(err, ErrDurabilityUnreachable) {
+		t.Errorf("expected ErrDurabilityUnreachable, got %v", err)
+	}
+	if _, err := PlanShards(DurabilityTarget{Availability: 2}, 5, nil); err == nil {
+		t.Error("expected an availability over 1 to be rejected")
+	}
+	if _, err := PlanShards(DurabilityTarget{}, 2, []float64{0.5, 0.5, 0.5}); err == nil {
+		t.Error("expected more uptimes than peers to be rejected")
+	}
+}
+
+func TestUpPeerDistribution(t *testing.T) {
+	up := upPeerDistribution([]float64{0.5, 0.5, 0.5})
+	want := []float64{0.125, 0.375, 0.375, 0.125}
+	for i := range want {
+		if math.Abs(up[i]-want[i]) > 1e-12 {
+			t.Errorf("P(%d up) = %v, expected %v", i, up[i], want[i])
+		}
+	}
+	if got := atLeast(up, 2); math.Abs(got-0.5) > 1e-12 {
+		t.Errorf("P(at least 2 up) = %v, expected 0.5", got)
+	}
+}
+
+func repeatUptime(count int, uptime float64) []float64 {
+	uptimes := make([]float64, count)
+	for i := range uptimes {
+		uptimes[i] = uptime
+	}
+	return uptimes
+}
@@ -0,0 +1,109 @@
+package encoding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+var ErrInvalidRange = errors.New("range is outside the file")
+
+// DecodeRange writes length bytes of the file starting at offset to w, reading
+// only the stripes that cover the range. relativePath is the shard directory
+// inside the IN folder like for DecodeShards. A range running past the end of
+// the file is cut short at the end. Since only part of the file is read the
+// file hash can't be checked, but every stripe is still checked against the
+// stripe hash in its blocks.
+func (e *Encoder) DecodeRange(relativePath string, offset int64, length int64, w io.Writer) error {
+	shards, err := openShards(e.shardsIn, filepath.ToSlash(relativePath))
+	if err != nil {
+		return err
+	}
+	defer closeShards(shards)
+
+	header, ordered, err := readShardHeaders(rewindShards(shards))
+	if err != nil {
+		return err
+	}
+	if header.FileLength < 0 {
+		return fmt.Errorf("%w: file length was never recorded", ErrInvalidRange)
+	}
+	if offset < 0 || length < 0 || offset > header.FileLength {
+		return fmt.Errorf("%w: %d bytes at %d of a %d byte file", ErrInvalidRange, length, offset, header.FileLength)
+	}
+	length = min(length, header.FileLength-offset)
+	if length == 0 {
+		return nil
+	}
+
+	sealer, _, err := openFileCipher(e.identity, header)
+	if err != nil {
+		return err
+	}
+
+	stripeSize := int64(header.StripeSize)
+	first := int(offset / stripeSize)
+	last := int((offset + length - 1) / stripeSize)
+
+	for i, shard := range ordered {
+		if shard == nil {
+			continue
+		}
+		if err := seekToStripe(shard.(io.ReadSeeker), header, first); err != nil {
+			ordered[i] = nil
+		}
+	}
+
+	stripes := newStripeReader(header, ordered)
+	stripes.stripe = first
+	stripes.stripeCount = last + 1
+
+	out := &rangeWriter{w: w, skip: offset - int64(first)*stripeSize, remaining: length}
+	return joinStripes(context.Background(), header, sealer, stripes, out, nil)
+}
+
+// seekToStripe moves a shard that has been read past its header to the block
+// of the given stripe. Without compression every block but the last is full
+// size so it can seek there directly, otherwise it has to hop from block to
+// block.
+func seekToStripe(shard io.ReadSeeker, header *ShardHeader, stripe int) error {
+	if header.Compression == "" {
+		_, err := shard.Seek(int64(stripe)*int64(blockHeaderSize+header.BlockSize), io.SeekCurrent)
+		return err
+	}
+
+	for range stripe {
+		if err := skipBlock(shard, header.BlockSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rangeWriter drops the first skip bytes written to it, passes on the next
+// remaining bytes and drops the rest
+type rangeWriter struct {
+	w         io.Writer
+	skip      int64
+	remaining int64
+}
+
+func (r *rangeWriter) Write(p []byte) (int, error) {
+	n := len(p)
+
+	skipped := min(r.skip, int64(len(p)))
+	r.skip -= skipped
+	p = p[skipped:]
+
+	p = p[:min(r.remaining, int64(len(p)))]
+	if len(p) > 0 {
+		if _, err := r.w.Write(p); err != nil {
+			return 0, err
+		}
+		r.remaining -= int64(len(p))
+	}
+
+	return n, nil
+}
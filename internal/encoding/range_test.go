@@ -0,0 +1,93 @@
+package encoding
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDecodeRange(t *testing.T) {
+	data := bytes.Repeat(testData(1000), 50)
+
+	tests := []struct {
+		name    string
+		options *EncoderOptions
+	}{
+		{"plain", &EncoderOptions{BlockSize: 1024}},
+		{"compressed", &EncoderOptions{BlockSize: 1024, Compress: true}},
+		{"encrypted", &EncoderOptions{BlockSize: 1024, Identity: []byte("alice's account key")}},
+	}
+
+	ranges := []struct{ offset, length int64 }{
+		{0, 10},
+		{4000, 5000},
+		{int64(len(data)) - 100, 100},
+		{int64(len(data)) - 100, 1000},
+		{12345, 0},
+		{int64(len(data)), 10},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			enc, shardDir := encodeTestFile(t, "big.bin", data, test.options)
+			if err := os.Remove(filepath.Join(shardDir, shardFileName(2, "big.bin"))); err != nil {
+				t.Fatalf("failed to remove shard: %v", err)
+			}
+
+			for _, r := range ranges {
+				var out bytes.Buffer
+				if err := enc.DecodeRange("big.bin", r.offset, r.length, &out); err != nil {
+					t.Fatalf("DecodeRange(%d, %d) failed: %v", r.offset, r.length, err)
+				}
+				end := min(r.offset+r.length, int64(len(data)))
+				if !bytes.Equal(out.Bytes(), data[r.offset:end]) {
+					t.Errorf("DecodeRange(%d, %d) returned the wrong %d bytes", r.offset, r.length, out.Len())
+				}
+			}
+
+			if err := enc.DecodeRange("big.bin", int64(len(data))+1, 10, &bytes.Buffer{}); !errors.Is(err, ErrInvalidRange) {
+				t.Errorf("expected ErrInvalidRange past the end, got %v", err)
+			}
+			if err := enc.DecodeRange("big.bin", -1, 10, &bytes.Buffer{}); !errors.Is(err, ErrInvalidRange) {
+				t.Errorf("expected ErrInvalidRange for a negative offset, got %v", err)
+			}
+		})
+	}
+}
+
+func TestDecodeRange_SkipsStripesOutsideRange(t *testing.T) {
+	data := testData(50000)
+	enc, shardDir := encodeTestFile(t, "big.bin", data, &EncoderOptions{BlockSize: 1024})
+
+	// wreck the first block of three shards so the first stripe can't be rebuilt
+	for i := range 3 {
+		path := filepath.Join(shardDir, shardFileName(i, "big.bin"))
+		shard, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read shard: %v", err)
+		}
+		header, err := ReadShardHeader(bytes.NewReader(shard))
+		if err != nil {
+			t.Fatalf("failed to read shard header: %v", err)
+		}
+		headerSize, _ := marshalShardHeader(header)
+		shard[len(headerSize)+blockHeaderSize] ^= 0xff
+		if err := os.WriteFile(path, shard, 0644); err != nil {
+			t.Fatalf("failed to write shard: %v", err)
+		}
+	}
+
+	if err := enc.DecodeRange("big.bin", 0, 10, &bytes.Buffer{}); !errors.Is(err, ErrTooFewShards) {
+		t.Errorf("expected ErrTooFewShards for the broken stripe, got %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := enc.DecodeRange("big.bin", 40000, 10000, &out); err != nil {
+		t.Fatalf("DecodeRange failed: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), data[40000:]) {
+		t.Error("decoded range does not match original data")
+	}
+}
@@ -0,0 +1,487 @@
+package encoding
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// Scheme names stored in the shard headers so the decoder knows which code
+// the shards were made with
+const (
+	SchemeReedSolomon = "reed-solomon"
+	SchemeReplication = "replication"
+	SchemeLRC         = "lrc"
+)
+
+// Redundancy is a way of turning a stripe into shard blocks that survive
+// losing some of them. Shards are ordered data shards first, and every method
+// works on one stripe with all blocks the same length. Missing blocks are nil.
+type Redundancy interface {
+	// Scheme is the identifier stored in the shard headers
+	Scheme() string
+	DataShards() int
+	TotalShards() int
+
+	// Split cuts data into TotalShards equal blocks with room for the parity,
+	// zero padding the last data block. Use Join to undo it.
+	Split(data []byte) ([][]byte, error)
+	// Encode fills in the parity blocks from the data blocks
+	Encode(shards [][]byte) error
+	// Reconstruct fills in every missing block, ReconstructData only the data ones.
+	// Both return ErrTooFewShards when not enough blocks are left.
+	Reconstruct(shards [][]byte) error
+	ReconstructData(shards [][]byte) error
+	// CanReconstruct reports whether the missing blocks can be rebuilt
+	CanReconstruct(shards [][]byte) bool
+	// Join writes the first outSize bytes of the data blocks to dst
+	Join(dst io.Writer, shards [][]byte, outSize int) error
+
+	Cost() RedundancyCost
+}
+
+// RedundancyCost describes what a scheme costs and what it buys
+type RedundancyCost struct {
+	// StorageOverhead is how many bytes are stored per byte of file
+	StorageOverhead float64
+	// RepairReads is how many blocks have to be read to rebuild a single lost one
+	RepairReads int
+	// FaultTolerance is how many shards can be lost in any combination
+	FaultTolerance int
+}
+
+// NewRedundancy returns the code for scheme with dataShards data and
+// parityShards parity shards. localGroupSize is only used by SchemeLRC.
+// Replication ignores dataShards and keeps dataShards+parityShards copies.
+func NewRedundancy(scheme string, dataShards int, parityShards int, localGroupSize int) (Redundancy, error) {
+	switch scheme {
+	case SchemeReedSolomon, "":
+		return newReedSolomonCode(dataShards, parityShards)
+	case SchemeReplication:
+		return newReplicationCode(dataShards + parityShards)
+	case SchemeLRC:
+		return newLRCCode(dataShards, parityShards, localGroupSize)
+	default:
+		return nil, fmt.Errorf("%w: unknown redundancy scheme %q", ErrUnsupportedFormat, scheme)
+	}
+}
+
+// redundancyFor returns the code the shards described by header were made with
+func redundancyFor(header *ShardHeader) (Redundancy, error) {
+	if header.Scheme == SchemeReplication {
+		// the header counts one data shard and the other copies as parity
+		return newReplicationCode(header.DataShards + header.ParityShards)
+	}
+	return NewRedundancy(header.Scheme, header.DataShards, header.ParityShards, header.LocalGroupSize)
+}
+
+// reedSolomonCode is the plain Reed-Solomon code, any dataShards blocks are
+// enough to rebuild the rest
+type reedSolomonCode struct {
+	reedsolomon.Encoder
+	dataShards   int
+	parityShards int
+}
+
+func newReedSolomonCode(dataShards int, parityShards int) (*reedSolomonCode, error) {
+	encoder, err := reedsolomon.New(dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+	return &reedSolomonCode{
+		Encoder:      encoder,
+		dataShards:   dataShards,
+		parityShards: parityShards,
+	}, nil
+}
+
+func (c *reedSolomonCode) Scheme() string   { return SchemeReedSolomon }
+func (c *reedSolomonCode) DataShards() int  { return c.dataShards }
+func (c *reedSolomonCode) TotalShards() int { return c.dataShards + c.parityShards }
+
+func (c *reedSolomonCode) Reconstruct(shards [][]byte) error {
+	return tooFewShards(c.Encoder.Reconstruct(shards))
+}
+
+func (c *reedSolomonCode) ReconstructData(shards [][]byte) error {
+	return tooFewShards(c.Encoder.ReconstructData(shards))
+}
+
+func (c *reedSolomonCode) CanReconstruct(shards [][]byte) bool {
+	return countBlocks(shards) >= c.dataShards
+}
+
+func (c *reedSolomonCode) Cost() RedundancyCost {
+	return RedundancyCost{
+		StorageOverhead: float64(c.TotalShards()) / float64(c.dataShards),
+		RepairReads:     c.dataShards,
+		FaultTolerance:  c.parityShards,
+	}
+}
+
+// tooFewShards turns the reedsolomon error for too few shards into ours
+func tooFewShards(err error) error {
+	if errors.Is(err, reedsolomon.ErrTooFewShards) {
+		return ErrTooFewShards
+	}
+	return err
+}
+
+// replicationCode stores a full copy of the stripe in every shard. It costs
+// the most space but any single shard is the whole file, which is the better
+// deal for tiny files where the space doesn't matter.
+type replicationCode struct {
+	copies int
+}
+
+func newReplicationCode(copies int) (*replicationCode, error) {
+	if copies <= 0 {
+		return nil, errors.New("Replication needs at least one copy")
+	}
+	return &replicationCode{copies: copies}, nil
+}
+
+func (c *replicationCode) Scheme() string   { return SchemeReplication }
+func (c *replicationCode) DataShards() int  { return 1 }
+func (c *replicationCode) TotalShards() int { return c.copies }
+
+func (c *replicationCode) Split(data []byte) ([][]byte, error) {
+	if len(data) == 0 {
+		return nil, reedsolomon.ErrShortData
+	}
+	// the copies go in data's spare capacity when there is enough of it
+	size := len(data)
+	buf := data[:cap(data)]
+	if len(buf) < size*c.copies {
+		buf = make([]byte, size*c.copies)
+		copy(buf, data)
+	}
+
+	shards := make([][]byte, c.copies)
+	for i := range shards {
+		shards[i] = buf[i*size : (i+1)*size : (i+1)*size]
+	}
+	return shards, nil
+}
+
+func (c *replicationCode) Encode(shards [][]byte) error {
+	for i := 1; i < len(shards); i++ {
+		copy(shards[i], shards[0])
+	}
+	return nil
+}
+
+func (c *replicationCode) Reconstruct(shards [][]byte) error {
+	var present []byte
+	for _, shard := range shards {
+		if shard != nil {
+			present = shard
+			break
+		}
+	}
+	if present == nil {
+		return ErrTooFewShards
+	}
+
+	for i := range shards {
+		if shards[i] == nil {
+			shards[i] = append([]byte(nil), present...)
+		}
+	}
+	return nil
+}
+
+func (c *replicationCode) ReconstructData(shards [][]byte) error {
+	if shards[0] != nil {
+		return nil
+	}
+	for _, shard := range shards {
+		if shard != nil {
+			shards[0] = shard
+			return nil
+		}
+	}
+	return ErrTooFewShards
+}
+
+func (c *replicationCode) CanReconstruct(shards [][]byte) bool {
+	return countBlocks(shards) > 0
+}
+
+func (c *replicationCode) Join(dst io.Writer, shards [][]byte, outSize int) error {
+	return joinShards(dst, shards[:1], outSize)
+}
+
+func (c *replicationCode) Cost() RedundancyCost {
+	return RedundancyCost{
+		StorageOverhead: float64(c.copies),
+		RepairReads:     1,
+		FaultTolerance:  c.copies - 1,
+	}
+}
+
+// lrcCode is a locally repairable code. The data shards are cut into groups of
+// groupSize with an XOR parity shard each, and a Reed-Solomon code over all the
+// data shards adds the global parity shards on top. A single lost shard is
+// rebuilt from the rest of its group instead of from dataShards other shards.
+//
+// Shards are ordered data, then local parities (one per group), then global parities.
+type lrcCode struct {
+	dataShards   int
+	groupSize    int
+	localShards  int
+	globalShards int
+	global       reedsolomon.Encoder
+}
+
+// newLRCCode makes an LRC with parityShards parity shards in total, one local
+// parity per group and the remaining ones global
+func newLRCCode(dataShards int, parityShards int, groupSize int) (*lrcCode, error) {
+	if dataShards <= 0 || groupSize <= 0 {
+		return nil, errors.New("LRC needs data shards and a positive local group size")
+	}
+
+	localShards := (dataShards + groupSize - 1) / groupSize
+	globalShards := parityShards - localShards
+	if globalShards <= 0 {
+		return nil, fmt.Errorf("LRC with %d local groups needs more than %d parity shards", localShards, localShards)
+	}
+
+	global, err := reedsolomon.New(dataShards, globalShards)
+	if err != nil {
+		return nil, err
+	}
+
+	return &lrcCode{
+		dataShards:   dataShards,
+		groupSize:    groupSize,
+		localShards:  localShards,
+		globalShards: globalShards,
+		global:       global,
+	}, nil
+}
+
+func (c *lrcCode) Scheme() string   { return SchemeLRC }
+func (c *lrcCode) DataShards() int  { return c.dataShards }
+func (c *lrcCode) TotalShards() int { return c.dataShards + c.localShards + c.globalShards }
+
+// group returns the shard indices of local group g, its parity shard last
+func (c *lrcCode) group(g int) []int {
+	start := g * c.groupSize
+	end := min(start+c.groupSize, c.dataShards)
+
+	members := make([]int, 0, end-start+1)
+	for i := start; i < end; i++ {
+		members = append(members, i)
+	}
+	return append(members, c.dataShards+g)
+}
+
+// globalView returns the data and global parity shards the way the Reed-Solomon code wants them
+func (c *lrcCode) globalView(shards [][]byte) [][]byte {
+	view := make([][]byte, 0, c.dataShards+c.globalShards)
+	view = append(view, shards[:c.dataShards]...)
+	return append(view, shards[c.dataShards+c.localShards:]...)
+}
+
+func (c *lrcCode) Split(data []byte) ([][]byte, error) {
+	return splitShards(data, c.dataShards, c.TotalShards())
+}
+
+func (c *lrcCode) Encode(shards [][]byte) error {
+	for g := range c.localShards {
+		members := c.group(g)
+		xorShards(shards[members[len(members)-1]], shards, members[:len(members)-1])
+	}
+	return c.global.Encode(c.globalView(shards))
+}
+
+func (c *lrcCode) Reconstruct(shards [][]byte) error {
+	return c.reconstruct(shards, false)
+}
+
+func (c *lrcCode) ReconstructData(shards [][]byte) error {
+	return c.reconstruct(shards, true)
+}
+
+func (c *lrcCode) reconstruct(shards [][]byte, dataOnly bool) error {
+	blockSize := -1
+	for _, shard := range shards {
+		if shard != nil {
+			blockSize = len(shard)
+			break
+		}
+	}
+	if blockSize < 0 {
+		return ErrTooFewShards
+	}
+
+	// groups missing just one shard are fixed with their XOR parity first
+	for g := range c.localShards {
+		members := c.group(g)
+		missing := -1
+		for _, index := range members {
+			if shards[index] != nil {
+				continue
+			}
+			if missing >= 0 {
+				missing = -1
+				break
+			}
+			missing = index
+		}
+		if missing < 0 || (dataOnly && missing >= c.dataShards) {
+			continue
+		}
+
+		rest := make([]int, 0, len(members)-1)
+		for _, index := range members {
+			if index != missing {
+				rest = append(rest, index)
+			}
+		}
+		shards[missing] = make([]byte, blockSize)
+		xorShards(shards[missing], shards, rest)
+	}
+
+	// whatever is left goes through the global code
+	view := c.globalView(shards)
+	needsGlobal := countBlocks(view[:c.dataShards]) < c.dataShards
+	if !dataOnly && countBlocks(view) < len(view) {
+		needsGlobal = true
+	}
+	if needsGlobal {
+		var err error
+		if dataOnly {
+			err = c.global.ReconstructData(view)
+		} else {
+			err = c.global.Reconstruct(view)
+		}
+		if err != nil {
+			return tooFewShards(err)
+		}
+		copy(shards[:c.dataShards], view[:c.dataShards])
+		copy(shards[c.dataShards+c.localShards:], view[c.dataShards:])
+	}
+	if dataOnly {
+		return nil
+	}
+
+	// with all the data back any local parity still missing is a plain XOR
+	for g := range c.localShards {
+		members := c.group(g)
+		parity := members[len(members)-1]
+		if shards[parity] == nil {
+			shards[parity] = make([]byte, blockSize)
+			xorShards(shards[parity], shards, members[:len(members)-1])
+		}
+	}
+	return nil
+}
+
+func (c *lrcCode) CanReconstruct(shards [][]byte) bool {
+	present := make([]bool, len(shards))
+	for i, shard := range shards {
+		present[i] = shard != nil
+	}
+
+	for g := range c.localShards {
+		missing := 0
+		members := c.group(g)
+		for _, index := range members {
+			if !present[index] {
+				missing++
+			}
+		}
+		if missing == 1 {
+			for _, index := range members {
+				present[index] = true
+			}
+		}
+	}
+
+	available := 0
+	for i := range c.dataShards {
+		if present[i] {
+			available++
+		}
+	}
+	for i := c.dataShards + c.localShards; i < len(present); i++ {
+		if present[i] {
+			available++
+		}
+	}
+	return available >= c.dataShards
+}
+
+func (c *lrcCode) Join(dst io.Writer, shards [][]byte, outSize int) error {
+	return joinShards(dst, shards[:c.dataShards], outSize)
+}
+
+func (c *lrcCode) Cost() RedundancyCost {
+	return RedundancyCost{
+		StorageOverhead: float64(c.TotalShards()) / float64(c.dataShards),
+		RepairReads:     c.groupSize,
+		// a whole group can go missing, then only the global parities help
+		FaultTolerance: c.globalShards,
+	}
+}
+
+// splitShards cuts data into dataShards equal blocks followed by empty parity
+// blocks, zero padding the end, the same way reedsolomon's Split does. Like
+// there, data's spare capacity is used instead of allocating if it is enough.
+func splitShards(data []byte, dataShards int, totalShards int) ([][]byte, error) {
+	if len(data) == 0 {
+		return nil, reedsolomon.ErrShortData
+	}
+
+	perShard := (len(data) + dataShards - 1) / dataShards
+	var buf []byte
+	if cap(data) >= perShard*totalShards {
+		buf = data[:perShard*totalShards]
+		clear(buf[len(data):])
+	} else {
+		buf = make([]byte, perShard*totalShards)
+		copy(buf, data)
+	}
+
+	shards := make([][]byte, totalShards)
+	for i := range shards {
+		shards[i] = buf[i*perShard : (i+1)*perShard : (i+1)*perShard]
+	}
+	return shards, nil
+}
+
+// joinShards writes the first outSize bytes of the data blocks to dst
+func joinShards(dst io.Writer, dataShards [][]byte, outSize int) error {
+	for _, shard := range dataShards {
+		if outSize <= 0 {
+			break
+		}
+		if shard == nil {
+			return reedsolomon.ErrReconstructRequired
+		}
+
+		n := min(len(shard), outSize)
+		if _, err := dst.Write(shard[:n]); err != nil {
+			return err
+		}
+		outSize -= n
+	}
+	if outSize > 0 {
+		return reedsolomon.ErrShortData
+	}
+	return nil
+}
+
+// xorShards sets dst to the XOR of the shards at indices
+func xorShards(dst []byte, shards [][]byte, indices []int) {
+	clear(dst)
+	for _, index := range indices {
+		for i, b := range shards[index] {
+			dst[i] ^= b
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package encoding
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestRedundancy_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		options *EncoderOptions
+		scheme  string
+		// lost shards that still have to decode
+		lost []int
+	}{
+		{"reed-solomon", &EncoderOptions{}, SchemeReedSolomon, []int{0, 3, 7, 9}},
+		{"replication", &EncoderOptions{Scheme: SchemeReplication}, SchemeReplication, []int{0, 1, 2, 3, 4, 5, 6, 7, 8}},
+		{"lrc", &EncoderOptions{Scheme: SchemeLRC, LocalGroupSize: 3}, SchemeLRC, []int{0, 1, 4, 6}},
+		{"tiny file replicated", &EncoderOptions{ReplicateBelow: 1 << 20}, SchemeReplication, []int{1, 2, 3, 4, 5, 6, 7, 8, 9}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.options.MinBlockSize = 64
+			test.options.MaxBlockSize = 1024
+			enc := newTestEncoder(t, 6, 4, test.options)
+			data := testData(20000)
+			shards := encodeToBuffers(t, enc, data, FileMeta{Name: "data.bin", Size: int64(len(data))})
+
+			header, _, err := readShardHeaders(shardReaders(shards))
+			if err != nil {
+				t.Fatalf("failed to read headers: %v", err)
+			}
+			if header.Scheme != test.scheme {
+				t.Errorf("expected scheme %q, got %q", test.scheme, header.Scheme)
+			}
+
+			for _, index := range test.lost {
+				shards[index] = nil
+			}
+
+			// decoding uses the scheme from the headers, not the decoder's own options
+			decoder, err := NewEncoder(2, 1, t.TempDir(), t.TempDir())
+			if err != nil {
+				t.Fatalf("failed to create decoder: %v", err)
+			}
+
+			var out bytes.Buffer
+			if err := decoder.DecodeStream(shardReaders(shards), &out); err != nil {
+				t.Fatalf("DecodeStream failed: %v", err)
+			}
+			if !bytes.Equal(out.Bytes(), data) {
+				t.Fatal("decoded data does not match original")
+			}
+		})
+	}
+}
+
+func TestLRC_LocalRepair(t *testing.T) {
+	code, err := newLRCCode(6, 4, 3)
+	if err != nil {
+		t.Fatalf("failed to create lrc: %v", err)
+	}
+	if code.TotalShards() != 10 || code.localShards != 2 || code.globalShards != 2 {
+		t.Fatalf("unexpected layout %+v", code)
+	}
+
+	shards, err := code.Split(testData(6000))
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+	if err := code.Encode(shards); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	original := make([][]byte, len(shards))
+	for i := range shards {
+		original[i] = append([]byte(nil), shards[i]...)
+	}
+
+	// only the rest of the first group is needed to get shard 1 back
+	group := [][]byte{shards[0], nil, shards[2], nil, nil, nil, shards[6], nil, nil, nil}
+	if err := code.ReconstructData(group); err != nil && !errors.Is(err, ErrTooFewShards) {
+		t.Fatalf("ReconstructData failed: %v", err)
+	}
+	if !bytes.Equal(group[1], original[1]) {
+		t.Error("shard 1 was not rebuilt from its local group")
+	}
+
+	// a whole group gone needs the global parities
+	for i := range shards {
+		shards[i] = original[i]
+	}
+	shards[3], shards[4], shards[5], shards[7] = nil, nil, nil, nil
+	if code.CanReconstruct(shards) {
+		t.Error("expected four losses including a whole group to be unrecoverable")
+	}
+	shards[5] = original[5]
+	if !code.CanReconstruct(shards) {
+		t.Error("expected three losses to be recoverable")
+	}
+	if err := code.Reconstruct(shards); err != nil {
+		t.Fatalf("Reconstruct failed: %v", err)
+	}
+	for i := range shards {
+		if !bytes.Equal(shards[i], original[i]) {
+			t.Errorf("shard %d does not match after reconstruct", i)
+		}
+	}
+
+	cost := code.Cost()
+	if cost.RepairReads != 3 || cost.FaultTolerance != 2 {
+		t.Errorf("unexpected cost %+v", cost)
+	}
+}
+
+func TestNewRedundancy_Invalid(t *testing.T) {
+	if _, err := NewRedundancy("fountain", 4, 2, 0); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("expected ErrUnsupportedFormat for unknown scheme, got %v", err)
+	}
+	// two local groups leave no room for a global parity
+	if _, err := NewRedundancy(SchemeLRC, 4, 2, 2); err == nil {
+		t.Error("expected error for lrc without global parity, got nil")
+	}
+}
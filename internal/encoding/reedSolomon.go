@@ -3,27 +3,116 @@ package encoding
 import (
 	"errors"
 	"os"
-
-	"github.com/klauspost/reedsolomon"
+	"path/filepath"
 )
 
 type Encoder struct {
-	encoder   reedsolomon.Encoder
+	encoder   Redundancy
 	shards    int
 	parity    int
 	blockSize int
 
+	// files no bigger than replicateBelow are replicated instead of using encoder
+	replicateBelow int64
+
+	minBlockSize int
+	maxBlockSize int
+
+	// identity turns on encryption when set, see encryption.go
+	identity []byte
+	compress bool
+
+	// buffers is set on the copy of the encoder a Pipeline runs, see pipeline.go
+	buffers *bufferPool
+
 	dirOut string
 	dirIn  string
+
+	// shardsOut is where EncodeFile puts shards, shardsIn is where the
+	// decoder and Repair find them
+	shardsOut ShardStore
+	shardsIn  ShardStore
+}
+
+// EncoderOptions controls how files are cut into stripes
+type EncoderOptions struct {
+	// BlockSize fixes the number of bytes every shard gets per stripe.
+	// Leave it at 0 to have the encoder pick one per file.
+	BlockSize int
+
+	// MinBlockSize and MaxBlockSize bound the block size picked per file, 0
+	// means the default. The total amount of bytes in ram while encoding is
+	// dataShards * block size.
+	MinBlockSize int
+	MaxBlockSize int
+
+	// Identity is a secret that belongs to the user, like their account key.
+	// When set every file is encrypted before it is split up and can only be
+	// decoded by an encoder with the same identity.
+	Identity []byte
+
+	// Compress deflates every stripe before it is encrypted and split. Stripes
+	// that don't shrink, and files that already look compressed like images
+	// and archives, are stored as they are.
+	Compress bool
+
+	// Scheme picks the redundancy scheme, see redundancy.go. Empty means
+	// SchemeReedSolomon. For SchemeLRC LocalGroupSize sets how many data shards
+	// share a local parity shard, one of the parity shards per group is local
+	// and the rest are global.
+	Scheme         string
+	LocalGroupSize int
+
+	// ReplicateBelow makes files of at most this many bytes get a full copy in
+	// every shard instead. 0 turns it off.
+	ReplicateBelow int64
+
+	// Store keeps the shards for both encoding and decoding. nil keeps them as
+	// files, encoded shards under .bin in the OUT folder and shards to decode
+	// in the IN folder.
+	Store ShardStore
+}
+
+const (
+	defaultMinBlockSize = 4 * 1024
+	defaultMaxBlockSize = 20 * 1024 * 1024
+)
+
+// DefaultEncoderOptions returns the default encoder options
+func DefaultEncoderOptions() *EncoderOptions {
+	return &EncoderOptions{
+		BlockSize:    0,
+		MinBlockSize: defaultMinBlockSize,
+		MaxBlockSize: defaultMaxBlockSize,
+	}
 }
 
 func NewEncoder(dataShards int, parityShards int, outPath string, inPath string) (*Encoder, error) {
+	return NewEncoderWithOptions(dataShards, parityShards, outPath, inPath, nil)
+}
+
+// NewEncoderWithOptions creates an encoder, nil options means DefaultEncoderOptions
+func NewEncoderWithOptions(dataShards int, parityShards int, outPath string, inPath string, options *EncoderOptions) (*Encoder, error) {
+	if options == nil {
+		options = DefaultEncoderOptions()
+	}
 
 	if dataShards <= 0 || parityShards <= 0 {
 		return nil, errors.New("Shard counts have to be greater than or equal to 0")
 	}
 
-	encoder, err := reedsolomon.New(dataShards, parityShards)
+	minBlockSize, maxBlockSize := options.MinBlockSize, options.MaxBlockSize
+	if minBlockSize == 0 {
+		minBlockSize = defaultMinBlockSize
+	}
+	if maxBlockSize == 0 {
+		maxBlockSize = defaultMaxBlockSize
+	}
+	if options.BlockSize < 0 || minBlockSize < 0 || maxBlockSize < minBlockSize {
+		return nil, errors.New("Block sizes can't be negative and min has to be <= max")
+	}
+
+	encoder, err := NewRedundancy(options.Scheme, dataShards, parityShards, options.LocalGroupSize)
 
 	if err != nil {
 		return nil, err
@@ -40,17 +129,53 @@ func NewEncoder(dataShards int, parityShards int, outPath string, inPath string)
 		encoder: encoder,
 		shards:  dataShards,
 		parity:  parityShards,
-		// essentially the maximum amount of bytes in one individual dataShards
-		// the total amount of bytes in ram will be #dataShard * blockSize
-		blockSize: 20 * 1024 * 1024,
+
+		replicateBelow: options.ReplicateBelow,
+
+		blockSize:    options.BlockSize,
+		minBlockSize: minBlockSize,
+		maxBlockSize: maxBlockSize,
+
+		identity: options.Identity,
+		compress: options.Compress,
 
 		dirOut: outPath,
 		dirIn:  inPath,
+
+		shardsOut: options.Store,
+		shardsIn:  options.Store,
+	}
+	if options.Store == nil {
+		newEncoder.shardsOut = NewFileStore(filepath.Join(outPath, ".bin"))
+		newEncoder.shardsIn = NewFileStore(inPath)
 	}
 
 	return newEncoder, nil
 }
 
+// blockSizeFor picks the block size for a file of size bytes, -1 meaning unknown.
+// Small files get blocks just big enough to fit in one stripe so they aren't
+// padded out to a full max sized stripe.
+func (e *Encoder) blockSizeFor(size int64) int {
+	return e.blockSizeForShards(size, e.shards)
+}
+
+// blockSizeForShards is blockSizeFor for a code with dataShards data shards
+func (e *Encoder) blockSizeForShards(size int64, dataShards int) int {
+	if e.blockSize > 0 {
+		return e.blockSize
+	}
+	if size < 0 {
+		return e.maxBlockSize
+	}
+
+	blockSize := (size + int64(dataShards) - 1) / int64(dataShards)
+	// keep blocks a multiple of 64 bytes, reedsolomon is fastest that way
+	blockSize = (blockSize + 63) &^ 63
+
+	return int(max(int64(e.minBlockSize), min(blockSize, int64(e.maxBlockSize))))
+}
+
 func checkDirectory(path string) error {
 	info, err := os.Stat(path)
 
@@ -69,3 +194,11 @@ func checkDirectory(path string) error {
 }
 
 
+
+// redundancyForSize returns the code a file of size bytes is encoded with
+func (e *Encoder) redundancyForSize(size int64) (Redundancy, error) {
+	if e.replicateBelow > 0 && size >= 0 && size <= e.replicateBelow {
+		return newReplicationCode(e.shards + e.parity)
+	}
+	return e.encoder, nil
+}
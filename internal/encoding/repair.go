@@ -0,0 +1,145 @@
+package encoding
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// RepairReport says what Repair found in a file's shard directory
+type RepairReport struct {
+	// Rebuilt holds the indices of shards that were missing or corrupt and have been rewritten
+	Rebuilt []int
+	// Intact holds the indices of shards that passed every checksum and were left alone
+	Intact []int
+}
+
+// Repair scrubs the shards of relativePath in the IN folder and rewrites the
+// ones that are missing or have a bad header or block. Only the broken shards
+// are regenerated, the intact ones are never touched. As long as every stripe
+// still has dataShards good blocks the file is back at full redundancy after.
+func (e *Encoder) Repair(relativePath string) (*RepairReport, error) {
+	fileID := filepath.ToSlash(relativePath)
+	shards, err := openShards(e.shardsIn, fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer closeShards(shards)
+
+	header, ordered, err := readShardHeaders(rewindShards(shards))
+	if err != nil {
+		return nil, err
+	}
+
+	codec, err := redundancyFor(header)
+	if err != nil {
+		return nil, err
+	}
+
+	// first pass only reads, any shard missing a block anywhere gets rebuilt
+	broken := make([]bool, len(ordered))
+	for i, shard := range ordered {
+		broken[i] = shard == nil
+	}
+
+	stripes := newStripeReader(header, ordered)
+	for {
+		blocks, _, err := stripes.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if !codec.CanReconstruct(blocks) {
+			return nil, fmt.Errorf("%w: stripe %d has only %d of %d blocks", ErrTooFewShards, stripes.stripe-1, countBlocks(blocks), len(blocks))
+		}
+		for i, block := range blocks {
+			if block == nil {
+				broken[i] = true
+			}
+		}
+	}
+
+	report := &RepairReport{}
+	for i := range broken {
+		if broken[i] {
+			report.Rebuilt = append(report.Rebuilt, i)
+		} else {
+			report.Intact = append(report.Intact, i)
+		}
+	}
+	if len(report.Rebuilt) == 0 {
+		return report, nil
+	}
+
+	// second pass rebuilds the broken shards, nothing is replaced until they are all done
+	header, ordered, err = readShardHeaders(rewindShards(shards))
+	if err != nil {
+		return nil, err
+	}
+
+	rebuilt := make(map[int]ShardWriter, len(report.Rebuilt))
+	defer func() {
+		for _, writer := range rebuilt {
+			writer.Abort()
+		}
+	}()
+
+	for _, index := range report.Rebuilt {
+		writer, err := e.shardsIn.Put(fileID, index)
+		if err != nil {
+			return nil, err
+		}
+		rebuilt[index] = writer
+
+		shardHeader := *header
+		shardHeader.ShardIndex = index
+		buf, err := marshalShardHeader(&shardHeader)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := writer.Write(buf); err != nil {
+			return nil, err
+		}
+	}
+
+	stripes = newStripeReader(header, ordered)
+	for {
+		blocks, record, err := stripes.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// the second read has to see the same good blocks as the first
+		if !codec.CanReconstruct(blocks) {
+			return nil, fmt.Errorf("%w: stripe %d changed while repairing", ErrTooFewShards, stripes.stripe-1)
+		}
+
+		if err := codec.Reconstruct(blocks); err != nil {
+			return nil, err
+		}
+
+		for index, writer := range rebuilt {
+			if err := writeBlock(writer, blocks[index], record); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// the broken shards may still be open for reading which stops the rename on windows
+	closeShards(shards)
+
+	for index, writer := range rebuilt {
+		if err := writer.Commit(); err != nil {
+			return nil, err
+		}
+		delete(rebuilt, index)
+	}
+
+	return report, nil
+}
@@ -0,0 +1,85 @@
+package encoding
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRepair_RebuildsBrokenShards(t *testing.T) {
+	enc, shardDir := encodeTestFile(t, "report.pdf", testData(50000), &EncoderOptions{BlockSize: 4096})
+	originals := make([][]byte, 6)
+	for i := range originals {
+		var err error
+		originals[i], err = os.ReadFile(filepath.Join(shardDir, shardFileName(i, "report.pdf")))
+		if err != nil {
+			t.Fatalf("failed to read shard %d: %v", i, err)
+		}
+	}
+
+	// lose shard 1 entirely and flip a bit in the middle of parity shard 4
+	if err := os.Remove(filepath.Join(shardDir, shardFileName(1, "report.pdf"))); err != nil {
+		t.Fatalf("failed to remove shard: %v", err)
+	}
+	corrupt := bytes.Clone(originals[4])
+	corrupt[len(corrupt)/2] ^= 0xFF
+	if err := os.WriteFile(filepath.Join(shardDir, shardFileName(4, "report.pdf")), corrupt, 0644); err != nil {
+		t.Fatalf("failed to corrupt shard: %v", err)
+	}
+
+	report, err := enc.Repair("report.pdf")
+	if err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+
+	if !reflect.DeepEqual(report.Rebuilt, []int{1, 4}) {
+		t.Errorf("expected shards [1 4] rebuilt, got %v", report.Rebuilt)
+	}
+	if !reflect.DeepEqual(report.Intact, []int{0, 2, 3, 5}) {
+		t.Errorf("expected shards [0 2 3 5] intact, got %v", report.Intact)
+	}
+
+	for i, original := range originals {
+		shard, err := os.ReadFile(filepath.Join(shardDir, shardFileName(i, "report.pdf")))
+		if err != nil {
+			t.Fatalf("failed to read shard %d: %v", i, err)
+		}
+		if !bytes.Equal(shard, original) {
+			t.Errorf("shard %d does not match the original after repair", i)
+		}
+	}
+
+	entries, _ := os.ReadDir(shardDir)
+	if len(entries) != 6 {
+		t.Errorf("expected 6 files in the shard dir after repair, got %d", len(entries))
+	}
+}
+
+func TestRepair_HealthyShards(t *testing.T) {
+	enc, _ := encodeTestFile(t, "report.pdf", testData(50000), &EncoderOptions{BlockSize: 4096})
+
+	report, err := enc.Repair("report.pdf")
+	if err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	if len(report.Rebuilt) != 0 || len(report.Intact) != 6 {
+		t.Errorf("expected nothing rebuilt, got %+v", report)
+	}
+}
+
+func TestRepair_TooManyLosses(t *testing.T) {
+	enc, shardDir := encodeTestFile(t, "report.pdf", testData(50000), &EncoderOptions{BlockSize: 4096})
+
+	for _, i := range []int{0, 2, 5} {
+		if err := os.Remove(filepath.Join(shardDir, shardFileName(i, "report.pdf"))); err != nil {
+			t.Fatalf("failed to remove shard: %v", err)
+		}
+	}
+
+	if _, err := enc.Repair("report.pdf"); !errors.Is(err, ErrTooFewShards) {
+		t.Errorf("expected ErrTooFewShards, got %v", err)
+	}
+}
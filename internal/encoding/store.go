@@ -0,0 +1,270 @@
+package encoding
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrShardNotFound = errors.New("shard not found")
+	ErrInvalidFileID = errors.New("invalid file id")
+)
+
+// ShardStore is where the encoder keeps shards. A file's shards are found by
+// the file's ID, which is its path relative to the folder it was encoded from,
+// and the shard index.
+type ShardStore interface {
+	// Put starts writing shard index of fileID. Nothing changes in the store
+	// until the writer is committed, which replaces any shard already there.
+	Put(fileID string, index int) (ShardWriter, error)
+	// Get opens shard index of fileID, ErrShardNotFound if it isn't there
+	Get(fileID string, index int) (io.ReadSeekCloser, error)
+	// List returns the indices of the shards stored for fileID in order
+	List(fileID string) ([]int, error)
+	// Delete removes shard index of fileID, ErrShardNotFound if it isn't there
+	Delete(fileID string, index int) error
+}
+
+// ShardWriter is a shard being written to a ShardStore. It can seek so the
+// encoder can go back and fill in the header once the file is read.
+type ShardWriter interface {
+	io.WriteSeeker
+	// Commit puts the shard in the store
+	Commit() error
+	// Abort throws the shard away, it does nothing after Commit
+	Abort() error
+}
+
+// openShards opens every shard stored for fileID. Shards that can't be opened
+// are skipped, the decoder treats them as missing.
+func openShards(store ShardStore, fileID string) ([]io.ReadSeekCloser, error) {
+	indices, err := store.List(fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	shards := make([]io.ReadSeekCloser, 0, len(indices))
+	for _, index := range indices {
+		shard, err := store.Get(fileID, index)
+		if err != nil {
+			continue
+		}
+		shards = append(shards, shard)
+	}
+
+	return shards, nil
+}
+
+func closeShards(shards []io.ReadSeekCloser) {
+	for _, shard := range shards {
+		shard.Close()
+	}
+}
+
+// rewindShards returns the shards as readers, rewound to their start
+func rewindShards(shards []io.ReadSeekCloser) []io.Reader {
+	readers := make([]io.Reader, len(shards))
+	for i, shard := range shards {
+		if _, err := shard.Seek(0, io.SeekStart); err != nil {
+			continue
+		}
+		readers[i] = shard
+	}
+	return readers
+}
+
+// FileStore keeps shards as files, one folder per file ID holding files named
+// by shardFileName. It is the layout EncodeFile has always written to .bin.
+type FileStore struct {
+	root string
+}
+
+func NewFileStore(root string) *FileStore {
+	return &FileStore{root: root}
+}
+
+// dir returns the folder holding fileID's shards
+func (s *FileStore) dir(fileID string) (string, error) {
+	path := filepath.FromSlash(fileID)
+	if !filepath.IsLocal(path) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidFileID, fileID)
+	}
+	return filepath.Join(s.root, path), nil
+}
+
+// shardFiles returns the names of the shard files in dir by index. Shards
+// received from peers don't always follow shardFileName past the index.
+func (s *FileStore) shardFiles(dir string) (map[int][]string, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[int][]string)
+	for _, entry := range entries {
+		index, ok := parseShardFileName(entry.Name())
+		if entry.IsDir() || !ok {
+			continue
+		}
+		files[index] = append(files[index], entry.Name())
+	}
+	return files, nil
+}
+
+func (s *FileStore) Put(fileID string, index int) (ShardWriter, error) {
+	dir, err := s.dir(fileID)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	file, err := os.CreateTemp(dir, ".shard-*")
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileShardWriter{
+		File:  file,
+		store: s,
+		dir:   dir,
+		name:  shardFileName(index, filepath.Base(dir)),
+		index: index,
+	}, nil
+}
+
+func (s *FileStore) Get(fileID string, index int) (io.ReadSeekCloser, error) {
+	dir, err := s.dir(fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(filepath.Join(dir, shardFileName(index, filepath.Base(dir))))
+	if err == nil || !os.IsNotExist(err) {
+		return file, err
+	}
+
+	files, err := s.shardFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(files[index]) == 0 {
+		return nil, fmt.Errorf("%w: %s shard %d", ErrShardNotFound, fileID, index)
+	}
+	return os.Open(filepath.Join(dir, files[index][0]))
+}
+
+func (s *FileStore) List(fileID string) ([]int, error) {
+	dir, err := s.dir(fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := s.shardFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	indices := make([]int, 0, len(files))
+	for index := range files {
+		indices = append(indices, index)
+	}
+	slices.Sort(indices)
+	return indices, nil
+}
+
+func (s *FileStore) Delete(fileID string, index int) error {
+	dir, err := s.dir(fileID)
+	if err != nil {
+		return err
+	}
+
+	files, err := s.shardFiles(dir)
+	if err != nil {
+		return err
+	}
+	if len(files[index]) == 0 {
+		return fmt.Errorf("%w: %s shard %d", ErrShardNotFound, fileID, index)
+	}
+
+	for _, name := range files[index] {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileShardWriter writes a shard to a temp file and renames it into place on commit
+type fileShardWriter struct {
+	*os.File
+	store *FileStore
+	dir   string
+	name  string
+	index int
+	done  bool
+}
+
+func (w *fileShardWriter) Commit() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+
+	if err := w.File.Close(); err != nil {
+		os.Remove(w.File.Name())
+		return err
+	}
+
+	// a shard under another name with the same index is the one being replaced
+	files, err := w.store.shardFiles(w.dir)
+	if err != nil {
+		os.Remove(w.File.Name())
+		return err
+	}
+	for _, name := range files[w.index] {
+		if name != w.name {
+			os.Remove(filepath.Join(w.dir, name))
+		}
+	}
+
+	return os.Rename(w.File.Name(), filepath.Join(w.dir, w.name))
+}
+
+func (w *fileShardWriter) Abort() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+
+	w.File.Close()
+	return os.Remove(w.File.Name())
+}
+
+// parseShardFileName returns the index of a shard file named shard<index>_<anything>.dat
+func parseShardFileName(name string) (int, bool) {
+	rest, ok := strings.CutPrefix(name, "shard")
+	if !ok || !strings.HasSuffix(rest, ".dat") {
+		return 0, false
+	}
+
+	number, _, ok := strings.Cut(rest, "_")
+	if !ok {
+		return 0, false
+	}
+	index, err := strconv.Atoi(number)
+	if err != nil || index < 0 {
+		return 0, false
+	}
+	return index, true
+}
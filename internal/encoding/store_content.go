@@ -0,0 +1,295 @@
+package encoding
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentStore keeps every shard once under the sha256 of its contents, with
+// a small ref file per file ID and index naming the hash. Peers can ask for a
+// shard by hash and check what they got, and shards with the same contents
+// are only stored once. The layout under root is
+//
+//	objects/<first 2 hex digits>/<hash>
+//	refs/<escaped file id>/<index>
+//
+// An object goes once the last ref naming it does. The number of refs naming
+// each hash is counted from refs/ on first use and kept up to date after.
+type ContentStore struct {
+	root string
+
+	// mutex covers moving objects into place, the refs and the counts, so an
+	// object can't be removed between being stored and being referenced
+	mutex  sync.Mutex
+	counts map[string]int
+}
+
+func NewContentStore(root string) *ContentStore {
+	return &ContentStore{root: root}
+}
+
+func (s *ContentStore) objectPath(hash string) string {
+	return filepath.Join(s.root, "objects", hash[:2], hash)
+}
+
+// refDir returns the folder holding fileID's refs. The escaped ID is a single
+// path element, but "", "." and ".." would still be the refs folder or the root.
+func (s *ContentStore) refDir(fileID string) (string, error) {
+	if fileID == "" || fileID == "." || fileID == ".." {
+		return "", fmt.Errorf("%w: %q", ErrInvalidFileID, fileID)
+	}
+	return filepath.Join(s.root, "refs", url.PathEscape(fileID)), nil
+}
+
+// Hash returns the hash shard index of fileID is stored under
+func (s *ContentStore) Hash(fileID string, index int) (string, error) {
+	dir, err := s.refDir(fileID)
+	if err != nil {
+		return "", err
+	}
+	ref, err := os.ReadFile(filepath.Join(dir, strconv.Itoa(index)))
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("%w: %s shard %d", ErrShardNotFound, fileID, index)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	hash := strings.TrimSpace(string(ref))
+	if len(hash) != sha256.Size*2 {
+		return "", fmt.Errorf("bad ref for %s shard %d", fileID, index)
+	}
+	return hash, nil
+}
+
+// GetByHash opens the shard stored under hash
+func (s *ContentStore) GetByHash(hash string) (io.ReadSeekCloser, error) {
+	if _, err := hex.DecodeString(hash); err != nil || len(hash) != sha256.Size*2 {
+		return nil, fmt.Errorf("%w: bad hash %q", ErrShardNotFound, hash)
+	}
+
+	file, err := os.Open(s.objectPath(hash))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrShardNotFound, hash)
+	}
+	return file, err
+}
+
+func (s *ContentStore) Put(fileID string, index int) (ShardWriter, error) {
+	if _, err := s.refDir(fileID); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(s.root, 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(s.root, ".put-*")
+	if err != nil {
+		return nil, err
+	}
+	return &contentShardWriter{File: file, store: s, fileID: fileID, index: index}, nil
+}
+
+func (s *ContentStore) Get(fileID string, index int) (io.ReadSeekCloser, error) {
+	hash, err := s.Hash(fileID, index)
+	if err != nil {
+		return nil, err
+	}
+	return s.GetByHash(hash)
+}
+
+func (s *ContentStore) List(fileID string) ([]int, error) {
+	dir, err := s.refDir(fileID)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	indices := make([]int, 0, len(entries))
+	for _, entry := range entries {
+		index, err := strconv.Atoi(entry.Name())
+		if err != nil || index < 0 {
+			continue
+		}
+		indices = append(indices, index)
+	}
+	slices.Sort(indices)
+	return indices, nil
+}
+
+func (s *ContentStore) Delete(fileID string, index int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	hash, err := s.Hash(fileID, index)
+	if err != nil {
+		return err
+	}
+	if err := s.loadCounts(); err != nil {
+		return err
+	}
+	dir, _ := s.refDir(fileID)
+	if err := os.Remove(filepath.Join(dir, strconv.Itoa(index))); err != nil {
+		return err
+	}
+	os.Remove(dir) // only goes if it's empty
+
+	return s.release(hash)
+}
+
+// loadCounts counts the refs naming each hash the first time it is called.
+// Callers hold the mutex.
+func (s *ContentStore) loadCounts() error {
+	if s.counts != nil {
+		return nil
+	}
+
+	counts := make(map[string]int)
+	err := filepath.WalkDir(filepath.Join(s.root, "refs"), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			return err
+		}
+		ref, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		counts[strings.TrimSpace(string(ref))]++
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.counts = counts
+	return nil
+}
+
+// release drops a ref to hash and deletes its object once no ref names it.
+// Callers hold the mutex.
+func (s *ContentStore) release(hash string) error {
+	s.counts[hash]--
+	if s.counts[hash] > 0 {
+		return nil
+	}
+	delete(s.counts, hash)
+
+	if err := os.Remove(s.objectPath(hash)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// writeRef points fileID's shard index at hash and returns the hash it used
+// to point at, if any. Callers hold the mutex.
+func (s *ContentStore) writeRef(fileID string, index int, hash string) (string, error) {
+	old, err := s.Hash(fileID, index)
+	if err != nil {
+		old = ""
+	}
+
+	dir, err := s.refDir(fileID)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	temp, err := os.CreateTemp(dir, ".ref-*")
+	if err != nil {
+		return "", err
+	}
+	if _, err := temp.WriteString(hash); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return "", err
+	}
+	if err := temp.Close(); err != nil {
+		os.Remove(temp.Name())
+		return "", err
+	}
+
+	return old, os.Rename(temp.Name(), filepath.Join(dir, strconv.Itoa(index)))
+}
+
+// contentShardWriter writes a shard to a temp file, hashes it on commit and
+// moves it to its object path
+type contentShardWriter struct {
+	*os.File
+	store  *ContentStore
+	fileID string
+	index  int
+	done   bool
+}
+
+func (w *contentShardWriter) Commit() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	defer os.Remove(w.File.Name())
+
+	// the header was rewritten at the end so the hash can only be taken now
+	hasher := sha256.New()
+	if _, err := w.File.Seek(0, io.SeekStart); err != nil {
+		w.File.Close()
+		return err
+	}
+	if _, err := io.Copy(hasher, w.File); err != nil {
+		w.File.Close()
+		return err
+	}
+	if err := w.File.Close(); err != nil {
+		return err
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+
+	w.store.mutex.Lock()
+	defer w.store.mutex.Unlock()
+	if err := w.store.loadCounts(); err != nil {
+		return err
+	}
+
+	objectPath := w.store.objectPath(hash)
+	if _, err := os.Stat(objectPath); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(objectPath), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(w.File.Name(), objectPath); err != nil {
+			return err
+		}
+	}
+
+	old, err := w.store.writeRef(w.fileID, w.index, hash)
+	if err != nil {
+		return err
+	}
+	w.store.counts[hash]++
+	if old != "" {
+		return w.store.release(old)
+	}
+	return nil
+}
+
+func (w *contentShardWriter) Abort() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+
+	w.File.Close()
+	return os.Remove(w.File.Name())
+}
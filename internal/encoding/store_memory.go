@@ -0,0 +1,139 @@
+package encoding
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+)
+
+// MemoryStore keeps shards in memory, it is meant for tests
+type MemoryStore struct {
+	mutex  sync.Mutex
+	shards map[string]map[int][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{shards: make(map[string]map[int][]byte)}
+}
+
+// Bytes returns the contents of a stored shard, nil if it isn't there. The
+// slice is the store's own, tests can change it to corrupt the shard.
+func (s *MemoryStore) Bytes(fileID string, index int) []byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.shards[fileID][index]
+}
+
+func (s *MemoryStore) Put(fileID string, index int) (ShardWriter, error) {
+	return &memoryShardWriter{store: s, fileID: fileID, index: index}, nil
+}
+
+func (s *MemoryStore) Get(fileID string, index int) (io.ReadSeekCloser, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	shard, ok := s.shards[fileID][index]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s shard %d", ErrShardNotFound, fileID, index)
+	}
+	return memoryShard{bytes.NewReader(shard)}, nil
+}
+
+func (s *MemoryStore) List(fileID string) ([]int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	indices := make([]int, 0, len(s.shards[fileID]))
+	for index := range s.shards[fileID] {
+		indices = append(indices, index)
+	}
+	slices.Sort(indices)
+	return indices, nil
+}
+
+func (s *MemoryStore) Delete(fileID string, index int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.shards[fileID][index]; !ok {
+		return fmt.Errorf("%w: %s shard %d", ErrShardNotFound, fileID, index)
+	}
+	delete(s.shards[fileID], index)
+	if len(s.shards[fileID]) == 0 {
+		delete(s.shards, fileID)
+	}
+	return nil
+}
+
+type memoryShard struct {
+	*bytes.Reader
+}
+
+func (memoryShard) Close() error {
+	return nil
+}
+
+// memoryShardWriter is a growable buffer that can seek
+type memoryShardWriter struct {
+	store  *MemoryStore
+	fileID string
+	index  int
+	buf    []byte
+	pos    int64
+	done   bool
+}
+
+func (w *memoryShardWriter) Write(p []byte) (int, error) {
+	if w.done {
+		return 0, errors.New("shard writer is already done")
+	}
+
+	end := w.pos + int64(len(p))
+	if end > int64(len(w.buf)) {
+		w.buf = append(w.buf, make([]byte, end-int64(len(w.buf)))...)
+	}
+	copy(w.buf[w.pos:], p)
+	w.pos = end
+	return len(p), nil
+}
+
+func (w *memoryShardWriter) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += w.pos
+	case io.SeekEnd:
+		offset += int64(len(w.buf))
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	w.pos = offset
+	return offset, nil
+}
+
+func (w *memoryShardWriter) Commit() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+
+	w.store.mutex.Lock()
+	defer w.store.mutex.Unlock()
+	if w.store.shards[w.fileID] == nil {
+		w.store.shards[w.fileID] = make(map[int][]byte)
+	}
+	w.store.shards[w.fileID][w.index] = w.buf
+	return nil
+}
+
+func (w *memoryShardWriter) Abort() error {
+	w.done = true
+	w.buf = nil
+	return nil
+}
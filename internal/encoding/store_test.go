@@ -0,0 +1,286 @@
+package encoding
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func putShard(t *testing.T, store ShardStore, fileID string, index int, data []byte) {
+	t.Helper()
+
+	writer, err := store.Put(fileID, index)
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, err := writer.Write(data); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := writer.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+}
+
+func getShard(t *testing.T, store ShardStore, fileID string, index int) []byte {
+	t.Helper()
+
+	shard, err := store.Get(fileID, index)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	defer shard.Close()
+	data, err := io.ReadAll(shard)
+	if err != nil {
+		t.Fatalf("failed to read shard: %v", err)
+	}
+	return data
+}
+
+func TestShardStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) ShardStore{
+		"file":    func(t *testing.T) ShardStore { return NewFileStore(t.TempDir()) },
+		"memory":  func(t *testing.T) ShardStore { return NewMemoryStore() },
+		"content": func(t *testing.T) ShardStore { return NewContentStore(t.TempDir()) },
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+
+			if indices, err := store.List("docs/notes.md"); err != nil || len(indices) != 0 {
+				t.Fatalf("expected no shards in an empty store, got %v, %v", indices, err)
+			}
+
+			putShard(t, store, "docs/notes.md", 2, []byte("shard two"))
+			putShard(t, store, "docs/notes.md", 0, []byte("shard zero"))
+			putShard(t, store, "other.txt", 0, []byte("shard zero"))
+
+			// the header is written last by seeking back, like encodeStripes does
+			writer, err := store.Put("docs/notes.md", 1)
+			if err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+			writer.Write([]byte("....body"))
+			writer.Seek(0, io.SeekStart)
+			writer.Write([]byte("head"))
+			writer.Seek(0, io.SeekEnd)
+			writer.Write([]byte("!"))
+			if err := writer.Commit(); err != nil {
+				t.Fatalf("Commit failed: %v", err)
+			}
+
+			// an aborted shard never shows up
+			writer, err = store.Put("docs/notes.md", 3)
+			if err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+			writer.Write([]byte("never committed"))
+			if err := writer.Abort(); err != nil {
+				t.Fatalf("Abort failed: %v", err)
+			}
+
+			indices, err := store.List("docs/notes.md")
+			if err != nil {
+				t.Fatalf("List failed: %v", err)
+			}
+			if !reflect.DeepEqual(indices, []int{0, 1, 2}) {
+				t.Fatalf("expected shards [0 1 2], got %v", indices)
+			}
+			if got := getShard(t, store, "docs/notes.md", 1); string(got) != "headbody!" {
+				t.Errorf("expected shard 1 to be %q, got %q", "headbody!", got)
+			}
+
+			putShard(t, store, "docs/notes.md", 2, []byte("shard two again"))
+			if got := getShard(t, store, "docs/notes.md", 2); string(got) != "shard two again" {
+				t.Errorf("expected Put to replace shard 2, got %q", got)
+			}
+
+			if err := store.Delete("docs/notes.md", 0); err != nil {
+				t.Fatalf("Delete failed: %v", err)
+			}
+			if _, err := store.Get("docs/notes.md", 0); !errors.Is(err, ErrShardNotFound) {
+				t.Errorf("expected ErrShardNotFound after Delete, got %v", err)
+			}
+			if err := store.Delete("docs/notes.md", 0); !errors.Is(err, ErrShardNotFound) {
+				t.Errorf("expected ErrShardNotFound deleting twice, got %v", err)
+			}
+			// the other file's shard had the same contents and has to survive
+			if got := getShard(t, store, "other.txt", 0); string(got) != "shard zero" {
+				t.Errorf("expected other.txt shard 0 to survive, got %q", got)
+			}
+		})
+	}
+}
+
+func TestFileStore_RejectsPathsOutsideRoot(t *testing.T) {
+	store := NewFileStore(t.TempDir())
+
+	if _, err := store.Put("../escape.txt", 0); !errors.Is(err, ErrInvalidFileID) {
+		t.Errorf("expected ErrInvalidFileID, got %v", err)
+	}
+	if _, err := store.List("/etc"); !errors.Is(err, ErrInvalidFileID) {
+		t.Errorf("expected ErrInvalidFileID, got %v", err)
+	}
+}
+
+func TestFileStore_FindsShardsUnderOtherNames(t *testing.T) {
+	root := t.TempDir()
+	shardDir := filepath.Join(root, "photo.jpg")
+	if err := os.MkdirAll(shardDir, 0755); err != nil {
+		t.Fatalf("failed to make shard dir: %v", err)
+	}
+	// shards from peers are named after the file hash
+	if err := os.WriteFile(filepath.Join(shardDir, "shard3_abc123.dat"), []byte("from a peer"), 0644); err != nil {
+		t.Fatalf("failed to write shard: %v", err)
+	}
+
+	store := NewFileStore(root)
+	if got := getShard(t, store, "photo.jpg", 3); string(got) != "from a peer" {
+		t.Errorf("expected the peer's shard, got %q", got)
+	}
+
+	putShard(t, store, "photo.jpg", 3, []byte("rebuilt"))
+	entries, _ := os.ReadDir(shardDir)
+	if len(entries) != 1 || entries[0].Name() != shardFileName(3, "photo.jpg") {
+		t.Errorf("expected the replaced shard to be the only file, got %v", entries)
+	}
+}
+
+func TestContentStore_StoresSameShardOnce(t *testing.T) {
+	root := t.TempDir()
+	store := NewContentStore(root)
+
+	putShard(t, store, "a.txt", 0, []byte("same bytes"))
+	putShard(t, store, "b.txt", 4, []byte("same bytes"))
+
+	hashA, err := store.Hash("a.txt", 0)
+	if err != nil {
+		t.Fatalf("Hash failed: %v", err)
+	}
+	hashB, err := store.Hash("b.txt", 4)
+	if err != nil {
+		t.Fatalf("Hash failed: %v", err)
+	}
+	if hashA != hashB {
+		t.Fatalf("expected identical shards to share a hash, got %s and %s", hashA, hashB)
+	}
+
+	objects, _ := filepath.Glob(filepath.Join(root, "objects", "*", "*"))
+	if len(objects) != 1 {
+		t.Errorf("expected one stored object, got %v", objects)
+	}
+
+	if err := store.Delete("a.txt", 0); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := store.Delete("b.txt", 4); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := store.GetByHash(hashA); !errors.Is(err, ErrShardNotFound) {
+		t.Errorf("expected the object to go with its last ref, got %v", err)
+	}
+}
+
+func TestContentStore_RefsNeverDangle(t *testing.T) {
+	root := t.TempDir()
+	store := NewContentStore(root)
+	putShard(t, store, "kept.txt", 0, []byte("same bytes"))
+
+	// shards with the same contents committed and deleted at once
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fileID := fmt.Sprintf("file%d.txt", i)
+			for range 20 {
+				putShard(t, store, fileID, 0, []byte("same bytes"))
+				if err := store.Delete(fileID, 0); err != nil {
+					t.Errorf("Delete failed: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := getShard(t, store, "kept.txt", 0); string(got) != "same bytes" {
+		t.Errorf("expected kept.txt to keep its shard, got %q", got)
+	}
+
+	// a store opened later counts the refs already there
+	reopened := NewContentStore(root)
+	putShard(t, reopened, "other.txt", 0, []byte("same bytes"))
+	if err := reopened.Delete("other.txt", 0); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if got := getShard(t, reopened, "kept.txt", 0); string(got) != "same bytes" {
+		t.Errorf("expected kept.txt to keep its shard after reopening, got %q", got)
+	}
+
+	for _, fileID := range []string{"", ".", ".."} {
+		if _, err := store.Put(fileID, 0); !errors.Is(err, ErrInvalidFileID) {
+			t.Errorf("expected ErrInvalidFileID for %q, got %v", fileID, err)
+		}
+	}
+}
+
+func TestEncoder_MemoryStore(t *testing.T) {
+	tmpOut := t.TempDir()
+	store := NewMemoryStore()
+	options := DefaultEncoderOptions()
+	options.BlockSize = 1024
+	options.Store = store
+	enc, err := NewEncoderWithOptions(4, 2, tmpOut, tmpOut, options)
+	if err != nil {
+		t.Fatalf("failed to create encoder: %v", err)
+	}
+
+	data := testData(20000)
+	path := filepath.Join(tmpOut, "docs", "notes.md")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("failed to make docs dir: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("failed to write input file: %v", err)
+	}
+	if err := enc.EncodeFile(filepath.Join("docs", "notes.md")); err != nil {
+		t.Fatalf("EncodeFile failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpOut, ".bin")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing written to .bin, got %v", err)
+	}
+
+	// break a shard and let Repair put it back
+	original := bytes.Clone(store.Bytes("docs/notes.md", 3))
+	store.Bytes("docs/notes.md", 3)[len(original)/2] ^= 0xFF
+	report, err := enc.Repair(filepath.Join("docs", "notes.md"))
+	if err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	if !reflect.DeepEqual(report.Rebuilt, []int{3}) {
+		t.Errorf("expected shard 3 rebuilt, got %v", report.Rebuilt)
+	}
+	if !bytes.Equal(store.Bytes("docs/notes.md", 3), original) {
+		t.Error("repaired shard does not match the original")
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("failed to remove input file: %v", err)
+	}
+	if err := enc.DecodeShards(filepath.Join("docs", "notes.md")); err != nil {
+		t.Fatalf("DecodeShards failed: %v", err)
+	}
+	decoded, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read decoded file: %v", err)
+	}
+	if !bytes.Equal(decoded, data) {
+		t.Fatal("decoded file does not match the original")
+	}
+}
@@ -0,0 +1,661 @@
+package encoding
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Progress is passed to a ProgressFunc after every stripe
+type Progress struct {
+	// Bytes is how many bytes of the file have been processed so far
+	Bytes int64
+	// Stripe is the index of the stripe that was just finished
+	Stripe int
+	// Total is the file length or -1 if it isn't known
+	Total int64
+}
+
+// ProgressFunc gets called as encoding or decoding moves along. It runs on the
+// encoding goroutine so it should return quickly.
+type ProgressFunc func(Progress)
+
+// FileMeta describes the file being encoded, it ends up in every shard header
+type FileMeta struct {
+	Name string
+	// Path is the file's path relative to the folder it is being backed up
+	// from, the decoder puts the file back there. Optional.
+	Path string
+	// Size is the length of the input or -1 if it isn't known up front
+	Size int64
+	// Mode and ModTime are restored on the decoded file when set
+	Mode    os.FileMode
+	ModTime time.Time
+}
+
+// fileInfo returns what of meta is recorded in the shard headers
+func (meta FileMeta) fileInfo() fileInfo {
+	info := fileInfo{
+		Name: meta.Name,
+		Path: filepath.ToSlash(meta.Path),
+		Mode: uint32(meta.Mode),
+	}
+	if !meta.ModTime.IsZero() {
+		info.ModTime = meta.ModTime.UnixNano()
+	}
+	return info
+}
+
+// EncodeStream reads r until EOF and writes a header followed by one block per
+// stripe to each of the shard writers. shards has to hold exactly
+// dataShards+parityShards writers, data shards first. The block size is picked
+// from meta.Size and every stripe is full size except the last, which is
+// trimmed down to what its data needs.
+//
+// The file length and hash only become known once r is used up. Shard writers
+// that can seek get their header rewritten with them at the end, for the rest
+// the header keeps whatever meta said.
+//
+// Stripes are compressed first if the encoder is set to, then encrypted, then split.
+func (e *Encoder) EncodeStream(r io.Reader, shards []io.Writer, meta FileMeta) error {
+	return e.EncodeStreamContext(context.Background(), r, shards, meta, nil)
+}
+
+// EncodeStreamContext is EncodeStream that stops between stripes once ctx is
+// done and calls progress, if not nil, after every stripe. What was written to
+// the shards before it stopped is left for the caller to clean up.
+func (e *Encoder) EncodeStreamContext(ctx context.Context, r io.Reader, shards []io.Writer, meta FileMeta, progress ProgressFunc) error {
+	_, err := e.encodeStripes(ctx, r, shards, meta, progress, nil)
+	return err
+}
+
+// encodeStripes does the work for EncodeStreamContext. When prior is set,
+// stripes whose data is the same as the stripe at the same index in prior are
+// copied over from it instead of being encoded again. The returned delta says
+// which parts of the shards were written fresh.
+func (e *Encoder) encodeStripes(ctx context.Context, r io.Reader, shards []io.Writer, meta FileMeta, progress ProgressFunc, prior *priorEncoding) (*Delta, error) {
+	if len(shards) != e.shards+e.parity {
+		return nil, fmt.Errorf("expected %d shard writers, got %d", e.shards+e.parity, len(shards))
+	}
+
+	codec, err := e.redundancyForSize(meta.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	header := &ShardHeader{
+		DataShards:   codec.DataShards(),
+		ParityShards: codec.TotalShards() - codec.DataShards(),
+		Scheme:       codec.Scheme(),
+		FileLength:   meta.Size,
+	}
+	if lrc, ok := codec.(*lrcCode); ok {
+		header.LocalGroupSize = lrc.groupSize
+	}
+	header.setFileInfo(meta.fileInfo())
+
+	if prior != nil && !prior.compatible(header, e.compress, e.identity != nil) {
+		prior = nil
+	}
+
+	// the file hash is only filled in if every shard's header can be rewritten
+	hashed := true
+	for _, shard := range shards {
+		if _, ok := shard.(io.WriteSeeker); !ok {
+			hashed = false
+		}
+	}
+
+	var sealer *stripeCipher
+	if prior != nil {
+		// keep the old stripe layout so unchanged stripes line up with the old ones
+		header.BlockSize = prior.header.BlockSize
+		header.StripeSize = prior.header.StripeSize
+		header.Compression = prior.header.Compression
+		header.Generation = prior.header.Generation + 1
+		if e.identity != nil {
+			sealer, err = reuseFileCipher(e.identity, prior.header, header, hashed)
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		// encrypted stripes grow by the nonce and the GCM tag, the block size has to leave room for them
+		overhead := 0
+		if e.identity != nil {
+			sealer, err = newFileCipher(e.identity, header, hashed)
+			if err != nil {
+				return nil, err
+			}
+			overhead = sealer.overhead()
+		}
+		if e.compress {
+			header.Compression = compressionFlate
+			overhead += compressionOverhead
+		}
+
+		sizeWithOverhead := meta.Size
+		if sizeWithOverhead >= 0 {
+			sizeWithOverhead += int64(overhead)
+		}
+		blockSize := e.blockSizeForShards(sizeWithOverhead, codec.DataShards())
+		header.BlockSize = blockSize
+		header.StripeSize = blockSize*codec.DataShards() - overhead
+		if header.StripeSize <= 0 {
+			return nil, fmt.Errorf("block size %d is too small to fit a stripe", blockSize)
+		}
+	}
+
+	var compressor *stripeCompressor
+	if header.Compression != "" {
+		compressor, err = e.buffers.getCompressor()
+		if err != nil {
+			return nil, err
+		}
+		defer e.buffers.putCompressor(compressor)
+	}
+
+	changes := make([][]ShardRange, len(shards))
+	offsets := make([]int64, len(shards))
+	headerOffsets := make([]int64, len(shards))
+	for i, shard := range shards {
+		if seeker, ok := shard.(io.WriteSeeker); ok {
+			offset, err := seeker.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return nil, err
+			}
+			headerOffsets[i] = offset
+		}
+
+		header.ShardIndex = i
+		buf, err := marshalShardHeader(header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := shard.Write(buf); err != nil {
+			return nil, err
+		}
+
+		// the header always changes since it carries the file hash and generation
+		changes[i] = addShardRange(changes[i], i, 0, int64(len(buf)))
+		offsets[i] = int64(len(buf))
+	}
+
+	fileHash := sha256.New()
+	stripeHash := sha256.New()
+	if sealer != nil {
+		fileHash = sealer.newHash()
+		stripeHash = sealer.newHash()
+	}
+
+	// the stripe is split in splitBuffer, which is big enough for Split to put
+	// the parity blocks in as well, so nothing is allocated per stripe
+	splitBuffer := e.buffers.get(header.BlockSize * codec.TotalShards())
+	defer e.buffers.put(splitBuffer)
+	readBuffer := e.buffers.get(header.StripeSize)
+	defer e.buffers.put(readBuffer)
+
+	// the input is read a byte ahead so the last stripe is known when it is sealed
+	in := bufio.NewReader(io.TeeReader(r, fileHash))
+	var fileLength int64
+
+	for stripe := 0; ; stripe++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		lastBitReadIndex, err := io.ReadFull(in, readBuffer)
+		// an encrypted file still gets an empty last stripe
+		if err == io.EOF && sealer == nil {
+			break
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		fileLength += int64(lastBitReadIndex)
+
+		last := lastBitReadIndex < len(readBuffer)
+		if !last {
+			if _, err := in.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return nil, err
+			}
+		}
+
+		data := readBuffer[:lastBitReadIndex]
+		record := blockMeta{generation: header.Generation}
+		stripeHash.Reset()
+		stripeHash.Write(data)
+		stripeHash.Sum(record.stripeHash[:0])
+
+		var blocks [][]byte
+		if prior != nil {
+			blocks, record = prior.unchangedStripe(codec, record, last)
+		}
+		changed := blocks == nil
+
+		if changed {
+			payload := data
+			if compressor != nil {
+				payload, err = compressor.compress(payload)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if sealer != nil {
+				payload = sealer.seal(splitBuffer[:0], payload, stripe, header.Generation, last)
+			} else {
+				payload = append(splitBuffer[:0], payload...)
+			}
+
+			// the last stripe only gets blocks as big as its data needs,
+			// Split zero pads it up to a multiple of the data shard count
+			blocks, err = codec.Split(payload)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := codec.Encode(blocks); err != nil {
+				return nil, err
+			}
+			record.dataLen = len(payload)
+		}
+
+		if err := writeBlocks(shards, blocks, record); err != nil {
+			return nil, err
+		}
+		for i := range shards {
+			size := int64(blockHeaderSize + len(blocks[i]))
+			if changed {
+				changes[i] = addShardRange(changes[i], i, offsets[i], size)
+			}
+			offsets[i] += size
+		}
+
+		if progress != nil {
+			progress(Progress{Bytes: fileLength, Stripe: stripe, Total: meta.Size})
+		}
+		if last {
+			break
+		}
+	}
+
+	if meta.Size >= 0 && meta.Size != fileLength {
+		return nil, fmt.Errorf("expected %d bytes of input, got %d", meta.Size, fileLength)
+	}
+
+	header.FileLength = fileLength
+	header.FileHash = hex.EncodeToString(fileHash.Sum(nil))
+	for i, shard := range shards {
+		// the sealed file info of an encrypted file says whether to expect a hash
+		seeker, ok := shard.(io.WriteSeeker)
+		if !ok || sealer != nil && !hashed {
+			continue
+		}
+
+		header.ShardIndex = i
+		buf, err := marshalShardHeader(header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := seeker.Seek(headerOffsets[i], io.SeekStart); err != nil {
+			return nil, err
+		}
+		if _, err := seeker.Write(buf); err != nil {
+			return nil, err
+		}
+		if _, err := seeker.Seek(0, io.SeekEnd); err != nil {
+			return nil, err
+		}
+	}
+
+	delta := &Delta{ShardSizes: offsets}
+	for _, ranges := range changes {
+		delta.Changed = append(delta.Changed, ranges...)
+	}
+	return delta, nil
+}
+
+// DecodeStream reads the shards stripe by stripe and writes the rebuilt file to w.
+// Everything needed to decode comes from the shard headers so the shards can be
+// passed in any order and missing ones left out or passed as nil. Shards with a
+// broken header, and blocks that fail their checksum, are treated as missing.
+// Encrypted files are decrypted with the encoder's identity.
+func (e *Encoder) DecodeStream(shards []io.Reader, w io.Writer) error {
+	return e.DecodeStreamContext(context.Background(), shards, w, nil)
+}
+
+// DecodeStreamContext is DecodeStream that stops between stripes once ctx is
+// done and calls progress, if not nil, after every stripe
+func (e *Encoder) DecodeStreamContext(ctx context.Context, shards []io.Reader, w io.Writer, progress ProgressFunc) error {
+	header, ordered, err := readShardHeaders(shards)
+	if err != nil {
+		return err
+	}
+	sealer, _, err := openFileCipher(e.identity, header)
+	if err != nil {
+		return err
+	}
+	return decodeStripes(ctx, header, sealer, ordered, w, progress)
+}
+
+// writeBlocks writes one stripe's blocks to their shards in parallel and
+// returns the first error any of the writes ran into
+func writeBlocks(shards []io.Writer, blocks [][]byte, record blockMeta) error {
+	errs := make([]error, len(shards))
+	var shardWriters sync.WaitGroup
+	for i := range len(shards) {
+		shardWriters.Add(1)
+		go func(i int) {
+			defer shardWriters.Done()
+			if err := writeBlock(shards[i], blocks[i], record); err != nil {
+				errs[i] = fmt.Errorf("shard %d: %w", i, err)
+			}
+		}(i)
+	}
+
+	shardWriters.Wait()
+	return errors.Join(errs...)
+}
+
+// readShardHeaders reads the header of every shard and returns the header most
+// shards agree on along with the shards that agree with it, ordered by index.
+// Shards with a broken or disagreeing header are left out.
+func readShardHeaders(shards []io.Reader) (*ShardHeader, []io.Reader, error) {
+	headers := make([]*ShardHeader, len(shards))
+	for i, shard := range shards {
+		if shard == nil {
+			continue
+		}
+		header, err := ReadShardHeader(shard)
+		if err != nil {
+			continue
+		}
+		headers[i] = header
+	}
+
+	var best *ShardHeader
+	bestVotes := 0
+	for _, candidate := range headers {
+		if candidate == nil {
+			continue
+		}
+		votes := 0
+		for _, other := range headers {
+			if other != nil && candidate.sameEncoding(other) {
+				votes++
+			}
+		}
+		if votes > bestVotes {
+			best = candidate
+			bestVotes = votes
+		}
+	}
+
+	if best == nil || bestVotes < best.DataShards {
+		return nil, nil, ErrTooFewShards
+	}
+
+	ordered := make([]io.Reader, best.DataShards+best.ParityShards)
+	for i, header := range headers {
+		if header == nil || !best.sameEncoding(header) || ordered[header.ShardIndex] != nil {
+			continue
+		}
+		ordered[header.ShardIndex] = shards[i]
+	}
+
+	return best, ordered, nil
+}
+
+// decodeStripes rebuilds the file described by header from shards that have
+// already been read past their header. shards is indexed by shard index and
+// sealer is nil unless the file is encrypted. Compressed stripes are inflated
+// after they are decrypted. progress may be nil.
+func decodeStripes(ctx context.Context, header *ShardHeader, sealer *stripeCipher, shards []io.Reader, w io.Writer, progress ProgressFunc) error {
+	fileHash := sha256.New()
+	if sealer != nil {
+		fileHash = sealer.newHash()
+	}
+
+	stripes := newStripeReader(header, shards)
+	if err := joinStripes(ctx, header, sealer, stripes, io.MultiWriter(w, fileHash), progress); err != nil {
+		return err
+	}
+
+	// openFileCipher already made sure an encrypted file's hash wasn't dropped
+	if header.FileHash != "" && hex.EncodeToString(fileHash.Sum(nil)) != header.FileHash {
+		return ErrFileHashMismatch
+	}
+
+	return nil
+}
+
+// joinStripes reads the stripes left in stripes, rebuilds them and writes
+// their file data to w. Every stripe is checked against the stripe hash in its
+// blocks, and for encrypted files against where the file ends: with a known
+// length the last stripe has to be sealed as such, without one the stripes
+// have to run out right after the one sealed as last.
+func joinStripes(ctx context.Context, header *ShardHeader, sealer *stripeCipher, stripes *stripeReader, w io.Writer, progress ProgressFunc) error {
+	codec, err := redundancyFor(header)
+	if err != nil {
+		return err
+	}
+
+	stripeHash := sha256.New()
+	if sealer != nil {
+		stripeHash = sealer.newHash()
+	}
+	counter := &countingWriter{}
+	out := io.MultiWriter(w, counter, stripeHash)
+	var joined bytes.Buffer
+	sawLast := false
+
+	first := stripes.stripe
+	for {
+		if progress != nil && stripes.stripe > first {
+			progress(Progress{Bytes: counter.n, Stripe: stripes.stripe - 1, Total: header.FileLength})
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		blocks, record, err := stripes.next()
+		if err == io.EOF {
+			if sealer != nil && stripes.fileStripes < 0 && !sawLast {
+				return fmt.Errorf("stripe %d: %w: the file ends before its last stripe", stripes.stripe, ErrStripeAuth)
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if sawLast {
+			return fmt.Errorf("stripe %d: %w: the file goes on past its last stripe", stripes.stripe-1, ErrStripeAuth)
+		}
+
+		if !codec.CanReconstruct(blocks) {
+			return fmt.Errorf("%w: stripe %d has only %d of %d blocks", ErrTooFewShards, stripes.stripe-1, countBlocks(blocks), len(blocks))
+		}
+
+		if err := codec.ReconstructData(blocks); err != nil {
+			return err
+		}
+
+		stripeHash.Reset()
+		if sealer == nil && header.Compression == "" {
+			if err := codec.Join(out, blocks, record.dataLen); err != nil {
+				return err
+			}
+		} else {
+			joined.Reset()
+			if err := codec.Join(&joined, blocks, record.dataLen); err != nil {
+				return err
+			}
+			stripe := joined.Bytes()
+			if sealer != nil {
+				stripe, sawLast, err = openStripe(sealer, stripe, stripes.stripe-1, record.generation, stripes.fileStripes)
+				if err != nil {
+					return fmt.Errorf("stripe %d: %w", stripes.stripe-1, err)
+				}
+			}
+			if header.Compression != "" {
+				stripe, err = decompressStripe(stripe, header.StripeSize)
+				if err != nil {
+					return fmt.Errorf("stripe %d: %w", stripes.stripe-1, err)
+				}
+			}
+			if _, err := out.Write(stripe); err != nil {
+				return err
+			}
+		}
+
+		if !bytes.Equal(stripeHash.Sum(nil), record.stripeHash[:]) {
+			return fmt.Errorf("stripe %d: %w", stripes.stripe-1, ErrFileHashMismatch)
+		}
+	}
+
+	return nil
+}
+
+// openStripe opens a sealed stripe and reports whether it was sealed as the
+// file's last. With the number of stripes in the file known only that one may
+// be, otherwise the stripe is opened either way.
+func openStripe(sealer *stripeCipher, sealed []byte, stripe int, generation uint32, fileStripes int) ([]byte, bool, error) {
+	if fileStripes >= 0 {
+		last := stripe == fileStripes-1
+		opened, err := sealer.open(sealed[:0], sealed, stripe, generation, last)
+		return opened, last, err
+	}
+
+	// a failed open leaves sealed as it was
+	if opened, err := sealer.open(nil, sealed, stripe, generation, false); err == nil {
+		return opened, false, nil
+	}
+	opened, err := sealer.open(sealed[:0], sealed, stripe, generation, true)
+	return opened, true, err
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// stripeReader reads the blocks of a file's shards one stripe at a time
+type stripeReader struct {
+	header *ShardHeader
+	// shards is indexed by shard index, a shard is set to nil once it can't be read anymore
+	shards []io.Reader
+	// stripe is the index of the next stripe and stripeCount the index to
+	// stop at. fileStripes is how many stripes the file has. Both are -1 when
+	// the file length isn't known.
+	stripe      int
+	stripeCount int
+	fileStripes int
+}
+
+func newStripeReader(header *ShardHeader, shards []io.Reader) *stripeReader {
+	stripeCount := -1
+	if header.FileLength >= 0 {
+		stripeSize := int64(header.StripeSize)
+		stripeCount = int((header.FileLength + stripeSize - 1) / stripeSize)
+	}
+
+	return &stripeReader{
+		header:      header,
+		shards:      append([]io.Reader(nil), shards...),
+		stripeCount: stripeCount,
+		fileStripes: stripeCount,
+	}
+}
+
+// next reads the next stripe. The returned blocks are indexed by shard index and
+// nil for shards that are missing or whose block is corrupt. record is what the
+// blocks' records say about the stripe. It returns io.EOF after the last stripe.
+func (s *stripeReader) next() ([][]byte, blockMeta, error) {
+	if s.stripe == s.stripeCount {
+		return nil, blockMeta{}, io.EOF
+	}
+
+	type shardResult struct {
+		index  int
+		block  []byte
+		record blockMeta
+		err    error
+	}
+
+	shardResults := make(chan shardResult, len(s.shards))
+	blocks := make([][]byte, len(s.shards))
+	var shardReaders sync.WaitGroup
+
+	for index, reader := range s.shards {
+		if reader == nil {
+			continue
+		}
+
+		shardReaders.Add(1)
+		go func(index int, reader io.Reader) {
+			defer shardReaders.Done()
+			block, record, err := readBlock(reader, s.header.BlockSize)
+			shardResults <- shardResult{index: index, block: block, record: record, err: err}
+		}(index, reader)
+	}
+
+	go func() {
+		shardReaders.Wait()
+		close(shardResults)
+	}()
+
+	var readCount, endedCount int
+	var record blockMeta
+	for res := range shardResults {
+		readCount++
+		switch {
+		case res.err == nil:
+			if countBlocks(blocks) == 0 {
+				record = res.record
+			}
+			blocks[res.index] = res.block
+		case errors.Is(res.err, ErrCorruptBlock):
+			// only this block is bad, the next one might still be fine
+		case res.err == io.EOF:
+			endedCount++
+			s.shards[res.index] = nil
+		default:
+			s.shards[res.index] = nil
+		}
+	}
+
+	// without a known length the file ends once every shard runs out
+	if s.stripeCount < 0 && readCount == endedCount {
+		return nil, blockMeta{}, io.EOF
+	}
+
+	s.stripe++
+	return blocks, record, nil
+}
+
+// countBlocks returns how many blocks of a stripe are present
+func countBlocks(blocks [][]byte) int {
+	count := 0
+	for _, block := range blocks {
+		if block != nil {
+			count++
+		}
+	}
+	return count
+}
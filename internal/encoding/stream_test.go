@@ -0,0 +1,280 @@
+package encoding
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// encodeToBuffers encodes data with enc and returns the raw bytes of every shard
+func encodeToBuffers(t *testing.T, enc *Encoder, data []byte, meta FileMeta) [][]byte {
+	t.Helper()
+
+	buffers := make([]*bytes.Buffer, enc.shards+enc.parity)
+	writers := make([]io.Writer, len(buffers))
+	for i := range buffers {
+		buffers[i] = &bytes.Buffer{}
+		writers[i] = buffers[i]
+	}
+
+	if err := enc.EncodeStream(bytes.NewReader(data), writers, meta); err != nil {
+		t.Fatalf("EncodeStream failed: %v", err)
+	}
+
+	shards := make([][]byte, len(buffers))
+	for i := range buffers {
+		shards[i] = buffers[i].Bytes()
+	}
+	return shards
+}
+
+func shardReaders(shards [][]byte) []io.Reader {
+	readers := make([]io.Reader, len(shards))
+	for i, shard := range shards {
+		if shard != nil {
+			readers[i] = bytes.NewReader(shard)
+		}
+	}
+	return readers
+}
+
+// newTestEncoder makes an encoder with options that reads and writes temp folders
+func newTestEncoder(t *testing.T, dataShards int, parityShards int, options *EncoderOptions) *Encoder {
+	t.Helper()
+
+	enc, err := NewEncoderWithOptions(dataShards, parityShards, t.TempDir(), t.TempDir(), options)
+	if err != nil {
+		t.Fatalf("failed to create encoder: %v", err)
+	}
+	return enc
+}
+
+// encodeTestFile encodes data as name with options straight into the
+// encoder's IN folder and returns the encoder along with the shard folder
+func encodeTestFile(t *testing.T, name string, data []byte, options *EncoderOptions) (*Encoder, string) {
+	t.Helper()
+
+	tmpOut := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tmpOut, ".bin"), 0755); err != nil {
+		t.Fatalf("failed to make .bin dir: %v", err)
+	}
+	enc, err := NewEncoderWithOptions(4, 2, tmpOut, filepath.Join(tmpOut, ".bin"), options)
+	if err != nil {
+		t.Fatalf("failed to create encoder: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(tmpOut, name), data, 0644); err != nil {
+		t.Fatalf("failed to write input file: %v", err)
+	}
+	if err := enc.EncodeFile(name); err != nil {
+		t.Fatalf("EncodeFile failed: %v", err)
+	}
+	return enc, filepath.Join(tmpOut, ".bin", name)
+}
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	return data
+}
+
+func TestStream_RoundTripWithMissingShard(t *testing.T) {
+	enc, err := NewEncoder(4, 2, t.TempDir(), t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create encoder: %v", err)
+	}
+	enc.blockSize = 1024
+
+	// a bit over two stripes so the last one is padded
+	data := testData(2*4*1024 + 100)
+	shards := encodeToBuffers(t, enc, data, FileMeta{Name: "data.bin", Size: -1})
+	shards[1] = nil
+	shards[4] = nil
+
+	var out bytes.Buffer
+	if err := enc.DecodeStream(shardReaders(shards), &out); err != nil {
+		t.Fatalf("DecodeStream failed: %v", err)
+	}
+
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Fatalf("decoded %d bytes do not match the %d original bytes", out.Len(), len(data))
+	}
+}
+
+func TestStream_WrongShardCount(t *testing.T) {
+	enc, err := NewEncoder(4, 2, t.TempDir(), t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create encoder: %v", err)
+	}
+
+	if err := enc.EncodeStream(bytes.NewReader(nil), make([]io.Writer, 3), FileMeta{Size: -1}); err == nil {
+		t.Error("expected error for wrong number of shard writers")
+	}
+	if err := enc.DecodeStream(make([]io.Reader, 3), io.Discard); !errors.Is(err, ErrTooFewShards) {
+		t.Errorf("expected ErrTooFewShards without any shards, got %v", err)
+	}
+}
+
+func TestStream_EmptyInput(t *testing.T) {
+	enc, err := NewEncoder(2, 1, t.TempDir(), t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create encoder: %v", err)
+	}
+
+	shards := encodeToBuffers(t, enc, nil, FileMeta{Name: "empty", Size: 0})
+
+	var out bytes.Buffer
+	if err := enc.DecodeStream(shardReaders(shards), &out); err != nil {
+		t.Fatalf("DecodeStream failed: %v", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("expected no output, got %d bytes", out.Len())
+	}
+}
+
+// failingWriter fails every write after the first n
+type failingWriter struct {
+	n int
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if f.n <= 0 {
+		return 0, errors.New("disk full")
+	}
+	f.n--
+	return len(p), nil
+}
+
+func TestEncodeStream_WriterErrorIsReturned(t *testing.T) {
+	enc, err := NewEncoder(4, 2, t.TempDir(), t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create encoder: %v", err)
+	}
+	enc.blockSize = 512
+
+	writers := make([]io.Writer, 6)
+	for i := range writers {
+		writers[i] = io.Discard
+	}
+	// header and two blocks make it, then the disk fills up
+	writers[3] = &failingWriter{n: 3}
+
+	data := testData(10000)
+	err = enc.EncodeStream(bytes.NewReader(data), writers, FileMeta{Name: "data.bin", Size: int64(len(data))})
+	if err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Errorf("expected the writer error, got %v", err)
+	}
+}
+
+func TestStreamContext_Progress(t *testing.T) {
+	enc, err := NewEncoder(4, 2, t.TempDir(), t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create encoder: %v", err)
+	}
+	enc.blockSize = 512
+
+	data := testData(10000)
+	buffers := make([]bytes.Buffer, 6)
+	writers := make([]io.Writer, len(buffers))
+	for i := range buffers {
+		writers[i] = &buffers[i]
+	}
+
+	var encodeProgress []Progress
+	err = enc.EncodeStreamContext(context.Background(), bytes.NewReader(data), writers, FileMeta{Name: "data.bin", Size: int64(len(data))}, func(p Progress) {
+		encodeProgress = append(encodeProgress, p)
+	})
+	if err != nil {
+		t.Fatalf("EncodeStreamContext failed: %v", err)
+	}
+
+	// 2048 bytes per stripe
+	if len(encodeProgress) != 5 {
+		t.Fatalf("expected 5 progress reports, got %d", len(encodeProgress))
+	}
+	for i, p := range encodeProgress {
+		if p.Stripe != i || p.Total != int64(len(data)) || p.Bytes != min(int64(i+1)*2048, int64(len(data))) {
+			t.Errorf("unexpected progress report %d: %+v", i, p)
+		}
+	}
+
+	shards := make([][]byte, len(buffers))
+	for i := range buffers {
+		shards[i] = buffers[i].Bytes()
+	}
+
+	var decodeProgress []Progress
+	err = enc.DecodeStreamContext(context.Background(), shardReaders(shards), io.Discard, func(p Progress) {
+		decodeProgress = append(decodeProgress, p)
+	})
+	if err != nil {
+		t.Fatalf("DecodeStreamContext failed: %v", err)
+	}
+	if !reflect.DeepEqual(decodeProgress, encodeProgress) {
+		t.Errorf("expected decode progress %+v, got %+v", encodeProgress, decodeProgress)
+	}
+}
+
+func TestFileContext_CancelRemovesPartialOutput(t *testing.T) {
+	tmpOut := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tmpOut, ".bin"), 0755); err != nil {
+		t.Fatalf("failed to make .bin dir: %v", err)
+	}
+	enc, err := NewEncoder(4, 2, tmpOut, filepath.Join(tmpOut, ".bin"))
+	if err != nil {
+		t.Fatalf("failed to create encoder: %v", err)
+	}
+	enc.blockSize = 512
+
+	data := testData(10000)
+	if err := os.WriteFile(filepath.Join(tmpOut, "data.bin"), data, 0644); err != nil {
+		t.Fatalf("failed to write input file: %v", err)
+	}
+
+	encodeCtx, cancelEncode := context.WithCancel(context.Background())
+	defer cancelEncode()
+
+	err = enc.EncodeFileContext(encodeCtx, "data.bin", func(Progress) { cancelEncode() })
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	entries, err := os.ReadDir(filepath.Join(tmpOut, ".bin", "data.bin"))
+	if err != nil {
+		t.Fatalf("failed to read shard dir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected no shards left after cancelling, found %d files", len(entries))
+	}
+
+	if err := enc.EncodeFile("data.bin"); err != nil {
+		t.Fatalf("EncodeFile failed: %v", err)
+	}
+	if err := os.Remove(filepath.Join(tmpOut, "data.bin")); err != nil {
+		t.Fatalf("failed to remove input file: %v", err)
+	}
+
+	decodeCtx, cancelDecode := context.WithCancel(context.Background())
+	defer cancelDecode()
+
+	err = enc.DecodeShardsContext(decodeCtx, "data.bin", func(Progress) { cancelDecode() })
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	entries, err = os.ReadDir(tmpOut)
+	if err != nil {
+		t.Fatalf("failed to read out dir: %v", err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != ".bin" && entry.Name() != ".roots" {
+			t.Errorf("expected no partial output after cancelling, found %s", entry.Name())
+		}
+	}
+}
@@ -2,6 +2,7 @@ package p2p
 
 import (
 	"context"
+	"crypto/ecdsa"
 	"fmt"
 	"net"
 	"sync"
@@ -12,8 +13,10 @@ import (
 
 // Client represents a STUN client
 type Client struct {
+	// id is the fingerprint of key, the server knows the client by it
 	id               string
-	serverAddr       *net.UDPAddr
+	key              *ecdsa.PrivateKey
+	publicKey        string
 	serverConn       *net.UDPConn
 	state            ClientState
 	peers            map[string]*PeerInfo
@@ -24,6 +27,34 @@ type Client struct {
 	peerCallbacks    []func(*PeerInfo)
 	errorCallbacks   []func(error)
 	messageCallbacks []func([]byte)
+
+	// bindings holds the STUN Binding requests waiting on a response
+	bindings   map[api.TransactionID]chan *net.UDPAddr
+	publicAddr *net.UDPAddr
+
+	// relays holds the relay requests waiting on an allocation, by peer address
+	relays       map[string]chan *net.UDPAddr
+	punchTimeout time.Duration
+
+	// term is the highest leader term heard from the server, assignments from
+	// older terms come from a stale leader and are rejected
+	term uint
+	// leaderID is the peer the server paired this member with, empty on the leader
+	leaderID     string
+	pingInterval time.Duration
+
+	// networkID and joinSecret name the network to register into
+	networkID  string
+	joinSecret string
+
+	// serverAddrs are the servers to fail over between, serverAddr is the
+	// one in use and lastServerReply when it was last heard from. They have
+	// their own lock since messages are sent to the server under c.mutex.
+	serverMutex     sync.Mutex
+	serverAddrs     []*net.UDPAddr
+	serverIndex     int
+	serverAddr      *net.UDPAddr
+	lastServerReply time.Time
 }
 
 // ClientConfig holds client configuration
@@ -31,6 +62,19 @@ type ClientConfig struct {
 	ServerAddress  string
 	PingInterval   time.Duration
 	ConnectTimeout time.Duration
+	// PunchTimeout is how long a peer has to answer hole punching before the
+	// client asks the server to relay instead, 0 never falls back to the relay
+	PunchTimeout time.Duration
+	// Key identifies the client to the server, a new one is generated if it is nil
+	Key *ecdsa.PrivateKey
+	// NetworkID is the network to register into, empty for the server's default
+	// one. JoinSecret has to match the secret the network was created with.
+	NetworkID  string
+	JoinSecret string
+
+	// ServerAddresses are the servers of a high-availability pair, tried in
+	// order, ServerAddress is used when it is empty
+	ServerAddresses []string
 }
 
 // DefaultClientConfig returns default client configuration
@@ -39,6 +83,7 @@ func DefaultClientConfig(serverAddr string) *ClientConfig {
 		ServerAddress:  serverAddr,
 		PingInterval:   10 * time.Second,
 		ConnectTimeout: 30 * time.Second,
+		PunchTimeout:   5 * time.Second,
 	}
 }
 
@@ -48,15 +93,47 @@ func NewClient(config *ClientConfig) (*Client, error) {
 		return nil, fmt.Errorf("config cannot be nil")
 	}
 
-	serverAddr, err := net.ResolveUDPAddr("udp", config.ServerAddress)
+	addresses := config.ServerAddresses
+	if len(addresses) == 0 {
+		addresses = []string{config.ServerAddress}
+	}
+	serverAddrs := make([]*net.UDPAddr, 0, len(addresses))
+	for _, address := range addresses {
+		serverAddr, err := net.ResolveUDPAddr("udp", address)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve server address: %w", err)
+		}
+		serverAddrs = append(serverAddrs, serverAddr)
+	}
+
+	pingInterval := config.PingInterval
+	if pingInterval <= 0 {
+		pingInterval = 10 * time.Second
+	}
+
+	var err error
+	key := config.Key
+	if key == nil {
+		key, err = api.GenerateKey()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate key: %w", err)
+		}
+	}
+	publicKey, err := api.EncodePublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode public key: %w", err)
+	}
+	id, err := api.Fingerprint(&key.PublicKey)
 	if err != nil {
-		return nil, fmt.Errorf("failed to resolve server address: %w", err)
+		return nil, fmt.Errorf("failed to fingerprint public key: %w", err)
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 
 	return &Client{
-		serverAddr:       serverAddr,
+		id:               id,
+		key:              key,
+		publicKey:        publicKey,
 		state:            StateDisconnected,
 		peers:            make(map[string]*PeerInfo),
 		ctx:              ctx,
@@ -65,6 +142,14 @@ func NewClient(config *ClientConfig) (*Client, error) {
 		peerCallbacks:    make([]func(*PeerInfo), 0),
 		errorCallbacks:   make([]func(error), 0),
 		messageCallbacks: make([]func([]byte), 0),
+		bindings:         make(map[api.TransactionID]chan *net.UDPAddr),
+		relays:           make(map[string]chan *net.UDPAddr),
+		punchTimeout:     config.PunchTimeout,
+		pingInterval:     pingInterval,
+		networkID:        config.NetworkID,
+		joinSecret:       config.JoinSecret,
+		serverAddrs:      serverAddrs,
+		serverAddr:       serverAddrs[0],
 	}, nil
 }
 
@@ -75,6 +160,13 @@ func (c *Client) GetState() ClientState {
 	return c.state
 }
 
+// GetTerm returns the highest leader term heard from the server
+func (c *Client) GetTerm() uint {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.term
+}
+
 func (c *Client) GetID() string {
 	c.mutex.RLock()
 	defer c.mutex.RUnlock()
@@ -102,7 +194,16 @@ func (c *Client) GetPeerById(id string) *PeerInfo {
 
 // register sends registration message to server
 func (c *Client) register() error {
-	msg := api.NewClientRegisterMessage()
+	msg := api.NewNetworkRegisterMessage(c.publicKey, c.networkID, c.joinSecret)
+	return c.sendToServer(msg)
+}
+
+// sendSignedToServer signs a message with the client's key before sending it,
+// for messages the server only accepts from the client itself
+func (c *Client) sendSignedToServer(msg *api.Message) error {
+	if err := msg.SignWith(c.key); err != nil {
+		return fmt.Errorf("failed to sign message: %w", err)
+	}
 	return c.sendToServer(msg)
 }
 
@@ -113,7 +214,7 @@ func (c *Client) sendToServer(msg *api.Message) error {
 		return fmt.Errorf("failed to serialize message: %w", err)
 	}
 
-	_, err = c.serverConn.WriteToUDP(data, c.serverAddr)
+	_, err = c.serverConn.WriteToUDP(data, c.server())
 	if err != nil {
 		return fmt.Errorf("failed to send message to server: %w", err)
 	}
@@ -143,8 +244,13 @@ func (c *Client) handleMessages() {
 		}
 
 		// Route message based on sender address
-		if fromAddr.String() == c.serverAddr.String() {
+		if fromAddr.String() == c.server().String() {
 			// Message from server - process as server message
+			c.heardFromServer()
+			if api.IsSTUNMessage(buffer[:n]) {
+				c.processBindingResponse(buffer[:n])
+				continue
+			}
 			c.processServerMessage(buffer[:n])
 		} else {
 			// Message from peer - route to peer message channel
@@ -255,12 +361,22 @@ func (c *Client) processMessage(msg *api.Message) {
 		c.setState(StateWaiting)
 
 	case api.AssignedAsLeader:
-		_, err := msg.GetAssignedAsLeaderData()
+		data, err := msg.GetAssignedAsLeaderData()
 		if err != nil {
 			c.notifyError(fmt.Errorf("Failed to parse assigned as leader: %w", err))
 			return
 		}
+
+		c.mutex.Lock()
+		if data.Term < c.term {
+			c.mutex.Unlock()
+			c.notifyError(fmt.Errorf("ignoring leader assignment for stale term %d, current term is %d", data.Term, c.term))
+			return
+		}
+		c.term = data.Term
+		c.leaderID = ""
 		c.setState(StateLeader)
+		c.mutex.Unlock()
 
 	case api.PeerAssignment:
 		data, err := msg.GetPeerAssignmentData()
@@ -281,8 +397,25 @@ func (c *Client) processMessage(msg *api.Message) {
 		}
 
 		c.mutex.Lock()
-		c.peers[data.PeerID] = peerInfo
+		if data.Term < c.term {
+			c.mutex.Unlock()
+			c.notifyError(fmt.Errorf("rejecting peer %s assigned in stale term %d, current term is %d", data.PeerID, data.Term, c.term))
+			return
+		}
 		state := c.state
+		// a leader hearing about a newer term has been replaced and joins as a member
+		if data.Term > c.term && state == StateLeader {
+			state = StatePaired
+		}
+		c.term = data.Term
+		c.peers[data.PeerID] = peerInfo
+		// members are only ever paired with their leader
+		if state != StateLeader {
+			if c.leaderID != "" && c.leaderID != data.PeerID {
+				delete(c.peers, c.leaderID)
+			}
+			c.leaderID = data.PeerID
+		}
 		c.mutex.Unlock()
 
 		if state != StateLeader {
@@ -292,7 +425,34 @@ func (c *Client) processMessage(msg *api.Message) {
 		c.notifyPeerAssigned(peerInfo)
 
 		if state == StateLeader {
-			c.leaderHandleJoiner(c.peers[data.PeerID])
+			c.leaderHandleJoiner(peerInfo)
+		}
+
+	case api.RelayAllocated:
+		data, err := msg.GetRelayAllocatedData()
+		if err != nil {
+			c.notifyError(fmt.Errorf("failed to parse relay allocation: %w", err))
+			return
+		}
+
+		relayAddr, err := net.ResolveUDPAddr("udp", data.RelayAddress)
+		if err != nil {
+			c.notifyError(fmt.Errorf("failed to resolve relay address: %w", err))
+			return
+		}
+		// a relay listening on every interface is reached the same way as the server
+		if relayAddr.IP.IsUnspecified() {
+			relayAddr.IP = c.server().IP
+		}
+
+		c.mutex.RLock()
+		response, ok := c.relays[data.PeerAddress]
+		c.mutex.RUnlock()
+		if ok {
+			select {
+			case response <- relayAddr:
+			default:
+			}
 		}
 
 	case api.ServerError:
@@ -304,6 +464,36 @@ func (c *Client) processMessage(msg *api.Message) {
 
 		c.notifyError(fmt.Errorf("server error [%s]: %s", data.ErrorCode, data.ErrorMessage))
 
+		switch data.ErrorCode {
+		case "STANDBY":
+			// the other server of the pair is the active one
+			c.failover()
+		case "NOT_MEMBER", "UNVERIFIED_ADDRESS":
+			// the server no longer knows this member or its address, a
+			// registration proves both again
+			if err := c.register(); err != nil {
+				c.notifyError(fmt.Errorf("failed to register again: %w", err))
+			}
+		}
+
+	case api.RegisterChallenge:
+		data, err := msg.GetRegisterChallengeData()
+		if err != nil {
+			c.notifyError(fmt.Errorf("failed to parse register challenge: %w", err))
+			return
+		}
+
+		// prove the key the registration named is ours, to this server only
+		// and for the address it sees us at
+		signature, err := api.SignChallenge(c.key, data.Nonce, c.server().String(), data.Address)
+		if err != nil {
+			c.notifyError(fmt.Errorf("failed to sign register challenge: %w", err))
+			return
+		}
+		if err := c.sendToServer(api.NewChallengeResponseMessage(data.Nonce, signature)); err != nil {
+			c.notifyError(fmt.Errorf("failed to answer register challenge: %w", err))
+		}
+
 	case api.RegisterSuccess:
 		data, err := msg.GetRegisterSuccessData()
 		if err != nil {
@@ -311,9 +501,11 @@ func (c *Client) processMessage(msg *api.Message) {
 			return
 		}
 
-		c.mutex.Lock()
-		c.id = data.ID
-		c.mutex.Unlock()
+		// server messages aren't signed, the ID has to be our key's fingerprint
+		if data.ID != c.GetID() {
+			c.notifyError(fmt.Errorf("server registered us as %s, expected %s", data.ID, c.GetID()))
+			return
+		}
 
 	default:
 		c.notifyError(fmt.Errorf("unknown message type: %s", msg.Type))
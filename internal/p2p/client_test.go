@@ -1,6 +1,7 @@
 package p2p
 
 import (
+	"crypto/ecdsa"
 	"fmt"
 	"net"
 	"strings"
@@ -89,6 +90,14 @@ func TestClientPairingWithServer(t *testing.T) {
 	if err := client1.ConnectToStun(); err != nil {
 		t.Fatalf("Failed to connect client 1: %v", err)
 	}
+	// registering takes a challenge, client 2 could otherwise finish first
+	deadline := time.Now().Add(5 * time.Second)
+	for client1.GetState() != StateLeader {
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for client 1 to lead")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
 	if err := client2.ConnectToStun(); err != nil {
 		t.Fatalf("Failed to connect client 2: %v", err)
 	}
@@ -114,14 +123,352 @@ func TestClientPairingWithServer(t *testing.T) {
 		t.Errorf("Expected client 2 to be paired, got: %v", client2.GetState())
 	}
 
-	if client1PeerInfo == nil || !strings.HasPrefix(client1PeerInfo.ID, "127.0.0.1:") {
+	// peers are known by the fingerprint of their key
+	if client1PeerInfo == nil || client1PeerInfo.ID != client2.GetID() {
 		t.Fatalf("Expected valid peer info for client 1, got: %#v", client1PeerInfo)
 	}
-	if client2PeerInfo == nil || !strings.HasPrefix(client2PeerInfo.ID, "127.0.0.1:") {
+	if client2PeerInfo == nil || client2PeerInfo.ID != client1.GetID() {
 		t.Fatalf("Expected valid peer info for client 2, got: %#v", client2PeerInfo)
 	}
 }
 
+func TestClientDiscoverPublicAddress(t *testing.T) {
+	config := &stun.ServerConfig{
+		ListenAddress: "127.0.0.1:0",
+		ClientTimeout: 5 * time.Second,
+		EnableLogging: false,
+	}
+
+	server := stun.NewServer(config)
+	if err := server.Start(config); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer server.Stop()
+
+	serverAddr := server.GetConn().LocalAddr().(*net.UDPAddr)
+
+	client, err := NewClient(DefaultClientConfig(serverAddr.String()))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	if _, err := client.DiscoverPublicAddress(time.Second); err == nil {
+		t.Error("Expected an error discovering the address before connecting")
+	}
+
+	if err := client.ConnectToStun(); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.DisconnectFromStun()
+
+	addr, err := client.DiscoverPublicAddress(2 * time.Second)
+	if err != nil {
+		t.Fatalf("Failed to discover public address: %v", err)
+	}
+
+	// the server sees the same socket the client registered from
+	if addr.Port != client.serverConn.LocalAddr().(*net.UDPAddr).Port || !addr.IP.IsLoopback() {
+		t.Errorf("Expected a loopback address on the client's port, got %v", addr)
+	}
+	if got := client.GetPublicAddress(); got == nil || got.String() != addr.String() {
+		t.Errorf("Expected GetPublicAddress to return %v, got %v", addr, got)
+	}
+}
+
+func TestClientFallsBackToRelay(t *testing.T) {
+	serverConfig := &stun.ServerConfig{
+		ListenAddress:       "127.0.0.1:0",
+		ClientTimeout:       5 * time.Second,
+		EnableRelay:         true,
+		MaxRelayAllocations: 1,
+	}
+
+	server := stun.NewServer(serverConfig)
+	if err := server.Start(serverConfig); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer server.Stop()
+
+	serverAddr := server.GetConn().LocalAddr().(*net.UDPAddr)
+
+	config := DefaultClientConfig(serverAddr.String())
+	config.PunchTimeout = 300 * time.Millisecond
+	client, err := NewClient(config)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := client.ConnectToStun(); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.DisconnectFromStun()
+	deadline := time.Now().Add(5 * time.Second)
+	for client.GetState() != StateLeader {
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for the client to lead")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the peer is a bare socket that never answers anything sent to it directly,
+	// like a peer behind a symmetric NAT. The server only relays between members
+	// of one network, so it joins the client's
+	peerConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to open peer socket: %v", err)
+	}
+	defer peerConn.Close()
+	peerAddr := peerConn.LocalAddr().(*net.UDPAddr)
+	peerKey, peerID := registerBareSocket(t, peerConn, serverAddr, "")
+
+	if err := client.ConnectToPeer(&PeerInfo{ID: peerID, Address: peerAddr}); err != nil {
+		t.Fatalf("Failed to connect to peer: %v", err)
+	}
+
+	clientAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: client.serverConn.LocalAddr().(*net.UDPAddr).Port}
+
+	// keep asking until the client has asked too, skipping its punches and pings
+	buffer := make([]byte, 1024)
+	var relayAddr *net.UDPAddr
+	deadline = time.Now().Add(5 * time.Second)
+	for relayAddr == nil && time.Now().Before(deadline) {
+		msg := api.NewRelayRequestMessage(api.NewSignature(peerID), clientAddr)
+		if err := msg.SignWith(peerKey); err != nil {
+			t.Fatalf("Failed to sign relay request: %v", err)
+		}
+		request, err := msg.Serialize()
+		if err != nil {
+			t.Fatalf("Failed to serialize relay request: %v", err)
+		}
+		if _, err := peerConn.WriteToUDP(request, serverAddr); err != nil {
+			t.Fatalf("Failed to send relay request: %v", err)
+		}
+		peerConn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		for {
+			n, from, err := peerConn.ReadFromUDP(buffer)
+			if err != nil {
+				break
+			}
+			if from.String() != serverAddr.String() {
+				continue
+			}
+			msg, err := api.DeserializeMessage(buffer[:n])
+			if err != nil || msg.Type != api.RelayAllocated {
+				continue
+			}
+			data, _ := msg.GetRelayAllocatedData()
+			relayAddr, _ = net.ResolveUDPAddr("udp", data.RelayAddress)
+			break
+		}
+	}
+	if relayAddr == nil {
+		t.Fatal("Client never asked for a relay")
+	}
+
+	// answer the client's pings through the relay
+	pong, err := api.NewPeerPongMessage(api.NewSignature(peerID)).Serialize()
+	if err != nil {
+		t.Fatalf("Failed to serialize pong: %v", err)
+	}
+	peerConn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		n, from, err := peerConn.ReadFromUDP(buffer)
+		if err != nil {
+			t.Fatalf("No ping from the client through the relay: %v", err)
+		}
+		if from.String() != relayAddr.String() {
+			continue
+		}
+		if msg, err := api.DeserializeMessage(buffer[:n]); err == nil && msg.Type == api.PeerPing {
+			break
+		}
+	}
+	if _, err := peerConn.WriteToUDP(pong, relayAddr); err != nil {
+		t.Fatalf("Failed to send pong: %v", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	client.mutex.RLock()
+	peer := client.peers[peerID]
+	relayed, address, lastPong := peer.Relayed, peer.Address, peer.LastPeerPong
+	client.mutex.RUnlock()
+
+	if !relayed {
+		t.Error("Expected the peer to be marked as relayed")
+	}
+	if address.Port == peerAddr.Port {
+		t.Errorf("Expected the peer to be reached through the relay, still at %v", address)
+	}
+	if time.Since(lastPong) > time.Second {
+		t.Errorf("Expected the pong through the relay to be recorded, last pong %v ago", time.Since(lastPong))
+	}
+	if server.GetRelayAllocations() != 1 {
+		t.Errorf("Expected 1 relay allocation, got %d", server.GetRelayAllocations())
+	}
+}
+
+func TestMembersReelectAfterLeaderLost(t *testing.T) {
+	serverConfig := &stun.ServerConfig{
+		ListenAddress: "127.0.0.1:0",
+		ClientTimeout: 5 * time.Second,
+		PingInterval:  100 * time.Millisecond,
+		LeaseDuration: 5 * time.Second,
+	}
+
+	server := stun.NewServer(serverConfig)
+	if err := server.Start(serverConfig); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer server.Stop()
+
+	serverAddr := server.GetConn().LocalAddr().(*net.UDPAddr)
+
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(3 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timeout waiting for %s", what)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	// clients join one at a time so the first one is the leader
+	clients := make([]*Client, 3)
+	for i := range clients {
+		config := DefaultClientConfig(serverAddr.String())
+		config.PingInterval = 100 * time.Millisecond
+		config.PunchTimeout = 0
+		client, err := NewClient(config)
+		if err != nil {
+			t.Fatalf("Failed to create client %d: %v", i, err)
+		}
+		client.OnPeerAssigned(func(peer *PeerInfo) {
+			client.ConnectToPeer(peer)
+		})
+		if err := client.ConnectToStun(); err != nil {
+			t.Fatalf("Failed to connect client %d: %v", i, err)
+		}
+		defer client.DisconnectFromStun()
+		clients[i] = client
+
+		want := StateConnectedToPeer
+		if i == 0 {
+			want = StateLeader
+		}
+		waitFor(fmt.Sprintf("client %d to be %s", i, want), func() bool { return client.GetState() == want })
+	}
+	leader, members := clients[0], clients[1:]
+
+	leader.DisconnectFromStun()
+
+	// the first member to notice leads term 2 and the other is pointed at it
+	var newLeader, member *Client
+	waitFor("a member to take over", func() bool {
+		for i, m := range members {
+			if m.GetState() == StateLeader {
+				newLeader, member = m, members[1-i]
+				return true
+			}
+		}
+		return false
+	})
+	waitFor("the other member to follow the new leader", func() bool {
+		member.mutex.RLock()
+		defer member.mutex.RUnlock()
+		return member.leaderID == newLeader.GetID() && member.term == 2 && member.state == StateConnectedToPeer
+	})
+
+	if id, term := server.GetLeader(""); id != newLeader.GetID() || term != 2 {
+		t.Errorf("Expected %s to lead term 2 on the server, got %s in term %d", newLeader.GetID(), id, term)
+	}
+	if newLeader.GetTerm() != 2 {
+		t.Errorf("Expected the new leader to be in term 2, got %d", newLeader.GetTerm())
+	}
+}
+
+func TestClientFailsOver(t *testing.T) {
+	// each server has to know where the other replicates before it starts
+	reserve := func() string {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to find a free port: %v", err)
+		}
+		defer listener.Close()
+		return listener.Addr().String()
+	}
+	primaryReplication, standbyReplication := reserve(), reserve()
+
+	startServer := func(replicationAddress, peerAddress string, standby bool) *stun.Server {
+		config := &stun.ServerConfig{
+			ListenAddress:      "127.0.0.1:0",
+			ClientTimeout:      5 * time.Second,
+			ReplicationAddress: replicationAddress,
+			PeerAddress:        peerAddress,
+			ReplicationSecret:  "secret",
+			Standby:            standby,
+			HeartbeatInterval:  50 * time.Millisecond,
+			FailoverTimeout:    300 * time.Millisecond,
+		}
+		server := stun.NewServer(config)
+		if err := server.Start(config); err != nil {
+			t.Fatalf("Failed to start server: %v", err)
+		}
+		return server
+	}
+	standby := startServer(standbyReplication, primaryReplication, true)
+	defer standby.Stop()
+	primary := startServer(primaryReplication, standbyReplication, false)
+
+	standbyAddr := standby.GetConn().LocalAddr().(*net.UDPAddr)
+	primaryAddr := primary.GetConn().LocalAddr().(*net.UDPAddr)
+
+	waitFor := func(what string, timeout time.Duration, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(timeout)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timeout waiting for %s", what)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	// the standby is listed first, it turns the client away to the primary
+	config := DefaultClientConfig(standbyAddr.String())
+	config.ServerAddresses = []string{standbyAddr.String(), primaryAddr.String()}
+	config.PingInterval = 100 * time.Millisecond
+	client, err := NewClient(config)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := client.ConnectToStun(); err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer client.DisconnectFromStun()
+
+	waitFor("the client to lead through the primary", 3*time.Second, func() bool {
+		id, _ := primary.GetLeader("")
+		return client.GetState() == StateLeader && id == client.GetID()
+	})
+	if got := client.server().String(); got != primaryAddr.String() {
+		t.Fatalf("Expected the client to use the primary %s, got %s", primaryAddr, got)
+	}
+
+	primary.Stop()
+
+	waitFor("the client to lead through the standby", 5*time.Second, func() bool {
+		id, _ := standby.GetLeader("")
+		return client.server().String() == standbyAddr.String() && id == client.GetID()
+	})
+	if client.GetState() != StateLeader {
+		t.Errorf("Expected the client to still be leader, got %s", client.GetState())
+	}
+	if client.GetTerm() != 1 {
+		t.Errorf("Expected the client to keep term 1, got %d", client.GetTerm())
+	}
+}
+
 func TestClientStateTransitions(t *testing.T) {
 	client, err := NewClient(&ClientConfig{
 		ServerAddress: "127.0.0.1:65535",
@@ -448,6 +795,76 @@ func TestPeerMessageProcessing(t *testing.T) {
 	}
 }
 
+func TestClientRejectsStaleTerms(t *testing.T) {
+	client, err := NewClient(DefaultClientConfig("127.0.0.1:3478"))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	errs := make(chan error, 4)
+	client.OnError(func(err error) { errs <- err })
+
+	leaderAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:5678")
+	newLeaderAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:5679")
+
+	client.processMessage(api.NewServerAssignedLeaderMessage(3, time.Minute))
+	if client.GetState() != StateLeader || client.GetTerm() != 3 {
+		t.Fatalf("Expected to lead term 3, got %s in term %d", client.GetState(), client.GetTerm())
+	}
+
+	// nothing from an older term is accepted
+	client.processMessage(api.NewPeerAssignmentMessage(leaderAddr, "old-leader", 2))
+	if client.GetPeerById("old-leader") != nil {
+		t.Error("Expected a peer assigned in a stale term to be rejected")
+	}
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), "stale term") {
+			t.Errorf("Expected a stale term error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the stale assignment to be reported")
+	}
+
+	client.processMessage(api.NewServerAssignedLeaderMessage(2, time.Minute))
+	if client.GetTerm() != 3 {
+		t.Errorf("Expected a stale leader assignment to be ignored, term is %d", client.GetTerm())
+	}
+
+	// a newer term means someone else leads now
+	client.processMessage(api.NewPeerAssignmentMessage(newLeaderAddr, "new-leader", 4))
+	if client.GetState() != StatePaired || client.GetTerm() != 4 {
+		t.Errorf("Expected to be paired in term 4, got %s in term %d", client.GetState(), client.GetTerm())
+	}
+	if client.GetPeerById("new-leader") == nil {
+		t.Error("Expected the new leader to be added as a peer")
+	}
+}
+
+func TestClientRejectsForeignRegistration(t *testing.T) {
+	client, err := NewClient(DefaultClientConfig("127.0.0.1:3478"))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	errs := make(chan error, 1)
+	client.OnError(func(err error) { errs <- err })
+
+	id := client.GetID()
+	client.processMessage(api.NewRegisterSuccessMessage("Registered", "someone-else"))
+	if client.GetID() != id {
+		t.Errorf("Expected to stay %s, got %s", id, client.GetID())
+	}
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), "registered us as someone-else") {
+			t.Errorf("Expected a registration mismatch error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the foreign registration to be reported")
+	}
+}
+
 func TestEdgeCasesAndErrorScenarios(t *testing.T) {
 	if _, err := NewClient(nil); err == nil {
 		t.Error("Expected error when creating client with nil config")
@@ -495,3 +912,63 @@ func TestEdgeCasesAndErrorScenarios(t *testing.T) {
 	client.processServerMessage([]byte("{invalid json"))
 	client.processMessage(&api.Message{Type: api.MessageType("unknown_type")})
 }
+
+// registerBareSocket registers conn with the server in networkID and returns
+// its key and ID, the server only sends registered addresses replies larger
+// than their requests
+func registerBareSocket(t *testing.T, conn *net.UDPConn, serverAddr *net.UDPAddr, networkID string) (*ecdsa.PrivateKey, string) {
+	t.Helper()
+
+	key, err := api.GenerateKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	publicKey, err := api.EncodePublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to encode public key: %v", err)
+	}
+	id, err := api.Fingerprint(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to fingerprint key: %v", err)
+	}
+
+	send := func(msg *api.Message) {
+		t.Helper()
+		data, err := msg.Serialize()
+		if err != nil {
+			t.Fatalf("Failed to serialize %s: %v", msg.Type, err)
+		}
+		if _, err := conn.WriteToUDP(data, serverAddr); err != nil {
+			t.Fatalf("Failed to send %s: %v", msg.Type, err)
+		}
+	}
+	receive := func() *api.Message {
+		t.Helper()
+		buffer := make([]byte, 1024)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := conn.Read(buffer)
+		if err != nil {
+			t.Fatalf("Failed to read from server: %v", err)
+		}
+		msg, err := api.DeserializeMessage(buffer[:n])
+		if err != nil {
+			t.Fatalf("Failed to deserialize message: %v", err)
+		}
+		return msg
+	}
+
+	send(api.NewNetworkRegisterMessage(publicKey, networkID, ""))
+	challenge, err := receive().GetRegisterChallengeData()
+	if err != nil {
+		t.Fatalf("Expected a register challenge: %v", err)
+	}
+	signature, err := api.SignChallenge(key, challenge.Nonce, serverAddr.String(), challenge.Address)
+	if err != nil {
+		t.Fatalf("Failed to sign challenge: %v", err)
+	}
+	send(api.NewChallengeResponseMessage(challenge.Nonce, signature))
+	if msg := receive(); msg.Type != api.RegisterSuccess {
+		t.Fatalf("Expected RegisterSuccess, got %s", msg.Type)
+	}
+	return key, id
+}
@@ -10,32 +10,42 @@ managing the network connection between peers goes here. NOT CODE THAT USES THAT
 
 import (
 	"fmt"
+	"net"
 	"time"
 
 	"github.com/hcp-uw/mosaic/internal/api"
 )
 
+// punchPingInterval is how often a peer is pinged while waiting on its first pong
+const punchPingInterval = 250 * time.Millisecond
+
 // sendPeerPing sends a ping message to the connected peer
 func (c *Client) sendPeerPing(id string) error {
 	c.mutex.RLock()
 	peerInfo := c.GetPeerById(id)
+	var peerConn *net.UDPConn
+	var peerAddr *net.UDPAddr
+	if peerInfo != nil {
+		peerConn, peerAddr = peerInfo.Conn, peerInfo.Address
+	}
+	sign := api.NewSignature(c.id)
 	c.mutex.RUnlock()
 
 	if peerInfo == nil {
 		return fmt.Errorf("peer not found")
 	}
 
-	if peerInfo.Conn == nil {
+	if peerConn == nil {
 		return fmt.Errorf("not connected to peer")
 	}
 
-	msg := api.NewPeerPingMessage(api.NewSignature(c.id))
+	msg := api.NewPeerPingMessage(sign)
 	data, err := msg.Serialize()
 	if err != nil {
 		return fmt.Errorf("failed to serialize peer ping: %w", err)
 	}
 
-	_, err = peerInfo.Conn.WriteToUDP(data, peerInfo.Address)
+	_, err = peerConn.WriteToUDP(data, peerAddr)
 	if err != nil {
 		return fmt.Errorf("failed to send peer ping: %w", err)
 	}
@@ -75,9 +85,40 @@ func (c *Client) sendPeerPong(peerId string) error {
 	return nil
 }
 
+// awaitPeerPong pings a peer until it pongs or timeout passes and reports
+// whether it did
+func (c *Client) awaitPeerPong(peerID string, timeout time.Duration) bool {
+	start := time.Now()
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(punchPingInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.sendPeerPing(peerID); err != nil {
+			c.notifyError(fmt.Errorf("failed to send peer ping: %w", err))
+		}
+
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			return false
+		case <-c.ctx.Done():
+			return false
+		}
+
+		c.mutex.RLock()
+		peerInfo := c.GetPeerById(peerID)
+		answered := peerInfo != nil && peerInfo.LastPeerPong.After(start)
+		c.mutex.RUnlock()
+		if answered {
+			return true
+		}
+	}
+}
+
 // pingRoutine sends periodic ping messages to keep connection alive
 func (c *Client) pingRoutine(id string) {
-	ticker := time.NewTicker(10 * time.Second)
+	ticker := time.NewTicker(c.pingInterval)
 	defer ticker.Stop()
 
 	for {
@@ -87,7 +128,12 @@ func (c *Client) pingRoutine(id string) {
 		case <-ticker.C:
 			c.mutex.RLock()
 			state := c.state
-			peerInfo := c.GetPeerById(id)
+			leaderID := c.leaderID
+			peerInfo := c.GetPeerById(leaderID)
+			var lastPong time.Time
+			if peerInfo != nil {
+				lastPong = peerInfo.LastPeerPong
+			}
 			c.mutex.RUnlock()
 
 			if state == StateDisconnected {
@@ -98,38 +144,48 @@ func (c *Client) pingRoutine(id string) {
 			if state == StateConnecting || state == StateWaiting || state == StateLeader {
 
 				msg := api.NewClientPingMessage(api.NewSignature(c.id))
-				if err := c.sendToServer(msg); err != nil {
+				if err := c.sendSignedToServer(msg); err != nil {
 					c.notifyError(fmt.Errorf("failed to send server ping: %w", err))
 				}
+
+				// pings aren't answered, the probe is
+				if c.probeServer(3 * c.pingInterval) {
+					c.failover()
+				}
 			}
 
-			// Send peer pings when connected to peer
+			// Members ping their leader when connected to it
 			if state == StateConnectedToPeer && peerInfo != nil {
-				// Check for peer timeout (30 seconds without pong)
-
-				if time.Since(peerInfo.LastPeerPong) > 30*time.Second {
-					// Clear peer info and re-register with server
-					c.mutex.Lock()
-					delete(c.peers, peerInfo.ID)
-					peerInfo = nil
-					if len(c.GetConnectedPeers()) == 0 {
-						c.setState(StateWaiting)
-						if err := c.register(); err != nil {
-							c.notifyError(fmt.Errorf("failed to re-register after peer timeout: %w", err))
-						} else {
-							c.notifyError(fmt.Errorf("peer connection timeout - re-registered with server"))
-						}
+				// Check for leader timeout (three pings without a pong)
+				if time.Since(lastPong) > 3*c.pingInterval {
+					// The server dropped us when we were paired, it has to hear
+					// about the lost leader to pair us with the next one
+					if err := c.reportLeaderLost(leaderID); err != nil {
+						c.notifyError(fmt.Errorf("failed to report lost leader: %w", err))
+					} else {
+						c.notifyError(fmt.Errorf("leader %s timed out - reported to server", leaderID))
 					}
-					c.mutex.Unlock()
-
-					// Re-register with server since we were removed when paired
 					continue
 				}
 
-				if err := c.sendPeerPing(c.id); err != nil {
+				if err := c.sendPeerPing(leaderID); err != nil {
 					c.notifyError(fmt.Errorf("failed to send peer ping: %w", err))
 				}
 			}
 		}
 	}
 }
+
+// reportLeaderLost forgets the leader and sends LeaderLost to the server,
+// which answers with a new leader or makes this client the leader
+func (c *Client) reportLeaderLost(leaderID string) error {
+	c.mutex.Lock()
+	delete(c.peers, leaderID)
+	c.leaderID = ""
+	term := c.term
+	sign := api.NewSignature(c.id)
+	c.setState(StateWaiting)
+	c.mutex.Unlock()
+
+	return c.sendSignedToServer(api.NewLeaderLostMessage(sign, c.publicKey, c.networkID, c.joinSecret, leaderID, term))
+}
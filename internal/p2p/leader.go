@@ -10,14 +10,17 @@ func (c *Client) leaderHandleJoiner(joiner *PeerInfo) {
 
 	currentMembers := make(map[string]*net.UDPAddr)
 
+	c.mutex.RLock()
 	for id, info := range c.peers {
 		if info.ID != joiner.ID {
 			currentMembers[id] = info.Address
 		}
 	}
+	joinerAddr := joiner.Address
+	c.mutex.RUnlock()
 
 	currentMembersMsg := api.NewCurrentMembersMessage(currentMembers, c.id)
-	newJoinerMsg := api.NewNewPeerJoinerMessage(c.id, joiner.ID, joiner.Address.String())
+	newJoinerMsg := api.NewNewPeerJoinerMessage(c.id, joiner.ID, joinerAddr.String())
 
 	c.SendToAllPeers(newJoinerMsg)
 	c.SendToPeer(joiner.ID, currentMembersMsg)
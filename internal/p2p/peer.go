@@ -14,12 +14,19 @@ type PeerInfo struct {
 	Conn         *net.UDPConn
 	ID           string
 	LastPeerPong time.Time
+	// Relayed is set when hole punching failed and Address is a relay on the server
+	Relayed bool
 }
 
 // SendToPeer sends data to the connected peer
 func (c *Client) SendToPeer(peerId string, message *api.Message) error {
 	c.mutex.RLock()
 	peerInfo := c.GetPeerById(peerId)
+	var peerConn *net.UDPConn
+	var peerAddr *net.UDPAddr
+	if peerInfo != nil {
+		peerConn, peerAddr = peerInfo.Conn, peerInfo.Address
+	}
 	state := c.state
 	c.mutex.RUnlock()
 
@@ -27,7 +34,7 @@ func (c *Client) SendToPeer(peerId string, message *api.Message) error {
 		return fmt.Errorf("no peer information available")
 	}
 
-	if peerInfo.Conn == nil {
+	if peerConn == nil {
 		return fmt.Errorf("not connected to peer")
 	}
 
@@ -41,17 +48,27 @@ func (c *Client) SendToPeer(peerId string, message *api.Message) error {
 		return err
 	}
 
-	_, err = peerInfo.Conn.WriteToUDP(data, peerInfo.Address)
+	_, err = peerConn.WriteToUDP(data, peerAddr)
 	return err
 }
 
 func (c *Client) SendToAllPeers(message *api.Message) error {
+	// ConnectToPeer and relays change peers, so they are copied under the lock
+	type destination struct {
+		conn *net.UDPConn
+		addr *net.UDPAddr
+	}
 	c.mutex.RLock()
-	allPeers := c.GetConnectedPeers()
+	var destinations []destination
+	for _, peer := range c.peers {
+		if peer.Conn != nil {
+			destinations = append(destinations, destination{peer.Conn, peer.Address})
+		}
+	}
 	state := c.state
 	c.mutex.RUnlock()
 
-	if len(allPeers) == 0 {
+	if len(destinations) == 0 {
 		return fmt.Errorf("no peer information available")
 	}
 
@@ -65,8 +82,8 @@ func (c *Client) SendToAllPeers(message *api.Message) error {
 		return err
 	}
 
-	for _, peer := range allPeers {
-		_, err := peer.Conn.WriteToUDP(data, peer.Address)
+	for _, peer := range destinations {
+		_, err := peer.conn.WriteToUDP(data, peer.addr)
 		if err != nil {
 			return err
 		}
@@ -82,7 +99,9 @@ func (c *Client) IsPeerCommunicationAvailable() bool {
 	return len(c.GetConnectedPeers()) > 0 && c.state != StateDisconnected
 }
 
-// ConnectToPeer attempts to establish direct connection to assigned peer using UDP hole punching
+// ConnectToPeer attempts to establish direct connection to assigned peer using
+// UDP hole punching, falling back to a relay on the server if the peer doesn't
+// answer within the PunchTimeout
 func (c *Client) ConnectToPeer(peer *PeerInfo) error {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
@@ -105,15 +124,22 @@ func (c *Client) ConnectToPeer(peer *PeerInfo) error {
 	}
 
 	// Start UDP hole punching - send initial packet to peer to establish connection
-	go c.establishPeerConnection(c.peers[peer.ID].Address)
+	go c.establishPeerConnection(peer.ID)
 
 	return nil
 }
 
 // establishPeerConnection performs UDP hole punching to establish peer connection
-func (c *Client) establishPeerConnection(peerAddr *net.UDPAddr) {
+// and relays through the server when the peer never answers
+func (c *Client) establishPeerConnection(peerID string) {
 	c.mutex.RLock()
-	peerConn := c.GetPeerById(peerAddr.String()).Conn
+	peerInfo := c.GetPeerById(peerID)
+	var peerConn *net.UDPConn
+	var peerAddr *net.UDPAddr
+	if peerInfo != nil {
+		peerConn, peerAddr = peerInfo.Conn, peerInfo.Address
+	}
+	timeout := c.punchTimeout
 	c.mutex.RUnlock()
 
 	if peerConn == nil {
@@ -129,4 +155,16 @@ func (c *Client) establishPeerConnection(peerAddr *net.UDPAddr) {
 		}
 		time.Sleep(100 * time.Millisecond)
 	}
+
+	if timeout <= 0 || c.awaitPeerPong(peerID, timeout) {
+		return
+	}
+
+	if err := c.relayToPeer(peerID, peerAddr); err != nil {
+		c.notifyError(fmt.Errorf("could not reach peer %s by hole punching or relay: %w", peerID, err))
+		return
+	}
+	if !c.awaitPeerPong(peerID, timeout) {
+		c.notifyError(fmt.Errorf("peer %s did not answer through the relay", peerID))
+	}
 }
@@ -9,6 +9,21 @@ This file is for connection logic that pertains to Client-Server Connection
 import (
 	"fmt"
 	"net"
+	"time"
+
+	"github.com/hcp-uw/mosaic/internal/api"
+)
+
+// bindingRetransmit is how long DiscoverPublicAddress waits on a response
+// before sending the Binding request again, UDP can drop either one
+const bindingRetransmit = 500 * time.Millisecond
+
+const (
+	// relayRetransmit is how often a relay request is repeated while the
+	// server waits on the peer to ask for the relay as well
+	relayRetransmit = time.Second
+	// relayTimeout is how long the peer has to ask
+	relayTimeout = 10 * time.Second
 )
 
 func (c *Client) ConnectToStun() error {
@@ -31,6 +46,7 @@ func (c *Client) ConnectToStun() error {
 	}
 
 	c.serverConn = conn
+	c.heardFromServer()
 	c.setState(StateConnecting)
 
 	// Start message handling
@@ -63,3 +79,186 @@ func (c *Client) DisconnectFromStun() error {
 
 	return nil
 }
+
+// DiscoverPublicAddress asks the STUN server, with a standard RFC 5389 Binding
+// request, which address it sees the client's socket coming from. That is the
+// address peers have to punch through to. The client has to be connected.
+func (c *Client) DiscoverPublicAddress(timeout time.Duration) (*net.UDPAddr, error) {
+	id, request, err := api.NewBindingRequest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create binding request: %w", err)
+	}
+
+	response := make(chan *net.UDPAddr, 1)
+	c.mutex.Lock()
+	conn := c.serverConn
+	if conn == nil {
+		c.mutex.Unlock()
+		return nil, fmt.Errorf("not connected to server")
+	}
+	c.bindings[id] = response
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		delete(c.bindings, id)
+		c.mutex.Unlock()
+	}()
+
+	deadline := time.After(timeout)
+	retransmit := time.NewTicker(bindingRetransmit)
+	defer retransmit.Stop()
+
+	for {
+		if _, err := conn.WriteToUDP(request, c.server()); err != nil {
+			return nil, fmt.Errorf("failed to send binding request: %w", err)
+		}
+
+		select {
+		case addr := <-response:
+			c.mutex.Lock()
+			c.publicAddr = addr
+			c.mutex.Unlock()
+			return addr, nil
+		case <-retransmit.C:
+		case <-deadline:
+			return nil, fmt.Errorf("no binding response from server within %v", timeout)
+		case <-c.ctx.Done():
+			return nil, fmt.Errorf("client disconnected")
+		}
+	}
+}
+
+// GetPublicAddress returns the address found by the last DiscoverPublicAddress, nil if there is none
+func (c *Client) GetPublicAddress() *net.UDPAddr {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.publicAddr
+}
+
+// processBindingResponse hands a Binding response from the server to the
+// DiscoverPublicAddress call waiting on it
+func (c *Client) processBindingResponse(data []byte) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	for id, response := range c.bindings {
+		addr, err := api.ParseBindingResponse(data, id)
+		if err != nil {
+			continue
+		}
+		select {
+		case response <- addr:
+		default:
+		}
+		return
+	}
+}
+
+// relayToPeer asks the server to relay traffic to a peer hole punching
+// couldn't reach. The server only allocates once the peer asks for a relay to
+// this client too, after which the peer's address is swapped for the relay's.
+// Requests are signed, the server only relays for clients it knows.
+func (c *Client) relayToPeer(peerID string, peerAddr *net.UDPAddr) error {
+	response := make(chan *net.UDPAddr, 1)
+	c.mutex.Lock()
+	c.relays[peerAddr.String()] = response
+	sign := api.NewSignature(c.id)
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		delete(c.relays, peerAddr.String())
+		c.mutex.Unlock()
+	}()
+
+	deadline := time.After(relayTimeout)
+	retransmit := time.NewTicker(relayRetransmit)
+	defer retransmit.Stop()
+
+	for {
+		// the server drops signed messages it has seen, so each retransmit is signed anew
+		if err := c.sendSignedToServer(api.NewRelayRequestMessage(sign, peerAddr)); err != nil {
+			return err
+		}
+
+		select {
+		case relayAddr := <-response:
+			c.mutex.Lock()
+			if peerInfo, ok := c.peers[peerID]; ok {
+				peerInfo.Address = relayAddr
+				peerInfo.Relayed = true
+			}
+			c.mutex.Unlock()
+			return nil
+		case <-retransmit.C:
+		case <-deadline:
+			return fmt.Errorf("no relay from server within %v", relayTimeout)
+		case <-c.ctx.Done():
+			return fmt.Errorf("client disconnected")
+		}
+	}
+}
+
+// server returns the address of the server in use
+func (c *Client) server() *net.UDPAddr {
+	c.serverMutex.Lock()
+	defer c.serverMutex.Unlock()
+	return c.serverAddr
+}
+
+// heardFromServer records that the server in use is alive
+func (c *Client) heardFromServer() {
+	c.serverMutex.Lock()
+	defer c.serverMutex.Unlock()
+	c.lastServerReply = time.Now()
+}
+
+// probeServer sends the server a Binding request, which it always answers,
+// when there is another server to fail over to and reports whether it has
+// been silent for longer than timeout
+func (c *Client) probeServer(timeout time.Duration) bool {
+	c.serverMutex.Lock()
+	serverAddr, silent := c.serverAddr, time.Since(c.lastServerReply)
+	servers := len(c.serverAddrs)
+	c.serverMutex.Unlock()
+	if servers < 2 {
+		return false
+	}
+
+	if _, request, err := api.NewBindingRequest(); err == nil {
+		c.mutex.RLock()
+		conn := c.serverConn
+		c.mutex.RUnlock()
+		if conn != nil {
+			conn.WriteToUDP(request, serverAddr)
+		}
+	}
+	return silent > timeout
+}
+
+// failover moves on to the next server of a high-availability pair and
+// registers with it again if the client still needs a server. The pair
+// replicates registrations, so the client keeps its queue position and a
+// leader its leadership.
+func (c *Client) failover() {
+	c.serverMutex.Lock()
+	if len(c.serverAddrs) < 2 {
+		c.serverMutex.Unlock()
+		return
+	}
+	c.serverIndex = (c.serverIndex + 1) % len(c.serverAddrs)
+	c.serverAddr = c.serverAddrs[c.serverIndex]
+	c.lastServerReply = time.Now()
+	serverAddr := c.serverAddr
+	c.serverMutex.Unlock()
+
+	c.notifyError(fmt.Errorf("failing over to server %s", serverAddr))
+
+	switch c.GetState() {
+	case StateConnecting, StateWaiting, StateLeader:
+		if err := c.register(); err != nil {
+			c.notifyError(fmt.Errorf("failed to register with server %s: %w", serverAddr, err))
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package stun
+
+/*
+
+This file is for the admin endpoint, an optional HTTP listener for operating
+the server without tailing its logs. It is meant for localhost: nothing on it
+is authenticated, so the server refuses to start it on any other address
+unless ServerConfig.AdminAllowRemote says to. It serves JSON for the
+registered clients, the leader and term of every network, the waiting
+queues and the message and error counters, and the same numbers for
+Prometheus at /metrics.
+
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hcp-uw/mosaic/internal/api"
+)
+
+// counters counts the messages the server handled by type, the errors it
+// answered with by code and the datagrams it dropped by reason
+type counters struct {
+	mutex    sync.Mutex
+	messages map[string]uint64
+	errors   map[string]uint64
+	dropped  map[string]uint64
+}
+
+func newCounters() *counters {
+	return &counters{
+		messages: make(map[string]uint64),
+		errors:   make(map[string]uint64),
+		dropped:  make(map[string]uint64),
+	}
+}
+
+func (c *counters) countMessage(messageType string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.messages[messageType]++
+}
+
+func (c *counters) countError(code string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.errors[code]++
+}
+
+func (c *counters) countDropped(reason string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.dropped[reason]++
+}
+
+// snapshot copies the counters so they can be read without the lock
+func (c *counters) snapshot() (messages, errorCodes, dropped map[string]uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return maps.Clone(c.messages), maps.Clone(c.errors), maps.Clone(c.dropped)
+}
+
+// AdminClient is a registered client as the admin endpoint reports it
+type AdminClient struct {
+	ID        string    `json:"id"`
+	Address   string    `json:"address"`
+	NetworkID string    `json:"network_id"`
+	Leader    bool      `json:"leader"`
+	Position  int       `json:"queue_position"`
+	LastPing  time.Time `json:"last_ping"`
+	Connected time.Time `json:"connected"`
+}
+
+// AdminLeader is the leadership of one network as the admin endpoint reports it
+type AdminLeader struct {
+	NetworkID string     `json:"network_id"`
+	LeaderID  string     `json:"leader_id"`
+	Term      uint       `json:"term"`
+	LeaseEnds *time.Time `json:"lease_ends,omitempty"`
+	Members   int        `json:"members"`
+}
+
+// AdminQueue is the waiting queue of one network as the admin endpoint reports it
+type AdminQueue struct {
+	NetworkID string        `json:"network_id"`
+	Waiting   []AdminClient `json:"waiting"`
+}
+
+// AdminCounters are the message, error and drop counters as the admin endpoint reports them
+type AdminCounters struct {
+	Messages map[string]uint64 `json:"messages"`
+	Errors   map[string]uint64 `json:"errors"`
+	Dropped  map[string]uint64 `json:"dropped"`
+	// BannedSources is how many IPs are banned right now
+	BannedSources int `json:"banned_sources"`
+}
+
+// startAdmin starts the admin endpoint on address, which has to be a
+// loopback address unless allowRemote is set
+func (s *Server) startAdmin(address string, allowRemote, enableLogging bool) error {
+	addr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to resolve admin address: %w", err)
+	}
+	if !allowRemote && (addr.IP == nil || !addr.IP.IsLoopback()) {
+		return fmt.Errorf("admin address %s isn't loopback, the endpoint has no authentication", address)
+	}
+
+	listener, err := net.Listen("tcp", addr.String())
+	if err != nil {
+		return fmt.Errorf("failed to listen for admin endpoint: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /clients", s.serveClients)
+	mux.HandleFunc("GET /leader", s.serveLeader)
+	mux.HandleFunc("GET /queue", s.serveQueue)
+	mux.HandleFunc("GET /counters", s.serveCounters)
+	mux.HandleFunc("GET /metrics", s.serveMetrics)
+
+	s.admin = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	s.adminAddr = listener.Addr()
+
+	go func() {
+		if err := s.admin.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Admin endpoint stopped: %v", err)
+		}
+	}()
+
+	if enableLogging {
+		log.Printf("Admin endpoint listening on %s", listener.Addr())
+	}
+	return nil
+}
+
+// GetAdminAddress returns the address of the admin endpoint, nil if it isn't running
+func (s *Server) GetAdminAddress() net.Addr {
+	return s.adminAddr
+}
+
+// adminClient reports a client, callers hold the mutex
+func (s *Server) adminClient(client *ClientInfo) AdminClient {
+	n := s.networkOf(client)
+	return AdminClient{
+		ID:        client.ID,
+		Address:   client.Address.String(),
+		NetworkID: client.NetworkID,
+		Leader:    n != nil && n.currentLeaderID == client.ID,
+		Position:  s.queuePositions[client.ID],
+		LastPing:  client.LastPing,
+		Connected: client.Connected,
+	}
+}
+
+// sortedNetworks returns the networks by ID, callers hold the mutex
+func (s *Server) sortedNetworks() []*network {
+	networks := make([]*network, 0, len(s.networks))
+	for _, n := range s.networks {
+		networks = append(networks, n)
+	}
+	slices.SortFunc(networks, func(a, b *network) int {
+		return strings.Compare(a.id, b.id)
+	})
+	return networks
+}
+
+func (s *Server) serveClients(w http.ResponseWriter, r *http.Request) {
+	s.mutex.RLock()
+	clients := make([]AdminClient, 0, len(s.clients))
+	for _, client := range s.clients {
+		clients = append(clients, s.adminClient(client))
+	}
+	s.mutex.RUnlock()
+
+	slices.SortFunc(clients, func(a, b AdminClient) int {
+		return a.Position - b.Position
+	})
+	writeJSON(w, clients)
+}
+
+func (s *Server) serveLeader(w http.ResponseWriter, r *http.Request) {
+	s.mutex.RLock()
+	leaders := make([]AdminLeader, 0, len(s.networks))
+	for _, n := range s.sortedNetworks() {
+		leaders = append(leaders, AdminLeader{
+			NetworkID: n.id,
+			LeaderID:  n.currentLeaderID,
+			Term:      n.currentTerm,
+			LeaseEnds: n.leaseExpirationTimeStamp,
+			Members:   len(n.members),
+		})
+	}
+	s.mutex.RUnlock()
+
+	writeJSON(w, leaders)
+}
+
+func (s *Server) serveQueue(w http.ResponseWriter, r *http.Request) {
+	s.mutex.RLock()
+	queues := make([]AdminQueue, 0, len(s.networks))
+	for _, n := range s.sortedNetworks() {
+		queue := AdminQueue{NetworkID: n.id, Waiting: make([]AdminClient, 0, len(n.waitingQueue))}
+		for _, client := range n.waitingQueue {
+			queue.Waiting = append(queue.Waiting, s.adminClient(client))
+		}
+		queues = append(queues, queue)
+	}
+	s.mutex.RUnlock()
+
+	writeJSON(w, queues)
+}
+
+func (s *Server) serveCounters(w http.ResponseWriter, r *http.Request) {
+	messages, errorCodes, dropped := s.counters.snapshot()
+	writeJSON(w, AdminCounters{
+		Messages:      messages,
+		Errors:        errorCodes,
+		Dropped:       dropped,
+		BannedSources: s.GetBannedSources(),
+	})
+}
+
+// serveMetrics writes the numbers in the Prometheus text format
+func (s *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+
+	writeMetric(&b, "mosaic_stun_connected_clients", "gauge", "Clients registered with the server.", float64(s.GetConnectedClients()))
+	writeMetric(&b, "mosaic_stun_waiting_clients", "gauge", "Clients waiting on a leader.", float64(s.GetWaitingClients()))
+	writeMetric(&b, "mosaic_stun_networks", "gauge", "Networks the server knows of.", float64(s.GetNetworks()))
+	writeMetric(&b, "mosaic_stun_relay_allocations", "gauge", "Open relay allocations.", float64(s.GetRelayAllocations()))
+	writeMetric(&b, "mosaic_stun_banned_sources", "gauge", "Source IPs that are banned.", float64(s.GetBannedSources()))
+	writeMetric(&b, "mosaic_stun_in_flight", "gauge", "Messages being handled.", float64(len(s.inFlight)))
+	active := 0.0
+	if s.IsActive() {
+		active = 1
+	}
+	writeMetric(&b, "mosaic_stun_active", "gauge", "Whether the server answers clients, 0 on a standby.", active)
+
+	s.mutex.RLock()
+	terms := make(map[string]uint64, len(s.networks))
+	leaders := make(map[string]uint64, len(s.networks))
+	for _, n := range s.networks {
+		terms[n.id] = uint64(n.currentTerm)
+		if _, ok := s.leaderOf(n); ok {
+			leaders[n.id] = 1
+		} else {
+			leaders[n.id] = 0
+		}
+	}
+	s.mutex.RUnlock()
+	writeMetricFamily(&b, "mosaic_stun_term", "gauge", "Current leader term.", "network", terms)
+	writeMetricFamily(&b, "mosaic_stun_leader_present", "gauge", "Whether the network's leader is registered.", "network", leaders)
+
+	messages, errorCodes, dropped := s.counters.snapshot()
+	writeMetricFamily(&b, "mosaic_stun_messages_total", "counter", "Messages handled by type.", "type", messages)
+	writeMetricFamily(&b, "mosaic_stun_errors_total", "counter", "Errors sent to clients by code.", "code", errorCodes)
+	writeMetricFamily(&b, "mosaic_stun_dropped_total", "counter", "Datagrams and replies dropped by reason.", "reason", dropped)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprint(w, b.String())
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write admin response: %v", err)
+	}
+}
+
+// writeMetric writes an unlabelled sample with its HELP and TYPE lines
+func writeMetric(b *strings.Builder, name, kind, help string, value float64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	fmt.Fprintf(b, "%s %g\n", name, value)
+}
+
+// writeMetricFamily writes a sample for every value of one label, sorted by it
+func writeMetricFamily(b *strings.Builder, name, kind, help, label string, values map[string]uint64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		fmt.Fprintf(b, "%s{%s=\"%s\"} %d\n", name, label, labelEscaper.Replace(key), values[key])
+	}
+}
+
+// labelEscaper keeps client chosen values, like network IDs, from breaking
+// out of a label
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// countedMessageType is the counter label of a message type, unknown types
+// share one so clients can't add labels
+func countedMessageType(messageType api.MessageType) string {
+	switch messageType {
+	case api.ClientRegister, api.ClientPing, api.RelayRequest, api.LeaderLost, api.ChallengeResponse:
+		return string(messageType)
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,127 @@
+package stun
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hcp-uw/mosaic/internal/api"
+)
+
+func getAdmin(t *testing.T, server *Server, path string) []byte {
+	t.Helper()
+
+	resp, err := http.Get("http://" + server.GetAdminAddress().String() + path)
+	if err != nil {
+		t.Fatalf("Failed to get %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 from %s, got %d: %s", path, resp.StatusCode, body)
+	}
+	return body
+}
+
+func TestAdminEndpoint(t *testing.T) {
+	config := &ServerConfig{
+		ListenAddress: "127.0.0.1:0",
+		ClientTimeout: 5 * time.Second,
+		AdminAddress:  "127.0.0.1:0",
+	}
+	server := NewServer(config)
+	if err := server.Start(config); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer server.Stop()
+	serverAddr := server.conn.LocalAddr().(*net.UDPAddr)
+
+	leader, leaderIdentity := newStateTestClient(t), newTestIdentity(t)
+	registerTestClient(t, leader, serverAddr, leaderIdentity, "", "")
+	expectMessages(t, leader, api.RegisterSuccess, api.AssignedAsLeader)
+
+	// an error and a message type the server doesn't know
+	sendToServer(t, leader, serverAddr, &api.Message{Type: "bogus", Timestamp: time.Now()})
+	expectServerError(t, leader, "UNKNOWN_MESSAGE")
+
+	var clients []AdminClient
+	if err := json.Unmarshal(getAdmin(t, server, "/clients"), &clients); err != nil {
+		t.Fatalf("Failed to parse clients: %v", err)
+	}
+	if len(clients) != 1 || clients[0].ID != leaderIdentity.id || !clients[0].Leader || clients[0].Position != 1 {
+		t.Errorf("Expected the leader as the only client, got %+v", clients)
+	}
+
+	var leaders []AdminLeader
+	if err := json.Unmarshal(getAdmin(t, server, "/leader"), &leaders); err != nil {
+		t.Fatalf("Failed to parse leaders: %v", err)
+	}
+	if len(leaders) != 1 || leaders[0].NetworkID != DefaultNetworkID || leaders[0].LeaderID != leaderIdentity.id || leaders[0].Term != 1 {
+		t.Errorf("Expected %s to lead term 1 of the default network, got %+v", leaderIdentity.id, leaders)
+	}
+
+	var queues []AdminQueue
+	if err := json.Unmarshal(getAdmin(t, server, "/queue"), &queues); err != nil {
+		t.Fatalf("Failed to parse queues: %v", err)
+	}
+	if len(queues) != 1 || len(queues[0].Waiting) != 0 {
+		t.Errorf("Expected an empty queue, got %+v", queues)
+	}
+
+	var counters AdminCounters
+	if err := json.Unmarshal(getAdmin(t, server, "/counters"), &counters); err != nil {
+		t.Fatalf("Failed to parse counters: %v", err)
+	}
+	if counters.Messages[string(api.ClientRegister)] != 1 || counters.Messages["unknown"] != 1 || counters.Errors["UNKNOWN_MESSAGE"] != 1 {
+		t.Errorf("Unexpected counters %+v", counters)
+	}
+
+	metrics := string(getAdmin(t, server, "/metrics"))
+	for _, want := range []string{
+		"mosaic_stun_connected_clients 1\n",
+		"mosaic_stun_term{network=\"default\"} 1\n",
+		"mosaic_stun_messages_total{type=\"challenge_response\"} 1\n",
+		"mosaic_stun_errors_total{code=\"UNKNOWN_MESSAGE\"} 1\n",
+		"# TYPE mosaic_stun_messages_total counter\n",
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", want, metrics)
+		}
+	}
+}
+
+func TestAdminEndpointOnlyOnLoopback(t *testing.T) {
+	for _, address := range []string{":0", "0.0.0.0:0"} {
+		config := &ServerConfig{
+			ListenAddress: "127.0.0.1:0",
+			ClientTimeout: 5 * time.Second,
+			AdminAddress:  address,
+		}
+		if err := NewServer(config).Start(config); err == nil {
+			t.Fatalf("Expected the admin endpoint on %s to be refused", address)
+		}
+	}
+
+	config := &ServerConfig{
+		ListenAddress:    "127.0.0.1:0",
+		ClientTimeout:    5 * time.Second,
+		AdminAddress:     ":0",
+		AdminAllowRemote: true,
+	}
+	server := NewServer(config)
+	if err := server.Start(config); err != nil {
+		t.Fatalf("Expected the admin endpoint on all interfaces once allowed: %v", err)
+	}
+	defer server.Stop()
+	if addr := server.GetAdminAddress().(*net.TCPAddr); addr.IP.IsLoopback() {
+		t.Errorf("Expected the admin endpoint on all interfaces, got %s", addr)
+	}
+}
@@ -0,0 +1,202 @@
+package stun
+
+/*
+
+This file is for the registration handshake. A ClientRegister names the
+client's P-256 public key and the server answers with a RegisterChallenge
+holding a random nonce and the address the server sees the client at. The
+client signs the nonce together with both addresses and sends it back in a
+ChallengeResponse, and only then is it registered, under the fingerprint of
+its key. The server takes the signature for any of its own addresses, see
+PublicAddress, so a client can't be tricked into answering another server's
+challenge. The UDP address is just where to reach the client: a signed ping
+from a new address gets a challenge sent there, and the client moves once it
+is answered. Signed messages are only taken in timestamp order, so a
+captured ping replayed from elsewhere is dropped.
+
+*/
+
+import (
+	"crypto/ecdsa"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/hcp-uw/mosaic/internal/api"
+)
+
+// challengeTimeout is how long a client has to answer its challenge
+const challengeTimeout = 10 * time.Second
+
+// errReplayedSignature is returned for signed messages that aren't newer
+// than the last one taken from the client
+var errReplayedSignature = errors.New("signed message isn't newer than the last one")
+
+// challenge is a registration waiting on the client to sign its nonce
+type challenge struct {
+	nonce      []byte
+	key        *ecdsa.PublicKey
+	networkID  string
+	joinSecret string
+	expires    time.Time
+	// rejoin is set for keys the server already knows in networkID, which
+	// aren't asked for its join secret again
+	rejoin bool
+}
+
+// sendChallenge keeps a registration from clientAddr until it signs the
+// returned nonce, requestSize is the size of the ClientRegister
+func (s *Server) sendChallenge(clientAddr *net.UDPAddr, requestSize int, key *ecdsa.PublicKey, data *api.ClientRegisterData, enableLogging bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.issueChallenge(clientAddr, requestSize, &challenge{
+		key:        key,
+		networkID:  data.NetworkID,
+		joinSecret: data.JoinSecret,
+	}, enableLogging)
+}
+
+// issueChallenge sends pending's nonce to clientAddr and keeps it until it is
+// answered. Callers hold the mutex.
+func (s *Server) issueChallenge(clientAddr *net.UDPAddr, requestSize int, pending *challenge, enableLogging bool) {
+	nonce, err := api.NewNonce()
+	if err != nil {
+		if enableLogging {
+			log.Printf("Failed to create challenge for %s: %v", clientAddr, err)
+		}
+		s.sendErrorMessage(clientAddr, requestSize, "Failed to create challenge", "INTERNAL_ERROR")
+		return
+	}
+
+	if _, answering := s.challenges[clientAddr.String()]; !answering && len(s.challenges) >= maxChallenges {
+		s.counters.countDropped("too_many_challenges")
+		return
+	}
+	pending.nonce = nonce
+	pending.expires = time.Now().Add(challengeTimeout)
+	s.challenges[clientAddr.String()] = pending
+
+	s.sendReply(clientAddr, requestSize, api.NewRegisterChallengeMessage(nonce, clientAddr.String()))
+}
+
+// handleChallengeResponse registers a client once it has signed its challenge
+func (s *Server) handleChallengeResponse(msg *api.Message, clientAddr *net.UDPAddr, enableLogging bool) {
+	data, err := msg.GetChallengeResponseData()
+	if err != nil {
+		if enableLogging {
+			log.Printf("Failed to parse challenge response data: %v", err)
+		}
+		s.sendErrorMessage(clientAddr, msg.Size(), "Invalid challenge response data", "INVALID_DATA")
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	pending, ok := s.challenges[clientAddr.String()]
+	if !ok || time.Now().After(pending.expires) || subtle.ConstantTimeCompare(pending.nonce, data.Nonce) != 1 {
+		s.sendErrorMessage(clientAddr, msg.Size(), "No matching challenge", "NO_CHALLENGE")
+		return
+	}
+	delete(s.challenges, clientAddr.String())
+
+	if !s.verifyChallenge(pending, clientAddr, data.Signature) {
+		if enableLogging {
+			log.Printf("Client %s failed its challenge", clientAddr)
+		}
+		s.sendErrorMessage(clientAddr, msg.Size(), "Challenge signature doesn't match the key", "INVALID_SIGNATURE")
+		return
+	}
+	// only a real address could have received the nonce
+	s.limiter.verify(clientAddr, time.Now())
+
+	clientID, err := api.Fingerprint(pending.key)
+	if err != nil {
+		s.sendErrorMessage(clientAddr, msg.Size(), "Invalid public key", "INVALID_KEY")
+		return
+	}
+	s.registerClient(clientID, pending, clientAddr, enableLogging)
+}
+
+// verifyChallenge reports whether sig signs pending's nonce for clientAddr
+// and one of the server's addresses
+func (s *Server) verifyChallenge(pending *challenge, clientAddr *net.UDPAddr, sig []byte) bool {
+	for _, address := range s.addresses {
+		if api.VerifyChallenge(pending.key, pending.nonce, address, clientAddr.String(), sig) {
+			return true
+		}
+	}
+	return false
+}
+
+// serverAddresses returns the addresses clients may have signed their
+// challenge for. That is publicAddress if it is set, otherwise the listen
+// address, or every address of the host on the listen port if the listen IP
+// is unspecified.
+func serverAddresses(publicAddress string, listen *net.UDPAddr) ([]string, error) {
+	if publicAddress != "" {
+		addr, err := net.ResolveUDPAddr("udp", publicAddress)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve public address: %w", err)
+		}
+		return []string{addr.String()}, nil
+	}
+	if !listen.IP.IsUnspecified() {
+		return []string{listen.String()}, nil
+	}
+
+	interfaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list interface addresses: %w", err)
+	}
+	addresses := make([]string, 0, len(interfaceAddrs))
+	for _, interfaceAddr := range interfaceAddrs {
+		if ipNet, ok := interfaceAddr.(*net.IPNet); ok {
+			addresses = append(addresses, (&net.UDPAddr{IP: ipNet.IP, Port: listen.Port}).String())
+		}
+	}
+	return addresses, nil
+}
+
+// expireChallenges drops challenges that were never answered
+func (s *Server) expireChallenges(now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for addr, pending := range s.challenges {
+		if now.After(pending.expires) {
+			delete(s.challenges, addr)
+		}
+	}
+}
+
+// verifySender checks that msg was signed by key and that key is the one of
+// the ID the message claims to be from
+func verifySender(msg *api.Message, key *ecdsa.PublicKey) error {
+	id, err := api.Fingerprint(key)
+	if err != nil {
+		return err
+	}
+	if msg.Sign.PubKey != id {
+		return api.ErrInvalidSignature
+	}
+	return msg.VerifySign(key)
+}
+
+// verifyClient checks that msg was signed by client and is newer than the
+// last signed message taken from it, which msg then becomes. Callers hold
+// the mutex.
+func verifyClient(msg *api.Message, client *ClientInfo) error {
+	if err := verifySender(msg, client.PublicKey); err != nil {
+		return err
+	}
+	if !msg.Timestamp.After(client.LastSigned) {
+		return errReplayedSignature
+	}
+	client.LastSigned = msg.Timestamp
+	return nil
+}
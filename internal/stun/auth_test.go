@@ -0,0 +1,205 @@
+package stun
+
+import (
+	"crypto/ecdsa"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hcp-uw/mosaic/internal/api"
+)
+
+// testIdentity is a client key and the ID the server knows it by
+type testIdentity struct {
+	key       *ecdsa.PrivateKey
+	publicKey string
+	id        string
+}
+
+func newTestIdentity(t *testing.T) *testIdentity {
+	t.Helper()
+
+	key, err := api.GenerateKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	publicKey, err := api.EncodePublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to encode public key: %v", err)
+	}
+	id, err := api.Fingerprint(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to fingerprint public key: %v", err)
+	}
+	return &testIdentity{key: key, publicKey: publicKey, id: id}
+}
+
+// answer signs the nonce of a RegisterChallenge
+func (i *testIdentity) answer(t *testing.T, serverAddr *net.UDPAddr, challenge *api.Message) *api.Message {
+	t.Helper()
+
+	data, err := challenge.GetRegisterChallengeData()
+	if err != nil {
+		t.Fatalf("Expected a register challenge, got %s: %v", challenge.Type, err)
+	}
+	signature, err := api.SignChallenge(i.key, data.Nonce, serverAddr.String(), data.Address)
+	if err != nil {
+		t.Fatalf("Failed to sign challenge: %v", err)
+	}
+	return api.NewChallengeResponseMessage(data.Nonce, signature)
+}
+
+// ping creates a ping signed with the identity's key
+func (i *testIdentity) ping(t *testing.T) *api.Message {
+	t.Helper()
+
+	msg := api.NewClientPingMessage(api.NewSignature(i.id))
+	if err := msg.SignWith(i.key); err != nil {
+		t.Fatalf("Failed to sign ping: %v", err)
+	}
+	return msg
+}
+
+// registerTestClient registers identity into a network over conn and answers
+// the server's challenge, the server's replies after that are left to the caller
+func registerTestClient(t *testing.T, conn *net.UDPConn, serverAddr *net.UDPAddr, identity *testIdentity, networkID, joinSecret string) {
+	t.Helper()
+
+	if serverAddr == nil {
+		serverAddr = conn.RemoteAddr().(*net.UDPAddr)
+	}
+	sendToServer(t, conn, serverAddr, api.NewNetworkRegisterMessage(identity.publicKey, networkID, joinSecret))
+	sendToServer(t, conn, serverAddr, identity.answer(t, serverAddr, readUDPMessage(t, conn)))
+}
+
+func expectServerError(t *testing.T, conn *net.UDPConn, code string) {
+	t.Helper()
+
+	msg := readUDPMessage(t, conn)
+	data, err := msg.GetServerErrorData()
+	if err != nil || data.ErrorCode != code {
+		t.Fatalf("Expected a %s error, got %s %+v", code, msg.Type, data)
+	}
+}
+
+func TestRegistrationChallenge(t *testing.T) {
+	server, serverAddr := newStateTestServer(t, "", time.Second)
+	defer server.Stop()
+
+	conn := newStateTestClient(t)
+	// as long as a real key, so the error fits in the reply
+	sendToServer(t, conn, serverAddr, api.NewClientRegisterMessage(strings.Repeat("A", 124)))
+	expectServerError(t, conn, "INVALID_KEY")
+
+	// answering without a challenge does nothing
+	identity, impostor := newTestIdentity(t), newTestIdentity(t)
+	sendToServer(t, conn, serverAddr, api.NewChallengeResponseMessage(make([]byte, api.NonceSize), nil))
+	expectServerError(t, conn, "NO_CHALLENGE")
+
+	// a signature from another key fails the challenge
+	sendToServer(t, conn, serverAddr, api.NewClientRegisterMessage(identity.publicKey))
+	sendToServer(t, conn, serverAddr, impostor.answer(t, serverAddr, readUDPMessage(t, conn)))
+	expectServerError(t, conn, "INVALID_SIGNATURE")
+	if server.GetConnectedClients() != 0 {
+		t.Fatalf("Expected no registered clients, got %d", server.GetConnectedClients())
+	}
+
+	// nor does one meant for another server
+	otherServer := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: serverAddr.Port + 1}
+	sendToServer(t, conn, serverAddr, api.NewClientRegisterMessage(identity.publicKey))
+	sendToServer(t, conn, serverAddr, identity.answer(t, otherServer, readUDPMessage(t, conn)))
+	expectServerError(t, conn, "INVALID_SIGNATURE")
+
+	// oversized join secrets and datagrams are turned away before a challenge
+	sendToServer(t, conn, serverAddr, api.NewNetworkRegisterMessage(identity.publicKey, "", strings.Repeat("s", maxJoinSecretLength+1)))
+	expectServerError(t, conn, "INVALID_NETWORK")
+	sendToServer(t, conn, serverAddr, api.NewNetworkRegisterMessage(identity.publicKey, "", strings.Repeat("s", maxMessageSize)))
+	expectServerError(t, conn, "MESSAGE_TOO_LARGE")
+
+	registerTestClient(t, conn, serverAddr, identity, "", "")
+	msg := readUDPMessage(t, conn)
+	data, err := msg.GetRegisterSuccessData()
+	if err != nil {
+		t.Fatalf("Expected RegisterSuccess, got %s: %v", msg.Type, err)
+	}
+	if data.ID != identity.id {
+		t.Errorf("Expected to be registered as %s, got %s", identity.id, data.ID)
+	}
+	expectMessages(t, conn, api.AssignedAsLeader)
+}
+
+func TestSignedPingMovesClientAfterChallenge(t *testing.T) {
+	server, serverAddr := newStateTestServer(t, "", time.Second)
+	defer server.Stop()
+
+	identity := newTestIdentity(t)
+	conn := newStateTestClient(t)
+	registerTestClient(t, conn, serverAddr, identity, "", "")
+	expectMessages(t, conn, api.RegisterSuccess, api.AssignedAsLeader)
+
+	// an unsigned ping naming the client can't move it
+	spoofer := newStateTestClient(t)
+	sendToServer(t, spoofer, serverAddr, api.NewClientPingMessage(api.NewSignature(identity.id)))
+	time.Sleep(100 * time.Millisecond)
+	if addr := clientAddress(server, identity.id); addr != conn.LocalAddr().String() {
+		t.Fatalf("Expected the client to stay at %s, got %s", conn.LocalAddr(), addr)
+	}
+
+	// nor can a signed one replayed from elsewhere
+	ping := identity.ping(t)
+	sendToServer(t, conn, serverAddr, ping)
+	time.Sleep(50 * time.Millisecond)
+	sendToServer(t, spoofer, serverAddr, ping)
+	spoofer.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	buffer := make([]byte, 1024)
+	if n, err := spoofer.Read(buffer); err == nil {
+		t.Fatalf("Expected a replayed ping to be dropped, got %s", buffer[:n])
+	}
+
+	// a fresh one from a new address moves the client once it is challenged there
+	moved := newStateTestClient(t)
+	sendToServer(t, moved, serverAddr, identity.ping(t))
+	challenge := readUDPMessage(t, moved)
+	if addr := clientAddress(server, identity.id); addr != conn.LocalAddr().String() {
+		t.Fatalf("Expected the client to stay at %s until the challenge is answered, got %s", conn.LocalAddr(), addr)
+	}
+	sendToServer(t, moved, serverAddr, identity.answer(t, serverAddr, challenge))
+	expectMessages(t, moved, api.RegisterSuccess, api.AssignedAsLeader)
+	if addr := clientAddress(server, identity.id); addr != moved.LocalAddr().String() {
+		t.Errorf("Expected the client to move to %s, got %s", moved.LocalAddr(), addr)
+	}
+}
+
+func TestSignatureCoversData(t *testing.T) {
+	identity := newTestIdentity(t)
+	buf, err := identity.leaderLost(t, "", "leader", 1).Serialize()
+	if err != nil {
+		t.Fatalf("Failed to serialize report: %v", err)
+	}
+
+	// the receiver holds the data as a map, not the struct it was signed as
+	msg, err := api.DeserializeMessage(buf)
+	if err != nil {
+		t.Fatalf("Failed to deserialize report: %v", err)
+	}
+	if err := verifySender(msg, &identity.key.PublicKey); err != nil {
+		t.Fatalf("Expected the report to verify, got %v", err)
+	}
+
+	msg.Data.(map[string]any)["leader_id"] = "someone else"
+	if err := verifySender(msg, &identity.key.PublicKey); err == nil {
+		t.Error("Expected a report with changed data not to verify")
+	}
+}
+
+func clientAddress(server *Server, clientID string) string {
+	server.mutex.RLock()
+	defer server.mutex.RUnlock()
+
+	client, ok := server.clients[clientID]
+	if !ok {
+		return ""
+	}
+	return client.Address.String()
+}
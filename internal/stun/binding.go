@@ -0,0 +1,51 @@
+package stun
+
+/*
+
+This file is for the standard STUN Binding method from RFC 5389, see
+api/stun.go for the messages. It lets anything that speaks STUN, our own
+nodes included, learn the address the server sees it as.
+
+*/
+
+import (
+	"errors"
+	"log"
+	"net"
+
+	"github.com/hcp-uw/mosaic/internal/api"
+)
+
+// handleSTUNMessage answers Binding requests, other requests get a 400 and
+// anything else is dropped like RFC 5389 says
+func (s *Server) handleSTUNMessage(data []byte, clientAddr *net.UDPAddr, enableLogging bool) {
+	method, id, err := api.ParseSTUNRequest(data)
+	if err != nil {
+		if enableLogging && !errors.Is(err, api.ErrNotSTUNRequest) {
+			log.Printf("Dropping bad STUN message from %s: %v", clientAddr, err)
+		}
+		return
+	}
+
+	var response []byte
+	if method == api.STUNMethodBinding {
+		response = api.NewBindingResponse(id, clientAddr)
+	} else {
+		response = api.NewSTUNErrorResponse(method, id, 400, "Bad Request")
+	}
+
+	if !s.mayReply(clientAddr, len(data), len(response)) {
+		// unknown sources get the bare response if it fits, see limits.go
+		if method == api.STUNMethodBinding {
+			response = api.NewBareBindingResponse(id, clientAddr)
+		}
+		if !s.mayReply(clientAddr, len(data), len(response)) {
+			s.counters.countDropped("oversized_reply")
+			return
+		}
+	}
+
+	if _, err := s.conn.WriteToUDP(response, clientAddr); err != nil && enableLogging {
+		log.Printf("Failed to send STUN response to %s: %v", clientAddr, err)
+	}
+}
@@ -0,0 +1,132 @@
+package stun
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hcp-uw/mosaic/internal/api"
+)
+
+func TestBindingResponseRoundTrip(t *testing.T) {
+	addrs := []*net.UDPAddr{
+		{IP: net.ParseIP("203.0.113.7"), Port: 54321},
+		{IP: net.ParseIP("2001:db8::1"), Port: 3478},
+	}
+
+	for _, addr := range addrs {
+		id, request, err := api.NewBindingRequest()
+		if err != nil {
+			t.Fatalf("Failed to create binding request: %v", err)
+		}
+		if !api.IsSTUNMessage(request) {
+			t.Fatalf("Binding request isn't recognised as STUN")
+		}
+
+		response := api.NewBindingResponse(id, addr)
+		got, err := api.ParseBindingResponse(response, id)
+		if err != nil {
+			t.Fatalf("Failed to parse binding response: %v", err)
+		}
+		if !got.IP.Equal(addr.IP) || got.Port != addr.Port {
+			t.Errorf("Expected %v, got %v", addr, got)
+		}
+
+		var other api.TransactionID
+		if _, err := api.ParseBindingResponse(response, other); !errors.Is(err, api.ErrTransactionMismatch) {
+			t.Errorf("Expected ErrTransactionMismatch, got %v", err)
+		}
+	}
+}
+
+func TestBindingResponseKnownAnswer(t *testing.T) {
+	// the IPv4 sample response from RFC 5769 section 2.2
+	response := []byte{
+		0x01, 0x01, 0x00, 0x3c, 0x21, 0x12, 0xa4, 0x42,
+		0xb7, 0xe7, 0xa7, 0x01, 0xbc, 0x34, 0xd6, 0x86,
+		0xfa, 0x87, 0xdf, 0xae, 0x80, 0x22, 0x00, 0x0b,
+		0x74, 0x65, 0x73, 0x74, 0x20, 0x76, 0x65, 0x63,
+		0x74, 0x6f, 0x72, 0x20, 0x00, 0x20, 0x00, 0x08,
+		0x00, 0x01, 0xa1, 0x47, 0xe1, 0x12, 0xa6, 0x43,
+		0x00, 0x08, 0x00, 0x14, 0x2b, 0x91, 0xf5, 0x99,
+		0xfd, 0x9e, 0x90, 0xc3, 0x8c, 0x74, 0x89, 0xf9,
+		0x2a, 0xf9, 0xba, 0x53, 0xf0, 0x6b, 0xe7, 0xd7,
+		0x80, 0x28, 0x00, 0x04, 0xc0, 0x7d, 0x4c, 0x96,
+	}
+	var id api.TransactionID
+	copy(id[:], response[8:20])
+
+	addr, err := api.ParseBindingResponse(response, id)
+	if err != nil {
+		t.Fatalf("Failed to parse RFC 5769 response: %v", err)
+	}
+	if !addr.IP.Equal(net.ParseIP("192.0.2.1")) || addr.Port != 32853 {
+		t.Errorf("Expected 192.0.2.1:32853, got %v", addr)
+	}
+
+	// a flipped bit fails the fingerprint
+	response[30] ^= 0x01
+	if _, err := api.ParseBindingResponse(response, id); !errors.Is(err, api.ErrNotSTUN) {
+		t.Errorf("Expected ErrNotSTUN for a bad fingerprint, got %v", err)
+	}
+}
+
+func TestServerAnswersBindingRequest(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Stop()
+
+	serverAddr := server.conn.LocalAddr().(*net.UDPAddr)
+	clientConn, err := net.DialUDP("udp", nil, serverAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer clientConn.Close()
+
+	id, request, err := api.NewBindingRequest()
+	if err != nil {
+		t.Fatalf("Failed to create binding request: %v", err)
+	}
+	if _, err := clientConn.Write(request); err != nil {
+		t.Fatalf("Failed to send binding request: %v", err)
+	}
+
+	buffer := make([]byte, 1024)
+	clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := clientConn.Read(buffer)
+	if err != nil {
+		t.Fatalf("Failed to read binding response: %v", err)
+	}
+	addr, err := api.ParseBindingResponse(buffer[:n], id)
+	if err != nil {
+		t.Fatalf("Failed to parse binding response: %v", err)
+	}
+
+	local := clientConn.LocalAddr().(*net.UDPAddr)
+	if !addr.IP.Equal(local.IP) || addr.Port != local.Port {
+		t.Errorf("Expected mapped address %v, got %v", local, addr)
+	}
+
+	// other methods get a 400 back
+	binary.BigEndian.PutUint16(request[0:2], 0x0003)
+	request = request[:len(request)-8]
+	binary.BigEndian.PutUint16(request[2:4], uint16(len(request)-20))
+	if _, err := clientConn.Write(request); err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err = clientConn.Read(buffer)
+	if err != nil {
+		t.Fatalf("Failed to read error response: %v", err)
+	}
+	if n < 2 || binary.BigEndian.Uint16(buffer[0:2]) != 0x0113 {
+		t.Errorf("Expected an error response for method 3, got %x", buffer[:n])
+	}
+
+	// the JSON protocol still works on the same port
+	registerTestClient(t, clientConn, nil, newTestIdentity(t), "", "")
+	if reply := readUDPMessage(t, clientConn); reply.Type != api.RegisterSuccess {
+		t.Errorf("Expected RegisterSuccess after STUN traffic, got %s", reply.Type)
+	}
+}
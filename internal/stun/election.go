@@ -0,0 +1,126 @@
+package stun
+
+/*
+
+This file is for member-driven re-election, see leaderTransfer.md. A member
+whose leader stops answering its pings sends LeaderLost. The server doesn't
+take its word for it: the leader pings the server every PingInterval, so if it
+has pinged recently only the member lost it and the member is simply paired
+with it again. Otherwise the leader is dropped, the reporter, which is
+certainly alive, leads the new term and every member is sent a PeerAssignment
+pointing at it.
+
+Only a member the server paired with the lost leader can report it. The
+report has to be signed with the key the member registered with and come from
+an address that answered a challenge, anyone else is told to register again.
+
+*/
+
+import (
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/hcp-uw/mosaic/internal/api"
+)
+
+// handleLeaderLost checks a member's report that the leader is gone and
+// elects the reporter if it is
+func (s *Server) handleLeaderLost(msg *api.Message, clientAddr *net.UDPAddr, enableLogging bool) {
+	data, err := msg.GetLeaderLostData()
+	if err != nil {
+		if enableLogging {
+			log.Printf("Failed to parse leader lost data: %v", err)
+		}
+		s.sendErrorMessage(clientAddr, msg.Size(), "Invalid leader lost data", "INVALID_DATA")
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// reports can't create networks, only members of one can make them
+	n, err := s.findNetwork(data.NetworkID, data.JoinSecret)
+	if err != nil && !errors.Is(err, errNoNetwork) {
+		if enableLogging {
+			log.Printf("Client %s can't report to network %q: %v", clientAddr, data.NetworkID, err)
+		}
+		s.sendJoinError(clientAddr, msg.Size(), err)
+		return
+	}
+
+	reporterID := msg.Sign.PubKey
+	var reporter *ClientInfo
+	if n != nil {
+		reporter = n.members[reporterID]
+	}
+	if reporter == nil || reporter.PairedWithID != data.LeaderID || data.Term > n.currentTerm {
+		if enableLogging {
+			log.Printf("Dropped leader lost report from %s, it isn't a member of leader %s in term %d", clientAddr, data.LeaderID, data.Term)
+		}
+		s.sendErrorMessage(clientAddr, msg.Size(), "Not a member of the leader's network, register again", "NOT_MEMBER")
+		return
+	}
+
+	if err := verifyClient(msg, reporter); err != nil {
+		if enableLogging {
+			log.Printf("Dropped leader lost report from %s: %v", clientAddr, err)
+		}
+		s.sendErrorMessage(clientAddr, msg.Size(), "Leader lost report isn't signed by its sender", "INVALID_SIGNATURE")
+		return
+	}
+
+	// the address is where the new leader gets pointed at, so it has to be real
+	if !s.limiter.isVerified(clientAddr, time.Now()) {
+		if enableLogging {
+			log.Printf("Dropped leader lost report for %s from unverified address %s", reporterID, clientAddr)
+		}
+		s.sendErrorMessage(clientAddr, msg.Size(), "Address hasn't answered a challenge, register again", "UNVERIFIED_ADDRESS")
+		return
+	}
+	reporter.Address = clientAddr
+	reporter.LastPing = time.Now()
+
+	leader, registered := s.leaderOf(n)
+	switch {
+	case registered && (data.Term < n.currentTerm || s.leaderAlive(leader)):
+		// the leader still pings the server or the report is about an older
+		// one, only the reporter lost touch
+		if enableLogging {
+			log.Printf("Client %s lost leader %s in term %d, but %s leads term %d", reporterID, data.LeaderID, data.Term, leader.ID, n.currentTerm)
+		}
+		s.pairClients(n, reporter, enableLogging)
+		return
+	case registered:
+		if enableLogging {
+			log.Printf("Client %s confirmed lost leader %s, ending term %d", reporterID, leader.ID, n.currentTerm)
+		}
+		s.vacateLeadership(n)
+	case s.awaitingReclaim(n):
+		// the leader from before a restart still has time to come back
+		if s.queueFull() {
+			s.sendErrorMessage(clientAddr, msg.Size(), "Waiting queue is full", "QUEUE_FULL")
+			return
+		}
+		s.clients[reporterID] = reporter
+		delete(n.members, reporterID)
+		n.waitingQueue = append(n.waitingQueue, reporter)
+		s.sendWaitingMessage(clientAddr)
+		return
+	}
+
+	s.clients[reporterID] = reporter
+	delete(n.members, reporterID)
+	s.assignLeader(n, reporter, enableLogging)
+
+	for _, member := range n.members {
+		s.pairClients(n, member, enableLogging)
+	}
+}
+
+// leaderAlive reports whether the leader pinged within the last ping interval
+// and a half, late enough that one lost ping doesn't count against it
+func (s *Server) leaderAlive(leader *ClientInfo) bool {
+	return time.Since(leader.LastPing) <= s.pingInterval*3/2
+}
@@ -0,0 +1,70 @@
+package stun
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hcp-uw/mosaic/internal/api"
+)
+
+// leaderLost creates a LeaderLost report signed with the identity's key
+func (i *testIdentity) leaderLost(t *testing.T, networkID, leaderID string, term uint) *api.Message {
+	t.Helper()
+
+	msg := api.NewLeaderLostMessage(api.NewSignature(i.id), i.publicKey, networkID, "", leaderID, term)
+	if err := msg.SignWith(i.key); err != nil {
+		t.Fatalf("Failed to sign leader lost report: %v", err)
+	}
+	return msg
+}
+
+func TestLeaderLostOnlyFromMembers(t *testing.T) {
+	config := &ServerConfig{
+		ListenAddress: "127.0.0.1:0",
+		ClientTimeout: 5 * time.Second,
+		PingInterval:  100 * time.Millisecond,
+		LeaseDuration: 5 * time.Second,
+	}
+	server := NewServer(config)
+	if err := server.Start(config); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer server.Stop()
+	serverAddr := server.conn.LocalAddr().(*net.UDPAddr)
+
+	leader, member := newStateTestClient(t), newStateTestClient(t)
+	leaderIdentity, memberIdentity := newTestIdentity(t), newTestIdentity(t)
+	registerTestClient(t, leader, serverAddr, leaderIdentity, "", "")
+	expectMessages(t, leader, api.RegisterSuccess, api.AssignedAsLeader)
+	registerTestClient(t, member, serverAddr, memberIdentity, "", "")
+	expectMessages(t, member, api.RegisterSuccess, api.PeerAssignment)
+	expectMessages(t, leader, api.PeerAssignment)
+
+	// the leader goes quiet
+	time.Sleep(200 * time.Millisecond)
+
+	// a key the server never paired can't take over, or create networks
+	outsider := newStateTestClient(t)
+	outsiderIdentity := newTestIdentity(t)
+	sendToServer(t, outsider, serverAddr, outsiderIdentity.leaderLost(t, "", leaderIdentity.id, 1))
+	expectServerError(t, outsider, "NOT_MEMBER")
+	sendToServer(t, outsider, serverAddr, outsiderIdentity.leaderLost(t, "other", leaderIdentity.id, 1))
+	expectServerError(t, outsider, "NOT_MEMBER")
+	if got := server.GetNetworks(); got != 1 {
+		t.Errorf("Expected reports not to create networks, got %d networks", got)
+	}
+
+	// nor can the member from an address that never answered a challenge
+	sendToServer(t, outsider, serverAddr, memberIdentity.leaderLost(t, "", leaderIdentity.id, 1))
+	expectServerError(t, outsider, "UNVERIFIED_ADDRESS")
+	if id, _ := server.GetLeader(""); id != leaderIdentity.id {
+		t.Fatalf("Expected %s to still lead, got %s", leaderIdentity.id, id)
+	}
+
+	sendToServer(t, member, serverAddr, memberIdentity.leaderLost(t, "", leaderIdentity.id, 1))
+	expectMessages(t, member, api.AssignedAsLeader)
+	if id, term := server.GetLeader(""); id != memberIdentity.id || term != 2 {
+		t.Errorf("Expected %s to lead term 2, got %s in term %d", memberIdentity.id, id, term)
+	}
+}
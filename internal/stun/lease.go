@@ -0,0 +1,73 @@
+package stun
+
+/*
+
+This file is for leader leases. A leader holds leadership for LeaseDuration
+and every ping renews it. A lease that runs out ends the leader's term: the
+leader is dropped, the term of its network goes up and the waiting client
+with the lowest queue position, if there is one, leads the new term. Every
+AssignedAsLeader and PeerAssignment carries the term so clients can tell a
+stale leader apart.
+
+*/
+
+import (
+	"log"
+	"slices"
+	"time"
+)
+
+// renewLease extends the lease of a network's leader. Callers hold the mutex.
+func (s *Server) renewLease(n *network) {
+	expiration := time.Now().Add(s.leaseDuration)
+	if n.leaseExpirationTimeStamp == nil {
+		n.leaseID++
+	}
+	n.leaseExpirationTimeStamp = &expiration
+}
+
+// expireLease ends the term of every leader whose lease ran out
+func (s *Server) expireLease(enableLogging bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	for _, n := range s.networks {
+		if n.currentLeaderID == "" || n.leaseExpirationTimeStamp == nil || now.Before(*n.leaseExpirationTimeStamp) {
+			continue
+		}
+
+		if enableLogging {
+			log.Printf("Lease %d of leader %s expired in term %d of network %s", n.leaseID, n.currentLeaderID, n.currentTerm, n.id)
+		}
+		s.vacateLeadership(n)
+		s.promoteWaiting(n, enableLogging)
+	}
+}
+
+// vacateLeadership drops a network's leader and starts a new term with
+// nobody leading it yet. Callers hold the mutex.
+func (s *Server) vacateLeadership(n *network) {
+	delete(s.clients, n.currentLeaderID)
+	n.currentLeaderID = ""
+	n.leaderKey = nil
+	n.currentTerm++
+	n.leaseExpirationTimeStamp = nil
+	n.vacated = time.Now()
+	s.saveState()
+}
+
+// promoteWaiting makes the waiting client of a network with the lowest queue
+// position its leader. Callers hold the mutex.
+func (s *Server) promoteWaiting(n *network, enableLogging bool) {
+	if len(n.waitingQueue) == 0 {
+		return
+	}
+
+	slices.SortFunc(n.waitingQueue, func(a, b *ClientInfo) int {
+		return s.queuePositions[a.ID] - s.queuePositions[b.ID]
+	})
+	next := n.waitingQueue[0]
+	n.waitingQueue = n.waitingQueue[1:]
+	s.assignLeader(n, next, enableLogging)
+}
@@ -0,0 +1,74 @@
+package stun
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hcp-uw/mosaic/internal/api"
+)
+
+func TestLeaderLeaseRenewalAndExpiry(t *testing.T) {
+	config := &ServerConfig{
+		ListenAddress: "127.0.0.1:0",
+		ClientTimeout: 400 * time.Millisecond,
+		LeaseDuration: 300 * time.Millisecond,
+	}
+	server := NewServer(config)
+	if err := server.Start(config); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer server.Stop()
+	serverAddr := server.conn.LocalAddr().(*net.UDPAddr)
+
+	leader, leaderIdentity := newStateTestClient(t), newTestIdentity(t)
+	leaderID := leaderIdentity.id
+	registerTestClient(t, leader, serverAddr, leaderIdentity, "", "")
+	expectMessages(t, leader, api.RegisterSuccess)
+	msg := readUDPMessage(t, leader)
+	data, err := msg.GetAssignedAsLeaderData()
+	if err != nil {
+		t.Fatalf("Expected AssignedAsLeader, got %s: %v", msg.Type, err)
+	}
+	if data.Term != 1 || data.LeaseDuration != 300*time.Millisecond {
+		t.Errorf("Expected term 1 with a 300ms lease, got %+v", data)
+	}
+
+	// pings keep the lease going well past its duration
+	for range 8 {
+		sendToServer(t, leader, serverAddr, leaderIdentity.ping(t))
+		time.Sleep(100 * time.Millisecond)
+	}
+	if id, term := server.GetLeader(""); id != leaderID || term != 1 {
+		t.Fatalf("Expected %s to still lead term 1, got %q in term %d", leaderID, id, term)
+	}
+
+	// without them it runs out and the term ends, the network may already be
+	// dropped as nobody is left in it
+	time.Sleep(800 * time.Millisecond)
+	if id, term := server.GetLeader(""); id != "" || term != 2 && server.GetNetworks() != 0 {
+		t.Fatalf("Expected no leader in term 2 after the lease expired, got %q in term %d", id, term)
+	}
+	if server.GetConnectedClients() != 0 {
+		t.Errorf("Expected the expired leader to be dropped, got %d clients", server.GetConnectedClients())
+	}
+
+	// the next client leads term 2 and the one after is paired in it
+	next, member := newStateTestClient(t), newStateTestClient(t)
+	nextIdentity := newTestIdentity(t)
+	registerTestClient(t, next, serverAddr, nextIdentity, "", "")
+	expectMessages(t, next, api.RegisterSuccess)
+	if data, err := readUDPMessage(t, next).GetAssignedAsLeaderData(); err != nil || data.Term != 2 {
+		t.Errorf("Expected leadership of term 2, got %+v, %v", data, err)
+	}
+
+	registerTestClient(t, member, serverAddr, newTestIdentity(t), "", "")
+	expectMessages(t, member, api.RegisterSuccess)
+	assignment, err := readUDPMessage(t, member).GetPeerAssignmentData()
+	if err != nil {
+		t.Fatalf("Expected PeerAssignment: %v", err)
+	}
+	if assignment.PeerID != nextIdentity.id || assignment.Term != 2 {
+		t.Errorf("Expected assignment to %s in term 2, got %+v", nextIdentity.id, assignment)
+	}
+}
@@ -0,0 +1,257 @@
+package stun
+
+/*
+
+This file is for abuse protection. Every source IP gets a token bucket of
+RateLimit messages a second, and datagrams over it are dropped before they
+are handled. Dropped datagrams and errors caused by the client are strikes;
+BanThreshold strikes within BanDuration get the IP banned for BanDuration.
+At most MaxInFlight messages are handled at once, anything past that is
+dropped too.
+
+Source IPs can be spoofed, so anyone could collect strikes in a leader's
+name. Addresses that answered a challenge are never struck and bans don't
+apply to them, only to the rest of their IP.
+
+UDP source addresses are easy to spoof, so the server could be used to
+reflect traffic at someone else. Until an address has proven it is real by
+answering a registration challenge, nothing sent back to it is larger than
+the datagram it answers: errors lose their text, Binding responses their
+SOFTWARE attribute, and whatever still doesn't fit is dropped. Our own
+Binding requests are padded so the answer always fits.
+
+*/
+
+import (
+	"maps"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxChallenges caps the registrations waiting on a signed nonce, spoofed
+// sources could otherwise fill the map
+const maxChallenges = 1024
+
+// verifiedTimeout is how long an address counts as real after its challenge
+// or its last signed ping, paired members stop talking to the server but may
+// still ask for a relay. At most maxVerified addresses are kept.
+const (
+	verifiedTimeout = time.Hour
+	maxVerified     = 65536
+)
+
+// clientFaultCodes are the errors that count as strikes against a source,
+// the rest are about the server's state
+var clientFaultCodes = map[string]bool{
+	"PARSE_ERROR":       true,
+	"UNKNOWN_MESSAGE":   true,
+	"INVALID_DATA":      true,
+	"INVALID_KEY":       true,
+	"INVALID_SIGNATURE": true,
+	"INVALID_SECRET":    true,
+	"INVALID_NETWORK":   true,
+	"NO_CHALLENGE":      true,
+}
+
+// source is the rate limiting state of one IP
+type source struct {
+	tokens     float64
+	last       time.Time
+	strikes    int
+	lastStrike time.Time
+	banned     time.Time
+}
+
+// limiter holds the token buckets, bans and verified addresses. It has its
+// own lock so replies can check it while the server's mutex is held.
+type limiter struct {
+	mutex        sync.Mutex
+	rate         float64
+	burst        float64
+	banThreshold int
+	banDuration  time.Duration
+	sources      map[string]*source
+	// verified holds when each address last proved it is real
+	verified map[string]time.Time
+}
+
+func newLimiter(config *ServerConfig) *limiter {
+	burst := float64(config.RateBurst)
+	if burst < config.RateLimit {
+		burst = config.RateLimit
+	}
+	return &limiter{
+		rate:         config.RateLimit,
+		burst:        burst,
+		banThreshold: config.BanThreshold,
+		banDuration:  config.BanDuration,
+		sources:      make(map[string]*source),
+		verified:     make(map[string]time.Time),
+	}
+}
+
+// allow reports whether a datagram from addr may be handled and takes a
+// token for it, banned reports whether it was dropped because its IP is banned
+func (l *limiter) allow(addr *net.UDPAddr, now time.Time) (ok, banned bool) {
+	if l.rate <= 0 && l.banThreshold <= 0 {
+		return true, false
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	verified := l.isVerifiedLocked(addr, now)
+	ip := addr.IP.String()
+	src, exists := l.sources[ip]
+	if !exists {
+		src = &source{tokens: l.burst, last: now}
+		l.sources[ip] = src
+	}
+	if now.Before(src.banned) && !verified {
+		return false, true
+	}
+	if l.rate <= 0 {
+		return true, false
+	}
+
+	src.tokens += now.Sub(src.last).Seconds() * l.rate
+	if src.tokens > l.burst {
+		src.tokens = l.burst
+	}
+	src.last = now
+	if src.tokens < 1 {
+		if !verified {
+			l.strikeLocked(src, now)
+		}
+		return false, false
+	}
+	src.tokens--
+	return true, false
+}
+
+// strike counts an offence against the IP of addr, unless addr answered a
+// challenge and the offence may have been spoofed in its name
+func (l *limiter) strike(addr *net.UDPAddr, now time.Time) {
+	if l.banThreshold <= 0 {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.isVerifiedLocked(addr, now) {
+		return
+	}
+	ip := addr.IP.String()
+	src, exists := l.sources[ip]
+	if !exists {
+		src = &source{tokens: l.burst, last: now}
+		l.sources[ip] = src
+	}
+	l.strikeLocked(src, now)
+}
+
+func (l *limiter) strikeLocked(src *source, now time.Time) {
+	if l.banThreshold <= 0 {
+		return
+	}
+	if now.Sub(src.lastStrike) > l.banDuration {
+		src.strikes = 0
+	}
+	src.strikes++
+	src.lastStrike = now
+	if src.strikes >= l.banThreshold {
+		src.banned = now.Add(l.banDuration)
+		src.strikes = 0
+	}
+}
+
+// verify records that addr answered a challenge, so it is a real address
+func (l *limiter) verify(addr *net.UDPAddr, now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if _, ok := l.verified[addr.String()]; !ok && len(l.verified) >= maxVerified {
+		return
+	}
+	l.verified[addr.String()] = now
+}
+
+// isVerified reports whether addr answered a challenge recently
+func (l *limiter) isVerified(addr *net.UDPAddr, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.isVerifiedLocked(addr, now)
+}
+
+func (l *limiter) isVerifiedLocked(addr *net.UDPAddr, now time.Time) bool {
+	at, ok := l.verified[addr.String()]
+	return ok && now.Sub(at) <= verifiedTimeout
+}
+
+// verifiedAddresses returns when every verified address last proved it is real
+func (l *limiter) verifiedAddresses() map[string]time.Time {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return maps.Clone(l.verified)
+}
+
+// restoreVerified replaces the verified addresses with the ones a peer
+// server sent, see replication.go
+func (l *limiter) restoreVerified(verified map[string]time.Time, now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.verified = make(map[string]time.Time, min(len(verified), maxVerified))
+	for addr, at := range verified {
+		if len(l.verified) >= maxVerified {
+			break
+		}
+		if now.Sub(at) <= verifiedTimeout {
+			l.verified[addr] = at
+		}
+	}
+}
+
+// expire forgets idle sources and stale verified addresses
+func (l *limiter) expire(now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// by then the bucket has refilled and old strikes no longer count
+	idleAfter := l.banDuration
+	if l.rate > 0 {
+		idleAfter = max(idleAfter, time.Duration(l.burst/l.rate*float64(time.Second)))
+	}
+	for ip, src := range l.sources {
+		idle := now.Sub(src.last) > idleAfter && now.Sub(src.lastStrike) > idleAfter
+		if idle && !now.Before(src.banned) {
+			delete(l.sources, ip)
+		}
+	}
+	for addr, at := range l.verified {
+		if now.Sub(at) > verifiedTimeout {
+			delete(l.verified, addr)
+		}
+	}
+}
+
+// bans returns how many IPs are banned
+func (l *limiter) bans(now time.Time) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	n := 0
+	for _, src := range l.sources {
+		if now.Before(src.banned) {
+			n++
+		}
+	}
+	return n
+}
+
+// GetBannedSources returns the number of source IPs that are banned
+func (s *Server) GetBannedSources() int {
+	return s.limiter.bans(time.Now())
+}
@@ -0,0 +1,234 @@
+package stun
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hcp-uw/mosaic/internal/api"
+)
+
+func TestLimiterBansRepeatOffenders(t *testing.T) {
+	l := newLimiter(&ServerConfig{
+		RateLimit:    1,
+		RateBurst:    2,
+		BanThreshold: 3,
+		BanDuration:  time.Minute,
+	})
+	now := time.Now()
+	source := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4000}
+	other := &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 4000}
+
+	// the burst goes through, then one message a second
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow(source, now); !ok {
+			t.Fatalf("Expected message %d of the burst to be allowed", i+1)
+		}
+	}
+	if ok, banned := l.allow(source, now); ok || banned {
+		t.Fatalf("Expected the message past the burst to be rate limited, got ok %v banned %v", ok, banned)
+	}
+	if ok, _ := l.allow(source, now.Add(time.Second)); !ok {
+		t.Fatal("Expected a message a second later to be allowed")
+	}
+	if ok, _ := l.allow(other, now); !ok {
+		t.Fatal("Expected another source to have its own bucket")
+	}
+
+	// two more strikes within BanDuration make three
+	l.strike(source, now.Add(time.Second))
+	l.strike(source, now.Add(2*time.Second))
+	if ok, banned := l.allow(source, now.Add(10*time.Second)); ok || !banned {
+		t.Fatalf("Expected the source to be banned, got ok %v banned %v", ok, banned)
+	}
+	if got := l.bans(now.Add(10 * time.Second)); got != 1 {
+		t.Errorf("Expected 1 banned source, got %d", got)
+	}
+
+	// an address of the IP that answered a challenge may have been spoofed,
+	// it is neither struck nor kept out by the ban
+	verified := &net.UDPAddr{IP: source.IP, Port: 5000}
+	l.verify(verified, now)
+	if ok, banned := l.allow(verified, now.Add(10*time.Second)); !ok || banned {
+		t.Errorf("Expected a verified address to get past the ban, got ok %v banned %v", ok, banned)
+	}
+	for i := 0; i < 5; i++ {
+		l.strike(verified, now.Add(10*time.Second))
+	}
+	if got := l.sources["192.0.2.1"].strikes; got != 0 {
+		t.Errorf("Expected no strikes for a verified address, got %d", got)
+	}
+
+	later := now.Add(2*time.Second + time.Minute + time.Millisecond)
+	if ok, banned := l.allow(source, later); !ok || banned {
+		t.Errorf("Expected the ban to be over, got ok %v banned %v", ok, banned)
+	}
+
+	l.expire(later.Add(2 * time.Minute))
+	if len(l.sources) != 0 {
+		t.Errorf("Expected idle sources to be forgotten, got %d", len(l.sources))
+	}
+}
+
+func TestServerDropsFloodedSource(t *testing.T) {
+	config := &ServerConfig{
+		ListenAddress: "127.0.0.1:0",
+		ClientTimeout: 5 * time.Second,
+		RateLimit:     1,
+		RateBurst:     2,
+		BanThreshold:  5,
+		BanDuration:   time.Minute,
+	}
+	server := NewServer(config)
+	if err := server.Start(config); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer server.Stop()
+	serverAddr := server.conn.LocalAddr().(*net.UDPAddr)
+
+	// every payload is a parse error, large enough to be answered
+	conn := newStateTestClient(t)
+	payload := []byte("invalid json " + strings.Repeat("x", 200))
+	for i := 0; i < 10; i++ {
+		if _, err := conn.WriteToUDP(payload, serverAddr); err != nil {
+			t.Fatalf("Failed to send payload: %v", err)
+		}
+	}
+	expectServerError(t, conn, "PARSE_ERROR")
+	expectServerError(t, conn, "PARSE_ERROR")
+
+	buffer := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := conn.Read(buffer); err == nil {
+		t.Fatalf("Expected only the burst to be answered, got %s", buffer[:n])
+	}
+
+	if got := server.GetBannedSources(); got != 1 {
+		t.Errorf("Expected the source to be banned, got %d banned sources", got)
+	}
+	_, _, dropped := server.counters.snapshot()
+	if dropped["rate_limited"] == 0 || dropped["banned"] == 0 {
+		t.Errorf("Expected rate limited and banned drops, got %v", dropped)
+	}
+}
+
+func TestUnverifiedRepliesNoLargerThanRequests(t *testing.T) {
+	server, serverAddr := newStateTestServer(t, "", time.Second)
+	defer server.Stop()
+
+	// the error is larger than the message, even without its text
+	conn := newStateTestClient(t)
+	sendToServer(t, conn, serverAddr, &api.Message{Type: "bogus", Timestamp: time.Now()})
+	buffer := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := conn.Read(buffer); err == nil {
+		t.Fatalf("Expected no reply to an unverified address, got %s", buffer[:n])
+	}
+	_, _, dropped := server.counters.snapshot()
+	if dropped["oversized_reply"] != 1 {
+		t.Errorf("Expected one oversized reply to be dropped, got %v", dropped)
+	}
+
+	// a Binding request with no attributes is smaller than any response
+	id, request, err := api.NewBindingRequest()
+	if err != nil {
+		t.Fatalf("Failed to create binding request: %v", err)
+	}
+	bare := append([]byte(nil), request[:20]...)
+	bare[2], bare[3] = 0, 0
+	if _, err := conn.WriteToUDP(bare, serverAddr); err != nil {
+		t.Fatalf("Failed to send binding request: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := conn.Read(buffer); err == nil {
+		t.Fatalf("Expected no reply to a bare binding request, got %x", buffer[:n])
+	}
+
+	// our own padded request gets the response without SOFTWARE
+	if _, err := conn.WriteToUDP(request, serverAddr); err != nil {
+		t.Fatalf("Failed to send binding request: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buffer)
+	if err != nil {
+		t.Fatalf("Failed to read binding response: %v", err)
+	}
+	if n > len(request) {
+		t.Errorf("Expected a response of at most %d bytes, got %d", len(request), n)
+	}
+	if _, err := api.ParseBindingResponse(buffer[:n], id); err != nil {
+		t.Errorf("Failed to parse binding response: %v", err)
+	}
+
+	// once the address answered a challenge it gets full replies
+	registerTestClient(t, conn, serverAddr, newTestIdentity(t), "", "")
+	expectMessages(t, conn, api.RegisterSuccess, api.AssignedAsLeader)
+	sendToServer(t, conn, serverAddr, &api.Message{Type: "bogus", Timestamp: time.Now()})
+	expectServerError(t, conn, "UNKNOWN_MESSAGE")
+}
+
+func TestQueueFull(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "stun-state.json")
+	server, serverAddr := newStateTestServer(t, stateFile, 5*time.Second)
+	leader := newStateTestClient(t)
+	registerTestClient(t, leader, serverAddr, newTestIdentity(t), "", "")
+	expectMessages(t, leader, api.RegisterSuccess, api.AssignedAsLeader)
+	server.Stop()
+
+	// after the restart everyone waits on the recorded leader
+	config := &ServerConfig{
+		ListenAddress: "127.0.0.1:0",
+		ClientTimeout: 5 * time.Second,
+		MaxQueueSize:  1,
+		StateFile:     stateFile,
+		ReclaimGrace:  5 * time.Second,
+	}
+	server = NewServer(config)
+	if err := server.Start(config); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer server.Stop()
+	serverAddr = server.conn.LocalAddr().(*net.UDPAddr)
+
+	first, second := newStateTestClient(t), newStateTestClient(t)
+	registerTestClient(t, first, serverAddr, newTestIdentity(t), "", "")
+	expectMessages(t, first, api.RegisterSuccess, api.WaitingForPeer)
+
+	registerTestClient(t, second, serverAddr, newTestIdentity(t), "", "")
+	expectServerError(t, second, "QUEUE_FULL")
+	if got := server.GetWaitingClients(); got != 1 {
+		t.Errorf("Expected 1 waiting client, got %d", got)
+	}
+	if got := server.GetConnectedClients(); got != 1 {
+		t.Errorf("Expected the full queue to keep the second client out, got %d clients", got)
+	}
+}
+
+func TestAssignmentsOnlyToVerifiedAddresses(t *testing.T) {
+	server, serverAddr := newStateTestServer(t, "", 5*time.Second)
+	defer server.Stop()
+
+	leader, member := newStateTestClient(t), newStateTestClient(t)
+	registerTestClient(t, leader, serverAddr, newTestIdentity(t), "", "")
+	expectMessages(t, leader, api.RegisterSuccess, api.AssignedAsLeader)
+
+	// as if the leader's verification had run out
+	server.limiter.mutex.Lock()
+	delete(server.limiter.verified, leader.LocalAddr().String())
+	server.limiter.mutex.Unlock()
+
+	registerTestClient(t, member, serverAddr, newTestIdentity(t), "", "")
+	expectMessages(t, member, api.RegisterSuccess, api.PeerAssignment)
+
+	buffer := make([]byte, 1024)
+	leader.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := leader.Read(buffer); err == nil {
+		t.Fatalf("Expected no assignment to an unverified address, got %s", buffer[:n])
+	}
+	_, _, dropped := server.counters.snapshot()
+	if dropped["oversized_reply"] != 1 {
+		t.Errorf("Expected the assignment to be dropped, got %v", dropped)
+	}
+}
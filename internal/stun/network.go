@@ -0,0 +1,207 @@
+package stun
+
+/*
+
+This file is for networks. Every client registers into a network, named by
+the network ID in its ClientRegister, and is only ever paired within it. Each
+network has its own leader, term, lease, members and waiting queue, so
+unrelated clusters can share one server without seeing each other.
+
+A network can be closed with a join secret: the client that creates the
+network sets it and everyone after has to present the same one. The server
+only keeps a hash of it, salted with the network ID. It travels in plaintext
+in every ClientRegister and LeaderLost though, so anyone who can see a
+registration can join.
+
+At most MaxNetworks exist at once. A network without a leader, waiting
+clients or members is dropped, as is one whose members haven't reported
+losing their leader within the ClientTimeout of its leadership being vacated;
+they have to register again. Terms never go back, a network created after
+one was dropped starts from the highest term any dropped network reached, so
+clients that remember an old term don't take the new leader for a stale one.
+
+*/
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net"
+	"time"
+)
+
+// DefaultNetworkID is the network of clients that don't name one
+const DefaultNetworkID = "default"
+
+const (
+	// maxNetworkIDLength keeps network IDs to something that fits in a log line
+	maxNetworkIDLength = 64
+	// maxJoinSecretLength keeps a registration well within maxMessageSize
+	maxJoinSecretLength = 128
+)
+
+var (
+	errInvalidNetworkID = errors.New("invalid network ID")
+	errWrongJoinSecret  = errors.New("wrong join secret")
+	errNoNetwork        = errors.New("no such network")
+	errTooManyNetworks  = errors.New("too many networks")
+)
+
+// network is the leadership state of one cluster
+type network struct {
+	id         string
+	secretHash []byte
+
+	currentLeaderID          string
+	currentTerm              uint
+	leaseExpirationTimeStamp *time.Time
+	leaseID                  uint
+	// leaderKey is the leader's public key, kept so it can reclaim
+	// leadership after a restart without registering again
+	leaderKey *ecdsa.PublicKey
+	// reclaimDeadline ends the window in which only the recorded leader can
+	// take leadership back after a restart
+	reclaimDeadline time.Time
+	// vacated is when the network last lost its leader, zero while it has one
+	vacated time.Time
+
+	waitingQueue []*ClientInfo
+	// members are the clients paired with a leader, kept so they can all be
+	// pointed at the next one, see election.go
+	members map[string]*ClientInfo
+}
+
+func newNetwork(id string, secretHash []byte) *network {
+	return &network{
+		id:           id,
+		secretHash:   secretHash,
+		waitingQueue: make([]*ClientInfo, 0),
+		members:      make(map[string]*ClientInfo),
+	}
+}
+
+// hashJoinSecret returns the hash kept for a network's join secret, nil for an open network
+func hashJoinSecret(networkID, secret string) []byte {
+	if secret == "" {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(networkID + "\x00" + secret))
+	return sum[:]
+}
+
+// joinNetwork returns the network a client naming networkID and secret
+// belongs to, creating it if it doesn't exist yet. Callers hold the mutex.
+func (s *Server) joinNetwork(networkID, secret string) (*network, error) {
+	n, err := s.findNetwork(networkID, secret)
+	if !errors.Is(err, errNoNetwork) {
+		return n, err
+	}
+
+	if s.maxNetworks > 0 && len(s.networks) >= s.maxNetworks {
+		return nil, errTooManyNetworks
+	}
+	if networkID == "" {
+		networkID = DefaultNetworkID
+	}
+	n = newNetwork(networkID, hashJoinSecret(networkID, secret))
+	n.currentTerm = s.droppedTerm
+	s.networks[networkID] = n
+	s.saveState()
+	return n, nil
+}
+
+// findNetwork returns the network networkID names if it exists and secret
+// is its join secret. Callers hold the mutex.
+func (s *Server) findNetwork(networkID, secret string) (*network, error) {
+	if networkID == "" {
+		networkID = DefaultNetworkID
+	}
+	if len(networkID) > maxNetworkIDLength {
+		return nil, errInvalidNetworkID
+	}
+
+	n, ok := s.networks[networkID]
+	if !ok {
+		return nil, errNoNetwork
+	}
+	if subtle.ConstantTimeCompare(n.secretHash, hashJoinSecret(networkID, secret)) != 1 {
+		return nil, errWrongJoinSecret
+	}
+	return n, nil
+}
+
+// networkOf returns the network a registered client is in. Callers hold the mutex.
+func (s *Server) networkOf(client *ClientInfo) *network {
+	return s.networks[client.NetworkID]
+}
+
+// knownClient returns the registered client or paired member with id and
+// its network, nil if there is none. Callers hold the mutex.
+func (s *Server) knownClient(id string) (*ClientInfo, *network) {
+	if client, ok := s.clients[id]; ok {
+		if n := s.networkOf(client); n != nil {
+			return client, n
+		}
+		return nil, nil
+	}
+	for _, n := range s.networks {
+		if member, ok := n.members[id]; ok {
+			return member, n
+		}
+	}
+	return nil, nil
+}
+
+// leaderOf returns the network's leader if it is registered. Callers hold the mutex.
+func (s *Server) leaderOf(n *network) (*ClientInfo, bool) {
+	if n.currentLeaderID == "" {
+		return nil, false
+	}
+	leader, ok := s.clients[n.currentLeaderID]
+	return leader, ok
+}
+
+// sendJoinError tells a client why it couldn't join a network
+func (s *Server) sendJoinError(clientAddr *net.UDPAddr, requestSize int, err error) {
+	if errors.Is(err, errWrongJoinSecret) {
+		s.sendErrorMessage(clientAddr, requestSize, "Wrong join secret for network", "INVALID_SECRET")
+	} else if errors.Is(err, errTooManyNetworks) {
+		s.sendErrorMessage(clientAddr, requestSize, "Too many networks", "NETWORKS_FULL")
+	} else {
+		s.sendErrorMessage(clientAddr, requestSize, "Invalid network ID", "INVALID_NETWORK")
+	}
+}
+
+// expireNetworks drops networks nobody is in anymore, and the members of
+// networks that have had no leader for longer than timeout
+func (s *Server) expireNetworks(timeout time.Duration, now time.Time, enableLogging bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	inUse := make(map[string]bool, len(s.networks))
+	for _, client := range s.clients {
+		inUse[client.NetworkID] = true
+	}
+
+	for id, n := range s.networks {
+		if inUse[id] || n.currentLeaderID != "" || len(n.waitingQueue) > 0 {
+			continue
+		}
+		// networks taken over from the other server of a pair don't say when
+		if n.vacated.IsZero() {
+			n.vacated = now
+		}
+		if len(n.members) > 0 && now.Sub(n.vacated) <= timeout {
+			continue
+		}
+
+		delete(s.networks, id)
+		s.droppedTerm = max(s.droppedTerm, n.currentTerm)
+		s.saveState()
+		if enableLogging {
+			log.Printf("Dropped network %s, it has no leader, waiting clients or members", id)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package stun
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hcp-uw/mosaic/internal/api"
+)
+
+func TestNetworksAreIsolated(t *testing.T) {
+	server, serverAddr := newStateTestServer(t, "", time.Second)
+	defer server.Stop()
+
+	alpha, beta := newStateTestClient(t), newStateTestClient(t)
+	alphaIdentity, betaIdentity := newTestIdentity(t), newTestIdentity(t)
+	registerTestClient(t, alpha, serverAddr, alphaIdentity, "alpha", "s3cret")
+	expectMessages(t, alpha, api.RegisterSuccess, api.AssignedAsLeader)
+
+	// another network gets a leader of its own instead of being paired with alpha
+	registerTestClient(t, beta, serverAddr, betaIdentity, "beta", "")
+	expectMessages(t, beta, api.RegisterSuccess, api.AssignedAsLeader)
+
+	if id, term := server.GetLeader("alpha"); id != alphaIdentity.id || term != 1 {
+		t.Errorf("Expected alpha to lead term 1 of its network, got %s in term %d", id, term)
+	}
+	if id, term := server.GetLeader("beta"); id != betaIdentity.id || term != 1 {
+		t.Errorf("Expected beta to lead term 1 of its network, got %s in term %d", id, term)
+	}
+	if id, _ := server.GetLeader(""); id != "" {
+		t.Errorf("Expected no leader in the default network, got %s", id)
+	}
+
+	intruder := newStateTestClient(t)
+	registerTestClient(t, intruder, serverAddr, newTestIdentity(t), "alpha", "guess")
+	msg := readUDPMessage(t, intruder)
+	if msg.Type != api.ServerError {
+		t.Fatalf("Expected %s, got %s", api.ServerError, msg.Type)
+	}
+	if data, err := msg.GetServerErrorData(); err != nil || data.ErrorCode != "INVALID_SECRET" {
+		t.Errorf("Expected INVALID_SECRET, got %+v (%v)", data, err)
+	}
+
+	member := newStateTestClient(t)
+	registerTestClient(t, member, serverAddr, newTestIdentity(t), "alpha", "s3cret")
+	expectMessages(t, member, api.RegisterSuccess, api.PeerAssignment)
+	expectMessages(t, alpha, api.PeerAssignment)
+
+	if got := server.GetNetworks(); got != 2 {
+		t.Errorf("Expected 2 networks, got %d", got)
+	}
+}
+
+func TestNetworksAreCappedAndExpire(t *testing.T) {
+	config := &ServerConfig{
+		ListenAddress: "127.0.0.1:0",
+		ClientTimeout: 400 * time.Millisecond,
+		MaxNetworks:   2,
+	}
+	server := NewServer(config)
+	if err := server.Start(config); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer server.Stop()
+	serverAddr := server.conn.LocalAddr().(*net.UDPAddr)
+
+	for _, id := range []string{"alpha", "beta"} {
+		conn := newStateTestClient(t)
+		registerTestClient(t, conn, serverAddr, newTestIdentity(t), id, "")
+		expectMessages(t, conn, api.RegisterSuccess, api.AssignedAsLeader)
+	}
+
+	late, lateIdentity := newStateTestClient(t), newTestIdentity(t)
+	registerTestClient(t, late, serverAddr, lateIdentity, "gamma", "")
+	expectServerError(t, late, "NETWORKS_FULL")
+
+	// the leaders stop pinging, lose their leases and leave their networks empty
+	deadline := time.Now().Add(3 * time.Second)
+	for server.GetNetworks() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected empty networks to expire, %d left", server.GetNetworks())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	registerTestClient(t, late, serverAddr, lateIdentity, "gamma", "")
+	expectMessages(t, late, api.RegisterSuccess, api.AssignedAsLeader)
+}
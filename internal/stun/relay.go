@@ -0,0 +1,391 @@
+package stun
+
+/*
+
+This file is for the relay, a TURN-style fallback for peers that can't reach
+each other with hole punching, usually because one of them is behind a
+symmetric NAT.
+
+Both peers ask the server for a relay to the other with a RelayRequest. Once
+both have asked, the server opens an allocation: two UDP ports, one facing
+each peer. Whatever a peer sends to its port is forwarded out of the other
+port to the other peer, so each peer sees the other as the address of its
+port and nothing else about the connection has to change. Asking from both
+sides keeps the server from being used to send traffic to anyone who didn't
+want it.
+
+Only registered clients and paired members can ask, with a request signed
+by their key from the address the server knows them at, and only for the
+address of a leader or member of their own network.
+
+*/
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hcp-uw/mosaic/internal/api"
+)
+
+// relayBufferSize fits any UDP datagram
+const relayBufferSize = 64 * 1024
+
+var errRelayFull = errors.New("no relay allocations left")
+
+// relayKey is a requester and the peer it asked for, in that order
+type relayKey struct {
+	from string
+	to   string
+}
+
+// relay holds the allocations the server forwards traffic for and the
+// requests still waiting on the other peer
+type relay struct {
+	mutex          sync.Mutex
+	host           net.IP
+	bandwidth      int
+	maxAllocations int
+	idleTimeout    time.Duration
+	enableLogging  bool
+
+	// pending maps a request to when it was last made
+	pending map[relayKey]time.Time
+	// allocations has every allocation under both of its keys
+	allocations map[relayKey]*allocation
+}
+
+// allocation relays between two clients, sides[i] is the port facing
+// clients[i] and addrs[i] its address
+type allocation struct {
+	mutex      sync.Mutex
+	clients    [2]*net.UDPAddr
+	sides      [2]*net.UDPConn
+	addrs      [2]*net.UDPAddr
+	tokens     float64
+	lastRefill time.Time
+	lastActive time.Time
+	bandwidth  int
+}
+
+func newRelay(config *ServerConfig, listenAddr *net.UDPAddr) *relay {
+	host := listenAddr.IP
+	if config.RelayHost != "" {
+		host = net.ParseIP(config.RelayHost)
+	}
+
+	return &relay{
+		host:           host,
+		bandwidth:      config.RelayBandwidth,
+		maxAllocations: config.MaxRelayAllocations,
+		idleTimeout:    config.ClientTimeout,
+		enableLogging:  config.EnableLogging,
+		pending:        make(map[relayKey]time.Time),
+		allocations:    make(map[relayKey]*allocation),
+	}
+}
+
+// request records that from wants a relay to to. It returns the allocation
+// once both of them have asked, nil while the other one hasn't, and whether
+// this request is the one that opened it.
+func (r *relay) request(from, to *net.UDPAddr) (*allocation, bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	key := relayKey{from: from.String(), to: to.String()}
+	if a, ok := r.allocations[key]; ok {
+		return a, false, nil
+	}
+
+	reverse := relayKey{from: key.to, to: key.from}
+	if _, ok := r.pending[reverse]; !ok {
+		if _, ok := r.pending[key]; !ok && len(r.pending) >= r.maxAllocations {
+			return nil, false, errRelayFull
+		}
+		r.pending[key] = time.Now()
+		return nil, false, nil
+	}
+
+	if len(r.allocations)/2 >= r.maxAllocations {
+		return nil, false, errRelayFull
+	}
+
+	a, err := r.allocate(to, from)
+	if err != nil {
+		return nil, false, err
+	}
+	delete(r.pending, reverse)
+	r.allocations[key] = a
+	r.allocations[reverse] = a
+
+	if r.enableLogging {
+		log.Printf("Relaying between %s on %s and %s on %s", to, a.addrs[0], from, a.addrs[1])
+	}
+	return a, true, nil
+}
+
+// allocate opens a port for each of the clients and starts forwarding
+func (r *relay) allocate(first, second *net.UDPAddr) (*allocation, error) {
+	a := &allocation{
+		clients:    [2]*net.UDPAddr{first, second},
+		tokens:     float64(r.bandwidth),
+		lastRefill: time.Now(),
+		lastActive: time.Now(),
+		bandwidth:  r.bandwidth,
+	}
+
+	for i := range a.sides {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: r.host})
+		if err != nil {
+			a.close()
+			return nil, fmt.Errorf("failed to open relay port: %w", err)
+		}
+		a.sides[i] = conn
+		a.addrs[i] = conn.LocalAddr().(*net.UDPAddr)
+	}
+
+	for i := range a.sides {
+		go a.forward(i, a.sides[i], a.sides[1-i], r.enableLogging)
+	}
+	return a, nil
+}
+
+// expire closes allocations that carried nothing for the idle timeout and
+// forgets requests the other peer never matched
+func (r *relay) expire(now time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for key, requested := range r.pending {
+		if now.Sub(requested) > r.idleTimeout {
+			delete(r.pending, key)
+		}
+	}
+
+	for key, a := range r.allocations {
+		if now.Sub(a.lastActiveAt()) > r.idleTimeout {
+			delete(r.allocations, key)
+			if a.close() && r.enableLogging {
+				log.Printf("Closed idle relay between %s and %s", a.clients[0], a.clients[1])
+			}
+		}
+	}
+}
+
+// close closes every allocation
+func (r *relay) close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for key, a := range r.allocations {
+		delete(r.allocations, key)
+		a.close()
+	}
+}
+
+// count returns the number of open allocations
+func (r *relay) count() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.allocations) / 2
+}
+
+// relayAddress is the address client has to send to to reach its peer
+func (a *allocation) relayAddress(client *net.UDPAddr) *net.UDPAddr {
+	if client.String() == a.clients[0].String() {
+		return a.addrs[0]
+	}
+	return a.addrs[1]
+}
+
+// peer is the client on the other side from client
+func (a *allocation) peer(client *net.UDPAddr) *net.UDPAddr {
+	if client.String() == a.clients[0].String() {
+		return a.clients[1]
+	}
+	return a.clients[0]
+}
+
+// forward sends what clients[side] sends to its port, in, on to the other
+// client through out until the allocation is closed
+func (a *allocation) forward(side int, in, out *net.UDPConn, enableLogging bool) {
+	from, to := a.clients[side], a.clients[1-side]
+
+	buffer := make([]byte, relayBufferSize)
+	for {
+		n, addr, err := in.ReadFromUDP(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		// only the client the port was opened for can use it
+		if addr.String() != from.String() {
+			continue
+		}
+		if !a.allow(n) {
+			if enableLogging {
+				log.Printf("Relay from %s over quota, dropping %d bytes", from, n)
+			}
+			continue
+		}
+
+		if _, err := out.WriteToUDP(buffer[:n], to); err != nil && enableLogging {
+			log.Printf("Failed to relay to %s: %v", to, err)
+		}
+	}
+}
+
+// allow takes n bytes from the allocation's quota, refilled at bandwidth
+// bytes per second up to a second's worth. A bandwidth of 0 means no quota.
+func (a *allocation) allow(n int) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := time.Now()
+	a.lastActive = now
+	if a.bandwidth <= 0 {
+		return true
+	}
+
+	a.tokens += now.Sub(a.lastRefill).Seconds() * float64(a.bandwidth)
+	a.tokens = min(a.tokens, float64(a.bandwidth))
+	a.lastRefill = now
+
+	if a.tokens < float64(n) {
+		return false
+	}
+	a.tokens -= float64(n)
+	return true
+}
+
+func (a *allocation) lastActiveAt() time.Time {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.lastActive
+}
+
+// close closes both ports, it returns false if they already were
+func (a *allocation) close() bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	closed := false
+	for i, conn := range a.sides {
+		if conn != nil {
+			conn.Close()
+			a.sides[i] = nil
+			closed = true
+		}
+	}
+	return closed
+}
+
+// handleRelayRequest answers a RelayRequest, sending both peers their relay
+// address once the second one has asked
+func (s *Server) handleRelayRequest(msg *api.Message, clientAddr *net.UDPAddr, enableLogging bool) {
+	if s.relay == nil {
+		s.sendErrorMessage(clientAddr, msg.Size(), "Relay is not enabled", "RELAY_DISABLED")
+		return
+	}
+
+	data, err := msg.GetRelayRequestData()
+	if err != nil {
+		if enableLogging {
+			log.Printf("Failed to parse relay request data: %v", err)
+		}
+		s.sendErrorMessage(clientAddr, msg.Size(), "Invalid relay request data", "INVALID_DATA")
+		return
+	}
+
+	peerAddr, err := net.ResolveUDPAddr("udp", data.PeerAddress)
+	if err != nil || peerAddr.String() == clientAddr.String() {
+		s.sendErrorMessage(clientAddr, msg.Size(), "Invalid relay peer address", "INVALID_DATA")
+		return
+	}
+
+	if !s.mayRelay(msg, clientAddr, peerAddr, enableLogging) {
+		return
+	}
+
+	a, opened, err := s.relay.request(clientAddr, peerAddr)
+	if err != nil {
+		if enableLogging {
+			log.Printf("Failed to relay %s to %s: %v", clientAddr, peerAddr, err)
+		}
+		if errors.Is(err, errRelayFull) {
+			s.sendErrorMessage(clientAddr, msg.Size(), "No relay allocations left", "RELAY_FULL")
+		} else {
+			s.sendErrorMessage(clientAddr, msg.Size(), "Failed to allocate relay", "RELAY_FAILED")
+		}
+		return
+	}
+	if a == nil {
+		// the peer hasn't asked yet, the client keeps asking until it has
+		return
+	}
+
+	if !opened {
+		s.sendReply(clientAddr, msg.Size(), api.NewRelayAllocatedMessage(peerAddr, a.relayAddress(clientAddr), a.bandwidth))
+		return
+	}
+
+	// the peer that asked first is waiting on it too, its request was the
+	// same shape as this one
+	for _, client := range a.clients {
+		s.sendReply(client, msg.Size(), api.NewRelayAllocatedMessage(a.peer(client), a.relayAddress(client), a.bandwidth))
+	}
+}
+
+// mayRelay checks that a relay request comes from a registered client or
+// member at the address the server knows it at, and that the peer is a
+// leader or member of the same network. It answers the requester if not.
+func (s *Server) mayRelay(msg *api.Message, clientAddr, peerAddr *net.UDPAddr, enableLogging bool) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	client, n := s.knownClient(msg.Sign.PubKey)
+	if client == nil || client.Address.String() != clientAddr.String() {
+		if enableLogging {
+			log.Printf("Dropped relay request from unknown client %s", clientAddr)
+		}
+		s.sendErrorMessage(clientAddr, msg.Size(), "Only registered clients can ask for a relay", "UNKNOWN_CLIENT")
+		return false
+	}
+	if err := verifyClient(msg, client); err != nil {
+		if enableLogging {
+			log.Printf("Dropped relay request from %s: %v", clientAddr, err)
+		}
+		s.sendErrorMessage(clientAddr, msg.Size(), "Relay request isn't signed by its sender", "INVALID_SIGNATURE")
+		return false
+	}
+
+	peerKnown := false
+	if leader, ok := s.leaderOf(n); ok && leader.Address.String() == peerAddr.String() {
+		peerKnown = true
+	}
+	for _, member := range n.members {
+		peerKnown = peerKnown || member.Address.String() == peerAddr.String()
+	}
+	if !peerKnown {
+		if enableLogging {
+			log.Printf("Dropped relay request from %s for %s, which isn't in network %s", clientAddr, peerAddr, n.id)
+		}
+		s.sendErrorMessage(clientAddr, msg.Size(), "Relay peer isn't in the network", "UNKNOWN_PEER")
+		return false
+	}
+	return true
+}
+
+// GetRelayAllocations returns the number of open relay allocations
+func (s *Server) GetRelayAllocations() int {
+	if s.relay == nil {
+		return 0
+	}
+	return s.relay.count()
+}
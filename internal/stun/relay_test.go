@@ -0,0 +1,193 @@
+package stun
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hcp-uw/mosaic/internal/api"
+)
+
+func TestRelayForwardsBetweenPeers(t *testing.T) {
+	config := &ServerConfig{
+		ListenAddress:       "127.0.0.1:0",
+		ClientTimeout:       5 * time.Second,
+		EnableRelay:         true,
+		RelayBandwidth:      1000,
+		MaxRelayAllocations: 1,
+	}
+	server := NewServer(config)
+	if err := server.Start(config); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer server.Stop()
+	serverAddr := server.conn.LocalAddr().(*net.UDPAddr)
+
+	peers := make([]*net.UDPConn, 4)
+	for i := range peers {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("Failed to open peer socket: %v", err)
+		}
+		defer conn.Close()
+		peers[i] = conn
+	}
+	a, b, stranger, outsider := peers[0], peers[1], peers[2], peers[3]
+	aAddr, bAddr := a.LocalAddr().(*net.UDPAddr), b.LocalAddr().(*net.UDPAddr)
+	aIdentity, bIdentity, strangerIdentity := newTestIdentity(t), newTestIdentity(t), newTestIdentity(t)
+
+	// only registered clients can ask, for peers in their own network
+	registerTestClient(t, a, serverAddr, aIdentity, "relay", "")
+	expectMessages(t, a, api.RegisterSuccess, api.AssignedAsLeader)
+	for _, member := range []struct {
+		conn     *net.UDPConn
+		identity *testIdentity
+	}{{b, bIdentity}, {stranger, strangerIdentity}} {
+		registerTestClient(t, member.conn, serverAddr, member.identity, "relay", "")
+		expectMessages(t, member.conn, api.RegisterSuccess, api.PeerAssignment)
+		expectMessages(t, a, api.PeerAssignment)
+	}
+
+	send := func(conn *net.UDPConn, to *net.UDPAddr, data []byte) {
+		t.Helper()
+		if _, err := conn.WriteToUDP(data, to); err != nil {
+			t.Fatalf("Failed to send: %v", err)
+		}
+	}
+	requestRelay := func(conn *net.UDPConn, identity *testIdentity, peer *net.UDPAddr) {
+		t.Helper()
+		msg := api.NewRelayRequestMessage(api.NewSignature(identity.id), peer)
+		if err := msg.SignWith(identity.key); err != nil {
+			t.Fatalf("Failed to sign relay request: %v", err)
+		}
+		data, err := msg.Serialize()
+		if err != nil {
+			t.Fatalf("Failed to serialize relay request: %v", err)
+		}
+		send(conn, serverAddr, data)
+	}
+	readAllocation := func(conn *net.UDPConn) *api.RelayAllocatedData {
+		t.Helper()
+		msg := readUDPMessage(t, conn)
+		data, err := msg.GetRelayAllocatedData()
+		if err != nil {
+			t.Fatalf("Expected RelayAllocated, got %s: %v", msg.Type, err)
+		}
+		return data
+	}
+
+	requestRelay(outsider, newTestIdentity(t), bAddr)
+	expectServerError(t, outsider, "UNKNOWN_CLIENT")
+	requestRelay(outsider, aIdentity, bAddr)
+	expectServerError(t, outsider, "UNKNOWN_CLIENT")
+	requestRelay(a, aIdentity, outsider.LocalAddr().(*net.UDPAddr))
+	expectServerError(t, a, "UNKNOWN_PEER")
+
+	// nothing is relayed until both peers have asked
+	requestRelay(a, aIdentity, bAddr)
+	time.Sleep(100 * time.Millisecond)
+	if got := server.GetRelayAllocations(); got != 0 {
+		t.Fatalf("Expected no allocation after one request, got %d", got)
+	}
+
+	requestRelay(b, bIdentity, aAddr)
+	aAlloc, bAlloc := readAllocation(a), readAllocation(b)
+	if aAlloc.PeerAddress != bAddr.String() || bAlloc.PeerAddress != aAddr.String() {
+		t.Errorf("Allocations name the wrong peers: %+v, %+v", aAlloc, bAlloc)
+	}
+	if aAlloc.Bandwidth != 1000 {
+		t.Errorf("Expected a bandwidth of 1000, got %d", aAlloc.Bandwidth)
+	}
+	if got := server.GetRelayAllocations(); got != 1 {
+		t.Errorf("Expected 1 allocation, got %d", got)
+	}
+
+	aRelay, err := net.ResolveUDPAddr("udp", aAlloc.RelayAddress)
+	if err != nil {
+		t.Fatalf("Failed to resolve relay address: %v", err)
+	}
+	bRelay, err := net.ResolveUDPAddr("udp", bAlloc.RelayAddress)
+	if err != nil {
+		t.Fatalf("Failed to resolve relay address: %v", err)
+	}
+
+	expect := func(conn *net.UDPConn, from *net.UDPAddr, want []byte) {
+		t.Helper()
+		buffer := make([]byte, 2048)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, addr, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			t.Fatalf("Failed to read relayed data: %v", err)
+		}
+		if addr.String() != from.String() || !bytes.Equal(buffer[:n], want) {
+			t.Errorf("Expected %q from %s, got %q from %s", want, from, buffer[:n], addr)
+		}
+	}
+	expectNothing := func(conn *net.UDPConn, why string) {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if n, _, err := conn.ReadFromUDP(make([]byte, 2048)); err == nil {
+			t.Errorf("Expected %s to be dropped, got %d bytes", why, n)
+		}
+	}
+
+	// each peer sees the other as its own relay port
+	send(a, aRelay, []byte("hello"))
+	expect(b, bRelay, []byte("hello"))
+	send(b, bRelay, []byte("hi"))
+	expect(a, aRelay, []byte("hi"))
+
+	// asking again gets the same allocation back
+	requestRelay(a, aIdentity, bAddr)
+	if again := readAllocation(a); again.RelayAddress != aAlloc.RelayAddress {
+		t.Errorf("Expected the same relay address, got %s and %s", aAlloc.RelayAddress, again.RelayAddress)
+	}
+
+	// only the peer a port was opened for can use it
+	send(stranger, aRelay, []byte("spoofed"))
+	expectNothing(b, "traffic from a stranger")
+
+	// the allocation is full
+	requestRelay(stranger, strangerIdentity, aAddr)
+	time.Sleep(100 * time.Millisecond)
+	requestRelay(a, aIdentity, stranger.LocalAddr().(*net.UDPAddr))
+	if msg := readUDPMessage(t, a); msg.Type != api.ServerError {
+		t.Errorf("Expected ServerError past MaxRelayAllocations, got %s", msg.Type)
+	}
+
+	// the quota is a second's worth of bandwidth
+	payload := bytes.Repeat([]byte{0x42}, 800)
+	send(a, aRelay, payload)
+	send(a, aRelay, payload)
+	expect(b, bRelay, payload)
+	expectNothing(b, "traffic over the quota")
+}
+
+func TestRelayDisabled(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Stop()
+
+	conn, err := net.DialUDP("udp", nil, server.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+	registerTestClient(t, conn, nil, newTestIdentity(t), "", "")
+	expectMessages(t, conn, api.RegisterSuccess, api.AssignedAsLeader)
+
+	peer := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	data, err := api.NewRelayRequestMessage(api.NewSignature(""), peer).Serialize()
+	if err != nil {
+		t.Fatalf("Failed to serialize relay request: %v", err)
+	}
+	if _, err := conn.Write(data); err != nil {
+		t.Fatalf("Failed to send relay request: %v", err)
+	}
+
+	msg := readUDPMessage(t, conn)
+	errData, err := msg.GetServerErrorData()
+	if err != nil || errData.ErrorCode != "RELAY_DISABLED" {
+		t.Errorf("Expected RELAY_DISABLED, got %s %+v", msg.Type, errData)
+	}
+}
@@ -0,0 +1,571 @@
+package stun
+
+/*
+
+This file is for running two servers as a high-availability pair. Only the
+active server answers clients, the standby answers everything with a STANDBY
+error so clients move on to the next address they know, see
+p2p.ClientConfig.ServerAddresses.
+
+The active server dials its peer's ReplicationAddress over TCP and sends it a
+snapshot of the registered clients, members, leaders, terms, queue positions
+and verified addresses every HeartbeatInterval. The standby only writes its
+state file when what it holds changed. A snapshot larger than
+maxReplicationFrame isn't sent, a heartbeat without state goes instead so
+the standby doesn't take over, and the failure is logged. Every frame
+carries an HMAC-SHA256 of the ReplicationSecret over a nonce the receiver
+picked for the connection and the frame itself, and a sequence number that
+has to grow, so frames can't be forged or replayed. The dialer sends a
+nonce of its own first, which the receiver's hello is bound to.
+
+A standby that hasn't had a heartbeat for FailoverTimeout takes over: it
+serves the last snapshot and renews every lease, so leaders have a full lease
+to find it. A server that comes back while its peer is active sees so in the
+hello and becomes the standby, of two active servers the one that became
+active last steps down. Challenges, relay allocations, rate limits and bans
+are not replicated, and whatever changed since the last heartbeat is lost.
+Verified addresses are, so replies to clients that already answered a
+challenge aren't held back after a takeover.
+
+*/
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hcp-uw/mosaic/internal/api"
+)
+
+// maxReplicationFrame caps a replication line, it holds every client
+const maxReplicationFrame = 16 << 20
+
+var errReplicationAuth = errors.New("replication frame failed authentication")
+
+// replication is the state of one server of a pair
+type replication struct {
+	peerAddress     string
+	secret          []byte
+	heartbeat       time.Duration
+	failoverTimeout time.Duration
+	listener        net.Listener
+
+	mutex         sync.Mutex
+	active        bool
+	activeSince   time.Time
+	lastHeartbeat time.Time
+}
+
+// replicationHello is what the receiving server answers a new connection with
+type replicationHello struct {
+	Nonce       []byte    `json:"nonce"`
+	Active      bool      `json:"active"`
+	ActiveSince time.Time `json:"active_since"`
+	// MAC covers the dialer's nonce and the fields above
+	MAC []byte `json:"mac,omitempty"`
+}
+
+// replicationFrame is one snapshot, MAC covers the receiver's nonce and Payload
+type replicationFrame struct {
+	Payload json.RawMessage `json:"payload"`
+	MAC     []byte          `json:"mac"`
+}
+
+// replicatedState is the snapshot the active server sends
+type replicatedState struct {
+	Seq          uint64              `json:"seq"`
+	Clients      []replicatedClient  `json:"clients"`
+	Networks     []replicatedNetwork `json:"networks"`
+	Positions    map[string]int      `json:"positions"`
+	NextPosition int                 `json:"next_position"`
+	DroppedTerm  uint                `json:"dropped_term,omitempty"`
+	// Verified holds when each verified address last proved it is real
+	Verified map[string]time.Time `json:"verified,omitempty"`
+	// HeartbeatOnly is set when the snapshot was too large to send, the
+	// standby keeps what it has
+	HeartbeatOnly bool `json:"heartbeat_only,omitempty"`
+}
+
+type replicatedClient struct {
+	ID           string    `json:"id"`
+	PublicKey    string    `json:"public_key"`
+	Address      string    `json:"address"`
+	NetworkID    string    `json:"network_id"`
+	PairedWithID string    `json:"paired_with_id,omitempty"`
+	Leader       bool      `json:"leader"`
+	LastPing     time.Time `json:"last_ping"`
+	Connected    time.Time `json:"connected"`
+	LastSigned   time.Time `json:"last_signed"`
+}
+
+type replicatedNetwork struct {
+	ID         string             `json:"id"`
+	SecretHash []byte             `json:"secret_hash,omitempty"`
+	LeaderID   string             `json:"leader_id"`
+	LeaderKey  string             `json:"leader_key,omitempty"`
+	Term       uint               `json:"term"`
+	LeaseID    uint               `json:"lease_id"`
+	Waiting    []string           `json:"waiting"`
+	Members    []replicatedClient `json:"members"`
+}
+
+// startReplication listens for the peer's snapshots and starts sending our
+// own once the server is active
+func (s *Server) startReplication(config *ServerConfig, enableLogging bool) error {
+	if config.ReplicationSecret == "" {
+		return fmt.Errorf("replication needs a secret")
+	}
+
+	listener, err := net.Listen("tcp", config.ReplicationAddress)
+	if err != nil {
+		return fmt.Errorf("failed to listen for replication: %w", err)
+	}
+
+	heartbeat := config.HeartbeatInterval
+	if heartbeat <= 0 {
+		heartbeat = time.Second
+	}
+	failoverTimeout := config.FailoverTimeout
+	if failoverTimeout <= 0 {
+		failoverTimeout = 5 * heartbeat
+	}
+
+	r := &replication{
+		peerAddress:     config.PeerAddress,
+		secret:          []byte(config.ReplicationSecret),
+		heartbeat:       heartbeat,
+		failoverTimeout: failoverTimeout,
+		listener:        listener,
+		lastHeartbeat:   time.Now(),
+	}
+	if !config.Standby {
+		r.active = true
+		r.activeSince = time.Now()
+	}
+	s.replication = r
+
+	go s.acceptReplication(enableLogging)
+	go s.sendReplication(enableLogging)
+	go s.watchHeartbeat(enableLogging)
+
+	if enableLogging {
+		log.Printf("Replicating with %s, listening on %s, standby: %v", config.PeerAddress, listener.Addr(), config.Standby)
+	}
+	return nil
+}
+
+// IsActive reports whether the server answers clients, a server that isn't
+// one of a pair always does
+func (s *Server) IsActive() bool {
+	if s.replication == nil {
+		return true
+	}
+	s.replication.mutex.Lock()
+	defer s.replication.mutex.Unlock()
+	return s.replication.active
+}
+
+// GetReplicationAddress returns where the server takes replication from its
+// peer, nil if it isn't one of a pair
+func (s *Server) GetReplicationAddress() net.Addr {
+	if s.replication == nil {
+		return nil
+	}
+	return s.replication.listener.Addr()
+}
+
+func (r *replication) mac(nonce []byte, parts ...[]byte) []byte {
+	h := hmac.New(sha256.New, r.secret)
+	h.Write(nonce)
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+// helloMAC covers everything in the hello but its MAC
+func (r *replication) helloMAC(dialerNonce []byte, hello replicationHello) []byte {
+	hello.MAC = nil
+	buf, _ := json.Marshal(hello)
+	return r.mac(dialerNonce, buf)
+}
+
+// acceptReplication takes snapshots from the peer while the server is on standby
+func (s *Server) acceptReplication(enableLogging bool) {
+	for {
+		conn, err := s.replication.listener.Accept()
+		if err != nil {
+			if s.ctx.Err() == nil {
+				log.Printf("Replication listener stopped: %v", err)
+			}
+			return
+		}
+		go func() {
+			defer conn.Close()
+			if err := s.receiveReplication(conn, enableLogging); err != nil && enableLogging {
+				log.Printf("Replication from %s ended: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// receiveReplication answers the dialer's nonce with a hello and applies its
+// snapshots
+func (s *Server) receiveReplication(conn net.Conn, enableLogging bool) error {
+	r := s.replication
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxReplicationFrame)
+
+	conn.SetReadDeadline(time.Now().Add(r.failoverTimeout))
+	var dialerNonce struct {
+		Nonce []byte `json:"nonce"`
+	}
+	if err := readReplicationLine(scanner, &dialerNonce); err != nil {
+		return err
+	}
+
+	nonce, err := api.NewNonce()
+	if err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	hello := replicationHello{Nonce: nonce, Active: r.active, ActiveSince: r.activeSince}
+	r.mutex.Unlock()
+	hello.MAC = r.helloMAC(dialerNonce.Nonce, hello)
+	if err := writeReplicationLine(conn, hello); err != nil {
+		return err
+	}
+
+	var lastSeq uint64
+	for {
+		conn.SetReadDeadline(time.Now().Add(r.failoverTimeout))
+		var frame replicationFrame
+		if err := readReplicationLine(scanner, &frame); err != nil {
+			return err
+		}
+		if !hmac.Equal(frame.MAC, r.mac(nonce, frame.Payload)) {
+			return errReplicationAuth
+		}
+
+		var state replicatedState
+		if err := json.Unmarshal(frame.Payload, &state); err != nil {
+			return err
+		}
+		if state.Seq <= lastSeq {
+			return fmt.Errorf("replication frame %d after %d", state.Seq, lastSeq)
+		}
+		lastSeq = state.Seq
+
+		// the dialer only sends snapshots if it was active before us
+		r.mutex.Lock()
+		steppedDown := r.active
+		r.active = false
+		r.lastHeartbeat = time.Now()
+		r.mutex.Unlock()
+		if steppedDown && enableLogging {
+			log.Printf("Peer %s has been active longer, standing by", conn.RemoteAddr())
+		}
+		if !state.HeartbeatOnly {
+			s.applyReplicatedState(&state)
+		}
+	}
+}
+
+// sendReplication sends snapshots to the peer while the server is active
+func (s *Server) sendReplication(enableLogging bool) {
+	r := s.replication
+	ticker := time.NewTicker(r.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		if s.IsActive() {
+			if err := s.replicateTo(r.peerAddress, enableLogging); err != nil && enableLogging && s.ctx.Err() == nil {
+				log.Printf("Replication to %s failed: %v", r.peerAddress, err)
+			}
+		}
+
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// replicateTo connects to the peer and sends it a snapshot every heartbeat
+// until the connection fails or the server stops being active
+func (s *Server) replicateTo(peerAddress string, enableLogging bool) error {
+	r := s.replication
+	conn, err := net.DialTimeout("tcp", peerAddress, r.heartbeat)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	dialerNonce, err := api.NewNonce()
+	if err != nil {
+		return err
+	}
+	if err := writeReplicationLine(conn, map[string][]byte{"nonce": dialerNonce}); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(conn)
+	conn.SetReadDeadline(time.Now().Add(r.failoverTimeout))
+	var hello replicationHello
+	if err := readReplicationLine(scanner, &hello); err != nil {
+		return err
+	}
+	if !hmac.Equal(hello.MAC, r.helloMAC(dialerNonce, hello)) {
+		return errReplicationAuth
+	}
+
+	r.mutex.Lock()
+	if hello.Active && r.active && !hello.ActiveSince.After(r.activeSince) {
+		// the peer took over first, it keeps serving
+		r.active = false
+		r.lastHeartbeat = time.Now()
+		r.mutex.Unlock()
+		if enableLogging {
+			log.Printf("Peer %s has been active since %s, standing by", peerAddress, hello.ActiveSince.Format(time.RFC3339))
+		}
+		return nil
+	}
+	r.mutex.Unlock()
+
+	ticker := time.NewTicker(r.heartbeat)
+	defer ticker.Stop()
+	var seq uint64
+	for s.IsActive() {
+		seq++
+		s.mutex.RLock()
+		state := s.replicatedState(seq)
+		s.mutex.RUnlock()
+
+		payload, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		// the frame only adds its MAC and a few keys around the payload
+		if len(payload) > maxReplicationFrame-1024 {
+			if enableLogging {
+				log.Printf("Replication snapshot of %d bytes is too large, sending a heartbeat without it", len(payload))
+			}
+			payload, err = json.Marshal(&replicatedState{Seq: seq, HeartbeatOnly: true})
+			if err != nil {
+				return err
+			}
+		}
+		frame := replicationFrame{Payload: payload, MAC: r.mac(hello.Nonce, payload)}
+		conn.SetWriteDeadline(time.Now().Add(r.failoverTimeout))
+		if err := writeReplicationLine(conn, frame); err != nil {
+			return err
+		}
+
+		select {
+		case <-s.ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// watchHeartbeat takes over once a standby hasn't heard from the active peer
+// for the failover timeout
+func (s *Server) watchHeartbeat(enableLogging bool) {
+	r := s.replication
+	ticker := time.NewTicker(r.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		r.mutex.Lock()
+		takeOver := !r.active && time.Since(r.lastHeartbeat) > r.failoverTimeout
+		if takeOver {
+			r.active = true
+			r.activeSince = time.Now()
+		}
+		r.mutex.Unlock()
+		if !takeOver {
+			continue
+		}
+
+		s.mutex.Lock()
+		for _, client := range s.clients {
+			client.LastPing = time.Now()
+		}
+		for _, n := range s.networks {
+			if n.currentLeaderID != "" {
+				s.renewLease(n)
+			}
+		}
+		s.mutex.Unlock()
+
+		if enableLogging {
+			log.Printf("No heartbeat from %s for %v, taking over", r.peerAddress, r.failoverTimeout)
+		}
+	}
+}
+
+// replicatedState snapshots the server. Callers hold the mutex.
+func (s *Server) replicatedState(seq uint64) *replicatedState {
+	state := &replicatedState{
+		Seq:          seq,
+		Clients:      make([]replicatedClient, 0, len(s.clients)),
+		Networks:     make([]replicatedNetwork, 0, len(s.networks)),
+		Positions:    maps.Clone(s.queuePositions),
+		NextPosition: s.nextQueuePosition,
+		DroppedTerm:  s.droppedTerm,
+		Verified:     s.limiter.verifiedAddresses(),
+	}
+	for _, client := range s.clients {
+		state.Clients = append(state.Clients, replicateClient(client))
+	}
+	for _, n := range s.networks {
+		replicated := replicatedNetwork{
+			ID:         n.id,
+			SecretHash: n.secretHash,
+			LeaderID:   n.currentLeaderID,
+			Term:       n.currentTerm,
+			LeaseID:    n.leaseID,
+			Waiting:    make([]string, 0, len(n.waitingQueue)),
+			Members:    make([]replicatedClient, 0, len(n.members)),
+		}
+		if n.leaderKey != nil {
+			replicated.LeaderKey, _ = api.EncodePublicKey(n.leaderKey)
+		}
+		for _, waiter := range n.waitingQueue {
+			replicated.Waiting = append(replicated.Waiting, waiter.ID)
+		}
+		for _, member := range n.members {
+			replicated.Members = append(replicated.Members, replicateClient(member))
+		}
+		state.Networks = append(state.Networks, replicated)
+	}
+	return state
+}
+
+func replicateClient(client *ClientInfo) replicatedClient {
+	publicKey, _ := api.EncodePublicKey(client.PublicKey)
+	return replicatedClient{
+		ID:           client.ID,
+		PublicKey:    publicKey,
+		Address:      client.Address.String(),
+		NetworkID:    client.NetworkID,
+		PairedWithID: client.PairedWithID,
+		Leader:       client.Leader,
+		LastPing:     client.LastPing,
+		Connected:    client.Connected,
+		LastSigned:   client.LastSigned,
+	}
+}
+
+// restoreClient is the reverse of replicateClient, clients with a bad key or
+// address are skipped
+func restoreClient(replicated replicatedClient) (*ClientInfo, bool) {
+	key, err := api.ParsePublicKey(replicated.PublicKey)
+	if err != nil {
+		return nil, false
+	}
+	addr, err := net.ResolveUDPAddr("udp", replicated.Address)
+	if err != nil {
+		return nil, false
+	}
+	return &ClientInfo{
+		ID:           replicated.ID,
+		PublicKey:    key,
+		Address:      addr,
+		LastPing:     replicated.LastPing,
+		Connected:    replicated.Connected,
+		LastSigned:   replicated.LastSigned,
+		PairedWithID: replicated.PairedWithID,
+		NetworkID:    replicated.NetworkID,
+		Leader:       replicated.Leader,
+	}, true
+}
+
+// applyReplicatedState replaces the server's clients, networks and verified
+// addresses with the active peer's
+func (s *Server) applyReplicatedState(state *replicatedState) {
+	clients := make(map[string]*ClientInfo, len(state.Clients))
+	for _, replicated := range state.Clients {
+		if client, ok := restoreClient(replicated); ok {
+			clients[client.ID] = client
+		}
+	}
+
+	networks := make(map[string]*network, len(state.Networks))
+	for _, replicated := range state.Networks {
+		n := newNetwork(replicated.ID, replicated.SecretHash)
+		n.currentLeaderID = replicated.LeaderID
+		n.currentTerm = replicated.Term
+		n.leaseID = replicated.LeaseID
+		if key, err := api.ParsePublicKey(replicated.LeaderKey); err == nil {
+			n.leaderKey = key
+		}
+		for _, id := range replicated.Waiting {
+			if waiter, ok := clients[id]; ok {
+				n.waitingQueue = append(n.waitingQueue, waiter)
+			}
+		}
+		for _, member := range replicated.Members {
+			if client, ok := restoreClient(member); ok {
+				n.members[client.ID] = client
+			}
+		}
+		networks[n.id] = n
+	}
+
+	positions := state.Positions
+	if positions == nil {
+		positions = make(map[string]int)
+	}
+
+	s.limiter.restoreVerified(state.Verified, time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	changed := !samePersistedNetworks(s.networks, networks) || !maps.Equal(s.queuePositions, positions) ||
+		s.nextQueuePosition != state.NextPosition || s.droppedTerm != state.DroppedTerm
+	s.clients = clients
+	s.networks = networks
+	s.queuePositions = positions
+	s.nextQueuePosition = state.NextPosition
+	s.droppedTerm = state.DroppedTerm
+	if changed {
+		s.saveState()
+	}
+}
+
+func writeReplicationLine(conn net.Conn, v any) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(append(buf, '\n'))
+	return err
+}
+
+func readReplicationLine(scanner *bufio.Scanner, v any) error {
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		return errors.New("replication connection closed")
+	}
+	return json.Unmarshal(scanner.Bytes(), v)
+}
@@ -0,0 +1,163 @@
+package stun
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hcp-uw/mosaic/internal/api"
+)
+
+// freeTCPAddress returns a loopback address nothing listens on, for servers
+// that have to know their peer's address before it starts
+func freeTCPAddress(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func newPairTestServer(t *testing.T, replicationAddress, peerAddress, secret string, standby bool) (*Server, *net.UDPAddr) {
+	t.Helper()
+
+	config := &ServerConfig{
+		ListenAddress:      "127.0.0.1:0",
+		ClientTimeout:      5 * time.Second,
+		ReplicationAddress: replicationAddress,
+		PeerAddress:        peerAddress,
+		ReplicationSecret:  secret,
+		Standby:            standby,
+		HeartbeatInterval:  50 * time.Millisecond,
+		FailoverTimeout:    300 * time.Millisecond,
+	}
+	server := NewServer(config)
+	if err := server.Start(config); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	return server, server.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// waitFor polls condition until it holds or a couple of seconds pass
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestStandbyTakesOver(t *testing.T) {
+	primaryReplication, standbyReplication := freeTCPAddress(t), freeTCPAddress(t)
+	standby, standbyAddr := newPairTestServer(t, standbyReplication, primaryReplication, "secret", true)
+	defer standby.Stop()
+	primary, primaryAddr := newPairTestServer(t, primaryReplication, standbyReplication, "secret", false)
+
+	leader, member := newStateTestClient(t), newStateTestClient(t)
+	leaderIdentity, memberIdentity := newTestIdentity(t), newTestIdentity(t)
+	registerTestClient(t, leader, primaryAddr, leaderIdentity, "", "")
+	expectMessages(t, leader, api.RegisterSuccess, api.AssignedAsLeader)
+	registerTestClient(t, member, primaryAddr, memberIdentity, "", "")
+	expectMessages(t, member, api.RegisterSuccess, api.PeerAssignment)
+	expectMessages(t, leader, api.PeerAssignment)
+
+	waitFor(t, "the standby to have the leader and member", func() bool {
+		id, _ := standby.GetLeader("")
+		return id == leaderIdentity.id && standby.GetQueuePosition(memberIdentity.id) == 2
+	})
+
+	// clients are sent on to the active server
+	stray := newStateTestClient(t)
+	sendToServer(t, stray, standbyAddr, api.NewClientRegisterMessage(newTestIdentity(t).publicKey))
+	expectServerError(t, stray, "STANDBY")
+
+	primary.Stop()
+	waitFor(t, "the standby to take over", standby.IsActive)
+
+	// addresses that answered the primary's challenges are still verified
+	for _, conn := range []*net.UDPConn{leader, member} {
+		if addr := conn.LocalAddr().(*net.UDPAddr); !standby.limiter.isVerified(addr, time.Now()) {
+			t.Errorf("Expected %s to stay verified after the takeover", addr)
+		}
+	}
+
+	// the leader fails over and keeps its leadership and term
+	registerTestClient(t, leader, standbyAddr, leaderIdentity, "", "")
+	expectMessages(t, leader, api.RegisterSuccess)
+	msg := readUDPMessage(t, leader)
+	data, err := msg.GetAssignedAsLeaderData()
+	if err != nil {
+		t.Fatalf("Expected AssignedAsLeader, got %s: %v", msg.Type, err)
+	}
+	if data.Term != 1 {
+		t.Errorf("Expected the leader to keep term 1, got %d", data.Term)
+	}
+
+	// the old primary comes back as the standby
+	primary, _ = newPairTestServer(t, primaryReplication, standbyReplication, "secret", false)
+	defer primary.Stop()
+	waitFor(t, "the old primary to stand by", func() bool {
+		id, _ := primary.GetLeader("")
+		return !primary.IsActive() && id == leaderIdentity.id
+	})
+	if !standby.IsActive() {
+		t.Error("Expected the server that took over to stay active")
+	}
+}
+
+func TestReplicationRejectsWrongSecret(t *testing.T) {
+	primaryReplication, standbyReplication := freeTCPAddress(t), freeTCPAddress(t)
+	standby, _ := newPairTestServer(t, standbyReplication, primaryReplication, "other secret", true)
+	defer standby.Stop()
+	primary, primaryAddr := newPairTestServer(t, primaryReplication, standbyReplication, "secret", false)
+	defer primary.Stop()
+
+	leader := newStateTestClient(t)
+	registerTestClient(t, leader, primaryAddr, newTestIdentity(t), "", "")
+	expectMessages(t, leader, api.RegisterSuccess, api.AssignedAsLeader)
+
+	// with no heartbeat it can trust the standby takes over on its own
+	waitFor(t, "the standby to take over", standby.IsActive)
+	if got := standby.GetConnectedClients(); got != 0 {
+		t.Errorf("Expected nothing to be replicated, got %d clients", got)
+	}
+}
+
+func TestStandbyOnlySavesChangedState(t *testing.T) {
+	server := NewServer(&ServerConfig{StateFile: filepath.Join(t.TempDir(), "stun-state.json")})
+	identity := newTestIdentity(t)
+	state := &replicatedState{
+		Seq:          1,
+		Networks:     []replicatedNetwork{{ID: DefaultNetworkID, LeaderID: identity.id, LeaderKey: identity.publicKey, Term: 1}},
+		Positions:    map[string]int{identity.id: 1},
+		NextPosition: 1,
+	}
+
+	server.applyReplicatedState(state)
+	if !server.stateDirty {
+		t.Fatal("Expected the first snapshot to be saved")
+	}
+	server.stateDirty = false
+
+	// heartbeats that don't change anything kept on disk aren't written
+	state.Seq++
+	server.applyReplicatedState(state)
+	if server.stateDirty {
+		t.Error("Expected an unchanged snapshot not to be saved")
+	}
+
+	state.Seq++
+	state.Networks[0].Term = 2
+	server.applyReplicatedState(state)
+	if !server.stateDirty {
+		t.Error("Expected a new term to be saved")
+	}
+}
@@ -2,40 +2,90 @@ package stun
 
 import (
 	"context"
+	"crypto/ecdsa"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"sync"
 	"time"
 
 	"github.com/hcp-uw/mosaic/internal/api"
 )
 
+// maxMessageSize is the largest datagram the server takes, longer ones get
+// MESSAGE_TOO_LARGE instead of being cut off
+const maxMessageSize = 1024
+
 // ClientInfo holds information about connected clients
 type ClientInfo struct {
+	// ID is the fingerprint of PublicKey, Address is only where the client was last heard from
 	ID           string
+	PublicKey    *ecdsa.PublicKey
 	Address      *net.UDPAddr
 	LastPing     time.Time
 	Connected    time.Time
 	PairedWithID string
+	NetworkID    string
+	// LastSigned is the timestamp of the last signed message taken from the
+	// client, older ones are replays
+	LastSigned time.Time
 
 	Leader bool
 }
 
 // Server represents a STUN server
 type Server struct {
-	conn         *net.UDPConn
-	clients      map[string]*ClientInfo
-	waitingQueue []*ClientInfo
-	mutex        sync.RWMutex
-	ctx          context.Context
-	cancel       context.CancelFunc
-	done         chan bool
-
-	currentLeaderID          string
-	currentTerm              uint
-	leaseExpirationTimeStamp *time.Time
-	leaseID                  uint
+	conn    *net.UDPConn
+	clients map[string]*ClientInfo
+	mutex   sync.RWMutex
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan bool
+
+	// networks holds the leader, term and members of every network, see
+	// network.go; droppedTerm is the highest term of a network dropped since
+	networks      map[string]*network
+	droppedTerm   uint
+	leaseDuration time.Duration
+	pingInterval  time.Duration
+
+	// challenges holds registrations waiting on a signed nonce, by address;
+	// addresses are the ones of the server they can be signed for, see auth.go
+	challenges map[string]*challenge
+	addresses  []string
+
+	// relay is nil unless the server was started with EnableRelay
+	relay *relay
+
+	// stateFile is where queue positions, terms and leaders are kept, see state.go;
+	// stateSaved is closed once the last changes are written; departed holds
+	// when clients with a position were first seen gone
+	stateFile         string
+	stateDirty        bool
+	stateChanged      chan struct{}
+	stateSaved        chan struct{}
+	queuePositions    map[string]int
+	nextQueuePosition int
+	departed          map[string]time.Time
+	reclaimGrace      time.Duration
+
+	// counters and the admin endpoint, see admin.go; admin is nil unless
+	// the server was started with an AdminAddress
+	counters  *counters
+	admin     *http.Server
+	adminAddr net.Addr
+
+	// replication is nil unless the server is one of a high-availability
+	// pair, see replication.go
+	replication *replication
+
+	// limiter and inFlight protect the server from floods, see limits.go;
+	// inFlight is nil when the number of messages handled at once isn't capped
+	limiter      *limiter
+	inFlight     chan struct{}
+	maxQueueSize int
+	maxNetworks  int
 }
 
 // ServerConfig holds server configuration
@@ -43,8 +93,67 @@ type ServerConfig struct {
 	ListenAddress string
 	ClientTimeout time.Duration
 	PingInterval  time.Duration
-	MaxQueueSize  int
+	// MaxQueueSize is how many clients can wait on a leader across all
+	// networks, 0 for no limit
+	MaxQueueSize int
+	// MaxNetworks is how many networks can exist at once, 0 for no limit
+	MaxNetworks   int
 	EnableLogging bool
+
+	// PublicAddress is the address clients reach the server at, which they
+	// sign their registration challenge for. By default it is the listen
+	// address, or every address of the host if the listen IP is unspecified.
+	PublicAddress string
+
+	// EnableRelay lets clients that can't hole punch to each other ask the
+	// server to relay their traffic
+	EnableRelay bool
+	// RelayHost is the IP relay ports are opened on, the listen address's by default
+	RelayHost string
+	// RelayBandwidth is the quota of every relay allocation in bytes per second, 0 for none
+	RelayBandwidth int
+	// MaxRelayAllocations is how many relays can be open at once
+	MaxRelayAllocations int
+
+	// StateFile keeps queue positions, the term and the leader across
+	// restarts, nothing is kept when it is empty
+	StateFile string
+	// ReclaimGrace is how long after a restart leadership is held for the
+	// leader recorded in the StateFile
+	ReclaimGrace time.Duration
+
+	// LeaseDuration is how long a leader stays leader without pinging, the
+	// ClientTimeout if it isn't set
+	LeaseDuration time.Duration
+
+	// AdminAddress is where to serve the admin and metrics endpoint, it
+	// isn't served when empty. It has no authentication, so it has to be a
+	// loopback address unless AdminAllowRemote is set.
+	AdminAddress     string
+	AdminAllowRemote bool
+
+	// RateLimit is how many messages a second one IP can send, with bursts
+	// of up to RateBurst, 0 for no limit
+	RateLimit float64
+	RateBurst int
+	// MaxInFlight is how many messages are handled at once, 0 for no limit
+	MaxInFlight int
+	// BanThreshold is how many dropped or faulty messages within
+	// BanDuration get an IP banned for BanDuration, 0 to never ban
+	BanThreshold int
+	BanDuration  time.Duration
+
+	// PeerAddress is the ReplicationAddress of the other server of a
+	// high-availability pair, the server runs alone when it is empty.
+	// ReplicationSecret authenticates what they send each other.
+	PeerAddress        string
+	ReplicationAddress string
+	ReplicationSecret  string
+	// Standby starts the server as the standby of the pair, it takes over
+	// when the active one hasn't sent a heartbeat for FailoverTimeout
+	Standby           bool
+	HeartbeatInterval time.Duration
+	FailoverTimeout   time.Duration
 }
 
 // DefaultServerConfig returns default server configuration
@@ -54,7 +163,22 @@ func DefaultServerConfig() *ServerConfig {
 		ClientTimeout: 30 * time.Second,
 		PingInterval:  10 * time.Second,
 		MaxQueueSize:  100,
+		MaxNetworks:   1000,
 		EnableLogging: true,
+
+		EnableRelay:         false,
+		RelayBandwidth:      64 * 1024,
+		MaxRelayAllocations: 50,
+
+		ReclaimGrace: 30 * time.Second,
+
+		LeaseDuration: 30 * time.Second,
+
+		RateLimit:    20,
+		RateBurst:    40,
+		MaxInFlight:  256,
+		BanThreshold: 100,
+		BanDuration:  time.Minute,
 	}
 }
 
@@ -64,23 +188,53 @@ func NewServer(config *ServerConfig) *Server {
 		config = DefaultServerConfig()
 	}
 
+	leaseDuration := config.LeaseDuration
+	if leaseDuration <= 0 {
+		leaseDuration = config.ClientTimeout
+	}
+	pingInterval := config.PingInterval
+	if pingInterval <= 0 {
+		pingInterval = leaseDuration / 3
+	}
+
+	var inFlight chan struct{}
+	if config.MaxInFlight > 0 {
+		inFlight = make(chan struct{}, config.MaxInFlight)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	return &Server{
-		clients:      make(map[string]*ClientInfo),
-		waitingQueue: make([]*ClientInfo, 0),
-		ctx:          ctx,
-		cancel:       cancel,
-		done:         make(chan bool),
-
-		currentLeaderID:          "",
-		currentTerm:              0,
-		leaseExpirationTimeStamp: nil,
-		leaseID:                  0,
+		clients: make(map[string]*ClientInfo),
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan bool),
+
+		challenges:    make(map[string]*challenge),
+		networks:      make(map[string]*network),
+		leaseDuration: leaseDuration,
+		pingInterval:  pingInterval,
+
+		stateFile:      config.StateFile,
+		stateChanged:   make(chan struct{}, 1),
+		queuePositions: make(map[string]int),
+		departed:       make(map[string]time.Time),
+		reclaimGrace:   config.ReclaimGrace,
+
+		counters: newCounters(),
+
+		limiter:      newLimiter(config),
+		inFlight:     inFlight,
+		maxQueueSize: config.MaxQueueSize,
+		maxNetworks:  config.MaxNetworks,
 	}
 }
 
 // Start begins listening for client connections
 func (s *Server) Start(config *ServerConfig) error {
+	if err := s.loadState(config.ReclaimGrace, config.EnableLogging); err != nil {
+		return err
+	}
+
 	addr, err := net.ResolveUDPAddr("udp", config.ListenAddress)
 	if err != nil {
 		return fmt.Errorf("failed to resolve UDP address: %w", err)
@@ -92,6 +246,32 @@ func (s *Server) Start(config *ServerConfig) error {
 	}
 
 	s.conn = conn
+	s.addresses, err = serverAddresses(config.PublicAddress, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	if config.EnableRelay {
+		s.relay = newRelay(config, conn.LocalAddr().(*net.UDPAddr))
+	}
+
+	if config.AdminAddress != "" {
+		if err := s.startAdmin(config.AdminAddress, config.AdminAllowRemote, config.EnableLogging); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+
+	if config.PeerAddress != "" {
+		if err := s.startReplication(config, config.EnableLogging); err != nil {
+			conn.Close()
+			if s.admin != nil {
+				s.admin.Close()
+			}
+			return err
+		}
+	}
 
 	if config.EnableLogging {
 		log.Printf("STUN server started on %s", config.ListenAddress)
@@ -100,6 +280,11 @@ func (s *Server) Start(config *ServerConfig) error {
 	// Start cleanup routine
 	go s.cleanupRoutine(config.ClientTimeout, config.EnableLogging)
 
+	if s.stateFile != "" {
+		s.stateSaved = make(chan struct{})
+		go s.saveRoutine()
+	}
+
 	// Start message handling
 	go s.handleMessages(config.EnableLogging)
 
@@ -114,6 +299,18 @@ func (s *Server) Stop() error {
 		s.conn.Close()
 	}
 
+	if s.relay != nil {
+		s.relay.close()
+	}
+
+	if s.admin != nil {
+		s.admin.Close()
+	}
+
+	if s.replication != nil {
+		s.replication.listener.Close()
+	}
+
 	// Wait for cleanup to finish
 	select {
 	case <-s.done:
@@ -121,6 +318,15 @@ func (s *Server) Stop() error {
 		log.Println("Server stop timeout")
 	}
 
+	// and for the last changes to reach the state file
+	if s.stateSaved != nil {
+		select {
+		case <-s.stateSaved:
+		case <-time.After(5 * time.Second):
+			log.Println("State save timeout")
+		}
+	}
+
 	return nil
 }
 
@@ -134,7 +340,8 @@ func (s *Server) handleMessages(enableLogging bool) {
 		s.done <- true
 	}()
 
-	buffer := make([]byte, 1024)
+	// one byte more than the largest message, so longer ones show up
+	buffer := make([]byte, maxMessageSize+1)
 
 	for {
 		select {
@@ -155,92 +362,199 @@ func (s *Server) handleMessages(enableLogging bool) {
 			continue
 		}
 
-		go s.processMessage(buffer[:n], clientAddr, enableLogging)
+		if ok, banned := s.limiter.allow(clientAddr, time.Now()); !ok {
+			if banned {
+				s.counters.countDropped("banned")
+			} else {
+				s.counters.countDropped("rate_limited")
+			}
+			continue
+		}
+		if n > maxMessageSize {
+			s.sendErrorMessage(clientAddr, n, "Message too large", "MESSAGE_TOO_LARGE")
+			continue
+		}
+		if s.inFlight != nil {
+			select {
+			case s.inFlight <- struct{}{}:
+			default:
+				s.counters.countDropped("overloaded")
+				continue
+			}
+		}
+
+		// the next read reuses buffer while this message is still being handled
+		data := append([]byte(nil), buffer[:n]...)
+		go func() {
+			s.processMessage(data, clientAddr, enableLogging)
+			if s.inFlight != nil {
+				<-s.inFlight
+			}
+		}()
 	}
 }
 
 // processMessage handles a single message from a client
 func (s *Server) processMessage(data []byte, clientAddr *net.UDPAddr, enableLogging bool) {
+	// a standby sends clients on to the active server of its pair
+	if !s.IsActive() {
+		if !api.IsSTUNMessage(data) {
+			s.sendErrorMessage(clientAddr, len(data), "Server is on standby", "STANDBY")
+		}
+		return
+	}
+
+	// standard STUN clients share the port with our own JSON protocol
+	if api.IsSTUNMessage(data) {
+		s.counters.countMessage("stun")
+		s.handleSTUNMessage(data, clientAddr, enableLogging)
+		return
+	}
+
 	msg, err := api.DeserializeMessage(data)
 	if err != nil {
 		if enableLogging {
 			log.Printf("Failed to deserialize message from %s: %v", clientAddr, err)
 		}
-		s.sendErrorMessage(clientAddr, "Invalid message format", "PARSE_ERROR")
+		s.sendErrorMessage(clientAddr, len(data), "Invalid message format", "PARSE_ERROR")
 		return
 	}
 
+	s.counters.countMessage(countedMessageType(msg.Type))
 	switch msg.Type {
 	case api.ClientRegister:
 		s.handleClientRegister(msg, clientAddr, enableLogging)
 	case api.ClientPing:
 		s.handleClientPing(msg, clientAddr, enableLogging)
+	case api.RelayRequest:
+		s.handleRelayRequest(msg, clientAddr, enableLogging)
+	case api.LeaderLost:
+		s.handleLeaderLost(msg, clientAddr, enableLogging)
+	case api.ChallengeResponse:
+		s.handleChallengeResponse(msg, clientAddr, enableLogging)
 	default:
 		if enableLogging {
 			log.Printf("Unknown message type %s from %s", msg.Type, clientAddr)
 		}
-		s.sendErrorMessage(clientAddr, "Unknown message type", "UNKNOWN_MESSAGE")
+		s.sendErrorMessage(clientAddr, msg.Size(), "Unknown message type", "UNKNOWN_MESSAGE")
 	}
 }
 
-// handleClientRegister handles client registration
+// handleClientRegister handles client registration, the client is only
+// registered once it answers the challenge, see auth.go
 func (s *Server) handleClientRegister(msg *api.Message, clientAddr *net.UDPAddr, enableLogging bool) {
-	_, err := msg.GetClientRegisterData()
+	data, err := msg.GetClientRegisterData()
 	if err != nil {
 		if enableLogging {
 			log.Printf("Failed to parse client register data: %v", err)
 		}
-		s.sendErrorMessage(clientAddr, "Invalid register data", "INVALID_DATA")
+		s.sendErrorMessage(clientAddr, msg.Size(), "Invalid register data", "INVALID_DATA")
 		return
 	}
 
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	key, err := api.ParsePublicKey(data.PublicKey)
+	if err != nil {
+		if enableLogging {
+			log.Printf("Client %s registered with an invalid key: %v", clientAddr, err)
+		}
+		s.sendErrorMessage(clientAddr, msg.Size(), "Invalid public key", "INVALID_KEY")
+		return
+	}
+	if len(data.NetworkID) > maxNetworkIDLength || len(data.JoinSecret) > maxJoinSecretLength {
+		s.sendErrorMessage(clientAddr, msg.Size(), "Network ID or join secret too long", "INVALID_NETWORK")
+		return
+	}
+
+	s.sendChallenge(clientAddr, msg.Size(), key, data, enableLogging)
+}
+
+// registerClient registers a client that answered pending with its key.
+// clientAddr answered the challenge, so replies to it aren't held to the
+// size of the request. Callers hold the mutex.
+func (s *Server) registerClient(clientID string, pending *challenge, clientAddr *net.UDPAddr, enableLogging bool) {
+	// Check if client already exists
+	if existingClient, exists := s.clients[clientID]; exists {
+		existingClient.Address = clientAddr
+		existingClient.LastPing = time.Now()
+		if enableLogging {
+			log.Printf("Client %s reconnected", clientID)
+		}
+		// it may have failed over from the other server of a pair and
+		// doesn't know what this one thinks of it
+		s.sendRegistrationSuccess(clientID, clientAddr)
+		if current := s.networkOf(existingClient); current != nil && current.currentLeaderID == clientID {
+			s.renewLease(current)
+			s.sendLeaderAssignment(current, clientAddr)
+		}
+		return
+	}
 
-	// Use IP:port as the client ID
-	clientID := clientAddr.String()
+	var n *network
+	var err error
+	if pending.rejoin {
+		// the key already belongs to the network, see handleClientPing
+		if n = s.networks[pending.networkID]; n == nil {
+			err = errNoNetwork
+		}
+	} else {
+		n, err = s.joinNetwork(pending.networkID, pending.joinSecret)
+	}
+	if err != nil {
+		if enableLogging {
+			log.Printf("Client %s can't join network %q: %v", clientID, pending.networkID, err)
+		}
+		s.sendJoinError(clientAddr, 0, err)
+		return
+	}
 
 	clientInfo := &ClientInfo{
 		ID:        clientID,
+		PublicKey: pending.key,
 		Address:   clientAddr,
 		LastPing:  time.Now(),
 		Connected: time.Now(),
+		NetworkID: n.id,
 	}
 
-	// Check if client already exists
-	if existingClient, exists := s.clients[clientID]; exists {
-		existingClient.Address = clientAddr
-		existingClient.LastPing = time.Now()
+	_, leaderRegistered := s.leaderOf(n)
+	leads := clientID == n.currentLeaderID || !leaderRegistered && !s.awaitingReclaim(n)
+	if !leads && !leaderRegistered && s.queueFull() {
 		if enableLogging {
-			log.Printf("Client %s reconnected", clientID)
+			log.Printf("Client %s can't wait in network %s, the queue is full", clientID, n.id)
 		}
+		s.sendErrorMessage(clientAddr, 0, "Waiting queue is full", "QUEUE_FULL")
 		return
 	}
 
 	s.clients[clientID] = clientInfo
+	position := s.queuePosition(clientID)
 
 	if enableLogging {
-		log.Printf("Client %s registered", clientID)
+		log.Printf("Client %s registered in network %s at queue position %d", clientID, n.id, position)
 	}
 
 	s.sendRegistrationSuccess(clientID, clientAddr)
 
-	if s.currentLeaderID == "" {
-		s.sendLeaderAssignment(clientAddr)
-
+	switch {
+	case leads:
 		// TODO: Need to perform a check to see if leader is accepted
-		s.clients[clientID].Leader = true
-		s.currentLeaderID = clientID
-
-	} else {
-		s.pairClients(clientInfo, true)
+		s.assignLeader(n, clientInfo, enableLogging)
+	case !leaderRegistered:
+		// the leader from before a restart still has time to come back
+		n.waitingQueue = append(n.waitingQueue, clientInfo)
+		s.sendWaitingMessage(clientAddr)
+	default:
+		s.pairClients(n, clientInfo, true)
 	}
 }
 
+// sendRegistrationSuccess and the assignments below aren't answers to
+// anything the size of the reply, so they only go to addresses that
+// answered a challenge, see limits.go
 func (s *Server) sendRegistrationSuccess(id string, clientAddr *net.UDPAddr) {
 	// Currently no specific success message defined
 	msg := api.NewRegisterSuccessMessage("Registration successful", id)
-	s.sendMessage(clientAddr, msg)
+	s.sendReply(clientAddr, 0, msg)
 }
 
 // handleClientPing handles ping messages
@@ -256,69 +570,127 @@ func (s *Server) handleClientPing(msg *api.Message, clientAddr *net.UDPAddr, ena
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	// Use IP:port as the client ID
-	clientID := clientAddr.String()
+	clientID := msg.Sign.PubKey
 
 	if client, exists := s.clients[clientID]; exists {
+		if err := verifyClient(msg, client); err != nil {
+			if enableLogging {
+				log.Printf("Dropped ping for %s from %s: %v", clientID, clientAddr, err)
+			}
+			return
+		}
 		client.LastPing = time.Now()
-		client.Address = clientAddr
+		if n := s.networkOf(client); n != nil && clientID == n.currentLeaderID {
+			s.renewLease(n)
+		}
+		if client.Address.String() == clientAddr.String() {
+			// the address answered a challenge when the client registered
+			s.limiter.verify(clientAddr, time.Now())
+		} else {
+			// the ping could have been captured and sent from elsewhere, the
+			// client only moves once the new address answers a challenge
+			s.issueChallenge(clientAddr, msg.Size(), &challenge{key: client.PublicKey, networkID: client.NetworkID, rejoin: true}, enableLogging)
+		}
 		if enableLogging {
 			log.Printf("Ping received from client %s", clientID)
 		}
+		return
+	}
+
+	for _, n := range s.networks {
+		if clientID == n.currentLeaderID && s.awaitingReclaim(n) {
+			// the leader kept pinging through a restart, it doesn't have to
+			// register again but its address has to answer a challenge
+			if n.leaderKey == nil || verifySender(msg, n.leaderKey) != nil {
+				return
+			}
+			s.issueChallenge(clientAddr, msg.Size(), &challenge{key: n.leaderKey, networkID: n.id, rejoin: true}, enableLogging)
+			return
+		}
 	}
 }
 
-// pairClients pairs two clients together
-func (s *Server) pairClients(client *ClientInfo, enableLogging bool) {
+// pairClients pairs a client with the leader of its network
+func (s *Server) pairClients(n *network, client *ClientInfo, enableLogging bool) {
+	leader := s.clients[n.currentLeaderID]
+
 	// Send peer info to both clients
-	s.sendPeerAssignment(s.clients[s.currentLeaderID].Address, client.Address, client.ID)
-	s.sendPeerAssignment(client.Address, s.clients[s.currentLeaderID].Address, s.currentLeaderID)
+	s.sendPeerAssignment(n, leader.Address, client.Address, client.ID)
+	s.sendPeerAssignment(n, client.Address, leader.Address, leader.ID)
 
 	if enableLogging {
-		log.Printf("Paired clients %s to leader %s", client.ID, s.currentLeaderID)
+		log.Printf("Paired clients %s to leader %s", client.ID, leader.ID)
 	}
 
-	// Remove both clients from server memory since they no longer need the server
+	// Remove the client from server memory since it no longer needs the server,
+	// only its address is kept as a member to point at the next leader
 	delete(s.clients, client.ID)
+	client.NetworkID = n.id
+	client.PairedWithID = leader.ID
+	n.members[client.ID] = client
 
 	if enableLogging {
 		log.Printf("Removed paired client %s from server memory", client.ID)
 	}
 }
 
-func (s *Server) sendLeaderAssignment(clientAddr *net.UDPAddr) {
-	msg := api.NewServerAssignedLeaderMessage()
-	s.sendMessage(clientAddr, msg)
+func (s *Server) sendLeaderAssignment(n *network, clientAddr *net.UDPAddr) {
+	msg := api.NewServerAssignedLeaderMessage(n.currentTerm, s.leaseDuration)
+	s.sendReply(clientAddr, 0, msg)
 }
 
 // sendPeerAssignment sends peer information to a client
-func (s *Server) sendPeerAssignment(clientAddr, peerAddr *net.UDPAddr, peerID string) {
-	msg := api.NewPeerAssignmentMessage(peerAddr, peerID)
-	s.sendMessage(clientAddr, msg)
+func (s *Server) sendPeerAssignment(n *network, clientAddr, peerAddr *net.UDPAddr, peerID string) {
+	msg := api.NewPeerAssignmentMessage(peerAddr, peerID, n.currentTerm)
+	s.sendReply(clientAddr, 0, msg)
 }
 
 // sendWaitingMessage sends waiting message to a client
 func (s *Server) sendWaitingMessage(clientAddr *net.UDPAddr) {
 	msg := api.NewWaitingForPeerMessage()
-	s.sendMessage(clientAddr, msg)
+	s.sendReply(clientAddr, 0, msg)
 }
 
-// sendErrorMessage sends error message to a client
-func (s *Server) sendErrorMessage(clientAddr *net.UDPAddr, errorMsg, errorCode string) {
+// sendErrorMessage sends error message to a client in answer to a request of
+// requestSize bytes, errors the client caused are strikes against it
+func (s *Server) sendErrorMessage(clientAddr *net.UDPAddr, requestSize int, errorMsg, errorCode string) {
+	s.counters.countError(errorCode)
+	if clientFaultCodes[errorCode] {
+		s.limiter.strike(clientAddr, time.Now())
+	}
+
 	msg := api.NewServerErrorMessage(errorMsg, errorCode)
-	s.sendMessage(clientAddr, msg)
+	if data, err := msg.Serialize(); err == nil && !s.mayReply(clientAddr, requestSize, len(data)) {
+		// the code alone may still fit
+		msg = api.NewServerErrorMessage("", errorCode)
+	}
+	s.sendReply(clientAddr, requestSize, msg)
 }
 
-// sendMessage sends a message to a client
-func (s *Server) sendMessage(clientAddr *net.UDPAddr, msg *api.Message) {
+// sendReply sends msg in answer to a request of requestSize bytes, it is
+// dropped if it is larger and clientAddr hasn't proven it is real
+func (s *Server) sendReply(clientAddr *net.UDPAddr, requestSize int, msg *api.Message) {
 	data, err := msg.Serialize()
 	if err != nil {
 		log.Printf("Failed to serialize message: %v", err)
 		return
 	}
 
-	_, err = s.conn.WriteToUDP(data, clientAddr)
-	if err != nil {
+	if !s.mayReply(clientAddr, requestSize, len(data)) {
+		s.counters.countDropped("oversized_reply")
+		return
+	}
+	s.write(clientAddr, data)
+}
+
+// mayReply reports whether replySize bytes can be sent to clientAddr in
+// answer to requestSize, see limits.go
+func (s *Server) mayReply(clientAddr *net.UDPAddr, requestSize, replySize int) bool {
+	return replySize <= requestSize || s.limiter.isVerified(clientAddr, time.Now())
+}
+
+func (s *Server) write(clientAddr *net.UDPAddr, data []byte) {
+	if _, err := s.conn.WriteToUDP(data, clientAddr); err != nil {
 		log.Printf("Failed to send message to %s: %v", clientAddr, err)
 	}
 }
@@ -333,7 +705,20 @@ func (s *Server) cleanupRoutine(timeout time.Duration, enableLogging bool) {
 		case <-s.ctx.Done():
 			return
 		case <-ticker.C:
+			// a standby's state is its peer's, the peer does the cleanup
+			if !s.IsActive() {
+				continue
+			}
 			s.cleanupInactiveClients(timeout, enableLogging)
+			s.expireReclaim(enableLogging)
+			s.expireLease(enableLogging)
+			s.expireNetworks(timeout, time.Now(), enableLogging)
+			s.expireChallenges(time.Now())
+			s.pruneQueuePositions(s.reclaimGrace, time.Now(), enableLogging)
+			s.limiter.expire(time.Now())
+			if s.relay != nil {
+				s.relay.expire(time.Now())
+			}
 		}
 	}
 }
@@ -347,6 +732,11 @@ func (s *Server) cleanupInactiveClients(timeout time.Duration, enableLogging boo
 	var toRemove []string
 
 	for clientID, client := range s.clients {
+		// the leader is held to its lease instead, see lease.go
+		if n := s.networkOf(client); n != nil && clientID == n.currentLeaderID {
+			continue
+		}
+
 		// Remove inactive clients (paired clients are already removed from memory)
 		if now.Sub(client.LastPing) > timeout {
 			toRemove = append(toRemove, clientID)
@@ -354,13 +744,16 @@ func (s *Server) cleanupInactiveClients(timeout time.Duration, enableLogging boo
 	}
 
 	for _, clientID := range toRemove {
+		client := s.clients[clientID]
 		delete(s.clients, clientID)
 
 		// Remove from waiting queue if present
-		for i, waitingClient := range s.waitingQueue {
-			if waitingClient.ID == clientID {
-				s.waitingQueue = append(s.waitingQueue[:i], s.waitingQueue[i+1:]...)
-				break
+		if n := s.networkOf(client); n != nil {
+			for i, waitingClient := range n.waitingQueue {
+				if waitingClient.ID == clientID {
+					n.waitingQueue = append(n.waitingQueue[:i], n.waitingQueue[i+1:]...)
+					break
+				}
 			}
 		}
 
@@ -377,9 +770,35 @@ func (s *Server) GetConnectedClients() int {
 	return len(s.clients)
 }
 
-// GetWaitingClients returns the number of clients in waiting queue
+// GetWaitingClients returns the number of clients in the waiting queues of all networks
 func (s *Server) GetWaitingClients() int {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
-	return len(s.waitingQueue)
+
+	waiting := 0
+	for _, n := range s.networks {
+		waiting += len(n.waitingQueue)
+	}
+	return waiting
+}
+
+// queueFull reports whether MaxQueueSize clients are waiting on a leader.
+// Callers hold the mutex.
+func (s *Server) queueFull() bool {
+	if s.maxQueueSize <= 0 {
+		return false
+	}
+
+	waiting := 0
+	for _, n := range s.networks {
+		waiting += len(n.waitingQueue)
+	}
+	return waiting >= s.maxQueueSize
+}
+
+// GetNetworks returns the number of networks the server knows of
+func (s *Server) GetNetworks() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return len(s.networks)
 }
@@ -2,6 +2,7 @@ package stun
 
 import (
 	"net"
+	"strings"
 	"testing"
 	"time"
 
@@ -65,15 +66,7 @@ func TestClientRegistrationAssignsLeader(t *testing.T) {
 	}
 	defer clientConn.Close()
 
-	registerMsg := api.NewClientRegisterMessage()
-	data, err := registerMsg.Serialize()
-	if err != nil {
-		t.Fatalf("Failed to serialize message: %v", err)
-	}
-
-	if _, err := clientConn.Write(data); err != nil {
-		t.Fatalf("Failed to send registration: %v", err)
-	}
+	registerTestClient(t, clientConn, serverAddr, newTestIdentity(t), "", "")
 
 	first := readUDPMessage(t, clientConn)
 	second := readUDPMessage(t, clientConn)
@@ -111,11 +104,8 @@ func TestClientPairing(t *testing.T) {
 	}
 	defer client2Conn.Close()
 
-	registerMsg1 := api.NewClientRegisterMessage()
-	data1, _ := registerMsg1.Serialize()
-	if _, err := client1Conn.Write(data1); err != nil {
-		t.Fatalf("Failed to send registration for client 1: %v", err)
-	}
+	client1Identity, client2Identity := newTestIdentity(t), newTestIdentity(t)
+	registerTestClient(t, client1Conn, serverAddr, client1Identity, "", "")
 
 	if msg := readUDPMessage(t, client1Conn); msg.Type != api.RegisterSuccess {
 		t.Fatalf("Expected register success for client 1, got: %v", msg.Type)
@@ -124,11 +114,7 @@ func TestClientPairing(t *testing.T) {
 		t.Fatalf("Expected leader assignment for client 1, got: %v", msg.Type)
 	}
 
-	registerMsg2 := api.NewClientRegisterMessage()
-	data2, _ := registerMsg2.Serialize()
-	if _, err := client2Conn.Write(data2); err != nil {
-		t.Fatalf("Failed to send registration for client 2: %v", err)
-	}
+	registerTestClient(t, client2Conn, serverAddr, client2Identity, "", "")
 
 	client2Register := readUDPMessage(t, client2Conn)
 	client2Peer := readUDPMessage(t, client2Conn)
@@ -153,14 +139,14 @@ func TestClientPairing(t *testing.T) {
 		t.Fatalf("Failed to get peer data for client 2: %v", err)
 	}
 
-	client1Addr := client1Conn.LocalAddr().(*net.UDPAddr).String()
-	client2Addr := client2Conn.LocalAddr().(*net.UDPAddr).String()
-
-	if peerData1.PeerID != client2Addr {
-		t.Errorf("Expected client 1 peer ID %q, got %q", client2Addr, peerData1.PeerID)
+	if peerData1.PeerID != client2Identity.id {
+		t.Errorf("Expected client 1 peer ID %q, got %q", client2Identity.id, peerData1.PeerID)
 	}
-	if peerData2.PeerID != client1Addr {
-		t.Errorf("Expected client 2 peer ID %q, got %q", client1Addr, peerData2.PeerID)
+	if peerData2.PeerID != client1Identity.id {
+		t.Errorf("Expected client 2 peer ID %q, got %q", client1Identity.id, peerData2.PeerID)
+	}
+	if peerData1.PeerAddress != client2Conn.LocalAddr().String() {
+		t.Errorf("Expected client 1 peer address %s, got %s", client2Conn.LocalAddr(), peerData1.PeerAddress)
 	}
 
 	if server.GetConnectedClients() != 1 {
@@ -182,9 +168,8 @@ func TestClientPing(t *testing.T) {
 	}
 	defer clientConn.Close()
 
-	registerMsg := api.NewClientRegisterMessage()
-	data, _ := registerMsg.Serialize()
-	clientConn.Write(data)
+	identity := newTestIdentity(t)
+	registerTestClient(t, clientConn, serverAddr, identity, "", "")
 
 	registerResp := readUDPMessage(t, clientConn)
 	if registerResp.Type != api.RegisterSuccess {
@@ -192,9 +177,7 @@ func TestClientPing(t *testing.T) {
 	}
 	_ = readUDPMessage(t, clientConn)
 
-	pingMsg := api.NewClientPingMessage(api.NewSignature(clientConn.LocalAddr().String()))
-	pingData, _ := pingMsg.Serialize()
-	clientConn.Write(pingData)
+	sendToServer(t, clientConn, serverAddr, identity.ping(t))
 
 	time.Sleep(100 * time.Millisecond)
 
@@ -225,9 +208,7 @@ func TestClientTimeout(t *testing.T) {
 	}
 	defer clientConn.Close()
 
-	registerMsg := api.NewClientRegisterMessage()
-	data, _ := registerMsg.Serialize()
-	clientConn.Write(data)
+	registerTestClient(t, clientConn, serverAddr, newTestIdentity(t), "", "")
 
 	if msg := readUDPMessage(t, clientConn); msg.Type != api.RegisterSuccess {
 		t.Fatalf("Expected register success, got: %v", msg.Type)
@@ -256,9 +237,19 @@ func TestInvalidMessage(t *testing.T) {
 	}
 	defer clientConn.Close()
 
+	// the error is only sent if it is no larger than the payload
 	if _, err := clientConn.Write([]byte("invalid json")); err != nil {
 		t.Fatalf("Failed to write invalid payload: %v", err)
 	}
+	buffer := make([]byte, 1024)
+	clientConn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := clientConn.Read(buffer); err == nil {
+		t.Fatalf("Expected no reply to a short payload, got %s", buffer[:n])
+	}
+
+	if _, err := clientConn.Write([]byte("invalid json " + strings.Repeat("x", 200))); err != nil {
+		t.Fatalf("Failed to write invalid payload: %v", err)
+	}
 
 	responseMsg := readUDPMessage(t, clientConn)
 	if responseMsg.Type != api.ServerError {
@@ -333,7 +324,7 @@ func TestMessageCreation(t *testing.T) {
 func TestMessageSerialization(t *testing.T) {
 	sign := api.NewSignature("test-sender")
 	messages := []*api.Message{
-		api.NewClientRegisterMessage(),
+		api.NewClientRegisterMessage(""),
 		api.NewClientPingMessage(sign),
 		api.NewWaitingForPeerMessage(),
 		api.NewServerErrorMessage("test", "ERR"),
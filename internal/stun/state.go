@@ -0,0 +1,381 @@
+package stun
+
+/*
+
+This file is for the state the server keeps on disk so a restart doesn't hand
+leadership to whoever re-registers first. The queue position of every
+identity and the term, leader and join secret hash of every network are
+written to ServerConfig.StateFile whenever they change. On start the server
+reloads them and for ReclaimGrace only the recorded leader of a network can
+take leadership back, by pinging with the key it registered with, other
+clients wait in the queue until it does or the window runs out. Files from
+before clients were known by their key, versions 1 and 2, named them by
+address; only their terms and join secrets are kept.
+
+Changes only mark the state dirty, saveRoutine writes it at most once every
+stateSaveDelay and outside the mutex, so a burst of new identities costs one
+write. The position of a client that has been gone longer than ReclaimGrace
+is forgotten, it gets a new one if it ever comes back.
+
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hcp-uw/mosaic/internal/api"
+)
+
+// stateVersion is bumped whenever the layout of the state file changes
+const stateVersion = 3
+
+// stateSaveDelay is how long changes are collected before the state is written
+const stateSaveDelay = 100 * time.Millisecond
+
+// persistentState is what the state file holds
+type persistentState struct {
+	Version  int                               `json:"version"`
+	Networks map[string]persistentNetworkState `json:"networks,omitempty"`
+	// Positions maps every identity the server has seen to its queue position
+	Positions    map[string]int `json:"positions"`
+	NextPosition int            `json:"next_position"`
+	// DroppedTerm is the highest term of a network that was dropped, see network.go
+	DroppedTerm uint `json:"dropped_term,omitempty"`
+
+	// Term and LeaderID are only set in version 1 files
+	Term     uint   `json:"term,omitempty"`
+	LeaderID string `json:"leader_id,omitempty"`
+}
+
+// persistentNetworkState is what the state file holds for each network
+type persistentNetworkState struct {
+	Term     uint   `json:"term"`
+	LeaderID string `json:"leader_id"`
+	// LeaderKey is the leader's public key, encoded by api.EncodePublicKey
+	LeaderKey  string `json:"leader_key,omitempty"`
+	SecretHash []byte `json:"secret_hash,omitempty"`
+}
+
+// loadState restores the state recorded in the state file, if there is one,
+// and opens the reclaim window for the recorded leader
+func (s *Server) loadState(grace time.Duration, enableLogging bool) error {
+	if s.stateFile == "" {
+		return nil
+	}
+
+	buf, err := os.ReadFile(s.stateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	var state persistentState
+	if err := json.Unmarshal(buf, &state); err != nil {
+		return fmt.Errorf("failed to parse state file: %w", err)
+	}
+	switch state.Version {
+	case 1, 2:
+		if state.Version == 1 {
+			state.Networks = map[string]persistentNetworkState{
+				DefaultNetworkID: {Term: state.Term},
+			}
+		}
+		// address based identities can't prove who they are
+		for id, recorded := range state.Networks {
+			recorded.LeaderID = ""
+			state.Networks[id] = recorded
+		}
+		state.Positions = nil
+	case stateVersion:
+	default:
+		return fmt.Errorf("state file is version %d, expected %d", state.Version, stateVersion)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for id, recorded := range state.Networks {
+		n := newNetwork(id, recorded.SecretHash)
+		n.currentTerm = recorded.Term
+		if key, err := api.ParsePublicKey(recorded.LeaderKey); err == nil && recorded.LeaderID != "" {
+			n.currentLeaderID = recorded.LeaderID
+			n.leaderKey = key
+			n.reclaimDeadline = time.Now().Add(grace)
+		}
+		s.networks[id] = n
+
+		if enableLogging {
+			log.Printf("Restored network %s: term %d, leader %q", id, n.currentTerm, n.currentLeaderID)
+		}
+	}
+	if state.Positions != nil {
+		s.queuePositions = state.Positions
+	}
+	s.nextQueuePosition = state.NextPosition
+	s.droppedTerm = state.DroppedTerm
+
+	if enableLogging {
+		log.Printf("Restored state: %d networks, %d queue positions", len(s.networks), len(s.queuePositions))
+	}
+	return nil
+}
+
+// saveState marks the state as changed for saveRoutine to write. Callers
+// hold the mutex.
+func (s *Server) saveState() {
+	if s.stateFile == "" {
+		return
+	}
+	s.stateDirty = true
+	select {
+	case s.stateChanged <- struct{}{}:
+	default:
+	}
+}
+
+// saveRoutine writes the state once changes have collected for
+// stateSaveDelay, and a last time when the server stops
+func (s *Server) saveRoutine() {
+	defer close(s.stateSaved)
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			s.writeState()
+			return
+		case <-s.stateChanged:
+		}
+
+		select {
+		case <-s.ctx.Done():
+		case <-time.After(stateSaveDelay):
+		}
+		s.writeState()
+	}
+}
+
+// writeState writes the state to the state file if it changed, through a
+// temporary file so a crash never leaves half of it behind
+func (s *Server) writeState() {
+	s.mutex.Lock()
+	if !s.stateDirty {
+		s.mutex.Unlock()
+		return
+	}
+	s.stateDirty = false
+
+	state := persistentState{
+		Version:      stateVersion,
+		Networks:     make(map[string]persistentNetworkState, len(s.networks)),
+		Positions:    maps.Clone(s.queuePositions),
+		NextPosition: s.nextQueuePosition,
+		DroppedTerm:  s.droppedTerm,
+	}
+	for id, n := range s.networks {
+		recorded := persistentNetworkState{
+			Term:       n.currentTerm,
+			LeaderID:   n.currentLeaderID,
+			SecretHash: n.secretHash,
+		}
+		if n.leaderKey != nil {
+			recorded.LeaderKey, _ = api.EncodePublicKey(n.leaderKey)
+		}
+		state.Networks[id] = recorded
+	}
+	s.mutex.Unlock()
+
+	if err := writeFileAtomic(s.stateFile, state); err != nil {
+		log.Printf("Failed to save state: %v", err)
+	}
+}
+
+func writeFileAtomic(path string, v any) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(path), ".state-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(buf); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
+
+// queuePosition returns the queue position of clientID, giving it the next
+// one if it has never registered. Callers hold the mutex.
+func (s *Server) queuePosition(clientID string) int {
+	if position, ok := s.queuePositions[clientID]; ok {
+		return position
+	}
+
+	s.nextQueuePosition++
+	s.queuePositions[clientID] = s.nextQueuePosition
+	s.saveState()
+	return s.nextQueuePosition
+}
+
+// pruneQueuePositions forgets the positions of clients that haven't been
+// registered, a member, waiting or a recorded leader for longer than grace
+func (s *Server) pruneQueuePositions(grace time.Duration, now time.Time, enableLogging bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	present := make(map[string]bool, len(s.clients))
+	for id := range s.clients {
+		present[id] = true
+	}
+	for _, n := range s.networks {
+		present[n.currentLeaderID] = true
+		for id := range n.members {
+			present[id] = true
+		}
+		for _, waiter := range n.waitingQueue {
+			present[waiter.ID] = true
+		}
+	}
+
+	pruned := 0
+	for id := range s.queuePositions {
+		if present[id] {
+			delete(s.departed, id)
+			continue
+		}
+		left, ok := s.departed[id]
+		if !ok {
+			s.departed[id] = now
+			continue
+		}
+		if now.Sub(left) > grace {
+			delete(s.queuePositions, id)
+			delete(s.departed, id)
+			pruned++
+		}
+	}
+
+	if pruned > 0 {
+		s.saveState()
+		if enableLogging {
+			log.Printf("Forgot the queue positions of %d departed clients", pruned)
+		}
+	}
+}
+
+// samePersistedNetworks reports whether a and b would be written to the
+// state file the same way
+func samePersistedNetworks(a, b map[string]*network) bool {
+	return maps.EqualFunc(a, b, func(x, y *network) bool {
+		sameKey := x.leaderKey == nil && y.leaderKey == nil ||
+			x.leaderKey != nil && y.leaderKey != nil && x.leaderKey.Equal(y.leaderKey)
+		return x.currentTerm == y.currentTerm && x.currentLeaderID == y.currentLeaderID &&
+			sameKey && bytes.Equal(x.secretHash, y.secretHash)
+	})
+}
+
+// awaitingReclaim reports whether leadership of a network is being held for
+// its recorded leader. Callers hold the mutex.
+func (s *Server) awaitingReclaim(n *network) bool {
+	if n.currentLeaderID == "" {
+		return false
+	}
+	_, registered := s.clients[n.currentLeaderID]
+	return !registered && time.Now().Before(n.reclaimDeadline)
+}
+
+// expireReclaim gives up on recorded leaders once the reclaim window has
+// passed and promotes the waiting client with the lowest queue position
+func (s *Server) expireReclaim(enableLogging bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	for _, n := range s.networks {
+		if n.currentLeaderID == "" || n.reclaimDeadline.IsZero() || now.Before(n.reclaimDeadline) {
+			continue
+		}
+		n.reclaimDeadline = time.Time{}
+		if _, registered := s.clients[n.currentLeaderID]; registered {
+			continue
+		}
+
+		if enableLogging {
+			log.Printf("Leader %s did not reclaim leadership of network %s in time", n.currentLeaderID, n.id)
+		}
+		s.vacateLeadership(n)
+		s.promoteWaiting(n, enableLogging)
+	}
+}
+
+// assignLeader makes client the leader of the network's current term, or of
+// a new one if another client already led it, and pairs everyone waiting on a
+// leader with it. Callers hold the mutex.
+func (s *Server) assignLeader(n *network, client *ClientInfo, enableLogging bool) {
+	if n.currentTerm == 0 || n.currentLeaderID != "" && n.currentLeaderID != client.ID {
+		n.currentTerm++
+	}
+	n.currentLeaderID = client.ID
+	n.leaderKey = client.PublicKey
+	n.reclaimDeadline = time.Time{}
+	n.vacated = time.Time{}
+	client.Leader = true
+	client.NetworkID = n.id
+	s.renewLease(n)
+	s.saveState()
+
+	s.sendLeaderAssignment(n, client.Address)
+	if enableLogging {
+		log.Printf("Client %s is leader of network %s for term %d", client.ID, n.id, n.currentTerm)
+	}
+
+	waiting := n.waitingQueue
+	n.waitingQueue = make([]*ClientInfo, 0)
+	for _, waiter := range waiting {
+		s.pairClients(n, waiter, enableLogging)
+	}
+}
+
+// GetQueuePosition returns the queue position recorded for a client ID, 0 if there is none
+func (s *Server) GetQueuePosition(clientID string) int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.queuePositions[clientID]
+}
+
+// GetLeader returns the ID and term of a network's leader, the ID is empty if
+// there is no leader. An empty networkID means the default network.
+func (s *Server) GetLeader(networkID string) (string, uint) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if networkID == "" {
+		networkID = DefaultNetworkID
+	}
+	n, ok := s.networks[networkID]
+	if !ok {
+		return "", 0
+	}
+	return n.currentLeaderID, n.currentTerm
+}
@@ -0,0 +1,210 @@
+package stun
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hcp-uw/mosaic/internal/api"
+)
+
+func newStateTestServer(t *testing.T, stateFile string, grace time.Duration) (*Server, *net.UDPAddr) {
+	t.Helper()
+
+	config := &ServerConfig{
+		ListenAddress: "127.0.0.1:0",
+		ClientTimeout: 400 * time.Millisecond,
+		StateFile:     stateFile,
+		ReclaimGrace:  grace,
+	}
+	server := NewServer(config)
+	if err := server.Start(config); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	return server, server.conn.LocalAddr().(*net.UDPAddr)
+}
+
+func newStateTestClient(t *testing.T) *net.UDPConn {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to open client socket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func sendToServer(t *testing.T, conn *net.UDPConn, serverAddr *net.UDPAddr, msg *api.Message) {
+	t.Helper()
+
+	data, err := msg.Serialize()
+	if err != nil {
+		t.Fatalf("Failed to serialize message: %v", err)
+	}
+	if conn.RemoteAddr() != nil {
+		_, err = conn.Write(data)
+	} else {
+		_, err = conn.WriteToUDP(data, serverAddr)
+	}
+	if err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+}
+
+func expectMessages(t *testing.T, conn *net.UDPConn, types ...api.MessageType) {
+	t.Helper()
+
+	for _, want := range types {
+		if msg := readUDPMessage(t, conn); msg.Type != want {
+			t.Fatalf("Expected %s, got %s", want, msg.Type)
+		}
+	}
+}
+
+func TestLeaderReclaimsAfterRestart(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "stun-state.json")
+	server, serverAddr := newStateTestServer(t, stateFile, 5*time.Second)
+
+	leader, member := newStateTestClient(t), newStateTestClient(t)
+	leaderIdentity, memberIdentity := newTestIdentity(t), newTestIdentity(t)
+	registerTestClient(t, leader, serverAddr, leaderIdentity, "", "")
+	expectMessages(t, leader, api.RegisterSuccess, api.AssignedAsLeader)
+	registerTestClient(t, member, serverAddr, memberIdentity, "", "")
+	expectMessages(t, member, api.RegisterSuccess, api.PeerAssignment)
+	expectMessages(t, leader, api.PeerAssignment)
+	server.Stop()
+
+	buf, err := os.ReadFile(stateFile)
+	if err != nil {
+		t.Fatalf("Failed to read state file: %v", err)
+	}
+	var state persistentState
+	if err := json.Unmarshal(buf, &state); err != nil {
+		t.Fatalf("Failed to parse state file: %v", err)
+	}
+	leaderID, memberID := leaderIdentity.id, memberIdentity.id
+	recorded := state.Networks[DefaultNetworkID]
+	if recorded.Term != 1 || recorded.LeaderID != leaderID || recorded.LeaderKey != leaderIdentity.publicKey || state.Positions[leaderID] != 1 || state.Positions[memberID] != 2 {
+		t.Fatalf("Unexpected state after first run: %+v", state)
+	}
+
+	// someone racing the leader after the restart has to wait
+	server, serverAddr = newStateTestServer(t, stateFile, 5*time.Second)
+	defer server.Stop()
+
+	racer, racerIdentity := newStateTestClient(t), newTestIdentity(t)
+	registerTestClient(t, racer, serverAddr, racerIdentity, "", "")
+	expectMessages(t, racer, api.RegisterSuccess, api.WaitingForPeer)
+	if got := server.GetQueuePosition(racerIdentity.id); got != 3 {
+		t.Errorf("Expected the racer at queue position 3, got %d", got)
+	}
+
+	// a ping naming the leader that isn't signed with its key doesn't count
+	sendToServer(t, racer, serverAddr, api.NewClientPingMessage(api.NewSignature(leaderID)))
+	time.Sleep(100 * time.Millisecond)
+	if id, _ := server.GetLeader(""); id != leaderID {
+		t.Fatalf("Expected leadership to still be held for %s, got %s", leaderID, id)
+	}
+
+	// the leader's next ping is enough to take leadership back, once its
+	// address answers a challenge
+	sendToServer(t, leader, serverAddr, leaderIdentity.ping(t))
+	sendToServer(t, leader, serverAddr, leaderIdentity.answer(t, serverAddr, readUDPMessage(t, leader)))
+	expectMessages(t, leader, api.RegisterSuccess, api.AssignedAsLeader, api.PeerAssignment)
+	expectMessages(t, racer, api.PeerAssignment)
+
+	if id, term := server.GetLeader(""); id != leaderID || term != 1 {
+		t.Errorf("Expected %s to lead term 1, got %s in term %d", leaderID, id, term)
+	}
+}
+
+func TestReclaimGraceExpires(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "stun-state.json")
+	server, serverAddr := newStateTestServer(t, stateFile, time.Hour)
+
+	leader, leaderIdentity := newStateTestClient(t), newTestIdentity(t)
+	registerTestClient(t, leader, serverAddr, leaderIdentity, "", "")
+	expectMessages(t, leader, api.RegisterSuccess, api.AssignedAsLeader)
+	server.Stop()
+
+	server, serverAddr = newStateTestServer(t, stateFile, 300*time.Millisecond)
+	defer server.Stop()
+
+	waiter, waiterIdentity := newStateTestClient(t), newTestIdentity(t)
+	registerTestClient(t, waiter, serverAddr, waiterIdentity, "", "")
+	expectMessages(t, waiter, api.RegisterSuccess, api.WaitingForPeer)
+
+	// keep the waiter alive until the window closes and it is promoted
+	deadline := time.Now().Add(3 * time.Second)
+	promoted := false
+	for !promoted && time.Now().Before(deadline) {
+		sendToServer(t, waiter, serverAddr, waiterIdentity.ping(t))
+		waiter.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		buffer := make([]byte, 1024)
+		if n, err := waiter.Read(buffer); err == nil {
+			msg, err := api.DeserializeMessage(buffer[:n])
+			promoted = err == nil && msg.Type == api.AssignedAsLeader
+		}
+	}
+	if !promoted {
+		t.Fatal("Expected the waiting client to be promoted after the reclaim window")
+	}
+
+	if id, term := server.GetLeader(""); id != waiterIdentity.id || term != 2 {
+		t.Errorf("Expected the waiter to lead term 2, got %s in term %d", id, term)
+	}
+
+	// the old leader is just another member now
+	registerTestClient(t, leader, serverAddr, leaderIdentity, "", "")
+	expectMessages(t, leader, api.RegisterSuccess, api.PeerAssignment)
+}
+
+func TestQueuePositionsForgottenAfterGrace(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "stun-state.json")
+	server, serverAddr := newStateTestServer(t, stateFile, 300*time.Millisecond)
+
+	client, identity := newStateTestClient(t), newTestIdentity(t)
+	registerTestClient(t, client, serverAddr, identity, "", "")
+	expectMessages(t, client, api.RegisterSuccess, api.AssignedAsLeader)
+	if got := server.GetQueuePosition(identity.id); got != 1 {
+		t.Fatalf("Expected queue position 1, got %d", got)
+	}
+
+	// the state is written while the server runs, not only when it stops
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := os.Stat(stateFile); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("State file was never written")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// the client stops pinging, loses its lease and is forgotten after the grace
+	deadline = time.Now().Add(3 * time.Second)
+	for server.GetQueuePosition(identity.id) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Queue position of a departed client was never forgotten")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	server.Stop()
+
+	buf, err := os.ReadFile(stateFile)
+	if err != nil {
+		t.Fatalf("Failed to read state file: %v", err)
+	}
+	var state persistentState
+	if err := json.Unmarshal(buf, &state); err != nil {
+		t.Fatalf("Failed to parse state file: %v", err)
+	}
+	if len(state.Positions) != 0 || state.NextPosition != 1 {
+		t.Errorf("Expected no positions and the next one to stay taken, got %+v", state)
+	}
+}